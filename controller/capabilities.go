@@ -0,0 +1,86 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ProtocolVersion is the newest version of the message protocol the
+// controller speaks. Version 1 runtimes report their capabilities in the
+// started message. Runtimes from before, whose started message carries an
+// empty string, speak version 0.
+const ProtocolVersion = 1
+
+// Features a runtime can report supporting
+const (
+	// FeatureIDs is copying the ID of a function or request into its reply
+	FeatureIDs = "ids"
+	// FeatureLogs is sending log messages
+	FeatureLogs = "logs"
+	// FeatureConcurrency is serving further requests while one is in flight
+	FeatureConcurrency = "concurrency"
+)
+
+// Capabilities is what a runtime reports about itself in its started message
+type Capabilities struct {
+	ProtocolVersion int    `json:"protocol_version"`
+	Runtime         string `json:"runtime"`
+	RuntimeVersion  string `json:"runtime_version"`
+	// Features lists what the runtime supports of the optional parts of
+	// the protocol
+	Features []string `json:"features"`
+	// Protocols lists the protocols other than line messages the runtime
+	// can switch to, such as FramedProtocol
+	Protocols []string `json:"protocols"`
+}
+
+// Supports is true when the runtime reported supporting feature
+func (c Capabilities) Supports(feature string) bool {
+	return contains(c.Features, feature)
+}
+
+// Concurrent is true when the runtime can be sent further requests while one
+// is in flight. It must serve them concurrently and reply with their IDs, as
+// IDs alone only match replies to requests.
+func (c Capabilities) Concurrent() bool {
+	return c.Supports(FeatureConcurrency) && c.Supports(FeatureIDs)
+}
+
+// Offers is true when the runtime can switch to protocol
+func (c Capabilities) Offers(protocol string) bool {
+	return contains(c.Protocols, protocol)
+}
+
+func contains(list []string, item string) bool {
+	for _, listed := range list {
+		if listed == item {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCapabilities reads the data of a started message
+func parseCapabilities(startedData interface{}) (Capabilities, error) {
+	var capabilities Capabilities
+	if _, ok := startedData.(map[string]interface{}); !ok {
+		return capabilities, nil
+	}
+
+	encoded, err := json.Marshal(startedData)
+	if err != nil {
+		return capabilities, fmt.Errorf("could not encode runtime capabilities: %s", err)
+	}
+	err = json.Unmarshal(encoded, &capabilities)
+	if err != nil {
+		return capabilities, fmt.Errorf("could not parse runtime capabilities: %s", err)
+	}
+
+	return capabilities, nil
+}
+
+// Capabilities is what the runtime reported about itself when the worker was
+// activated
+func (c *controller) Capabilities() Capabilities {
+	return c.capabilities
+}
@@ -2,6 +2,7 @@ package controller
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +10,8 @@ import (
 	"io/ioutil"
 	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -32,17 +35,30 @@ type Controller interface {
 	Detach() error
 	End() error
 	Restore() error
+	RestoreTo(index int) error
+	RestoreToNamed(name string) error
 
 	TakeCheckpoint() error
+	TakeNamedCheckpoint(name string) error
+	SaveCheckpoint(index int, path string) error
+	LoadCheckpoint(path string) error
 	InitialCheckpoint() (*state.State, error)
 	Checkpoints() []*state.State
 	State() (*state.State, error)
 
 	SendFunction(function string) error
+	SendFunctionContext(ctx context.Context, function string) error
 	SendRequest(request interface{}) (interface{}, error)
+	SendRequestContext(ctx context.Context, request interface{}) (interface{}, error)
+	SendRequestWithLogs(ctx context.Context, request interface{}) (interface{}, []LogLine, error)
+	SetLogLimit(bytes int)
 
 	AwaitMessage(messageType string) Message
+	AwaitMessageContext(ctx context.Context, messageType string) (Message, error)
 	SendMessage(messageType string, data interface{}) error
+	EnableFramedProtocol(hostDir string, runtimeDir string) error
+	Protocol() string
+	Capabilities() Capabilities
 
 	AwaitSignal(waitingFor syscall.Signal)
 	PauseAtSignal(waitingFor syscall.Signal)
@@ -56,13 +72,86 @@ type Controller interface {
 	Stop() error
 	SetRegs(state *state.State) error
 	ClearMemRefs() error
+	SetDirtyTracker(tracker state.DirtyTracker)
+	SetRestoreMode(mode RestoreMode) error
+	SetMemoryIO(io state.MemoryIO, concurrency int)
+	SetPageStore(store *state.PageStore)
+	SetHugePages(enabled bool)
+	SetConcurrency(limit int)
+	DirtyTracker() state.DirtyTracker
+	RemoteSyscall(nr uint64, args ...uint64) (uint64, error)
+	LastRestoreStats() RestoreStats
+	SetVerifyRestore(verify bool)
+	LastVerifyReport() *state.VerifyReport
 }
 
 type Message struct {
-	Type string      `json:"type"`
+	Type string `json:"type"`
+	// ID pairs a request with its reply. Runtimes copy it from the function
+	// or request they answer. Zero is left out for runtimes without IDs.
+	ID   uint64      `json:"id,omitempty"`
 	Data interface{} `json:"data"`
 }
 
+// AwaitMessageError is returned when the context of a wait for a message
+// from the worker is done before the message arrives
+type AwaitMessageError struct {
+	MessageType string
+	// Err is the context's error, context.DeadlineExceeded or
+	// context.Canceled
+	Err error
+}
+
+func (e *AwaitMessageError) Error() string {
+	return fmt.Sprintf("no %s message from worker: %s", e.MessageType, e.Err)
+}
+
+func (e *AwaitMessageError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout is true when the wait ended at the context's deadline
+func (e *AwaitMessageError) Timeout() bool {
+	return errors.Is(e.Err, context.DeadlineExceeded)
+}
+
+type RestoreMode int
+
+const (
+	// EagerRestore writes dirty pages back before the process continues
+	EagerRestore RestoreMode = iota
+	// LazyRestore drops dirty anonymous pages and serves them from the
+	// checkpoint with userfaultfd when the process next touches them
+	LazyRestore
+)
+
+func (m RestoreMode) String() string {
+	switch m {
+	case EagerRestore:
+		return "eager"
+	case LazyRestore:
+		return "lazy"
+	}
+	return "unknown"
+}
+
+// RestoreStats describes what the last successful restore did
+type RestoreStats struct {
+	Duration        time.Duration
+	TasksExited     int
+	ProcessesKilled int
+	// FullMemory is set when every writable page was restored, because dirty
+	// pages were tracked against a different checkpoint
+	FullMemory bool
+	// DirtyTracker names the strategy used to find pages to restore
+	DirtyTracker string
+	Mode         RestoreMode
+	// HugePageBytes is how much writable memory transparent huge pages
+	// backed. Dirty pages of huge pages are restored a whole huge page at a
+	// time.
+	HugePageBytes int64
+}
+
 type Streams struct {
 	Stdin  *io.PipeWriter
 	Stdout *io.PipeReader
@@ -72,18 +161,49 @@ type Streams struct {
 type controller struct {
 	pid           int
 	messages      chan Message
+	replies       map[uint64]chan Message
+	repliesMutex  sync.Mutex
+	nextID        uint64
+	requestSlots  chan struct{}
+	slotsMutex    sync.Mutex
+	concurrency   int
+	activated     bool
+	collectors    map[uint64]*logCollector
+	logsMutex     sync.Mutex
+	logLimit      int
 	streams       *Streams
+	channel       *framedChannel
+	framed        int32
+	capabilities  Capabilities
 	traceTasks    map[int]*ptrace.TraceTask
 	checkpoints   []*state.State
+	names         map[string]int
+	dirtyBase     int
+	tracker       state.DirtyTracker
+	restoreMode   RestoreMode
+	lazy          *state.LazyRestorer
+	memoryIO      state.MemoryIO
+	ioConcurrency int
+	pages         *state.PageStore
+	noHugePages   bool
 	attached      bool
 	ptraceOptions ptrace.Options
+	restoreStats  RestoreStats
+	verifyRestore bool
+	verifyReport  *state.VerifyReport
 }
 
 func NewController() Controller {
 	return &controller{
-		attached:   false,
-		messages:   make(chan Message, 1),
-		traceTasks: make(map[int]*ptrace.TraceTask),
+		attached:     false,
+		messages:     make(chan Message, 1),
+		replies:      make(map[uint64]chan Message),
+		requestSlots: make(chan struct{}, 1),
+		collectors:   make(map[uint64]*logCollector),
+		traceTasks:   make(map[int]*ptrace.TraceTask),
+		names:        make(map[string]int),
+		dirtyBase:    -1,
+		pages:        state.NewPageStore(),
 		ptraceOptions: ptrace.Options{
 			StraceEnabled: false,
 		},
@@ -115,10 +235,15 @@ func (c *controller) SetStreams(in *io.PipeWriter, out *io.PipeReader, err *io.P
 			// Uncomment for debugging
 			// fmt.Printf("line from child: %s", line)
 
+			// Once messages are framed, all of stdout is output of the function
 			var message Message
-			err = json.Unmarshal([]byte(line), &message)
-			if err != nil {
+			if atomic.LoadInt32(&c.framed) == 0 {
+				err = json.Unmarshal([]byte(line), &message)
+			}
+			// Anything but a message is output of the function
+			if err != nil || message.Type == "" {
 				log.Debug(line)
+				c.collectLog(0, LogLine{Time: time.Now(), Stream: "stdout", Message: trimLine(line)})
 				continue
 			}
 
@@ -127,16 +252,36 @@ func (c *controller) SetStreams(in *io.PipeWriter, out *io.PipeReader, err *io.P
 				log.Debug(dataString)
 			}
 
-			if message.Type == "info" || message.Type == "log" {
-				// Ignore these for now
-				// log.Debug(message.Data)
-			} else {
-				c.messages <- message
+			c.handleMessage(message)
+		}
+	}()
+
+	go func() {
+		errBuffer := bufio.NewReader(err)
+
+		for {
+			line, err := errBuffer.ReadString('\n')
+			if err != nil {
+				return
 			}
+
+			log.Debug(line)
+			c.collectLog(0, LogLine{Time: time.Now(), Stream: "stderr", Message: trimLine(line)})
 		}
 	}()
 }
 
+// handleMessage hands a message from the runtime to whoever waits for it
+func (c *controller) handleMessage(message Message) {
+	if message.Type == "info" || message.Type == "log" {
+		c.collectLog(message.ID, LogLine{Time: time.Now(), Stream: "stdout", Message: logMessage(message.Data)})
+	} else if message.ID != 0 {
+		c.deliverReply(message)
+	} else {
+		c.messages <- message
+	}
+}
+
 func (c *controller) Streams() (*io.PipeWriter, *io.PipeReader, *io.PipeReader) {
 	return c.streams.Stdin, c.streams.Stdout, c.streams.Stderr
 }
@@ -154,9 +299,25 @@ func (c *controller) Activate() error {
 		return errors.New("controller has no in/out streams")
 	}
 
-	c.AwaitMessage("started")
+	started := c.AwaitMessage("started")
+
+	capabilities, err := parseCapabilities(started.Data)
+	if err != nil {
+		return err
+	}
+	c.capabilities = capabilities
+
+	c.slotsMutex.Lock()
+	c.activated = true
+	c.applyConcurrency()
+	c.slotsMutex.Unlock()
+
+	err = c.negotiateProtocol(capabilities)
+	if err != nil {
+		return err
+	}
 
-	err := c.Attach()
+	err = c.Attach()
 	if err != nil {
 		return fmt.Errorf("could not attach to process: %s", err)
 	}
@@ -194,10 +355,47 @@ func (c *controller) Attach() error {
 	}
 
 	c.attached = true
+
+	if c.tracker == nil {
+		err = c.probeDirtyTracker()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// probeDirtyTracker chooses the tracker by whether the kernel sets soft-dirty
+// bits for the process
+func (c *controller) probeDirtyTracker() error {
+	err := c.Stop()
+	if err != nil {
+		return fmt.Errorf("could not stop to probe dirty tracker: %s", err)
+	}
+
+	c.tracker = state.ProbeDirtyTracker(c.pid)
+	if !c.tracker.SinceReset() {
+		log.Warnf("soft-dirty page bits unavailable, restoring pages by %s", c.tracker.Name())
+	}
+
+	c.Continue()
 	return nil
 }
 
 func (c *controller) TakeCheckpoint() error {
+	return c.takeCheckpoint("")
+}
+
+// TakeNamedCheckpoint takes a checkpoint that can be restored by name. A
+// checkpoint already taken with the same name is replaced.
+func (c *controller) TakeNamedCheckpoint(name string) error {
+	if name == "" {
+		return errors.New("checkpoint name cannot be empty")
+	}
+	return c.takeCheckpoint(name)
+}
+
+func (c *controller) takeCheckpoint(name string) error {
 	err := c.Stop()
 	if err != nil {
 		return fmt.Errorf("could not stop for checkpoint")
@@ -205,6 +403,24 @@ func (c *controller) TakeCheckpoint() error {
 
 	checkStart := time.Now()
 
+	// Dropped pages cannot be read through /proc/pid/mem
+	if c.lazy != nil {
+		err = c.lazy.FillDropped()
+		if err != nil {
+			c.Continue()
+			return fmt.Errorf("could not fill lazily restored pages: %s", err)
+		}
+
+		// A replaced checkpoint is released, so no page may be served from it
+		if index, replacing := c.names[name]; replacing {
+			err = c.lazy.Forget(c.checkpoints[index])
+			if err != nil {
+				c.Continue()
+				return fmt.Errorf("could not forget replaced checkpoint %s: %s", name, err)
+			}
+		}
+	}
+
 	state, err := c.State()
 	if err != nil {
 		return err
@@ -212,13 +428,30 @@ func (c *controller) TakeCheckpoint() error {
 
 	err = state.SaveWritablePages()
 	if err != nil {
-		return err
+		// Nothing changed, so the process carries on without the checkpoint
+		c.Continue()
+		return fmt.Errorf("could not save pages: %w", err)
 	}
-	err = c.ClearMemRefs()
+	err = c.tracker.Reset(c.pid)
 	if err != nil {
+		state.Release()
+		c.Continue()
 		return err
 	}
-	c.checkpoints = append(c.checkpoints, state)
+
+	index, replacing := c.names[name]
+	if replacing {
+		c.checkpoints[index].Release()
+		c.checkpoints[index] = state
+	} else {
+		index = len(c.checkpoints)
+		c.checkpoints = append(c.checkpoints, state)
+		if name != "" {
+			c.names[name] = index
+		}
+	}
+	// Soft-dirty bits now track changes since this checkpoint
+	c.dirtyBase = index
 
 	fmt.Printf("checkpoint time: %s", time.Since(checkStart))
 
@@ -230,21 +463,78 @@ func (c *controller) Checkpoints() []*state.State {
 	return c.checkpoints
 }
 
-func (c *controller) SendFunction(function string) error {
-	functionReq := &Message{Type: "function", Data: function}
+// SaveCheckpoint writes checkpoint number index to a file at path
+func (c *controller) SaveCheckpoint(index int, path string) error {
+	if index < 0 || index >= len(c.checkpoints) {
+		return fmt.Errorf("no checkpoint %d to save", index)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("could not create checkpoint file: %s", err)
+	}
+	defer f.Close()
 
-	functionReqString, err := json.Marshal(functionReq)
+	_, err = c.checkpoints[index].WriteTo(f)
 	if err != nil {
 		return err
 	}
 
-	newLineReq := append(functionReqString, []byte("\n")...)
-	_, err = c.streams.Stdin.Write(newLineReq)
+	return f.Close()
+}
+
+// LoadCheckpoint reads a checkpoint file written by SaveCheckpoint and adds
+// it to the checkpoints, after verifying it belongs to the attached process.
+// The first restore to it writes back all of its writable pages.
+func (c *controller) LoadCheckpoint(path string) error {
+	if !c.attached {
+		return errors.New("controller must be attached to load a checkpoint")
+	}
+
+	f, err := os.Open(path)
 	if err != nil {
-		return fmt.Errorf("could not write to worker stdin: %s", err)
+		return fmt.Errorf("could not open checkpoint file: %s", err)
 	}
+	defer f.Close()
 
-	loadedMessage := c.AwaitMessage("function_loaded")
+	err = c.Stop()
+	if err != nil {
+		return fmt.Errorf("could not stop to load checkpoint: %s", err)
+	}
+	defer c.Continue()
+
+	state, err := state.ReadState(f, c.pid, c.pages)
+	if err != nil {
+		return fmt.Errorf("could not read checkpoint file: %s", err)
+	}
+
+	err = state.AttachTasks(c.traceTasks)
+	if err != nil {
+		return fmt.Errorf("checkpoint does not match process: %s", err)
+	}
+
+	err = state.VerifyMappings()
+	if err != nil {
+		return fmt.Errorf("checkpoint does not match process: %s", err)
+	}
+	state.SetMemoryIO(c.memoryIO, c.ioConcurrency)
+
+	c.checkpoints = append(c.checkpoints, state)
+	return nil
+}
+
+func (c *controller) SendFunction(function string) error {
+	return c.SendFunctionContext(context.Background(), function)
+}
+
+// SendFunctionContext loads function in the worker. If ctx is done before the
+// worker reports the function loaded, an AwaitMessageError is returned and
+// the worker should be restored before it is used again.
+func (c *controller) SendFunctionContext(ctx context.Context, function string) error {
+	loadedMessage, err := c.exchange(ctx, &Message{Type: "function", Data: function}, "function_loaded")
+	if err != nil {
+		return fmt.Errorf("could not load function: %w", err)
+	}
 	success, ok := loadedMessage.Data.(bool)
 	if !ok || !success {
 		return fmt.Errorf("function failed to load")
@@ -254,48 +544,201 @@ func (c *controller) SendFunction(function string) error {
 }
 
 func (c *controller) SendRequest(request interface{}) (interface{}, error) {
-	functionReq := &Message{Type: "request", Data: request}
-	functionReqString, err := json.Marshal(functionReq)
+	return c.SendRequestContext(context.Background(), request)
+}
+
+// SendRequestContext sends request to the worker's function and returns its
+// response. Up to the concurrency limit of requests are sent at once, later
+// ones wait for a slot. If ctx is done before the response arrives, an
+// AwaitMessageError is returned and the worker should be restored before it
+// is used again.
+func (c *controller) SendRequestContext(ctx context.Context, request interface{}) (interface{}, error) {
+	response, _, err := c.sendRequest(ctx, request, false)
+	return response, err
+}
+
+// SendRequestWithLogs is SendRequestContext that also returns what the
+// function wrote to stdout and stderr, and what its runtime logged, until the
+// response. Lines are capped by the log limit.
+func (c *controller) SendRequestWithLogs(ctx context.Context, request interface{}) (interface{}, []LogLine, error) {
+	return c.sendRequest(ctx, request, true)
+}
+
+func (c *controller) sendRequest(ctx context.Context, request interface{}, collectLogs bool) (interface{}, []LogLine, error) {
+	release, err := c.acquireRequestSlot(ctx)
 	if err != nil {
-		return "", err
+		return "", nil, fmt.Errorf("could not send request: %w", err)
 	}
-	newLineReq := append(functionReqString, []byte("\n")...)
-	_, err = c.streams.Stdin.Write(newLineReq)
+	defer release()
+
+	requestMessage := &Message{Type: "request", ID: atomic.AddUint64(&c.nextID, 1), Data: request}
+	stopLogs := func() []LogLine { return nil }
+	if collectLogs {
+		stopLogs = c.startLogs(requestMessage.ID)
+	}
+
+	message, err := c.exchange(ctx, requestMessage, "response")
+	logs := stopLogs()
 	if err != nil {
-		return "", err
+		return "", logs, fmt.Errorf("could not get response: %w", err)
+	}
+	return message.Data, logs, nil
+}
+
+// SetConcurrency sets how many requests may wait for a response at once. Only
+// runtimes that serve requests concurrently and reply with request IDs can be
+// sent more than one, so once activated, runtimes that did not report
+// supporting both are sent one.
+func (c *controller) SetConcurrency(limit int) {
+	c.slotsMutex.Lock()
+	defer c.slotsMutex.Unlock()
+	c.concurrency = limit
+	c.applyConcurrency()
+}
+
+// applyConcurrency must be called with the slots mutex held
+func (c *controller) applyConcurrency() {
+	limit := c.concurrency
+	if limit < 1 || (c.activated && !c.capabilities.Concurrent()) {
+		limit = 1
 	}
 
-	message := c.AwaitMessage("response")
-	return message.Data, nil
+	// Requests in flight give back their slot to the channel they took it from
+	c.requestSlots = make(chan struct{}, limit)
 }
 
-func (c *controller) AwaitMessage(messageType string) Message {
+// acquireRequestSlot waits until fewer requests than the concurrency limit
+// are in flight, and returns the function that gives the slot back
+func (c *controller) acquireRequestSlot(ctx context.Context) (func(), error) {
+	c.slotsMutex.Lock()
+	slots := c.requestSlots
+	c.slotsMutex.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, &AwaitMessageError{MessageType: "response", Err: ctx.Err()}
+	}
+}
+
+// exchange sends message, with a new ID unless it has one, and waits for the
+// reply of replyType with the same ID. Runtimes that do not send IDs are
+// answered by the next untagged reply of replyType.
+func (c *controller) exchange(ctx context.Context, message *Message, replyType string) (Message, error) {
+	if message.ID == 0 {
+		message.ID = atomic.AddUint64(&c.nextID, 1)
+	}
+	reply := make(chan Message, 1)
+	c.repliesMutex.Lock()
+	c.replies[message.ID] = reply
+	c.repliesMutex.Unlock()
+	defer func() {
+		c.repliesMutex.Lock()
+		delete(c.replies, message.ID)
+		c.repliesMutex.Unlock()
+	}()
+
+	err := c.writeMessage(ctx, message)
+	if err != nil {
+		return Message{}, err
+	}
+
 	for {
-		message := <-c.messages
-		if message.Type == messageType {
-			return message
+		select {
+		case replyMessage := <-reply:
+			if replyMessage.Type != replyType {
+				return Message{}, fmt.Errorf("worker replied to %s %d with %s", message.Type, message.ID, replyMessage.Type)
+			}
+			return replyMessage, nil
+		case untagged := <-c.messages:
+			if untagged.Type == replyType {
+				return untagged, nil
+			}
+		case <-ctx.Done():
+			return Message{}, &AwaitMessageError{MessageType: replyType, Err: ctx.Err()}
 		}
 	}
 }
 
-// SendMessage writes a message to the containers stdin
-func (c *controller) SendMessage(messageType string, data interface{}) error {
-	message := &Message{Type: messageType, Data: data}
+// deliverReply hands a message with an ID to the caller waiting for it.
+// Replies nobody waits for any more, such as late responses to requests that
+// were given up on, are dropped.
+func (c *controller) deliverReply(message Message) {
+	c.repliesMutex.Lock()
+	reply, waiting := c.replies[message.ID]
+	delete(c.replies, message.ID)
+	c.repliesMutex.Unlock()
+
+	if !waiting {
+		log.Debugf("dropping %s %d with no one waiting for it", message.Type, message.ID)
+		return
+	}
+	reply <- message
+}
+
+// writeMessage writes message to the worker's stdin, or in a frame once the
+// framed protocol is in use, unless ctx is already done
+func (c *controller) writeMessage(ctx context.Context, message *Message) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("could not send %s: %w", message.Type, &AwaitMessageError{MessageType: message.Type, Err: err})
+	}
+
+	if atomic.LoadInt32(&c.framed) == 1 {
+		return c.channel.writeFrame(message)
+	}
+
 	messageString, err := json.Marshal(message)
 	if err != nil {
 		return err
 	}
 
 	newLineReq := append(messageString, []byte("\n")...)
-
 	_, err = c.streams.Stdin.Write(newLineReq)
 	if err != nil {
-		return err
+		return fmt.Errorf("could not write to worker stdin: %s", err)
 	}
 
 	return nil
 }
 
+func (c *controller) AwaitMessage(messageType string) Message {
+	message, _ := c.AwaitMessageContext(context.Background(), messageType)
+	return message
+}
+
+// AwaitMessageContext waits for the next message of messageType from the
+// worker, discarding messages of other types, until ctx is done
+func (c *controller) AwaitMessageContext(ctx context.Context, messageType string) (Message, error) {
+	for {
+		select {
+		case message := <-c.messages:
+			if message.Type == messageType {
+				return message, nil
+			}
+		case <-ctx.Done():
+			return Message{}, &AwaitMessageError{MessageType: messageType, Err: ctx.Err()}
+		}
+	}
+}
+
+// discardMessages drops messages the worker sent before a restore, such as
+// the response to a request that was given up on
+func (c *controller) discardMessages() {
+	for {
+		select {
+		case <-c.messages:
+		default:
+			return
+		}
+	}
+}
+
+// SendMessage writes a message to the containers stdin
+func (c *controller) SendMessage(messageType string, data interface{}) error {
+	return c.writeMessage(context.Background(), &Message{Type: messageType, Data: data})
+}
+
 // AwaitSignal lets the process continue until the desired signal is caught.
 // Allows the process to continue after the signal is caught
 func (c *controller) AwaitSignal(waitingFor syscall.Signal) {
@@ -323,20 +766,67 @@ func (c *controller) PauseAtSignal(waitingFor syscall.Signal) {
 // Restore returns process state to first checkpoint
 // Restore takes responsibility for stopping tasks
 func (c *controller) Restore() error {
-	err := c.Stop()
-	if err != nil {
-		return fmt.Errorf("could not stop worker for restore: %s", err)
-	}
-
 	if len(c.checkpoints) == 0 {
 		return fmt.Errorf("no checkpoints to restore")
 	}
 
-	state := c.checkpoints[0]
+	return c.RestoreTo(0)
+}
+
+// RestoreToNamed restores the checkpoint taken with TakeNamedCheckpoint(name)
+func (c *controller) RestoreToNamed(name string) error {
+	index, ok := c.names[name]
+	if !ok {
+		return fmt.Errorf("no checkpoint named %s", name)
+	}
+
+	return c.RestoreTo(index)
+}
+
+// RestoreTo returns process state to checkpoint number index. Only pages
+// dirtied since the last checkpoint or full restore are tracked, so restoring
+// any other checkpoint writes back all of its writable pages.
+// RestoreTo takes responsibility for stopping tasks
+func (c *controller) RestoreTo(index int) error {
+	if index < 0 || index >= len(c.checkpoints) {
+		return fmt.Errorf("no checkpoint %d to restore", index)
+	}
+
+	state := c.checkpoints[index]
+
+	exited, err := state.ExitedTasks()
+	if err != nil {
+		return fmt.Errorf("could not check for exited tasks on restore: %s", err)
+	}
+	if len(exited) > 0 {
+		return fmt.Errorf("checkpointed tasks %v have exited, process cannot be restored", exited)
+	}
+	c.forgetExitedTasks()
+
+	err = c.Stop()
+	if err != nil {
+		return fmt.Errorf("could not stop worker for restore: %s", err)
+	}
+	err = c.resetChannel()
+	if err != nil {
+		return fmt.Errorf("could not reset worker channel: %s", err)
+	}
+	c.discardMessages()
 
 	start := time.Now()
 
-	fixup := false
+	tasksExited, err := c.exitNewTasks(state)
+	if err != nil {
+		return fmt.Errorf("could not exit new tasks: %s", err)
+	}
+
+	processesKilled, err := state.KillNewProcesses()
+	if err != nil {
+		return fmt.Errorf("could not kill new processes: %s", err)
+	}
+
+	// Reaping killed processes runs syscalls in the process
+	fixup := processesKilled > 0
 	changed, err := state.ProgramBreakChanged()
 	if err != nil {
 		return fmt.Errorf("could not check program break on restore: %s", err)
@@ -350,16 +840,58 @@ func (c *controller) Restore() error {
 		}
 	}
 
-	changed, err = state.NumMemoryLocationsChanged()
+	mappingChanges, err := state.MappingChanges()
 	if err != nil {
-		return fmt.Errorf("could not check num mem locations changed on restore: %s", err)
+		return fmt.Errorf("could not diff mappings on restore: %s", err)
 	}
 
-	if changed {
+	if len(mappingChanges) > 0 {
+		fixup = true
+		err := state.RestoreMappings(mappingChanges)
+		if err != nil {
+			return fmt.Errorf("could not restore mappings: %w", err)
+		}
+	}
+
+	signalsRestored, err := state.RestoreSignals()
+	if signalsRestored {
+		fixup = true
+	}
+	if err != nil {
+		return fmt.Errorf("could not restore signals: %s", err)
+	}
+
+	fdsRestored, err := state.RestoreFileDescriptors()
+	if fdsRestored {
+		fixup = true
+	}
+	if err != nil {
+		return fmt.Errorf("could not restore file descriptors: %w", err)
+	}
+
+	timersRestored, err := state.RestoreTimers()
+	if timersRestored {
 		fixup = true
-		err := state.UnmapNewLocations()
+	}
+	if err != nil {
+		return fmt.Errorf("could not restore timers: %s", err)
+	}
+
+	credentialsRestored, err := state.RestoreCredentials()
+	if credentialsRestored {
+		fixup = true
+	}
+	if err != nil {
+		return fmt.Errorf("could not restore credentials: %w", err)
+	}
+
+	if c.noHugePages {
+		advised, err := state.DisableHugePages()
+		if advised {
+			fixup = true
+		}
 		if err != nil {
-			return fmt.Errorf("count not unmap new locations: %s", err)
+			return fmt.Errorf("could not disable huge pages: %s", err)
 		}
 	}
 
@@ -370,27 +902,174 @@ func (c *controller) Restore() error {
 		}
 	}
 
-	err = state.RestoreDirtyPages()
+	fullMemory := c.tracker.SinceReset() && index != c.dirtyBase
+	err = c.restorePages(state, fullMemory)
 	if err != nil {
-		return fmt.Errorf("could not restore stack: %s", err)
+		return err
+	}
+	if fullMemory {
+		err = c.tracker.Reset(c.pid)
+		if err != nil {
+			return err
+		}
+		c.dirtyBase = index
+	}
+
+	err = state.RestoreRlimits()
+	if err != nil {
+		return fmt.Errorf("could not restore rlimits: %s", err)
 	}
 
 	err = state.RestoreRegs()
 	if err != nil {
 		return fmt.Errorf("could not restore regs: %s", err)
 	}
-	fmt.Printf("restore time: %s", time.Since(start))
+	c.restoreStats = RestoreStats{
+		Duration:        time.Since(start),
+		TasksExited:     tasksExited,
+		ProcessesKilled: processesKilled,
+		FullMemory:      fullMemory,
+		DirtyTracker:    c.tracker.Name(),
+		Mode:            c.restoreMode,
+		HugePageBytes:   state.HugePageBytes(),
+	}
+	fmt.Printf("restore time: %s", c.restoreStats.Duration)
+
+	if c.verifyRestore {
+		err := c.verify(state)
+		if err != nil {
+			return err
+		}
+	}
 
 	c.Continue()
 
 	return nil
 }
 
+// verify compares the process with the checkpoint it was restored to
+func (c *controller) verify(checkpoint *state.State) error {
+	report, err := checkpoint.Verify()
+	if err != nil {
+		return fmt.Errorf("could not verify restore: %s", err)
+	}
+
+	c.verifyReport = report
+	if !report.Matches() {
+		return fmt.Errorf("could not verify restore: %w", &state.VerifyError{Report: report})
+	}
+	return nil
+}
+
+// restorePages brings writable memory back to checkpoint. fullMemory restores
+// every page, for when dirty pages were tracked against another checkpoint.
+func (c *controller) restorePages(checkpoint *state.State, fullMemory bool) error {
+	if c.restoreMode == LazyRestore {
+		tracker := c.tracker
+		if fullMemory {
+			tracker = state.FullCopyTracker{}
+		}
+
+		if c.lazy == nil {
+			lazy, err := state.NewLazyRestorer(c.pid, c.traceTasks[c.pid])
+			if err != nil {
+				return fmt.Errorf("could not start lazy restore: %s", err)
+			}
+			c.lazy = lazy
+		}
+
+		err := checkpoint.RestoreLazily(tracker, c.lazy)
+		if err != nil {
+			return fmt.Errorf("could not restore pages lazily: %s", err)
+		}
+		return nil
+	}
+
+	if fullMemory {
+		err := checkpoint.RestoreWritablePages()
+		if err != nil {
+			return fmt.Errorf("could not restore writable pages: %s", err)
+		}
+		return nil
+	}
+
+	err := checkpoint.RestoreTrackedPages(c.tracker)
+	if err != nil {
+		return fmt.Errorf("could not restore dirty pages: %s", err)
+	}
+	return nil
+}
+
+// exitNewTasks ends threads started since the checkpoint, attaching to them
+// first if needed. Untraced threads can start more threads until they are
+// stopped, so this repeats until none are left. Threads stopped outside a
+// syscall cannot be ended safely and fail the restore. Returns how many were
+// ended.
+func (c *controller) exitNewTasks(state *state.State) (int, error) {
+	exited := 0
+	for {
+		newTids, err := state.NewTasks()
+		if err != nil {
+			return exited, err
+		}
+		if len(newTids) == 0 {
+			return exited, nil
+		}
+
+		for _, tid := range newTids {
+			task, ok := c.traceTasks[tid]
+			if !ok {
+				task, err = ptrace.NewTraceTask(tid, c.pid, c.ptraceOptions)
+				if err != nil {
+					if !c.taskExists(tid) {
+						// Exited by itself in the meantime
+						continue
+					}
+					return exited, fmt.Errorf("could not attach to new task %d: %s", tid, err)
+				}
+			}
+
+			err = task.Stop()
+			if err != nil {
+				return exited, fmt.Errorf("could not stop new task %d: %s", tid, err)
+			}
+
+			task.Exit <- 1
+			err = <-task.HasExited
+			delete(c.traceTasks, tid)
+			if err != nil {
+				return exited, fmt.Errorf("could not exit new task %d: %s", tid, err)
+			}
+			exited++
+		}
+	}
+}
+
+// forgetExitedTasks drops trace tasks of threads that have exited
+func (c *controller) forgetExitedTasks() {
+	for tid := range c.traceTasks {
+		if !c.taskExists(tid) {
+			delete(c.traceTasks, tid)
+		}
+	}
+}
+
+func (c *controller) taskExists(tid int) bool {
+	_, err := os.Stat(fmt.Sprintf("/proc/%d/task/%d", c.pid, tid))
+	return !os.IsNotExist(err)
+}
+
 // Detach 'es all tasks from ptrace supervision
 // For PTRACE_DETACH to on a task, it must be in a ptrace-stop state
 // Tgkilling the task and supressing injection on detach is a good way to
 // do this.
 func (c *controller) Detach() error {
+	// Pages still dropped are lost once nothing serves them
+	err := c.closeLazyRestorer()
+	if err != nil {
+		return err
+	}
+
 	for _, task := range c.traceTasks {
 		// Ensure the task is stopped
 		err := task.Stop()
@@ -460,6 +1139,8 @@ func (c *controller) State() (*state.State, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not get state: %s", err)
 	}
+	state.SetMemoryIO(c.memoryIO, c.ioConcurrency)
+	state.SetPageStore(c.pages)
 
 	return state, nil
 }
@@ -482,22 +1163,104 @@ func (c *controller) SetRegs(state *state.State) error {
 	return nil
 }
 
+// RemoteSyscall runs a syscall in the main task of the process
+// Caller must ensure tasks are stopped
+func (c *controller) RemoteSyscall(nr uint64, args ...uint64) (uint64, error) {
+	task, ok := c.traceTasks[c.pid]
+	if !ok {
+		return 0, errors.New("controller is not attached")
+	}
+
+	return task.RemoteSyscall(nr, args...)
+}
+
+func (c *controller) LastRestoreStats() RestoreStats {
+	return c.restoreStats
+}
+
+// SetVerifyRestore makes every later restore compare the process with its
+// checkpoint before continuing it. A restore that does not match returns a
+// *state.VerifyError and leaves the process stopped. Verifying reads every
+// page, so lazy restores become eager.
+func (c *controller) SetVerifyRestore(verify bool) {
+	c.verifyRestore = verify
+	c.verifyReport = nil
+}
+
+// LastVerifyReport is the report of the last verified restore, or nil
+func (c *controller) LastVerifyReport() *state.VerifyReport {
+	return c.verifyReport
+}
+
+// ClearMemRefs clears the soft-dirty bits of the process, whichever
+// tracker is in use
 func (c *controller) ClearMemRefs() error {
-	pid := c.pid
-	f, err := os.OpenFile(fmt.Sprintf("/proc/%d/clear_refs", pid), os.O_WRONLY, 0)
-	if err != nil {
-		return fmt.Errorf("could not open clear_refs for pid %d: %s", pid, err)
+	return state.SoftDirtyTracker{}.Reset(c.pid)
+}
+
+// SetRestoreMode chooses how later restores bring back writable memory.
+// Leaving lazy mode fills any pages still dropped.
+func (c *controller) SetRestoreMode(mode RestoreMode) error {
+	if mode != LazyRestore {
+		err := c.closeLazyRestorer()
+		if err != nil {
+			return err
+		}
 	}
-	defer f.Close()
 
-	// https://github.com/torvalds/linux/blob/master/Documentation/admin-guide/mm/soft-dirty.rst
-	_, err = f.WriteString("4")
+	c.restoreMode = mode
+	return nil
+}
+
+func (c *controller) closeLazyRestorer() error {
+	if c.lazy == nil {
+		return nil
+	}
+
+	err := c.lazy.Close()
+	c.lazy = nil
 	if err != nil {
-		return fmt.Errorf("could not clear_refs for pid %d: %s", pid, err)
+		return fmt.Errorf("could not close lazy restorer: %s", err)
 	}
 	return nil
 }
 
+// SetDirtyTracker replaces the tracker chosen by probing the kernel. The
+// next restore writes back all writable pages of its checkpoint.
+func (c *controller) SetDirtyTracker(tracker state.DirtyTracker) {
+	c.tracker = tracker
+	c.dirtyBase = -1
+}
+
+// SetMemoryIO chooses how checkpoint pages are copied, for the checkpoints
+// already taken as well as later ones. A concurrency below 1 is the default.
+func (c *controller) SetMemoryIO(io state.MemoryIO, concurrency int) {
+	c.memoryIO = io
+	c.ioConcurrency = concurrency
+	for _, checkpoint := range c.checkpoints {
+		checkpoint.SetMemoryIO(io, concurrency)
+	}
+}
+
+// SetPageStore shares checkpoint pages with other controllers using store.
+// Checkpoints already taken keep their pages where they are.
+func (c *controller) SetPageStore(store *state.PageStore) {
+	c.pages = store
+}
+
+// SetHugePages chooses whether transparent huge pages may back the process's
+// anonymous memory. When disabled, each restore madvises anonymous mappings
+// not yet advised with MADV_NOHUGEPAGE.
+func (c *controller) SetHugePages(enabled bool) {
+	c.noHugePages = !enabled
+}
+
+// DirtyTracker is the tracker in use. Unless one was set, it is chosen on the
+// first Attach and nil until then.
+func (c *controller) DirtyTracker() state.DirtyTracker {
+	return c.tracker
+}
+
 func (c *controller) End() error {
 	var detachErr error
 	if c.attached {
@@ -508,6 +1271,17 @@ func (c *controller) End() error {
 		c.streams.Stdout.Close()
 		c.streams.Stderr.Close()
 	}
+	if c.channel != nil {
+		c.channel.close()
+	}
+
+	// Pages shared with other controllers stay stored
+	for _, checkpoint := range c.checkpoints {
+		checkpoint.Release()
+	}
+	c.checkpoints = nil
+	c.names = make(map[string]int)
+	c.dirtyBase = -1
 
 	if detachErr != nil {
 		return fmt.Errorf("could not detach on end: %s", detachErr)
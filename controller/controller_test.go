@@ -1,6 +1,17 @@
 package controller_test
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
@@ -22,4 +33,229 @@ var _ = Describe("Controller", func() {
 		Expect(c.Activate()).To(MatchError("controller has no in/out streams"))
 	})
 
+	Context("when waiting for messages with a context", func() {
+		var stdout *io.PipeWriter
+
+		BeforeEach(func() {
+			inReader, inWriter := io.Pipe()
+			go io.Copy(ioutil.Discard, inReader)
+			var outReader, errReader *io.PipeReader
+			outReader, stdout = io.Pipe()
+			errReader, _ = io.Pipe()
+			c.SetStreams(inWriter, outReader, errReader)
+		})
+
+		AfterEach(func() {
+			stdout.Close()
+		})
+
+		It("returns the response when it arrives in time", func() {
+			go stdout.Write([]byte("{\"type\": \"response\", \"data\": \"grape\"}\n"))
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			response, err := c.SendRequestContext(ctx, "potato")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(Equal("grape"))
+		})
+
+		It("returns a timeout error when no response arrives", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, err := c.SendRequestContext(ctx, "potato")
+
+			var awaitErr *AwaitMessageError
+			Expect(errors.As(err, &awaitErr)).To(BeTrue())
+			Expect(awaitErr.MessageType).To(Equal("response"))
+			Expect(awaitErr.Timeout()).To(BeTrue())
+			Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+		})
+
+		It("returns a cancellation error when the function is not loaded", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				cancel()
+			}()
+			err := c.SendFunctionContext(ctx, "def main(req):\n  while True: pass")
+
+			var awaitErr *AwaitMessageError
+			Expect(errors.As(err, &awaitErr)).To(BeTrue())
+			Expect(awaitErr.MessageType).To(Equal("function_loaded"))
+			Expect(awaitErr.Timeout()).To(BeFalse())
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+		})
+
+		It("does not send when the context is already done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := c.SendRequestContext(ctx, "potato")
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+		})
+	})
+
+	Context("when the runtime replies with request ids", func() {
+		var stdout *io.PipeWriter
+		var inFlight, maxInFlight int32
+
+		BeforeEach(func() {
+			inReader, inWriter := io.Pipe()
+			var outReader, errReader *io.PipeReader
+			outReader, stdout = io.Pipe()
+			errReader, _ = io.Pipe()
+			c.SetStreams(inWriter, outReader, errReader)
+			inFlight, maxInFlight = 0, 0
+
+			// Answers each request after the milliseconds it asks for
+			go func() {
+				lines := bufio.NewScanner(inReader)
+				for lines.Scan() {
+					var request Message
+					Expect(json.Unmarshal(lines.Bytes(), &request)).To(Succeed())
+					go func() {
+						defer GinkgoRecover()
+						current := atomic.AddInt32(&inFlight, 1)
+						for {
+							max := atomic.LoadInt32(&maxInFlight)
+							if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+								break
+							}
+						}
+						time.Sleep(time.Duration(request.Data.(float64)) * time.Millisecond)
+						atomic.AddInt32(&inFlight, -1)
+
+						response, err := json.Marshal(Message{Type: "response", ID: request.ID, Data: request.Data})
+						Expect(err).NotTo(HaveOccurred())
+						stdout.Write(append(response, '\n'))
+					}()
+				}
+			}()
+		})
+
+		AfterEach(func() {
+			stdout.Close()
+		})
+
+		sendAll := func(waits []float64) []interface{} {
+			responses := make([]interface{}, len(waits))
+			var wg sync.WaitGroup
+			for i, wait := range waits {
+				wg.Add(1)
+				go func(i int, wait float64) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					response, err := c.SendRequest(wait)
+					Expect(err).NotTo(HaveOccurred())
+					responses[i] = response
+				}(i, wait)
+			}
+			wg.Wait()
+			return responses
+		}
+
+		It("routes each response to the request with its id", func() {
+			c.SetConcurrency(3)
+			waits := []float64{150, 50, 100}
+			Expect(sendAll(waits)).To(Equal([]interface{}{150.0, 50.0, 100.0}))
+			Expect(atomic.LoadInt32(&maxInFlight)).To(BeEquivalentTo(3))
+		})
+
+		It("sends one request at a time by default", func() {
+			Expect(sendAll([]float64{30, 10, 20})).To(Equal([]interface{}{30.0, 10.0, 20.0}))
+			Expect(atomic.LoadInt32(&maxInFlight)).To(BeEquivalentTo(1))
+		})
+
+		It("drops late responses to requests that were given up on", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			_, err := c.SendRequestContext(ctx, 100.0)
+			Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+
+			c.SetConcurrency(2)
+			response, err := c.SendRequest(200.0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(Equal(200.0))
+		})
+	})
+
+	Context("when collecting the logs of a request", func() {
+		var stdout, stderr *io.PipeWriter
+
+		BeforeEach(func() {
+			inReader, inWriter := io.Pipe()
+			var outReader, errReader *io.PipeReader
+			outReader, stdout = io.Pipe()
+			errReader, stderr = io.Pipe()
+			c.SetStreams(inWriter, outReader, errReader)
+
+			// Prints, logs and writes to stderr before each response
+			go func() {
+				lines := bufio.NewScanner(inReader)
+				for lines.Scan() {
+					var request Message
+					Expect(json.Unmarshal(lines.Bytes(), &request)).To(Succeed())
+
+					stdout.Write([]byte(fmt.Sprintf("print %s\n", request.Data)))
+					stdout.Write([]byte("{\"type\": \"log\", \"data\": \"runtime log\"}\n"))
+					stderr.Write([]byte("an error\n"))
+					// stderr is read separately from the response
+					time.Sleep(20 * time.Millisecond)
+
+					response, err := json.Marshal(Message{Type: "response", ID: request.ID, Data: request.Data})
+					Expect(err).NotTo(HaveOccurred())
+					stdout.Write(append(response, '\n'))
+				}
+			}()
+		})
+
+		AfterEach(func() {
+			stdout.Close()
+			stderr.Close()
+		})
+
+		It("returns stdout, stderr and runtime log lines with the response", func() {
+			response, logs, err := c.SendRequestWithLogs(context.Background(), "potato")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(Equal("potato"))
+
+			var lines []string
+			for _, line := range logs {
+				lines = append(lines, line.Stream+": "+line.Message)
+				Expect(line.String()).To(HaveSuffix(line.Stream + ": " + line.Message))
+			}
+			Expect(lines).To(ConsistOf("stdout: print potato", "stdout: runtime log", "stderr: an error"))
+		})
+
+		It("truncates logs over the limit", func() {
+			// Room for two of the three lines, whichever order they arrive in
+			c.SetLogLimit(len("print potato") + len("runtime log"))
+			_, logs, err := c.SendRequestWithLogs(context.Background(), "potato")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(logs).To(HaveLen(3))
+			Expect(logs[2].Stream).To(Equal("stderr"))
+			Expect(logs[2].Message).To(ContainSubstring("Logs were truncated"))
+		})
+
+		It("does not collect logs of requests sent without", func() {
+			_, err := c.SendRequest("potato")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, logs, err := c.SendRequestWithLogs(context.Background(), "grape")
+			Expect(err).NotTo(HaveOccurred())
+			var messages []string
+			for _, line := range logs {
+				messages = append(messages, line.Message)
+			}
+			Expect(messages).To(ConsistOf("print grape", "runtime log", "an error"))
+		})
+	})
+})
+
+var _ = Describe("Capabilities", func() {
+	It("is concurrent only with both ids and concurrency", func() {
+		Expect(Capabilities{Features: []string{FeatureIDs, FeatureLogs}}.Concurrent()).To(BeFalse())
+		Expect(Capabilities{Features: []string{FeatureConcurrency}}.Concurrent()).To(BeFalse())
+		Expect(Capabilities{Features: []string{FeatureIDs, FeatureConcurrency}}.Concurrent()).To(BeTrue())
+	})
 })
@@ -2,6 +2,7 @@
 package controllerfakes
 
 import (
+	"context"
 	"io"
 	"sync"
 	"syscall"
@@ -42,11 +43,35 @@ type FakeController struct {
 	awaitMessageReturnsOnCall map[int]struct {
 		result1 controller.Message
 	}
+	AwaitMessageContextStub        func(context.Context, string) (controller.Message, error)
+	awaitMessageContextMutex       sync.RWMutex
+	awaitMessageContextArgsForCall []struct {
+		arg1 context.Context
+		arg2 string
+	}
+	awaitMessageContextReturns struct {
+		result1 controller.Message
+		result2 error
+	}
+	awaitMessageContextReturnsOnCall map[int]struct {
+		result1 controller.Message
+		result2 error
+	}
 	AwaitSignalStub        func(syscall.Signal)
 	awaitSignalMutex       sync.RWMutex
 	awaitSignalArgsForCall []struct {
 		arg1 syscall.Signal
 	}
+	CapabilitiesStub        func() controller.Capabilities
+	capabilitiesMutex       sync.RWMutex
+	capabilitiesArgsForCall []struct {
+	}
+	capabilitiesReturns struct {
+		result1 controller.Capabilities
+	}
+	capabilitiesReturnsOnCall map[int]struct {
+		result1 controller.Capabilities
+	}
 	CheckpointsStub        func() []*state.State
 	checkpointsMutex       sync.RWMutex
 	checkpointsArgsForCall []struct {
@@ -92,6 +117,28 @@ type FakeController struct {
 	detachReturnsOnCall map[int]struct {
 		result1 error
 	}
+	DirtyTrackerStub        func() state.DirtyTracker
+	dirtyTrackerMutex       sync.RWMutex
+	dirtyTrackerArgsForCall []struct {
+	}
+	dirtyTrackerReturns struct {
+		result1 state.DirtyTracker
+	}
+	dirtyTrackerReturnsOnCall map[int]struct {
+		result1 state.DirtyTracker
+	}
+	EnableFramedProtocolStub        func(string, string) error
+	enableFramedProtocolMutex       sync.RWMutex
+	enableFramedProtocolArgsForCall []struct {
+		arg1 string
+		arg2 string
+	}
+	enableFramedProtocolReturns struct {
+		result1 error
+	}
+	enableFramedProtocolReturnsOnCall map[int]struct {
+		result1 error
+	}
 	EndStub        func() error
 	endMutex       sync.RWMutex
 	endArgsForCall []struct {
@@ -114,6 +161,37 @@ type FakeController struct {
 		result1 *state.State
 		result2 error
 	}
+	LastRestoreStatsStub        func() controller.RestoreStats
+	lastRestoreStatsMutex       sync.RWMutex
+	lastRestoreStatsArgsForCall []struct {
+	}
+	lastRestoreStatsReturns struct {
+		result1 controller.RestoreStats
+	}
+	lastRestoreStatsReturnsOnCall map[int]struct {
+		result1 controller.RestoreStats
+	}
+	LastVerifyReportStub        func() *state.VerifyReport
+	lastVerifyReportMutex       sync.RWMutex
+	lastVerifyReportArgsForCall []struct {
+	}
+	lastVerifyReportReturns struct {
+		result1 *state.VerifyReport
+	}
+	lastVerifyReportReturnsOnCall map[int]struct {
+		result1 *state.VerifyReport
+	}
+	LoadCheckpointStub        func(string) error
+	loadCheckpointMutex       sync.RWMutex
+	loadCheckpointArgsForCall []struct {
+		arg1 string
+	}
+	loadCheckpointReturns struct {
+		result1 error
+	}
+	loadCheckpointReturnsOnCall map[int]struct {
+		result1 error
+	}
 	PauseAtSignalStub        func(syscall.Signal)
 	pauseAtSignalMutex       sync.RWMutex
 	pauseAtSignalArgsForCall []struct {
@@ -129,6 +207,30 @@ type FakeController struct {
 	pidReturnsOnCall map[int]struct {
 		result1 int
 	}
+	ProtocolStub        func() string
+	protocolMutex       sync.RWMutex
+	protocolArgsForCall []struct {
+	}
+	protocolReturns struct {
+		result1 string
+	}
+	protocolReturnsOnCall map[int]struct {
+		result1 string
+	}
+	RemoteSyscallStub        func(uint64, ...uint64) (uint64, error)
+	remoteSyscallMutex       sync.RWMutex
+	remoteSyscallArgsForCall []struct {
+		arg1 uint64
+		arg2 []uint64
+	}
+	remoteSyscallReturns struct {
+		result1 uint64
+		result2 error
+	}
+	remoteSyscallReturnsOnCall map[int]struct {
+		result1 uint64
+		result2 error
+	}
 	RestoreStub        func() error
 	restoreMutex       sync.RWMutex
 	restoreArgsForCall []struct {
@@ -139,6 +241,40 @@ type FakeController struct {
 	restoreReturnsOnCall map[int]struct {
 		result1 error
 	}
+	RestoreToStub        func(int) error
+	restoreToMutex       sync.RWMutex
+	restoreToArgsForCall []struct {
+		arg1 int
+	}
+	restoreToReturns struct {
+		result1 error
+	}
+	restoreToReturnsOnCall map[int]struct {
+		result1 error
+	}
+	RestoreToNamedStub        func(string) error
+	restoreToNamedMutex       sync.RWMutex
+	restoreToNamedArgsForCall []struct {
+		arg1 string
+	}
+	restoreToNamedReturns struct {
+		result1 error
+	}
+	restoreToNamedReturnsOnCall map[int]struct {
+		result1 error
+	}
+	SaveCheckpointStub        func(int, string) error
+	saveCheckpointMutex       sync.RWMutex
+	saveCheckpointArgsForCall []struct {
+		arg1 int
+		arg2 string
+	}
+	saveCheckpointReturns struct {
+		result1 error
+	}
+	saveCheckpointReturnsOnCall map[int]struct {
+		result1 error
+	}
 	SendFunctionStub        func(string) error
 	sendFunctionMutex       sync.RWMutex
 	sendFunctionArgsForCall []struct {
@@ -150,6 +286,18 @@ type FakeController struct {
 	sendFunctionReturnsOnCall map[int]struct {
 		result1 error
 	}
+	SendFunctionContextStub        func(context.Context, string) error
+	sendFunctionContextMutex       sync.RWMutex
+	sendFunctionContextArgsForCall []struct {
+		arg1 context.Context
+		arg2 string
+	}
+	sendFunctionContextReturns struct {
+		result1 error
+	}
+	sendFunctionContextReturnsOnCall map[int]struct {
+		result1 error
+	}
 	SendMessageStub        func(string, interface{}) error
 	sendMessageMutex       sync.RWMutex
 	sendMessageArgsForCall []struct {
@@ -175,6 +323,36 @@ type FakeController struct {
 		result1 interface{}
 		result2 error
 	}
+	SendRequestContextStub        func(context.Context, interface{}) (interface{}, error)
+	sendRequestContextMutex       sync.RWMutex
+	sendRequestContextArgsForCall []struct {
+		arg1 context.Context
+		arg2 interface{}
+	}
+	sendRequestContextReturns struct {
+		result1 interface{}
+		result2 error
+	}
+	sendRequestContextReturnsOnCall map[int]struct {
+		result1 interface{}
+		result2 error
+	}
+	SendRequestWithLogsStub        func(context.Context, interface{}) (interface{}, []controller.LogLine, error)
+	sendRequestWithLogsMutex       sync.RWMutex
+	sendRequestWithLogsArgsForCall []struct {
+		arg1 context.Context
+		arg2 interface{}
+	}
+	sendRequestWithLogsReturns struct {
+		result1 interface{}
+		result2 []controller.LogLine
+		result3 error
+	}
+	sendRequestWithLogsReturnsOnCall map[int]struct {
+		result1 interface{}
+		result2 []controller.LogLine
+		result3 error
+	}
 	SendSignalStub        func(syscall.Signal) error
 	sendSignalMutex       sync.RWMutex
 	sendSignalArgsForCall []struct {
@@ -197,6 +375,37 @@ type FakeController struct {
 	sendSignalContReturnsOnCall map[int]struct {
 		result1 error
 	}
+	SetConcurrencyStub        func(int)
+	setConcurrencyMutex       sync.RWMutex
+	setConcurrencyArgsForCall []struct {
+		arg1 int
+	}
+	SetDirtyTrackerStub        func(state.DirtyTracker)
+	setDirtyTrackerMutex       sync.RWMutex
+	setDirtyTrackerArgsForCall []struct {
+		arg1 state.DirtyTracker
+	}
+	SetHugePagesStub        func(bool)
+	setHugePagesMutex       sync.RWMutex
+	setHugePagesArgsForCall []struct {
+		arg1 bool
+	}
+	SetLogLimitStub        func(int)
+	setLogLimitMutex       sync.RWMutex
+	setLogLimitArgsForCall []struct {
+		arg1 int
+	}
+	SetMemoryIOStub        func(state.MemoryIO, int)
+	setMemoryIOMutex       sync.RWMutex
+	setMemoryIOArgsForCall []struct {
+		arg1 state.MemoryIO
+		arg2 int
+	}
+	SetPageStoreStub        func(*state.PageStore)
+	setPageStoreMutex       sync.RWMutex
+	setPageStoreArgsForCall []struct {
+		arg1 *state.PageStore
+	}
 	SetPidStub        func(int)
 	setPidMutex       sync.RWMutex
 	setPidArgsForCall []struct {
@@ -213,6 +422,17 @@ type FakeController struct {
 	setRegsReturnsOnCall map[int]struct {
 		result1 error
 	}
+	SetRestoreModeStub        func(controller.RestoreMode) error
+	setRestoreModeMutex       sync.RWMutex
+	setRestoreModeArgsForCall []struct {
+		arg1 controller.RestoreMode
+	}
+	setRestoreModeReturns struct {
+		result1 error
+	}
+	setRestoreModeReturnsOnCall map[int]struct {
+		result1 error
+	}
 	SetStreamsStub        func(*io.PipeWriter, *io.PipeReader, *io.PipeReader)
 	setStreamsMutex       sync.RWMutex
 	setStreamsArgsForCall []struct {
@@ -220,6 +440,11 @@ type FakeController struct {
 		arg2 *io.PipeReader
 		arg3 *io.PipeReader
 	}
+	SetVerifyRestoreStub        func(bool)
+	setVerifyRestoreMutex       sync.RWMutex
+	setVerifyRestoreArgsForCall []struct {
+		arg1 bool
+	}
 	StateStub        func() (*state.State, error)
 	stateMutex       sync.RWMutex
 	stateArgsForCall []struct {
@@ -266,6 +491,17 @@ type FakeController struct {
 	takeCheckpointReturnsOnCall map[int]struct {
 		result1 error
 	}
+	TakeNamedCheckpointStub        func(string) error
+	takeNamedCheckpointMutex       sync.RWMutex
+	takeNamedCheckpointArgsForCall []struct {
+		arg1 string
+	}
+	takeNamedCheckpointReturns struct {
+		result1 error
+	}
+	takeNamedCheckpointReturnsOnCall map[int]struct {
+		result1 error
+	}
 	WithSyscallTraceStub        func(io.Writer)
 	withSyscallTraceMutex       sync.RWMutex
 	withSyscallTraceArgsForCall []struct {
@@ -439,6 +675,70 @@ func (fake *FakeController) AwaitMessageReturnsOnCall(i int, result1 controller.
 	}{result1}
 }
 
+func (fake *FakeController) AwaitMessageContext(arg1 context.Context, arg2 string) (controller.Message, error) {
+	fake.awaitMessageContextMutex.Lock()
+	ret, specificReturn := fake.awaitMessageContextReturnsOnCall[len(fake.awaitMessageContextArgsForCall)]
+	fake.awaitMessageContextArgsForCall = append(fake.awaitMessageContextArgsForCall, struct {
+		arg1 context.Context
+		arg2 string
+	}{arg1, arg2})
+	fake.recordInvocation("AwaitMessageContext", []interface{}{arg1, arg2})
+	fake.awaitMessageContextMutex.Unlock()
+	if fake.AwaitMessageContextStub != nil {
+		return fake.AwaitMessageContextStub(arg1, arg2)
+	}
+	if specificReturn {
+		return ret.result1, ret.result2
+	}
+	fakeReturns := fake.awaitMessageContextReturns
+	return fakeReturns.result1, fakeReturns.result2
+}
+
+func (fake *FakeController) AwaitMessageContextCallCount() int {
+	fake.awaitMessageContextMutex.RLock()
+	defer fake.awaitMessageContextMutex.RUnlock()
+	return len(fake.awaitMessageContextArgsForCall)
+}
+
+func (fake *FakeController) AwaitMessageContextCalls(stub func(context.Context, string) (controller.Message, error)) {
+	fake.awaitMessageContextMutex.Lock()
+	defer fake.awaitMessageContextMutex.Unlock()
+	fake.AwaitMessageContextStub = stub
+}
+
+func (fake *FakeController) AwaitMessageContextArgsForCall(i int) (context.Context, string) {
+	fake.awaitMessageContextMutex.RLock()
+	defer fake.awaitMessageContextMutex.RUnlock()
+	argsForCall := fake.awaitMessageContextArgsForCall[i]
+	return argsForCall.arg1, argsForCall.arg2
+}
+
+func (fake *FakeController) AwaitMessageContextReturns(result1 controller.Message, result2 error) {
+	fake.awaitMessageContextMutex.Lock()
+	defer fake.awaitMessageContextMutex.Unlock()
+	fake.AwaitMessageContextStub = nil
+	fake.awaitMessageContextReturns = struct {
+		result1 controller.Message
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeController) AwaitMessageContextReturnsOnCall(i int, result1 controller.Message, result2 error) {
+	fake.awaitMessageContextMutex.Lock()
+	defer fake.awaitMessageContextMutex.Unlock()
+	fake.AwaitMessageContextStub = nil
+	if fake.awaitMessageContextReturnsOnCall == nil {
+		fake.awaitMessageContextReturnsOnCall = make(map[int]struct {
+			result1 controller.Message
+			result2 error
+		})
+	}
+	fake.awaitMessageContextReturnsOnCall[i] = struct {
+		result1 controller.Message
+		result2 error
+	}{result1, result2}
+}
+
 func (fake *FakeController) AwaitSignal(arg1 syscall.Signal) {
 	fake.awaitSignalMutex.Lock()
 	fake.awaitSignalArgsForCall = append(fake.awaitSignalArgsForCall, struct {
@@ -470,6 +770,58 @@ func (fake *FakeController) AwaitSignalArgsForCall(i int) syscall.Signal {
 	return argsForCall.arg1
 }
 
+func (fake *FakeController) Capabilities() controller.Capabilities {
+	fake.capabilitiesMutex.Lock()
+	ret, specificReturn := fake.capabilitiesReturnsOnCall[len(fake.capabilitiesArgsForCall)]
+	fake.capabilitiesArgsForCall = append(fake.capabilitiesArgsForCall, struct {
+	}{})
+	fake.recordInvocation("Capabilities", []interface{}{})
+	fake.capabilitiesMutex.Unlock()
+	if fake.CapabilitiesStub != nil {
+		return fake.CapabilitiesStub()
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	fakeReturns := fake.capabilitiesReturns
+	return fakeReturns.result1
+}
+
+func (fake *FakeController) CapabilitiesCallCount() int {
+	fake.capabilitiesMutex.RLock()
+	defer fake.capabilitiesMutex.RUnlock()
+	return len(fake.capabilitiesArgsForCall)
+}
+
+func (fake *FakeController) CapabilitiesCalls(stub func() controller.Capabilities) {
+	fake.capabilitiesMutex.Lock()
+	defer fake.capabilitiesMutex.Unlock()
+	fake.CapabilitiesStub = stub
+}
+
+func (fake *FakeController) CapabilitiesReturns(result1 controller.Capabilities) {
+	fake.capabilitiesMutex.Lock()
+	defer fake.capabilitiesMutex.Unlock()
+	fake.CapabilitiesStub = nil
+	fake.capabilitiesReturns = struct {
+		result1 controller.Capabilities
+	}{result1}
+}
+
+func (fake *FakeController) CapabilitiesReturnsOnCall(i int, result1 controller.Capabilities) {
+	fake.capabilitiesMutex.Lock()
+	defer fake.capabilitiesMutex.Unlock()
+	fake.CapabilitiesStub = nil
+	if fake.capabilitiesReturnsOnCall == nil {
+		fake.capabilitiesReturnsOnCall = make(map[int]struct {
+			result1 controller.Capabilities
+		})
+	}
+	fake.capabilitiesReturnsOnCall[i] = struct {
+		result1 controller.Capabilities
+	}{result1}
+}
+
 func (fake *FakeController) Checkpoints() []*state.State {
 	fake.checkpointsMutex.Lock()
 	ret, specificReturn := fake.checkpointsReturnsOnCall[len(fake.checkpointsArgsForCall)]
@@ -712,6 +1064,119 @@ func (fake *FakeController) DetachReturnsOnCall(i int, result1 error) {
 	}{result1}
 }
 
+func (fake *FakeController) DirtyTracker() state.DirtyTracker {
+	fake.dirtyTrackerMutex.Lock()
+	ret, specificReturn := fake.dirtyTrackerReturnsOnCall[len(fake.dirtyTrackerArgsForCall)]
+	fake.dirtyTrackerArgsForCall = append(fake.dirtyTrackerArgsForCall, struct {
+	}{})
+	fake.recordInvocation("DirtyTracker", []interface{}{})
+	fake.dirtyTrackerMutex.Unlock()
+	if fake.DirtyTrackerStub != nil {
+		return fake.DirtyTrackerStub()
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	fakeReturns := fake.dirtyTrackerReturns
+	return fakeReturns.result1
+}
+
+func (fake *FakeController) DirtyTrackerCallCount() int {
+	fake.dirtyTrackerMutex.RLock()
+	defer fake.dirtyTrackerMutex.RUnlock()
+	return len(fake.dirtyTrackerArgsForCall)
+}
+
+func (fake *FakeController) DirtyTrackerCalls(stub func() state.DirtyTracker) {
+	fake.dirtyTrackerMutex.Lock()
+	defer fake.dirtyTrackerMutex.Unlock()
+	fake.DirtyTrackerStub = stub
+}
+
+func (fake *FakeController) DirtyTrackerReturns(result1 state.DirtyTracker) {
+	fake.dirtyTrackerMutex.Lock()
+	defer fake.dirtyTrackerMutex.Unlock()
+	fake.DirtyTrackerStub = nil
+	fake.dirtyTrackerReturns = struct {
+		result1 state.DirtyTracker
+	}{result1}
+}
+
+func (fake *FakeController) DirtyTrackerReturnsOnCall(i int, result1 state.DirtyTracker) {
+	fake.dirtyTrackerMutex.Lock()
+	defer fake.dirtyTrackerMutex.Unlock()
+	fake.DirtyTrackerStub = nil
+	if fake.dirtyTrackerReturnsOnCall == nil {
+		fake.dirtyTrackerReturnsOnCall = make(map[int]struct {
+			result1 state.DirtyTracker
+		})
+	}
+	fake.dirtyTrackerReturnsOnCall[i] = struct {
+		result1 state.DirtyTracker
+	}{result1}
+}
+
+func (fake *FakeController) EnableFramedProtocol(arg1 string, arg2 string) error {
+	fake.enableFramedProtocolMutex.Lock()
+	ret, specificReturn := fake.enableFramedProtocolReturnsOnCall[len(fake.enableFramedProtocolArgsForCall)]
+	fake.enableFramedProtocolArgsForCall = append(fake.enableFramedProtocolArgsForCall, struct {
+		arg1 string
+		arg2 string
+	}{arg1, arg2})
+	fake.recordInvocation("EnableFramedProtocol", []interface{}{arg1, arg2})
+	fake.enableFramedProtocolMutex.Unlock()
+	if fake.EnableFramedProtocolStub != nil {
+		return fake.EnableFramedProtocolStub(arg1, arg2)
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	fakeReturns := fake.enableFramedProtocolReturns
+	return fakeReturns.result1
+}
+
+func (fake *FakeController) EnableFramedProtocolCallCount() int {
+	fake.enableFramedProtocolMutex.RLock()
+	defer fake.enableFramedProtocolMutex.RUnlock()
+	return len(fake.enableFramedProtocolArgsForCall)
+}
+
+func (fake *FakeController) EnableFramedProtocolCalls(stub func(string, string) error) {
+	fake.enableFramedProtocolMutex.Lock()
+	defer fake.enableFramedProtocolMutex.Unlock()
+	fake.EnableFramedProtocolStub = stub
+}
+
+func (fake *FakeController) EnableFramedProtocolArgsForCall(i int) (string, string) {
+	fake.enableFramedProtocolMutex.RLock()
+	defer fake.enableFramedProtocolMutex.RUnlock()
+	argsForCall := fake.enableFramedProtocolArgsForCall[i]
+	return argsForCall.arg1, argsForCall.arg2
+}
+
+func (fake *FakeController) EnableFramedProtocolReturns(result1 error) {
+	fake.enableFramedProtocolMutex.Lock()
+	defer fake.enableFramedProtocolMutex.Unlock()
+	fake.EnableFramedProtocolStub = nil
+	fake.enableFramedProtocolReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeController) EnableFramedProtocolReturnsOnCall(i int, result1 error) {
+	fake.enableFramedProtocolMutex.Lock()
+	defer fake.enableFramedProtocolMutex.Unlock()
+	fake.EnableFramedProtocolStub = nil
+	if fake.enableFramedProtocolReturnsOnCall == nil {
+		fake.enableFramedProtocolReturnsOnCall = make(map[int]struct {
+			result1 error
+		})
+	}
+	fake.enableFramedProtocolReturnsOnCall[i] = struct {
+		result1 error
+	}{result1}
+}
+
 func (fake *FakeController) End() error {
 	fake.endMutex.Lock()
 	ret, specificReturn := fake.endReturnsOnCall[len(fake.endArgsForCall)]
@@ -819,89 +1284,369 @@ func (fake *FakeController) InitialCheckpointReturnsOnCall(i int, result1 *state
 	}{result1, result2}
 }
 
-func (fake *FakeController) PauseAtSignal(arg1 syscall.Signal) {
-	fake.pauseAtSignalMutex.Lock()
-	fake.pauseAtSignalArgsForCall = append(fake.pauseAtSignalArgsForCall, struct {
-		arg1 syscall.Signal
-	}{arg1})
-	fake.recordInvocation("PauseAtSignal", []interface{}{arg1})
-	fake.pauseAtSignalMutex.Unlock()
-	if fake.PauseAtSignalStub != nil {
-		fake.PauseAtSignalStub(arg1)
+func (fake *FakeController) LastRestoreStats() controller.RestoreStats {
+	fake.lastRestoreStatsMutex.Lock()
+	ret, specificReturn := fake.lastRestoreStatsReturnsOnCall[len(fake.lastRestoreStatsArgsForCall)]
+	fake.lastRestoreStatsArgsForCall = append(fake.lastRestoreStatsArgsForCall, struct {
+	}{})
+	fake.recordInvocation("LastRestoreStats", []interface{}{})
+	fake.lastRestoreStatsMutex.Unlock()
+	if fake.LastRestoreStatsStub != nil {
+		return fake.LastRestoreStatsStub()
+	}
+	if specificReturn {
+		return ret.result1
 	}
+	fakeReturns := fake.lastRestoreStatsReturns
+	return fakeReturns.result1
 }
 
-func (fake *FakeController) PauseAtSignalCallCount() int {
-	fake.pauseAtSignalMutex.RLock()
-	defer fake.pauseAtSignalMutex.RUnlock()
-	return len(fake.pauseAtSignalArgsForCall)
+func (fake *FakeController) LastRestoreStatsCallCount() int {
+	fake.lastRestoreStatsMutex.RLock()
+	defer fake.lastRestoreStatsMutex.RUnlock()
+	return len(fake.lastRestoreStatsArgsForCall)
 }
 
-func (fake *FakeController) PauseAtSignalCalls(stub func(syscall.Signal)) {
-	fake.pauseAtSignalMutex.Lock()
-	defer fake.pauseAtSignalMutex.Unlock()
-	fake.PauseAtSignalStub = stub
+func (fake *FakeController) LastRestoreStatsCalls(stub func() controller.RestoreStats) {
+	fake.lastRestoreStatsMutex.Lock()
+	defer fake.lastRestoreStatsMutex.Unlock()
+	fake.LastRestoreStatsStub = stub
 }
 
-func (fake *FakeController) PauseAtSignalArgsForCall(i int) syscall.Signal {
-	fake.pauseAtSignalMutex.RLock()
-	defer fake.pauseAtSignalMutex.RUnlock()
-	argsForCall := fake.pauseAtSignalArgsForCall[i]
-	return argsForCall.arg1
+func (fake *FakeController) LastRestoreStatsReturns(result1 controller.RestoreStats) {
+	fake.lastRestoreStatsMutex.Lock()
+	defer fake.lastRestoreStatsMutex.Unlock()
+	fake.LastRestoreStatsStub = nil
+	fake.lastRestoreStatsReturns = struct {
+		result1 controller.RestoreStats
+	}{result1}
 }
 
-func (fake *FakeController) Pid() int {
-	fake.pidMutex.Lock()
-	ret, specificReturn := fake.pidReturnsOnCall[len(fake.pidArgsForCall)]
-	fake.pidArgsForCall = append(fake.pidArgsForCall, struct {
+func (fake *FakeController) LastRestoreStatsReturnsOnCall(i int, result1 controller.RestoreStats) {
+	fake.lastRestoreStatsMutex.Lock()
+	defer fake.lastRestoreStatsMutex.Unlock()
+	fake.LastRestoreStatsStub = nil
+	if fake.lastRestoreStatsReturnsOnCall == nil {
+		fake.lastRestoreStatsReturnsOnCall = make(map[int]struct {
+			result1 controller.RestoreStats
+		})
+	}
+	fake.lastRestoreStatsReturnsOnCall[i] = struct {
+		result1 controller.RestoreStats
+	}{result1}
+}
+
+func (fake *FakeController) LastVerifyReport() *state.VerifyReport {
+	fake.lastVerifyReportMutex.Lock()
+	ret, specificReturn := fake.lastVerifyReportReturnsOnCall[len(fake.lastVerifyReportArgsForCall)]
+	fake.lastVerifyReportArgsForCall = append(fake.lastVerifyReportArgsForCall, struct {
 	}{})
-	fake.recordInvocation("Pid", []interface{}{})
-	fake.pidMutex.Unlock()
-	if fake.PidStub != nil {
-		return fake.PidStub()
+	fake.recordInvocation("LastVerifyReport", []interface{}{})
+	fake.lastVerifyReportMutex.Unlock()
+	if fake.LastVerifyReportStub != nil {
+		return fake.LastVerifyReportStub()
 	}
 	if specificReturn {
 		return ret.result1
 	}
-	fakeReturns := fake.pidReturns
+	fakeReturns := fake.lastVerifyReportReturns
 	return fakeReturns.result1
 }
 
-func (fake *FakeController) PidCallCount() int {
-	fake.pidMutex.RLock()
-	defer fake.pidMutex.RUnlock()
-	return len(fake.pidArgsForCall)
+func (fake *FakeController) LastVerifyReportCallCount() int {
+	fake.lastVerifyReportMutex.RLock()
+	defer fake.lastVerifyReportMutex.RUnlock()
+	return len(fake.lastVerifyReportArgsForCall)
 }
 
-func (fake *FakeController) PidCalls(stub func() int) {
-	fake.pidMutex.Lock()
-	defer fake.pidMutex.Unlock()
-	fake.PidStub = stub
+func (fake *FakeController) LastVerifyReportCalls(stub func() *state.VerifyReport) {
+	fake.lastVerifyReportMutex.Lock()
+	defer fake.lastVerifyReportMutex.Unlock()
+	fake.LastVerifyReportStub = stub
 }
 
-func (fake *FakeController) PidReturns(result1 int) {
-	fake.pidMutex.Lock()
-	defer fake.pidMutex.Unlock()
-	fake.PidStub = nil
-	fake.pidReturns = struct {
-		result1 int
+func (fake *FakeController) LastVerifyReportReturns(result1 *state.VerifyReport) {
+	fake.lastVerifyReportMutex.Lock()
+	defer fake.lastVerifyReportMutex.Unlock()
+	fake.LastVerifyReportStub = nil
+	fake.lastVerifyReportReturns = struct {
+		result1 *state.VerifyReport
 	}{result1}
 }
 
-func (fake *FakeController) PidReturnsOnCall(i int, result1 int) {
-	fake.pidMutex.Lock()
-	defer fake.pidMutex.Unlock()
-	fake.PidStub = nil
-	if fake.pidReturnsOnCall == nil {
-		fake.pidReturnsOnCall = make(map[int]struct {
-			result1 int
+func (fake *FakeController) LastVerifyReportReturnsOnCall(i int, result1 *state.VerifyReport) {
+	fake.lastVerifyReportMutex.Lock()
+	defer fake.lastVerifyReportMutex.Unlock()
+	fake.LastVerifyReportStub = nil
+	if fake.lastVerifyReportReturnsOnCall == nil {
+		fake.lastVerifyReportReturnsOnCall = make(map[int]struct {
+			result1 *state.VerifyReport
 		})
 	}
-	fake.pidReturnsOnCall[i] = struct {
+	fake.lastVerifyReportReturnsOnCall[i] = struct {
+		result1 *state.VerifyReport
+	}{result1}
+}
+
+func (fake *FakeController) LoadCheckpoint(arg1 string) error {
+	fake.loadCheckpointMutex.Lock()
+	ret, specificReturn := fake.loadCheckpointReturnsOnCall[len(fake.loadCheckpointArgsForCall)]
+	fake.loadCheckpointArgsForCall = append(fake.loadCheckpointArgsForCall, struct {
+		arg1 string
+	}{arg1})
+	fake.recordInvocation("LoadCheckpoint", []interface{}{arg1})
+	fake.loadCheckpointMutex.Unlock()
+	if fake.LoadCheckpointStub != nil {
+		return fake.LoadCheckpointStub(arg1)
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	fakeReturns := fake.loadCheckpointReturns
+	return fakeReturns.result1
+}
+
+func (fake *FakeController) LoadCheckpointCallCount() int {
+	fake.loadCheckpointMutex.RLock()
+	defer fake.loadCheckpointMutex.RUnlock()
+	return len(fake.loadCheckpointArgsForCall)
+}
+
+func (fake *FakeController) LoadCheckpointCalls(stub func(string) error) {
+	fake.loadCheckpointMutex.Lock()
+	defer fake.loadCheckpointMutex.Unlock()
+	fake.LoadCheckpointStub = stub
+}
+
+func (fake *FakeController) LoadCheckpointArgsForCall(i int) string {
+	fake.loadCheckpointMutex.RLock()
+	defer fake.loadCheckpointMutex.RUnlock()
+	argsForCall := fake.loadCheckpointArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *FakeController) LoadCheckpointReturns(result1 error) {
+	fake.loadCheckpointMutex.Lock()
+	defer fake.loadCheckpointMutex.Unlock()
+	fake.LoadCheckpointStub = nil
+	fake.loadCheckpointReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeController) LoadCheckpointReturnsOnCall(i int, result1 error) {
+	fake.loadCheckpointMutex.Lock()
+	defer fake.loadCheckpointMutex.Unlock()
+	fake.LoadCheckpointStub = nil
+	if fake.loadCheckpointReturnsOnCall == nil {
+		fake.loadCheckpointReturnsOnCall = make(map[int]struct {
+			result1 error
+		})
+	}
+	fake.loadCheckpointReturnsOnCall[i] = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeController) PauseAtSignal(arg1 syscall.Signal) {
+	fake.pauseAtSignalMutex.Lock()
+	fake.pauseAtSignalArgsForCall = append(fake.pauseAtSignalArgsForCall, struct {
+		arg1 syscall.Signal
+	}{arg1})
+	fake.recordInvocation("PauseAtSignal", []interface{}{arg1})
+	fake.pauseAtSignalMutex.Unlock()
+	if fake.PauseAtSignalStub != nil {
+		fake.PauseAtSignalStub(arg1)
+	}
+}
+
+func (fake *FakeController) PauseAtSignalCallCount() int {
+	fake.pauseAtSignalMutex.RLock()
+	defer fake.pauseAtSignalMutex.RUnlock()
+	return len(fake.pauseAtSignalArgsForCall)
+}
+
+func (fake *FakeController) PauseAtSignalCalls(stub func(syscall.Signal)) {
+	fake.pauseAtSignalMutex.Lock()
+	defer fake.pauseAtSignalMutex.Unlock()
+	fake.PauseAtSignalStub = stub
+}
+
+func (fake *FakeController) PauseAtSignalArgsForCall(i int) syscall.Signal {
+	fake.pauseAtSignalMutex.RLock()
+	defer fake.pauseAtSignalMutex.RUnlock()
+	argsForCall := fake.pauseAtSignalArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *FakeController) Pid() int {
+	fake.pidMutex.Lock()
+	ret, specificReturn := fake.pidReturnsOnCall[len(fake.pidArgsForCall)]
+	fake.pidArgsForCall = append(fake.pidArgsForCall, struct {
+	}{})
+	fake.recordInvocation("Pid", []interface{}{})
+	fake.pidMutex.Unlock()
+	if fake.PidStub != nil {
+		return fake.PidStub()
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	fakeReturns := fake.pidReturns
+	return fakeReturns.result1
+}
+
+func (fake *FakeController) PidCallCount() int {
+	fake.pidMutex.RLock()
+	defer fake.pidMutex.RUnlock()
+	return len(fake.pidArgsForCall)
+}
+
+func (fake *FakeController) PidCalls(stub func() int) {
+	fake.pidMutex.Lock()
+	defer fake.pidMutex.Unlock()
+	fake.PidStub = stub
+}
+
+func (fake *FakeController) PidReturns(result1 int) {
+	fake.pidMutex.Lock()
+	defer fake.pidMutex.Unlock()
+	fake.PidStub = nil
+	fake.pidReturns = struct {
+		result1 int
+	}{result1}
+}
+
+func (fake *FakeController) PidReturnsOnCall(i int, result1 int) {
+	fake.pidMutex.Lock()
+	defer fake.pidMutex.Unlock()
+	fake.PidStub = nil
+	if fake.pidReturnsOnCall == nil {
+		fake.pidReturnsOnCall = make(map[int]struct {
+			result1 int
+		})
+	}
+	fake.pidReturnsOnCall[i] = struct {
 		result1 int
 	}{result1}
 }
 
+func (fake *FakeController) Protocol() string {
+	fake.protocolMutex.Lock()
+	ret, specificReturn := fake.protocolReturnsOnCall[len(fake.protocolArgsForCall)]
+	fake.protocolArgsForCall = append(fake.protocolArgsForCall, struct {
+	}{})
+	fake.recordInvocation("Protocol", []interface{}{})
+	fake.protocolMutex.Unlock()
+	if fake.ProtocolStub != nil {
+		return fake.ProtocolStub()
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	fakeReturns := fake.protocolReturns
+	return fakeReturns.result1
+}
+
+func (fake *FakeController) ProtocolCallCount() int {
+	fake.protocolMutex.RLock()
+	defer fake.protocolMutex.RUnlock()
+	return len(fake.protocolArgsForCall)
+}
+
+func (fake *FakeController) ProtocolCalls(stub func() string) {
+	fake.protocolMutex.Lock()
+	defer fake.protocolMutex.Unlock()
+	fake.ProtocolStub = stub
+}
+
+func (fake *FakeController) ProtocolReturns(result1 string) {
+	fake.protocolMutex.Lock()
+	defer fake.protocolMutex.Unlock()
+	fake.ProtocolStub = nil
+	fake.protocolReturns = struct {
+		result1 string
+	}{result1}
+}
+
+func (fake *FakeController) ProtocolReturnsOnCall(i int, result1 string) {
+	fake.protocolMutex.Lock()
+	defer fake.protocolMutex.Unlock()
+	fake.ProtocolStub = nil
+	if fake.protocolReturnsOnCall == nil {
+		fake.protocolReturnsOnCall = make(map[int]struct {
+			result1 string
+		})
+	}
+	fake.protocolReturnsOnCall[i] = struct {
+		result1 string
+	}{result1}
+}
+
+func (fake *FakeController) RemoteSyscall(arg1 uint64, arg2 ...uint64) (uint64, error) {
+	fake.remoteSyscallMutex.Lock()
+	ret, specificReturn := fake.remoteSyscallReturnsOnCall[len(fake.remoteSyscallArgsForCall)]
+	fake.remoteSyscallArgsForCall = append(fake.remoteSyscallArgsForCall, struct {
+		arg1 uint64
+		arg2 []uint64
+	}{arg1, arg2})
+	fake.recordInvocation("RemoteSyscall", []interface{}{arg1, arg2})
+	fake.remoteSyscallMutex.Unlock()
+	if fake.RemoteSyscallStub != nil {
+		return fake.RemoteSyscallStub(arg1, arg2...)
+	}
+	if specificReturn {
+		return ret.result1, ret.result2
+	}
+	fakeReturns := fake.remoteSyscallReturns
+	return fakeReturns.result1, fakeReturns.result2
+}
+
+func (fake *FakeController) RemoteSyscallCallCount() int {
+	fake.remoteSyscallMutex.RLock()
+	defer fake.remoteSyscallMutex.RUnlock()
+	return len(fake.remoteSyscallArgsForCall)
+}
+
+func (fake *FakeController) RemoteSyscallCalls(stub func(uint64, ...uint64) (uint64, error)) {
+	fake.remoteSyscallMutex.Lock()
+	defer fake.remoteSyscallMutex.Unlock()
+	fake.RemoteSyscallStub = stub
+}
+
+func (fake *FakeController) RemoteSyscallArgsForCall(i int) (uint64, []uint64) {
+	fake.remoteSyscallMutex.RLock()
+	defer fake.remoteSyscallMutex.RUnlock()
+	argsForCall := fake.remoteSyscallArgsForCall[i]
+	return argsForCall.arg1, argsForCall.arg2
+}
+
+func (fake *FakeController) RemoteSyscallReturns(result1 uint64, result2 error) {
+	fake.remoteSyscallMutex.Lock()
+	defer fake.remoteSyscallMutex.Unlock()
+	fake.RemoteSyscallStub = nil
+	fake.remoteSyscallReturns = struct {
+		result1 uint64
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeController) RemoteSyscallReturnsOnCall(i int, result1 uint64, result2 error) {
+	fake.remoteSyscallMutex.Lock()
+	defer fake.remoteSyscallMutex.Unlock()
+	fake.RemoteSyscallStub = nil
+	if fake.remoteSyscallReturnsOnCall == nil {
+		fake.remoteSyscallReturnsOnCall = make(map[int]struct {
+			result1 uint64
+			result2 error
+		})
+	}
+	fake.remoteSyscallReturnsOnCall[i] = struct {
+		result1 uint64
+		result2 error
+	}{result1, result2}
+}
+
 func (fake *FakeController) Restore() error {
 	fake.restoreMutex.Lock()
 	ret, specificReturn := fake.restoreReturnsOnCall[len(fake.restoreArgsForCall)]
@@ -954,6 +1699,187 @@ func (fake *FakeController) RestoreReturnsOnCall(i int, result1 error) {
 	}{result1}
 }
 
+func (fake *FakeController) RestoreTo(arg1 int) error {
+	fake.restoreToMutex.Lock()
+	ret, specificReturn := fake.restoreToReturnsOnCall[len(fake.restoreToArgsForCall)]
+	fake.restoreToArgsForCall = append(fake.restoreToArgsForCall, struct {
+		arg1 int
+	}{arg1})
+	fake.recordInvocation("RestoreTo", []interface{}{arg1})
+	fake.restoreToMutex.Unlock()
+	if fake.RestoreToStub != nil {
+		return fake.RestoreToStub(arg1)
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	fakeReturns := fake.restoreToReturns
+	return fakeReturns.result1
+}
+
+func (fake *FakeController) RestoreToCallCount() int {
+	fake.restoreToMutex.RLock()
+	defer fake.restoreToMutex.RUnlock()
+	return len(fake.restoreToArgsForCall)
+}
+
+func (fake *FakeController) RestoreToCalls(stub func(int) error) {
+	fake.restoreToMutex.Lock()
+	defer fake.restoreToMutex.Unlock()
+	fake.RestoreToStub = stub
+}
+
+func (fake *FakeController) RestoreToArgsForCall(i int) int {
+	fake.restoreToMutex.RLock()
+	defer fake.restoreToMutex.RUnlock()
+	argsForCall := fake.restoreToArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *FakeController) RestoreToReturns(result1 error) {
+	fake.restoreToMutex.Lock()
+	defer fake.restoreToMutex.Unlock()
+	fake.RestoreToStub = nil
+	fake.restoreToReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeController) RestoreToReturnsOnCall(i int, result1 error) {
+	fake.restoreToMutex.Lock()
+	defer fake.restoreToMutex.Unlock()
+	fake.RestoreToStub = nil
+	if fake.restoreToReturnsOnCall == nil {
+		fake.restoreToReturnsOnCall = make(map[int]struct {
+			result1 error
+		})
+	}
+	fake.restoreToReturnsOnCall[i] = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeController) RestoreToNamed(arg1 string) error {
+	fake.restoreToNamedMutex.Lock()
+	ret, specificReturn := fake.restoreToNamedReturnsOnCall[len(fake.restoreToNamedArgsForCall)]
+	fake.restoreToNamedArgsForCall = append(fake.restoreToNamedArgsForCall, struct {
+		arg1 string
+	}{arg1})
+	fake.recordInvocation("RestoreToNamed", []interface{}{arg1})
+	fake.restoreToNamedMutex.Unlock()
+	if fake.RestoreToNamedStub != nil {
+		return fake.RestoreToNamedStub(arg1)
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	fakeReturns := fake.restoreToNamedReturns
+	return fakeReturns.result1
+}
+
+func (fake *FakeController) RestoreToNamedCallCount() int {
+	fake.restoreToNamedMutex.RLock()
+	defer fake.restoreToNamedMutex.RUnlock()
+	return len(fake.restoreToNamedArgsForCall)
+}
+
+func (fake *FakeController) RestoreToNamedCalls(stub func(string) error) {
+	fake.restoreToNamedMutex.Lock()
+	defer fake.restoreToNamedMutex.Unlock()
+	fake.RestoreToNamedStub = stub
+}
+
+func (fake *FakeController) RestoreToNamedArgsForCall(i int) string {
+	fake.restoreToNamedMutex.RLock()
+	defer fake.restoreToNamedMutex.RUnlock()
+	argsForCall := fake.restoreToNamedArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *FakeController) RestoreToNamedReturns(result1 error) {
+	fake.restoreToNamedMutex.Lock()
+	defer fake.restoreToNamedMutex.Unlock()
+	fake.RestoreToNamedStub = nil
+	fake.restoreToNamedReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeController) RestoreToNamedReturnsOnCall(i int, result1 error) {
+	fake.restoreToNamedMutex.Lock()
+	defer fake.restoreToNamedMutex.Unlock()
+	fake.RestoreToNamedStub = nil
+	if fake.restoreToNamedReturnsOnCall == nil {
+		fake.restoreToNamedReturnsOnCall = make(map[int]struct {
+			result1 error
+		})
+	}
+	fake.restoreToNamedReturnsOnCall[i] = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeController) SaveCheckpoint(arg1 int, arg2 string) error {
+	fake.saveCheckpointMutex.Lock()
+	ret, specificReturn := fake.saveCheckpointReturnsOnCall[len(fake.saveCheckpointArgsForCall)]
+	fake.saveCheckpointArgsForCall = append(fake.saveCheckpointArgsForCall, struct {
+		arg1 int
+		arg2 string
+	}{arg1, arg2})
+	fake.recordInvocation("SaveCheckpoint", []interface{}{arg1, arg2})
+	fake.saveCheckpointMutex.Unlock()
+	if fake.SaveCheckpointStub != nil {
+		return fake.SaveCheckpointStub(arg1, arg2)
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	fakeReturns := fake.saveCheckpointReturns
+	return fakeReturns.result1
+}
+
+func (fake *FakeController) SaveCheckpointCallCount() int {
+	fake.saveCheckpointMutex.RLock()
+	defer fake.saveCheckpointMutex.RUnlock()
+	return len(fake.saveCheckpointArgsForCall)
+}
+
+func (fake *FakeController) SaveCheckpointCalls(stub func(int, string) error) {
+	fake.saveCheckpointMutex.Lock()
+	defer fake.saveCheckpointMutex.Unlock()
+	fake.SaveCheckpointStub = stub
+}
+
+func (fake *FakeController) SaveCheckpointArgsForCall(i int) (int, string) {
+	fake.saveCheckpointMutex.RLock()
+	defer fake.saveCheckpointMutex.RUnlock()
+	argsForCall := fake.saveCheckpointArgsForCall[i]
+	return argsForCall.arg1, argsForCall.arg2
+}
+
+func (fake *FakeController) SaveCheckpointReturns(result1 error) {
+	fake.saveCheckpointMutex.Lock()
+	defer fake.saveCheckpointMutex.Unlock()
+	fake.SaveCheckpointStub = nil
+	fake.saveCheckpointReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeController) SaveCheckpointReturnsOnCall(i int, result1 error) {
+	fake.saveCheckpointMutex.Lock()
+	defer fake.saveCheckpointMutex.Unlock()
+	fake.SaveCheckpointStub = nil
+	if fake.saveCheckpointReturnsOnCall == nil {
+		fake.saveCheckpointReturnsOnCall = make(map[int]struct {
+			result1 error
+		})
+	}
+	fake.saveCheckpointReturnsOnCall[i] = struct {
+		result1 error
+	}{result1}
+}
+
 func (fake *FakeController) SendFunction(arg1 string) error {
 	fake.sendFunctionMutex.Lock()
 	ret, specificReturn := fake.sendFunctionReturnsOnCall[len(fake.sendFunctionArgsForCall)]
@@ -1014,6 +1940,67 @@ func (fake *FakeController) SendFunctionReturnsOnCall(i int, result1 error) {
 	}{result1}
 }
 
+func (fake *FakeController) SendFunctionContext(arg1 context.Context, arg2 string) error {
+	fake.sendFunctionContextMutex.Lock()
+	ret, specificReturn := fake.sendFunctionContextReturnsOnCall[len(fake.sendFunctionContextArgsForCall)]
+	fake.sendFunctionContextArgsForCall = append(fake.sendFunctionContextArgsForCall, struct {
+		arg1 context.Context
+		arg2 string
+	}{arg1, arg2})
+	fake.recordInvocation("SendFunctionContext", []interface{}{arg1, arg2})
+	fake.sendFunctionContextMutex.Unlock()
+	if fake.SendFunctionContextStub != nil {
+		return fake.SendFunctionContextStub(arg1, arg2)
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	fakeReturns := fake.sendFunctionContextReturns
+	return fakeReturns.result1
+}
+
+func (fake *FakeController) SendFunctionContextCallCount() int {
+	fake.sendFunctionContextMutex.RLock()
+	defer fake.sendFunctionContextMutex.RUnlock()
+	return len(fake.sendFunctionContextArgsForCall)
+}
+
+func (fake *FakeController) SendFunctionContextCalls(stub func(context.Context, string) error) {
+	fake.sendFunctionContextMutex.Lock()
+	defer fake.sendFunctionContextMutex.Unlock()
+	fake.SendFunctionContextStub = stub
+}
+
+func (fake *FakeController) SendFunctionContextArgsForCall(i int) (context.Context, string) {
+	fake.sendFunctionContextMutex.RLock()
+	defer fake.sendFunctionContextMutex.RUnlock()
+	argsForCall := fake.sendFunctionContextArgsForCall[i]
+	return argsForCall.arg1, argsForCall.arg2
+}
+
+func (fake *FakeController) SendFunctionContextReturns(result1 error) {
+	fake.sendFunctionContextMutex.Lock()
+	defer fake.sendFunctionContextMutex.Unlock()
+	fake.SendFunctionContextStub = nil
+	fake.sendFunctionContextReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeController) SendFunctionContextReturnsOnCall(i int, result1 error) {
+	fake.sendFunctionContextMutex.Lock()
+	defer fake.sendFunctionContextMutex.Unlock()
+	fake.SendFunctionContextStub = nil
+	if fake.sendFunctionContextReturnsOnCall == nil {
+		fake.sendFunctionContextReturnsOnCall = make(map[int]struct {
+			result1 error
+		})
+	}
+	fake.sendFunctionContextReturnsOnCall[i] = struct {
+		result1 error
+	}{result1}
+}
+
 func (fake *FakeController) SendMessage(arg1 string, arg2 interface{}) error {
 	fake.sendMessageMutex.Lock()
 	ret, specificReturn := fake.sendMessageReturnsOnCall[len(fake.sendMessageArgsForCall)]
@@ -1138,6 +2125,137 @@ func (fake *FakeController) SendRequestReturnsOnCall(i int, result1 interface{},
 	}{result1, result2}
 }
 
+func (fake *FakeController) SendRequestContext(arg1 context.Context, arg2 interface{}) (interface{}, error) {
+	fake.sendRequestContextMutex.Lock()
+	ret, specificReturn := fake.sendRequestContextReturnsOnCall[len(fake.sendRequestContextArgsForCall)]
+	fake.sendRequestContextArgsForCall = append(fake.sendRequestContextArgsForCall, struct {
+		arg1 context.Context
+		arg2 interface{}
+	}{arg1, arg2})
+	fake.recordInvocation("SendRequestContext", []interface{}{arg1, arg2})
+	fake.sendRequestContextMutex.Unlock()
+	if fake.SendRequestContextStub != nil {
+		return fake.SendRequestContextStub(arg1, arg2)
+	}
+	if specificReturn {
+		return ret.result1, ret.result2
+	}
+	fakeReturns := fake.sendRequestContextReturns
+	return fakeReturns.result1, fakeReturns.result2
+}
+
+func (fake *FakeController) SendRequestContextCallCount() int {
+	fake.sendRequestContextMutex.RLock()
+	defer fake.sendRequestContextMutex.RUnlock()
+	return len(fake.sendRequestContextArgsForCall)
+}
+
+func (fake *FakeController) SendRequestContextCalls(stub func(context.Context, interface{}) (interface{}, error)) {
+	fake.sendRequestContextMutex.Lock()
+	defer fake.sendRequestContextMutex.Unlock()
+	fake.SendRequestContextStub = stub
+}
+
+func (fake *FakeController) SendRequestContextArgsForCall(i int) (context.Context, interface{}) {
+	fake.sendRequestContextMutex.RLock()
+	defer fake.sendRequestContextMutex.RUnlock()
+	argsForCall := fake.sendRequestContextArgsForCall[i]
+	return argsForCall.arg1, argsForCall.arg2
+}
+
+func (fake *FakeController) SendRequestContextReturns(result1 interface{}, result2 error) {
+	fake.sendRequestContextMutex.Lock()
+	defer fake.sendRequestContextMutex.Unlock()
+	fake.SendRequestContextStub = nil
+	fake.sendRequestContextReturns = struct {
+		result1 interface{}
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeController) SendRequestContextReturnsOnCall(i int, result1 interface{}, result2 error) {
+	fake.sendRequestContextMutex.Lock()
+	defer fake.sendRequestContextMutex.Unlock()
+	fake.SendRequestContextStub = nil
+	if fake.sendRequestContextReturnsOnCall == nil {
+		fake.sendRequestContextReturnsOnCall = make(map[int]struct {
+			result1 interface{}
+			result2 error
+		})
+	}
+	fake.sendRequestContextReturnsOnCall[i] = struct {
+		result1 interface{}
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeController) SendRequestWithLogs(arg1 context.Context, arg2 interface{}) (interface{}, []controller.LogLine, error) {
+	fake.sendRequestWithLogsMutex.Lock()
+	ret, specificReturn := fake.sendRequestWithLogsReturnsOnCall[len(fake.sendRequestWithLogsArgsForCall)]
+	fake.sendRequestWithLogsArgsForCall = append(fake.sendRequestWithLogsArgsForCall, struct {
+		arg1 context.Context
+		arg2 interface{}
+	}{arg1, arg2})
+	fake.recordInvocation("SendRequestWithLogs", []interface{}{arg1, arg2})
+	fake.sendRequestWithLogsMutex.Unlock()
+	if fake.SendRequestWithLogsStub != nil {
+		return fake.SendRequestWithLogsStub(arg1, arg2)
+	}
+	if specificReturn {
+		return ret.result1, ret.result2, ret.result3
+	}
+	fakeReturns := fake.sendRequestWithLogsReturns
+	return fakeReturns.result1, fakeReturns.result2, fakeReturns.result3
+}
+
+func (fake *FakeController) SendRequestWithLogsCallCount() int {
+	fake.sendRequestWithLogsMutex.RLock()
+	defer fake.sendRequestWithLogsMutex.RUnlock()
+	return len(fake.sendRequestWithLogsArgsForCall)
+}
+
+func (fake *FakeController) SendRequestWithLogsCalls(stub func(context.Context, interface{}) (interface{}, []controller.LogLine, error)) {
+	fake.sendRequestWithLogsMutex.Lock()
+	defer fake.sendRequestWithLogsMutex.Unlock()
+	fake.SendRequestWithLogsStub = stub
+}
+
+func (fake *FakeController) SendRequestWithLogsArgsForCall(i int) (context.Context, interface{}) {
+	fake.sendRequestWithLogsMutex.RLock()
+	defer fake.sendRequestWithLogsMutex.RUnlock()
+	argsForCall := fake.sendRequestWithLogsArgsForCall[i]
+	return argsForCall.arg1, argsForCall.arg2
+}
+
+func (fake *FakeController) SendRequestWithLogsReturns(result1 interface{}, result2 []controller.LogLine, result3 error) {
+	fake.sendRequestWithLogsMutex.Lock()
+	defer fake.sendRequestWithLogsMutex.Unlock()
+	fake.SendRequestWithLogsStub = nil
+	fake.sendRequestWithLogsReturns = struct {
+		result1 interface{}
+		result2 []controller.LogLine
+		result3 error
+	}{result1, result2, result3}
+}
+
+func (fake *FakeController) SendRequestWithLogsReturnsOnCall(i int, result1 interface{}, result2 []controller.LogLine, result3 error) {
+	fake.sendRequestWithLogsMutex.Lock()
+	defer fake.sendRequestWithLogsMutex.Unlock()
+	fake.SendRequestWithLogsStub = nil
+	if fake.sendRequestWithLogsReturnsOnCall == nil {
+		fake.sendRequestWithLogsReturnsOnCall = make(map[int]struct {
+			result1 interface{}
+			result2 []controller.LogLine
+			result3 error
+		})
+	}
+	fake.sendRequestWithLogsReturnsOnCall[i] = struct {
+		result1 interface{}
+		result2 []controller.LogLine
+		result3 error
+	}{result1, result2, result3}
+}
+
 func (fake *FakeController) SendSignal(arg1 syscall.Signal) error {
 	fake.sendSignalMutex.Lock()
 	ret, specificReturn := fake.sendSignalReturnsOnCall[len(fake.sendSignalArgsForCall)]
@@ -1258,6 +2376,193 @@ func (fake *FakeController) SendSignalContReturnsOnCall(i int, result1 error) {
 	}{result1}
 }
 
+func (fake *FakeController) SetConcurrency(arg1 int) {
+	fake.setConcurrencyMutex.Lock()
+	fake.setConcurrencyArgsForCall = append(fake.setConcurrencyArgsForCall, struct {
+		arg1 int
+	}{arg1})
+	fake.recordInvocation("SetConcurrency", []interface{}{arg1})
+	fake.setConcurrencyMutex.Unlock()
+	if fake.SetConcurrencyStub != nil {
+		fake.SetConcurrencyStub(arg1)
+	}
+}
+
+func (fake *FakeController) SetConcurrencyCallCount() int {
+	fake.setConcurrencyMutex.RLock()
+	defer fake.setConcurrencyMutex.RUnlock()
+	return len(fake.setConcurrencyArgsForCall)
+}
+
+func (fake *FakeController) SetConcurrencyCalls(stub func(int)) {
+	fake.setConcurrencyMutex.Lock()
+	defer fake.setConcurrencyMutex.Unlock()
+	fake.SetConcurrencyStub = stub
+}
+
+func (fake *FakeController) SetConcurrencyArgsForCall(i int) int {
+	fake.setConcurrencyMutex.RLock()
+	defer fake.setConcurrencyMutex.RUnlock()
+	argsForCall := fake.setConcurrencyArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *FakeController) SetDirtyTracker(arg1 state.DirtyTracker) {
+	fake.setDirtyTrackerMutex.Lock()
+	fake.setDirtyTrackerArgsForCall = append(fake.setDirtyTrackerArgsForCall, struct {
+		arg1 state.DirtyTracker
+	}{arg1})
+	fake.recordInvocation("SetDirtyTracker", []interface{}{arg1})
+	fake.setDirtyTrackerMutex.Unlock()
+	if fake.SetDirtyTrackerStub != nil {
+		fake.SetDirtyTrackerStub(arg1)
+	}
+}
+
+func (fake *FakeController) SetDirtyTrackerCallCount() int {
+	fake.setDirtyTrackerMutex.RLock()
+	defer fake.setDirtyTrackerMutex.RUnlock()
+	return len(fake.setDirtyTrackerArgsForCall)
+}
+
+func (fake *FakeController) SetDirtyTrackerCalls(stub func(state.DirtyTracker)) {
+	fake.setDirtyTrackerMutex.Lock()
+	defer fake.setDirtyTrackerMutex.Unlock()
+	fake.SetDirtyTrackerStub = stub
+}
+
+func (fake *FakeController) SetDirtyTrackerArgsForCall(i int) state.DirtyTracker {
+	fake.setDirtyTrackerMutex.RLock()
+	defer fake.setDirtyTrackerMutex.RUnlock()
+	argsForCall := fake.setDirtyTrackerArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *FakeController) SetHugePages(arg1 bool) {
+	fake.setHugePagesMutex.Lock()
+	fake.setHugePagesArgsForCall = append(fake.setHugePagesArgsForCall, struct {
+		arg1 bool
+	}{arg1})
+	fake.recordInvocation("SetHugePages", []interface{}{arg1})
+	fake.setHugePagesMutex.Unlock()
+	if fake.SetHugePagesStub != nil {
+		fake.SetHugePagesStub(arg1)
+	}
+}
+
+func (fake *FakeController) SetHugePagesCallCount() int {
+	fake.setHugePagesMutex.RLock()
+	defer fake.setHugePagesMutex.RUnlock()
+	return len(fake.setHugePagesArgsForCall)
+}
+
+func (fake *FakeController) SetHugePagesCalls(stub func(bool)) {
+	fake.setHugePagesMutex.Lock()
+	defer fake.setHugePagesMutex.Unlock()
+	fake.SetHugePagesStub = stub
+}
+
+func (fake *FakeController) SetHugePagesArgsForCall(i int) bool {
+	fake.setHugePagesMutex.RLock()
+	defer fake.setHugePagesMutex.RUnlock()
+	argsForCall := fake.setHugePagesArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *FakeController) SetLogLimit(arg1 int) {
+	fake.setLogLimitMutex.Lock()
+	fake.setLogLimitArgsForCall = append(fake.setLogLimitArgsForCall, struct {
+		arg1 int
+	}{arg1})
+	fake.recordInvocation("SetLogLimit", []interface{}{arg1})
+	fake.setLogLimitMutex.Unlock()
+	if fake.SetLogLimitStub != nil {
+		fake.SetLogLimitStub(arg1)
+	}
+}
+
+func (fake *FakeController) SetLogLimitCallCount() int {
+	fake.setLogLimitMutex.RLock()
+	defer fake.setLogLimitMutex.RUnlock()
+	return len(fake.setLogLimitArgsForCall)
+}
+
+func (fake *FakeController) SetLogLimitCalls(stub func(int)) {
+	fake.setLogLimitMutex.Lock()
+	defer fake.setLogLimitMutex.Unlock()
+	fake.SetLogLimitStub = stub
+}
+
+func (fake *FakeController) SetLogLimitArgsForCall(i int) int {
+	fake.setLogLimitMutex.RLock()
+	defer fake.setLogLimitMutex.RUnlock()
+	argsForCall := fake.setLogLimitArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *FakeController) SetMemoryIO(arg1 state.MemoryIO, arg2 int) {
+	fake.setMemoryIOMutex.Lock()
+	fake.setMemoryIOArgsForCall = append(fake.setMemoryIOArgsForCall, struct {
+		arg1 state.MemoryIO
+		arg2 int
+	}{arg1, arg2})
+	fake.recordInvocation("SetMemoryIO", []interface{}{arg1, arg2})
+	fake.setMemoryIOMutex.Unlock()
+	if fake.SetMemoryIOStub != nil {
+		fake.SetMemoryIOStub(arg1, arg2)
+	}
+}
+
+func (fake *FakeController) SetMemoryIOCallCount() int {
+	fake.setMemoryIOMutex.RLock()
+	defer fake.setMemoryIOMutex.RUnlock()
+	return len(fake.setMemoryIOArgsForCall)
+}
+
+func (fake *FakeController) SetMemoryIOCalls(stub func(state.MemoryIO, int)) {
+	fake.setMemoryIOMutex.Lock()
+	defer fake.setMemoryIOMutex.Unlock()
+	fake.SetMemoryIOStub = stub
+}
+
+func (fake *FakeController) SetMemoryIOArgsForCall(i int) (state.MemoryIO, int) {
+	fake.setMemoryIOMutex.RLock()
+	defer fake.setMemoryIOMutex.RUnlock()
+	argsForCall := fake.setMemoryIOArgsForCall[i]
+	return argsForCall.arg1, argsForCall.arg2
+}
+
+func (fake *FakeController) SetPageStore(arg1 *state.PageStore) {
+	fake.setPageStoreMutex.Lock()
+	fake.setPageStoreArgsForCall = append(fake.setPageStoreArgsForCall, struct {
+		arg1 *state.PageStore
+	}{arg1})
+	fake.recordInvocation("SetPageStore", []interface{}{arg1})
+	fake.setPageStoreMutex.Unlock()
+	if fake.SetPageStoreStub != nil {
+		fake.SetPageStoreStub(arg1)
+	}
+}
+
+func (fake *FakeController) SetPageStoreCallCount() int {
+	fake.setPageStoreMutex.RLock()
+	defer fake.setPageStoreMutex.RUnlock()
+	return len(fake.setPageStoreArgsForCall)
+}
+
+func (fake *FakeController) SetPageStoreCalls(stub func(*state.PageStore)) {
+	fake.setPageStoreMutex.Lock()
+	defer fake.setPageStoreMutex.Unlock()
+	fake.SetPageStoreStub = stub
+}
+
+func (fake *FakeController) SetPageStoreArgsForCall(i int) *state.PageStore {
+	fake.setPageStoreMutex.RLock()
+	defer fake.setPageStoreMutex.RUnlock()
+	argsForCall := fake.setPageStoreArgsForCall[i]
+	return argsForCall.arg1
+}
+
 func (fake *FakeController) SetPid(arg1 int) {
 	fake.setPidMutex.Lock()
 	fake.setPidArgsForCall = append(fake.setPidArgsForCall, struct {
@@ -1349,6 +2654,66 @@ func (fake *FakeController) SetRegsReturnsOnCall(i int, result1 error) {
 	}{result1}
 }
 
+func (fake *FakeController) SetRestoreMode(arg1 controller.RestoreMode) error {
+	fake.setRestoreModeMutex.Lock()
+	ret, specificReturn := fake.setRestoreModeReturnsOnCall[len(fake.setRestoreModeArgsForCall)]
+	fake.setRestoreModeArgsForCall = append(fake.setRestoreModeArgsForCall, struct {
+		arg1 controller.RestoreMode
+	}{arg1})
+	fake.recordInvocation("SetRestoreMode", []interface{}{arg1})
+	fake.setRestoreModeMutex.Unlock()
+	if fake.SetRestoreModeStub != nil {
+		return fake.SetRestoreModeStub(arg1)
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	fakeReturns := fake.setRestoreModeReturns
+	return fakeReturns.result1
+}
+
+func (fake *FakeController) SetRestoreModeCallCount() int {
+	fake.setRestoreModeMutex.RLock()
+	defer fake.setRestoreModeMutex.RUnlock()
+	return len(fake.setRestoreModeArgsForCall)
+}
+
+func (fake *FakeController) SetRestoreModeCalls(stub func(controller.RestoreMode) error) {
+	fake.setRestoreModeMutex.Lock()
+	defer fake.setRestoreModeMutex.Unlock()
+	fake.SetRestoreModeStub = stub
+}
+
+func (fake *FakeController) SetRestoreModeArgsForCall(i int) controller.RestoreMode {
+	fake.setRestoreModeMutex.RLock()
+	defer fake.setRestoreModeMutex.RUnlock()
+	argsForCall := fake.setRestoreModeArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *FakeController) SetRestoreModeReturns(result1 error) {
+	fake.setRestoreModeMutex.Lock()
+	defer fake.setRestoreModeMutex.Unlock()
+	fake.SetRestoreModeStub = nil
+	fake.setRestoreModeReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeController) SetRestoreModeReturnsOnCall(i int, result1 error) {
+	fake.setRestoreModeMutex.Lock()
+	defer fake.setRestoreModeMutex.Unlock()
+	fake.SetRestoreModeStub = nil
+	if fake.setRestoreModeReturnsOnCall == nil {
+		fake.setRestoreModeReturnsOnCall = make(map[int]struct {
+			result1 error
+		})
+	}
+	fake.setRestoreModeReturnsOnCall[i] = struct {
+		result1 error
+	}{result1}
+}
+
 func (fake *FakeController) SetStreams(arg1 *io.PipeWriter, arg2 *io.PipeReader, arg3 *io.PipeReader) {
 	fake.setStreamsMutex.Lock()
 	fake.setStreamsArgsForCall = append(fake.setStreamsArgsForCall, struct {
@@ -1382,6 +2747,37 @@ func (fake *FakeController) SetStreamsArgsForCall(i int) (*io.PipeWriter, *io.Pi
 	return argsForCall.arg1, argsForCall.arg2, argsForCall.arg3
 }
 
+func (fake *FakeController) SetVerifyRestore(arg1 bool) {
+	fake.setVerifyRestoreMutex.Lock()
+	fake.setVerifyRestoreArgsForCall = append(fake.setVerifyRestoreArgsForCall, struct {
+		arg1 bool
+	}{arg1})
+	fake.recordInvocation("SetVerifyRestore", []interface{}{arg1})
+	fake.setVerifyRestoreMutex.Unlock()
+	if fake.SetVerifyRestoreStub != nil {
+		fake.SetVerifyRestoreStub(arg1)
+	}
+}
+
+func (fake *FakeController) SetVerifyRestoreCallCount() int {
+	fake.setVerifyRestoreMutex.RLock()
+	defer fake.setVerifyRestoreMutex.RUnlock()
+	return len(fake.setVerifyRestoreArgsForCall)
+}
+
+func (fake *FakeController) SetVerifyRestoreCalls(stub func(bool)) {
+	fake.setVerifyRestoreMutex.Lock()
+	defer fake.setVerifyRestoreMutex.Unlock()
+	fake.SetVerifyRestoreStub = stub
+}
+
+func (fake *FakeController) SetVerifyRestoreArgsForCall(i int) bool {
+	fake.setVerifyRestoreMutex.RLock()
+	defer fake.setVerifyRestoreMutex.RUnlock()
+	argsForCall := fake.setVerifyRestoreArgsForCall[i]
+	return argsForCall.arg1
+}
+
 func (fake *FakeController) State() (*state.State, error) {
 	fake.stateMutex.Lock()
 	ret, specificReturn := fake.stateReturnsOnCall[len(fake.stateArgsForCall)]
@@ -1599,6 +2995,66 @@ func (fake *FakeController) TakeCheckpointReturnsOnCall(i int, result1 error) {
 	}{result1}
 }
 
+func (fake *FakeController) TakeNamedCheckpoint(arg1 string) error {
+	fake.takeNamedCheckpointMutex.Lock()
+	ret, specificReturn := fake.takeNamedCheckpointReturnsOnCall[len(fake.takeNamedCheckpointArgsForCall)]
+	fake.takeNamedCheckpointArgsForCall = append(fake.takeNamedCheckpointArgsForCall, struct {
+		arg1 string
+	}{arg1})
+	fake.recordInvocation("TakeNamedCheckpoint", []interface{}{arg1})
+	fake.takeNamedCheckpointMutex.Unlock()
+	if fake.TakeNamedCheckpointStub != nil {
+		return fake.TakeNamedCheckpointStub(arg1)
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	fakeReturns := fake.takeNamedCheckpointReturns
+	return fakeReturns.result1
+}
+
+func (fake *FakeController) TakeNamedCheckpointCallCount() int {
+	fake.takeNamedCheckpointMutex.RLock()
+	defer fake.takeNamedCheckpointMutex.RUnlock()
+	return len(fake.takeNamedCheckpointArgsForCall)
+}
+
+func (fake *FakeController) TakeNamedCheckpointCalls(stub func(string) error) {
+	fake.takeNamedCheckpointMutex.Lock()
+	defer fake.takeNamedCheckpointMutex.Unlock()
+	fake.TakeNamedCheckpointStub = stub
+}
+
+func (fake *FakeController) TakeNamedCheckpointArgsForCall(i int) string {
+	fake.takeNamedCheckpointMutex.RLock()
+	defer fake.takeNamedCheckpointMutex.RUnlock()
+	argsForCall := fake.takeNamedCheckpointArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *FakeController) TakeNamedCheckpointReturns(result1 error) {
+	fake.takeNamedCheckpointMutex.Lock()
+	defer fake.takeNamedCheckpointMutex.Unlock()
+	fake.TakeNamedCheckpointStub = nil
+	fake.takeNamedCheckpointReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeController) TakeNamedCheckpointReturnsOnCall(i int, result1 error) {
+	fake.takeNamedCheckpointMutex.Lock()
+	defer fake.takeNamedCheckpointMutex.Unlock()
+	fake.TakeNamedCheckpointStub = nil
+	if fake.takeNamedCheckpointReturnsOnCall == nil {
+		fake.takeNamedCheckpointReturnsOnCall = make(map[int]struct {
+			result1 error
+		})
+	}
+	fake.takeNamedCheckpointReturnsOnCall[i] = struct {
+		result1 error
+	}{result1}
+}
+
 func (fake *FakeController) WithSyscallTrace(arg1 io.Writer) {
 	fake.withSyscallTraceMutex.Lock()
 	fake.withSyscallTraceArgsForCall = append(fake.withSyscallTraceArgsForCall, struct {
@@ -1639,8 +3095,12 @@ func (fake *FakeController) Invocations() map[string][][]interface{} {
 	defer fake.attachMutex.RUnlock()
 	fake.awaitMessageMutex.RLock()
 	defer fake.awaitMessageMutex.RUnlock()
+	fake.awaitMessageContextMutex.RLock()
+	defer fake.awaitMessageContextMutex.RUnlock()
 	fake.awaitSignalMutex.RLock()
 	defer fake.awaitSignalMutex.RUnlock()
+	fake.capabilitiesMutex.RLock()
+	defer fake.capabilitiesMutex.RUnlock()
 	fake.checkpointsMutex.RLock()
 	defer fake.checkpointsMutex.RUnlock()
 	fake.clearMemRefsMutex.RLock()
@@ -1653,32 +3113,74 @@ func (fake *FakeController) Invocations() map[string][][]interface{} {
 	defer fake.continueWithMutex.RUnlock()
 	fake.detachMutex.RLock()
 	defer fake.detachMutex.RUnlock()
+	fake.dirtyTrackerMutex.RLock()
+	defer fake.dirtyTrackerMutex.RUnlock()
+	fake.enableFramedProtocolMutex.RLock()
+	defer fake.enableFramedProtocolMutex.RUnlock()
 	fake.endMutex.RLock()
 	defer fake.endMutex.RUnlock()
 	fake.initialCheckpointMutex.RLock()
 	defer fake.initialCheckpointMutex.RUnlock()
+	fake.lastRestoreStatsMutex.RLock()
+	defer fake.lastRestoreStatsMutex.RUnlock()
+	fake.lastVerifyReportMutex.RLock()
+	defer fake.lastVerifyReportMutex.RUnlock()
+	fake.loadCheckpointMutex.RLock()
+	defer fake.loadCheckpointMutex.RUnlock()
 	fake.pauseAtSignalMutex.RLock()
 	defer fake.pauseAtSignalMutex.RUnlock()
 	fake.pidMutex.RLock()
 	defer fake.pidMutex.RUnlock()
+	fake.protocolMutex.RLock()
+	defer fake.protocolMutex.RUnlock()
+	fake.remoteSyscallMutex.RLock()
+	defer fake.remoteSyscallMutex.RUnlock()
 	fake.restoreMutex.RLock()
 	defer fake.restoreMutex.RUnlock()
+	fake.restoreToMutex.RLock()
+	defer fake.restoreToMutex.RUnlock()
+	fake.restoreToNamedMutex.RLock()
+	defer fake.restoreToNamedMutex.RUnlock()
+	fake.saveCheckpointMutex.RLock()
+	defer fake.saveCheckpointMutex.RUnlock()
 	fake.sendFunctionMutex.RLock()
 	defer fake.sendFunctionMutex.RUnlock()
+	fake.sendFunctionContextMutex.RLock()
+	defer fake.sendFunctionContextMutex.RUnlock()
 	fake.sendMessageMutex.RLock()
 	defer fake.sendMessageMutex.RUnlock()
 	fake.sendRequestMutex.RLock()
 	defer fake.sendRequestMutex.RUnlock()
+	fake.sendRequestContextMutex.RLock()
+	defer fake.sendRequestContextMutex.RUnlock()
+	fake.sendRequestWithLogsMutex.RLock()
+	defer fake.sendRequestWithLogsMutex.RUnlock()
 	fake.sendSignalMutex.RLock()
 	defer fake.sendSignalMutex.RUnlock()
 	fake.sendSignalContMutex.RLock()
 	defer fake.sendSignalContMutex.RUnlock()
+	fake.setConcurrencyMutex.RLock()
+	defer fake.setConcurrencyMutex.RUnlock()
+	fake.setDirtyTrackerMutex.RLock()
+	defer fake.setDirtyTrackerMutex.RUnlock()
+	fake.setHugePagesMutex.RLock()
+	defer fake.setHugePagesMutex.RUnlock()
+	fake.setLogLimitMutex.RLock()
+	defer fake.setLogLimitMutex.RUnlock()
+	fake.setMemoryIOMutex.RLock()
+	defer fake.setMemoryIOMutex.RUnlock()
+	fake.setPageStoreMutex.RLock()
+	defer fake.setPageStoreMutex.RUnlock()
 	fake.setPidMutex.RLock()
 	defer fake.setPidMutex.RUnlock()
 	fake.setRegsMutex.RLock()
 	defer fake.setRegsMutex.RUnlock()
+	fake.setRestoreModeMutex.RLock()
+	defer fake.setRestoreModeMutex.RUnlock()
 	fake.setStreamsMutex.RLock()
 	defer fake.setStreamsMutex.RUnlock()
+	fake.setVerifyRestoreMutex.RLock()
+	defer fake.setVerifyRestoreMutex.RUnlock()
 	fake.stateMutex.RLock()
 	defer fake.stateMutex.RUnlock()
 	fake.stopMutex.RLock()
@@ -1687,6 +3189,8 @@ func (fake *FakeController) Invocations() map[string][][]interface{} {
 	defer fake.streamsMutex.RUnlock()
 	fake.takeCheckpointMutex.RLock()
 	defer fake.takeCheckpointMutex.RUnlock()
+	fake.takeNamedCheckpointMutex.RLock()
+	defer fake.takeNamedCheckpointMutex.RUnlock()
 	fake.withSyscallTraceMutex.RLock()
 	defer fake.withSyscallTraceMutex.RUnlock()
 	copiedInvocations := map[string][][]interface{}{}
@@ -0,0 +1,296 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// The framed protocol carries messages over a pair of FIFOs shared with the
+// runtime rather than its stdin and stdout, so nothing the function prints
+// can corrupt them and large data is decoded once. A frame is a 4 byte
+// big-endian length of the rest of the frame, the length of the message type
+// in one byte, the type, an 8 byte big-endian message ID and the data as
+// JSON.
+//
+// Runtimes offer it in the protocols of their capabilities. The controller
+// answers with a protocol message, still as a line, naming the FIFOs. The
+// runtime opens them and replies protocol_ready over them.
+const (
+	// LineProtocol is one JSON message per line on stdin and stdout
+	LineProtocol = "line"
+	// FramedProtocol is version 1 of the framed protocol
+	FramedProtocol = "framed/1"
+)
+
+// Frames from the runtime larger than this are taken as garbage
+const maxFrameSize = 256 << 20
+
+// How long a runtime that offered the framed protocol has to switch to it
+const negotiateTimeout = 10 * time.Second
+
+// framedChannel is the controller's end of the FIFOs. in and out are named as
+// the runtime sees them, like its stdin and stdout.
+type framedChannel struct {
+	in         *os.File
+	out        *os.File
+	runtimeIn  string
+	runtimeOut string
+	writeMutex sync.Mutex
+	readerDone chan struct{}
+}
+
+type protocolSwitch struct {
+	Name string `json:"name"`
+	In   string `json:"in"`
+	Out  string `json:"out"`
+}
+
+// EnableFramedProtocol offers the framed protocol to runtimes that support it
+// when the worker is activated. The FIFOs are made in hostDir, which the
+// runtime sees as runtimeDir.
+func (c *controller) EnableFramedProtocol(hostDir string, runtimeDir string) error {
+	channel := &framedChannel{
+		runtimeIn:  filepath.Join(runtimeDir, "in"),
+		runtimeOut: filepath.Join(runtimeDir, "out"),
+	}
+
+	files := make([]*os.File, 2)
+	for i, name := range []string{"in", "out"} {
+		path := filepath.Join(hostDir, name)
+		err := syscall.Mkfifo(path, 0600)
+		if err != nil {
+			return fmt.Errorf("could not make fifo %s: %s", path, err)
+		}
+
+		// Holding both ends keeps the runtime's opens from blocking, and what
+		// is in the FIFOs while the runtime is restored
+		files[i], err = os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			return fmt.Errorf("could not open fifo %s: %s", path, err)
+		}
+	}
+	channel.in = files[0]
+	channel.out = files[1]
+
+	c.channel = channel
+	return nil
+}
+
+// Protocol is the protocol messages are exchanged with the runtime in
+func (c *controller) Protocol() string {
+	if atomic.LoadInt32(&c.framed) == 1 {
+		return FramedProtocol
+	}
+	return LineProtocol
+}
+
+// negotiateProtocol switches to the framed protocol when it is enabled and
+// the runtime offers it. Other runtimes stay on lines.
+func (c *controller) negotiateProtocol(capabilities Capabilities) error {
+	if c.channel == nil || !capabilities.Offers(FramedProtocol) {
+		return nil
+	}
+
+	c.startFrameReader()
+
+	ctx, cancel := context.WithTimeout(context.Background(), negotiateTimeout)
+	defer cancel()
+
+	// The switch is sent as a line, and answered in a frame
+	_, err := c.exchange(ctx, &Message{
+		Type: "protocol",
+		Data: protocolSwitch{
+			Name: FramedProtocol,
+			In:   c.channel.runtimeIn,
+			Out:  c.channel.runtimeOut,
+		},
+	}, "protocol_ready")
+	if err != nil {
+		return fmt.Errorf("could not switch to %s protocol: %w", FramedProtocol, err)
+	}
+
+	atomic.StoreInt32(&c.framed, 1)
+	return nil
+}
+
+// startFrameReader hands the runtime's frames to whoever waits for them
+// until the channel is reset or closed
+func (c *controller) startFrameReader() {
+	done := make(chan struct{})
+	c.channel.readerDone = done
+
+	go func() {
+		defer close(done)
+		reader := bufio.NewReader(c.channel.out)
+
+		for {
+			messageType, id, data, err := readFrame(reader)
+			if err != nil {
+				if !os.IsTimeout(err) && !errors.Is(err, os.ErrClosed) {
+					log.Warnf("stopped reading frames from worker: %s", err)
+				}
+				return
+			}
+
+			message := Message{Type: messageType, ID: id}
+			err = json.Unmarshal(data, &message.Data)
+			if err != nil {
+				log.Warnf("dropping %s frame with undecodable data: %s", messageType, err)
+				continue
+			}
+
+			c.handleMessage(message)
+		}
+	}()
+}
+
+// resetChannel drops frames either side wrote that the other has not read,
+// including any the restore cut off part way. The process must be stopped.
+func (c *controller) resetChannel() error {
+	if atomic.LoadInt32(&c.framed) == 0 {
+		return nil
+	}
+	channel := c.channel
+
+	// Interrupts writes the stopped runtime is not reading, and the reader,
+	// which may be part way through a frame
+	now := time.Now()
+	channel.in.SetWriteDeadline(now)
+	channel.out.SetReadDeadline(now)
+
+	channel.writeMutex.Lock()
+	defer channel.writeMutex.Unlock()
+	for waiting := true; waiting; {
+		select {
+		case <-channel.readerDone:
+			waiting = false
+		case <-c.messages:
+		}
+	}
+
+	channel.in.SetWriteDeadline(time.Time{})
+	channel.out.SetReadDeadline(time.Time{})
+
+	for _, fifo := range []*os.File{channel.in, channel.out} {
+		err := drainFIFO(fifo)
+		if err != nil {
+			return fmt.Errorf("could not drain %s: %s", fifo.Name(), err)
+		}
+	}
+
+	c.startFrameReader()
+	return nil
+}
+
+// drainFIFO reads everything in the FIFO without waiting for more
+func drainFIFO(fifo *os.File) error {
+	raw, err := fifo.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var readErr error
+	buf := make([]byte, 64<<10)
+	err = raw.Read(func(fd uintptr) bool {
+		for {
+			n, err := syscall.Read(int(fd), buf)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != syscall.EAGAIN {
+				readErr = err
+			}
+			if err != nil || n == 0 {
+				return true
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return readErr
+}
+
+// writeFrame writes message to the runtime in one frame
+func (f *framedChannel) writeFrame(message *Message) error {
+	frame, err := encodeFrame(message)
+	if err != nil {
+		return err
+	}
+
+	f.writeMutex.Lock()
+	defer f.writeMutex.Unlock()
+
+	_, err = f.in.Write(frame)
+	if err != nil {
+		return fmt.Errorf("could not write frame to worker: %s", err)
+	}
+	return nil
+}
+
+func (f *framedChannel) close() {
+	f.in.Close()
+	f.out.Close()
+}
+
+func encodeFrame(message *Message) ([]byte, error) {
+	if len(message.Type) > 255 {
+		return nil, fmt.Errorf("message type %s is too long for a frame", message.Type)
+	}
+
+	data, err := json.Marshal(message.Data)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode %s data: %s", message.Type, err)
+	}
+
+	typeLength := len(message.Type)
+	size := 1 + typeLength + 8 + len(data)
+	frame := make([]byte, 4+size)
+	binary.BigEndian.PutUint32(frame, uint32(size))
+	frame[4] = byte(typeLength)
+	copy(frame[5:], message.Type)
+	binary.BigEndian.PutUint64(frame[5+typeLength:], message.ID)
+	copy(frame[13+typeLength:], data)
+
+	return frame, nil
+}
+
+// readFrame reads the next frame and returns its message type, ID and data
+func readFrame(r io.Reader) (string, uint64, []byte, error) {
+	var size uint32
+	err := binary.Read(r, binary.BigEndian, &size)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if size < 9 || size > maxFrameSize {
+		return "", 0, nil, fmt.Errorf("frame size %d out of range", size)
+	}
+
+	frame := make([]byte, size)
+	_, err = io.ReadFull(r, frame)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	typeLength := int(frame[0])
+	if 1+typeLength+8 > len(frame) {
+		return "", 0, nil, fmt.Errorf("frame of %d bytes has a type of %d bytes", size, typeLength)
+	}
+	messageType := string(frame[1 : 1+typeLength])
+	id := binary.BigEndian.Uint64(frame[1+typeLength:])
+
+	return messageType, id, frame[9+typeLength:], nil
+}
@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// LogLine is a line the function wrote, or its runtime logged, while a
+// request was in flight
+type LogLine struct {
+	Time time.Time
+	// Stream is stdout or stderr
+	Stream  string
+	Message string
+}
+
+// String formats the line as OpenWhisk activation logs are
+func (l LogLine) String() string {
+	return fmt.Sprintf("%s %s: %s", l.Time.UTC().Format(time.RFC3339Nano), l.Stream, l.Message)
+}
+
+// logCollector gathers the lines of one request, up to limit bytes of
+// messages when limit is above zero
+type logCollector struct {
+	lines     []LogLine
+	bytes     int
+	limit     int
+	truncated bool
+}
+
+func (l *logCollector) add(line LogLine) {
+	if l.truncated {
+		return
+	}
+
+	if l.limit > 0 && l.bytes+len(line.Message) > l.limit {
+		l.truncated = true
+		l.lines = append(l.lines, LogLine{
+			Time:    line.Time,
+			Stream:  "stderr",
+			Message: fmt.Sprintf("Logs were truncated because the total bytes size exceeds the limit of %d bytes.", l.limit),
+		})
+		return
+	}
+
+	l.bytes += len(line.Message)
+	l.lines = append(l.lines, line)
+}
+
+// SetLogLimit caps the bytes of log lines collected for each request. Zero
+// collects everything.
+func (c *controller) SetLogLimit(bytes int) {
+	c.logsMutex.Lock()
+	defer c.logsMutex.Unlock()
+	c.logLimit = bytes
+}
+
+// startLogs collects the log lines of the request with id until the returned
+// function is called, which gives back the lines
+func (c *controller) startLogs(id uint64) func() []LogLine {
+	c.logsMutex.Lock()
+	collector := &logCollector{limit: c.logLimit}
+	c.collectors[id] = collector
+	c.logsMutex.Unlock()
+
+	return func() []LogLine {
+		c.logsMutex.Lock()
+		defer c.logsMutex.Unlock()
+		delete(c.collectors, id)
+		return collector.lines
+	}
+}
+
+// collectLog adds line to the logs of the request with id. Lines without an
+// id cannot be told apart, so they go to every request in flight.
+func (c *controller) collectLog(id uint64, line LogLine) {
+	c.logsMutex.Lock()
+	defer c.logsMutex.Unlock()
+
+	if id != 0 {
+		if collector, exists := c.collectors[id]; exists {
+			collector.add(line)
+		}
+		return
+	}
+	for _, collector := range c.collectors {
+		collector.add(line)
+	}
+}
+
+// logMessage is the text of a log message's data
+func logMessage(data interface{}) string {
+	if text, ok := data.(string); ok {
+		return text
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Sprint(data)
+	}
+	return string(encoded)
+}
+
+func trimLine(line string) string {
+	return strings.TrimRight(line, "\r\n")
+}
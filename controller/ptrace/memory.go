@@ -0,0 +1,117 @@
+package ptrace
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Unlike PTRACE_PEEKDATA and /proc/pid/mem, process_vm_readv and
+// process_vm_writev wait for pages missing under a userfaultfd to be served
+// instead of failing with EIO.
+
+// iovMax is the most iovecs one process_vm call takes
+const iovMax = 1024
+
+// MemoryRun is a run of bytes at Address in a process, copied to or from
+// Local. Runs at consecutive addresses share one remote iovec.
+type MemoryRun struct {
+	Address uintptr
+	Local   []byte
+}
+
+// ReadMemoryRuns fills each run's Local from the process's memory, using as
+// few process_vm_readv calls as possible
+func ReadMemoryRuns(pid int, runs []MemoryRun) error {
+	return transferMemoryRuns(unix.SYS_PROCESS_VM_READV, pid, runs)
+}
+
+// WriteMemoryRuns writes each run's Local to the process's memory, using as
+// few process_vm_writev calls as possible
+func WriteMemoryRuns(pid int, runs []MemoryRun) error {
+	return transferMemoryRuns(unix.SYS_PROCESS_VM_WRITEV, pid, runs)
+}
+
+// readMemory fills data from address in the task's memory
+func readMemory(pid int, address uintptr, data []byte) error {
+	return ReadMemoryRuns(pid, []MemoryRun{{Address: address, Local: data}})
+}
+
+// writeMemory writes data to address in the task's memory
+func writeMemory(pid int, address uintptr, data []byte) error {
+	return WriteMemoryRuns(pid, []MemoryRun{{Address: address, Local: data}})
+}
+
+// iovec holds a remote address, which unix.Iovec cannot without a vet
+// warning
+type iovec struct {
+	base   uintptr
+	length uint64
+}
+
+func transferMemoryRuns(trap uintptr, pid int, runs []MemoryRun) error {
+	local := make([]iovec, 0, iovMax)
+	remote := make([]iovec, 0, iovMax)
+
+	// The kernel stops at the first page it cannot transfer, so each call
+	// carries on from where the last one stopped
+	run, done := 0, 0
+	for run < len(runs) {
+		local, remote = local[:0], remote[:0]
+		for i := run; i < len(runs) && len(local) < iovMax; i++ {
+			start := 0
+			if i == run {
+				start = done
+			}
+			if start == len(runs[i].Local) {
+				continue
+			}
+
+			address := runs[i].Address + uintptr(start)
+			length := uint64(len(runs[i].Local) - start)
+			last := len(remote) - 1
+			adjacent := last >= 0 && remote[last].base+uintptr(remote[last].length) == address
+			if !adjacent && len(remote) == iovMax {
+				break
+			}
+
+			local = append(local, iovec{base: uintptr(unsafe.Pointer(&runs[i].Local[start])), length: length})
+			if adjacent {
+				remote[last].length += length
+			} else {
+				remote = append(remote, iovec{base: address, length: length})
+			}
+		}
+		if len(local) == 0 {
+			return nil
+		}
+
+		n, _, errno := syscall.Syscall6(trap, uintptr(pid), uintptr(unsafe.Pointer(&local[0])), uintptr(len(local)), uintptr(unsafe.Pointer(&remote[0])), uintptr(len(remote)), 0)
+		runtime.KeepAlive(runs)
+		if errno != 0 {
+			return fmt.Errorf("could not transfer %d bytes at %x: %s", len(runs[run].Local)-done, runs[run].Address+uintptr(done), errno)
+		}
+		if n == 0 {
+			return fmt.Errorf("could not transfer %d bytes at %x: no progress", len(runs[run].Local)-done, runs[run].Address+uintptr(done))
+		}
+
+		transferred := int(n)
+		for transferred > 0 {
+			left := len(runs[run].Local) - done
+			if transferred < left {
+				done += transferred
+				break
+			}
+			transferred -= left
+			run, done = run+1, 0
+		}
+		for run < len(runs) && done == len(runs[run].Local) {
+			run, done = run+1, 0
+		}
+	}
+
+	return nil
+}
@@ -1,14 +1,17 @@
 package ptrace
 
 import (
+	"encoding/binary"
 	"fmt"
 	"runtime"
 	"strings"
 	"syscall"
+	"unsafe"
 
 	"github.com/ostenbom/refunction/controller/safewriter"
 	sec "github.com/seccomp/libseccomp-golang"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
 type TraceTask struct {
@@ -19,6 +22,8 @@ type TraceTask struct {
 	HasContinued   chan int
 	Detach         chan int
 	HasDetached    chan int
+	Exit           chan int
+	HasExited      chan error
 	RunSyscall     chan syscall.PtraceRegs
 	SyscallReturn  chan syscall.PtraceRegs
 	SyscallError   chan error
@@ -27,6 +32,8 @@ type TraceTask struct {
 	attachOptions  []int
 	straceEnabled  bool
 	writer         *safewriter.SafeWriter
+	// Signals reported while running remote syscalls, not yet delivered
+	deferredSignals []syscall.Signal
 }
 
 type Options struct {
@@ -44,6 +51,8 @@ func NewTraceTask(tid int, gid int, options Options) (*TraceTask, error) {
 		HasContinued:   make(chan int),
 		Detach:         make(chan int),
 		HasDetached:    make(chan int),
+		Exit:           make(chan int),
+		HasExited:      make(chan error),
 		RunSyscall:     make(chan syscall.PtraceRegs),
 		SyscallReturn:  make(chan syscall.PtraceRegs),
 		SyscallError:   make(chan error),
@@ -176,7 +185,7 @@ func (t *TraceTask) awaitContinueOrders() (bool, error) {
 		select {
 		case continueSignal := <-t.Continue:
 			t.popWait()
-			err := t.continueTrace(continueSignal)
+			err := t.continueTrace(t.nextSignal(continueSignal))
 			if err != nil {
 				return false, fmt.Errorf("could not continue after syscall stop: %s", err)
 			}
@@ -190,12 +199,20 @@ func (t *TraceTask) awaitContinueOrders() (bool, error) {
 				t.SyscallReturn <- returnRegs
 			}
 		case <-t.Detach:
+			// Deferred signals are left pending for the untraced task
+			for _, signal := range t.deferredSignals {
+				syscall.Tgkill(t.Gid, t.Tid, signal)
+			}
+			t.deferredSignals = nil
 			err := syscall.PtraceDetach(t.Tid)
 			if err != nil {
 				return false, fmt.Errorf("could not detach: %s", err)
 			}
 			t.HasDetached <- 1
 			return false, nil
+		case <-t.Exit:
+			t.HasExited <- t.exitTask()
+			return false, nil
 		case f := <-t.InStopFunction:
 			f(t)
 		}
@@ -219,6 +236,14 @@ func (t *TraceTask) runSyscall(argRegs syscall.PtraceRegs) (syscall.PtraceRegs,
 		return syscall.PtraceRegs{}, fmt.Errorf("could not get task regs: %s", err)
 	}
 
+	entry, err := atSyscallEntry(t.Tid, startRegs)
+	if err != nil {
+		return syscall.PtraceRegs{}, err
+	}
+	if entry {
+		return t.runSyscallAtEntry(startRegs, argRegs)
+	}
+
 	// Get current Rip data
 	preSyscallInstruction := make([]byte, 2)
 	count, err := syscall.PtracePeekData(t.Tid, uintptr(startRegs.PC()), preSyscallInstruction)
@@ -238,10 +263,10 @@ func (t *TraceTask) runSyscall(argRegs syscall.PtraceRegs) (syscall.PtraceRegs,
 	syscallRegs.Rax = argRegs.Rax
 	syscallRegs.Rdi = argRegs.Rdi
 	syscallRegs.Rsi = argRegs.Rsi
-	// syscallRegs.Rdx = argRegs.Rdx
-	// syscallRegs.Rcx = argRegs.Rcx
-	// syscallRegs.R8 = argRegs.R8
-	// syscallRegs.R9 = argRegs.R9
+	syscallRegs.Rdx = argRegs.Rdx
+	syscallRegs.R10 = argRegs.R10
+	syscallRegs.R8 = argRegs.R8
+	syscallRegs.R9 = argRegs.R9
 
 	// Change regs for syscall
 	err = syscall.PtraceSetRegs(t.Tid, &syscallRegs)
@@ -263,6 +288,22 @@ func (t *TraceTask) runSyscall(argRegs syscall.PtraceRegs) (syscall.PtraceRegs,
 		return syscall.PtraceRegs{}, fmt.Errorf("could wait on syscall task: %s", err)
 	}
 
+	// Pending signals, such as SIGCHLD from killed children, are reported
+	// before the syscall instruction runs. Stepping on drops them, so they
+	// are deferred.
+	for waitStat.Stopped() && waitStat.StopSignal() != syscall.SIGTRAP {
+		t.deferSignal(waitStat)
+		err = syscall.PtraceSingleStep(t.Tid)
+		if err != nil {
+			return syscall.PtraceRegs{}, fmt.Errorf("could not continue task: %s", err)
+		}
+
+		_, err = syscall.Wait4(t.Tid, &waitStat, syscall.WALL, nil)
+		if err != nil {
+			return syscall.PtraceRegs{}, fmt.Errorf("could wait on syscall task: %s", err)
+		}
+	}
+
 	var exitRegs syscall.PtraceRegs
 	err = syscall.PtraceGetRegs(t.Tid, &exitRegs)
 	if err != nil {
@@ -282,6 +323,148 @@ func (t *TraceTask) runSyscall(argRegs syscall.PtraceRegs) (syscall.PtraceRegs,
 	return exitRegs, nil
 }
 
+// atSyscallEntry is true when the task is stopped entering a syscall, as
+// after PTRACE_SYSCALL. A syscall instruction run there would not be reached:
+// continuing carries on with the syscall being entered.
+func atSyscallEntry(tid int, regs syscall.PtraceRegs) (bool, error) {
+	// struct ptrace_syscall_info starts with its op
+	info := make([]byte, 88)
+	err := ptrace(unix.PTRACE_GET_SYSCALL_INFO, tid, uintptr(len(info)), uintptr(unsafe.Pointer(&info[0])))
+	switch {
+	case err == syscall.EIO || err == syscall.EINVAL:
+		// Kernels before 5.3 do not have PTRACE_GET_SYSCALL_INFO
+	case err != nil:
+		return false, fmt.Errorf("could not get syscall info: %s", err)
+	case info[0] == unix.PTRACE_SYSCALL_INFO_ENTRY:
+		return true, nil
+	case info[0] != unix.PTRACE_SYSCALL_INFO_NONE:
+		return false, nil
+	}
+
+	// Without PTRACE_O_TRACESYSGOOD or PTRACE_GET_SYSCALL_INFO syscall stops
+	// are not told apart from other SIGTRAPs. Syscalls are entered with
+	// -ENOSYS in rax.
+	siginfo := make([]byte, 128)
+	err = ptrace(syscall.PTRACE_GETSIGINFO, tid, 0, uintptr(unsafe.Pointer(&siginfo[0])))
+	if err != nil {
+		return false, fmt.Errorf("could not get siginfo: %s", err)
+	}
+	signo := binary.LittleEndian.Uint32(siginfo[0:])
+	code := binary.LittleEndian.Uint32(siginfo[8:])
+	return signo == uint32(syscall.SIGTRAP) && code == uint32(syscall.SIGTRAP) && int64(regs.Rax) == -int64(syscall.ENOSYS), nil
+}
+
+// runSyscallAtEntry swaps the syscall being entered for the remote one and
+// runs it to its exit. The task then enters its own syscall again from a
+// syscall instruction just before its pc, so it is left as it was found.
+func (t *TraceTask) runSyscallAtEntry(startRegs syscall.PtraceRegs, argRegs syscall.PtraceRegs) (syscall.PtraceRegs, error) {
+	syscallRegs := startRegs
+	// The kernel reads the syscall number from orig_rax after the stop
+	syscallRegs.Orig_rax = argRegs.Rax
+	syscallRegs.Rdi = argRegs.Rdi
+	syscallRegs.Rsi = argRegs.Rsi
+	syscallRegs.Rdx = argRegs.Rdx
+	syscallRegs.R10 = argRegs.R10
+	syscallRegs.R8 = argRegs.R8
+	syscallRegs.R9 = argRegs.R9
+
+	err := syscall.PtraceSetRegs(t.Tid, &syscallRegs)
+	if err != nil {
+		return syscall.PtraceRegs{}, fmt.Errorf("could not set syscall regs: %s", err)
+	}
+	err = t.syscallStop()
+	if err != nil {
+		return syscall.PtraceRegs{}, err
+	}
+
+	var exitRegs syscall.PtraceRegs
+	err = syscall.PtraceGetRegs(t.Tid, &exitRegs)
+	if err != nil {
+		return syscall.PtraceRegs{}, fmt.Errorf("could not get task regs: %s", err)
+	}
+
+	// Enter the task's own syscall again
+	instructionAddr := uintptr(startRegs.PC() - 2)
+	preSyscallInstruction := make([]byte, 2)
+	count, err := syscall.PtracePeekData(t.Tid, instructionAddr, preSyscallInstruction)
+	if err != nil || count != 2 {
+		return syscall.PtraceRegs{}, fmt.Errorf("could not peek data: %s", err)
+	}
+	count, err = syscall.PtracePokeData(t.Tid, instructionAddr, []byte{byte(0x0f), byte(0x05)})
+	if err != nil || count != 2 {
+		return syscall.PtraceRegs{}, fmt.Errorf("could not poke instruction data: %s", err)
+	}
+
+	reenterRegs := startRegs
+	reenterRegs.Rip = uint64(instructionAddr)
+	reenterRegs.Rax = startRegs.Orig_rax
+	err = syscall.PtraceSetRegs(t.Tid, &reenterRegs)
+	if err != nil {
+		return syscall.PtraceRegs{}, fmt.Errorf("could not set reentry regs: %s", err)
+	}
+	err = t.syscallStop()
+	if err != nil {
+		return syscall.PtraceRegs{}, err
+	}
+
+	count, err = syscall.PtracePokeData(t.Tid, instructionAddr, preSyscallInstruction)
+	if err != nil || count != 2 {
+		return syscall.PtraceRegs{}, fmt.Errorf("could not poke instruction data: %s", err)
+	}
+	err = syscall.PtraceSetRegs(t.Tid, &startRegs)
+	if err != nil {
+		return syscall.PtraceRegs{}, fmt.Errorf("could not reset task regs: %s", err)
+	}
+
+	return exitRegs, nil
+}
+
+// syscallStop continues the task to its next syscall stop. Signals reported
+// on the way are deferred, as they are when running syscalls.
+func (t *TraceTask) syscallStop() error {
+	var waitStat syscall.WaitStatus
+	for {
+		err := syscall.PtraceSyscall(t.Tid, 0)
+		if err != nil {
+			return fmt.Errorf("could not continue task to syscall: %s", err)
+		}
+		_, err = syscall.Wait4(t.Tid, &waitStat, syscall.WALL, nil)
+		if err != nil {
+			return fmt.Errorf("could wait on syscall task: %s", err)
+		}
+		if waitStat.Stopped() && waitStat.StopSignal()&^0x80 == syscall.SIGTRAP {
+			return nil
+		}
+		t.deferSignal(waitStat)
+	}
+}
+
+// deferSignal keeps a signal reported while running a remote syscall, which
+// continuing past its stop would otherwise drop, to be delivered when the task
+// is next continued. SIGCHLD, as from children killed by a restore, is
+// dropped.
+func (t *TraceTask) deferSignal(waitStat syscall.WaitStatus) {
+	if !waitStat.Stopped() || waitStat>>16 == PTRACE_EVENT_STOP {
+		return
+	}
+	signal := waitStat.StopSignal()
+	if signal == syscall.SIGCHLD {
+		return
+	}
+	t.deferredSignals = append(t.deferredSignals, signal)
+}
+
+// nextSignal is the signal to continue the task with. Deferred signals are
+// delivered one per continue, after any signal the caller asks for.
+func (t *TraceTask) nextSignal(signal syscall.Signal) syscall.Signal {
+	if signal != 0 || len(t.deferredSignals) == 0 {
+		return signal
+	}
+	signal = t.deferredSignals[0]
+	t.deferredSignals = t.deferredSignals[1:]
+	return signal
+}
+
 func (t *TraceTask) continueTrace(signal syscall.Signal) error {
 	var err error
 	if t.straceEnabled {
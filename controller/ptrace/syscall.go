@@ -0,0 +1,328 @@
+package ptrace
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Bytes below the stack pointer the x86-64 ABI lets leaf functions use
+const redZoneSize = 128
+
+// RemoteSyscall runs syscall nr with up to six arguments in the task, which
+// must be stopped. A -errno result is returned as a syscall.Errno. It must not
+// be called from an InStopFunction of the same task.
+func (t *TraceTask) RemoteSyscall(nr uint64, args ...uint64) (uint64, error) {
+	regs, err := syscallRegs(nr, args)
+	if err != nil {
+		return 0, err
+	}
+
+	t.RunSyscall <- regs
+	select {
+	case returnRegs := <-t.SyscallReturn:
+		return decodeSyscallReturn(returnRegs.Rax)
+	case err := <-t.SyscallError:
+		return 0, err
+	}
+}
+
+// remoteSyscall is RemoteSyscall for use from inside the ptrace goroutine
+func (t *TraceTask) remoteSyscall(nr uint64, args ...uint64) (uint64, error) {
+	regs, err := syscallRegs(nr, args)
+	if err != nil {
+		return 0, err
+	}
+
+	returnRegs, err := t.runSyscall(regs)
+	if err != nil {
+		return 0, err
+	}
+
+	return decodeSyscallReturn(returnRegs.Rax)
+}
+
+func syscallRegs(nr uint64, args []uint64) (syscall.PtraceRegs, error) {
+	if len(args) > 6 {
+		return syscall.PtraceRegs{}, fmt.Errorf("syscall %d has too many arguments", nr)
+	}
+	argRegs := make([]uint64, 6)
+	copy(argRegs, args)
+
+	return syscall.PtraceRegs{
+		Rax: nr,
+		Rdi: argRegs[0],
+		Rsi: argRegs[1],
+		Rdx: argRegs[2],
+		R10: argRegs[3],
+		R8:  argRegs[4],
+		R9:  argRegs[5],
+	}, nil
+}
+
+func decodeSyscallReturn(rax uint64) (uint64, error) {
+	if errno := -int64(rax); errno > 0 && errno < 4096 {
+		return 0, syscall.Errno(errno)
+	}
+	return rax, nil
+}
+
+// RemoteMmap maps memory in the task and returns the mapped address
+func (t *TraceTask) RemoteMmap(addr uint64, length uint64, prot int, flags int, fd int, offset int64) (uint64, error) {
+	return t.RemoteSyscall(unix.SYS_MMAP, addr, length, uint64(prot), uint64(flags), uint64(int64(fd)), uint64(offset))
+}
+
+func (t *TraceTask) RemoteMunmap(addr uint64, length uint64) error {
+	_, err := t.RemoteSyscall(unix.SYS_MUNMAP, addr, length)
+	return err
+}
+
+func (t *TraceTask) RemoteMprotect(addr uint64, length uint64, prot int) error {
+	_, err := t.RemoteSyscall(unix.SYS_MPROTECT, addr, length, uint64(prot))
+	return err
+}
+
+func (t *TraceTask) RemoteClose(fd int) error {
+	_, err := t.RemoteSyscall(unix.SYS_CLOSE, uint64(fd))
+	return err
+}
+
+// RemoteLseek repositions fd in the task and returns the new offset
+func (t *TraceTask) RemoteLseek(fd int, offset int64, whence int) (int64, error) {
+	pos, err := t.RemoteSyscall(unix.SYS_LSEEK, uint64(fd), uint64(offset), uint64(whence))
+	return int64(pos), err
+}
+
+// RemotePrlimit sets the task's limit for resource, if newLimit is not nil,
+// and returns the previous limit
+func (t *TraceTask) RemotePrlimit(resource int, newLimit *unix.Rlimit) (unix.Rlimit, error) {
+	in := make([]byte, 16)
+	if newLimit != nil {
+		binary.LittleEndian.PutUint64(in[0:], newLimit.Cur)
+		binary.LittleEndian.PutUint64(in[8:], newLimit.Max)
+	}
+	out := make([]byte, 16)
+
+	_, err := t.remoteSyscallWithScratch(in, out, func(inAddr uint64, outAddr uint64) []uint64 {
+		if newLimit == nil {
+			inAddr = 0
+		}
+		return []uint64{unix.SYS_PRLIMIT64, 0, uint64(resource), inAddr, outAddr}
+	})
+	if err != nil {
+		return unix.Rlimit{}, err
+	}
+
+	return unix.Rlimit{
+		Cur: binary.LittleEndian.Uint64(out[0:]),
+		Max: binary.LittleEndian.Uint64(out[8:]),
+	}, nil
+}
+
+// RemoteChdir changes the working directory of the task
+func (t *TraceTask) RemoteChdir(path string) error {
+	in := append([]byte(path), 0)
+	_, err := t.remoteSyscallWithScratch(in, nil, func(inAddr uint64, outAddr uint64) []uint64 {
+		return []uint64{unix.SYS_CHDIR, inAddr}
+	})
+	return err
+}
+
+// RemoteSetgroups sets the supplementary groups of the task
+func (t *TraceTask) RemoteSetgroups(groups []uint32) error {
+	in := make([]byte, 4*len(groups))
+	for i, group := range groups {
+		binary.LittleEndian.PutUint32(in[4*i:], group)
+	}
+	_, err := t.remoteSyscallWithScratch(in, nil, func(inAddr uint64, outAddr uint64) []uint64 {
+		return []uint64{unix.SYS_SETGROUPS, uint64(len(groups)), inAddr}
+	})
+	return err
+}
+
+// RemoteCapset sets the effective, permitted and inheritable capabilities of
+// the task
+func (t *TraceTask) RemoteCapset(effective uint64, permitted uint64, inheritable uint64) error {
+	// A version 3 header, for this task, then the low and high 32 bits of
+	// each set
+	in := make([]byte, 8+24)
+	binary.LittleEndian.PutUint32(in[0:], unix.LINUX_CAPABILITY_VERSION_3)
+	for i, set := range []uint64{effective, permitted, inheritable} {
+		binary.LittleEndian.PutUint32(in[8+4*i:], uint32(set))
+		binary.LittleEndian.PutUint32(in[20+4*i:], uint32(set>>32))
+	}
+	_, err := t.remoteSyscallWithScratch(in, nil, func(inAddr uint64, outAddr uint64) []uint64 {
+		return []uint64{unix.SYS_CAPSET, inAddr, inAddr + 8}
+	})
+	return err
+}
+
+// Sigaction is the kernel's struct sigaction on x86-64
+type Sigaction struct {
+	Handler  uint64
+	Flags    uint64
+	Restorer uint64
+	Mask     uint64
+}
+
+// RemoteRtSigaction sets the task's action for sig, if act is not nil, and
+// returns the previous action
+func (t *TraceTask) RemoteRtSigaction(sig int, act *Sigaction) (Sigaction, error) {
+	var in bytes.Buffer
+	if act != nil {
+		binary.Write(&in, binary.LittleEndian, act)
+	} else {
+		in.Write(make([]byte, binary.Size(Sigaction{})))
+	}
+	out := make([]byte, binary.Size(Sigaction{}))
+
+	_, err := t.remoteSyscallWithScratch(in.Bytes(), out, func(inAddr uint64, outAddr uint64) []uint64 {
+		if act == nil {
+			inAddr = 0
+		}
+		// The last argument is the size of the kernel's sigset
+		return []uint64{unix.SYS_RT_SIGACTION, uint64(sig), inAddr, outAddr, 8}
+	})
+	if err != nil {
+		return Sigaction{}, err
+	}
+
+	var previous Sigaction
+	err = binary.Read(bytes.NewReader(out), binary.LittleEndian, &previous)
+	if err != nil {
+		return Sigaction{}, fmt.Errorf("could not decode sigaction: %s", err)
+	}
+
+	return previous, nil
+}
+
+// remoteSyscallWithScratch runs a syscall that takes pointers. in is copied
+// into scratch space below the task's stack red zone, followed by room for
+// out. buildArgs gets both addresses and returns the syscall number and
+// arguments. out is filled from the scratch space, which is put back after.
+func (t *TraceTask) remoteSyscallWithScratch(in []byte, out []byte, buildArgs func(inAddr uint64, outAddr uint64) []uint64) (uint64, error) {
+	var returnVal uint64
+	result := make(chan error)
+	t.InStopFunction <- func(t *TraceTask) {
+		var regs syscall.PtraceRegs
+		err := syscall.PtraceGetRegs(t.Tid, &regs)
+		if err != nil {
+			result <- fmt.Errorf("could not get regs for scratch space: %s", err)
+			return
+		}
+
+		size := uint64(len(in) + len(out))
+		scratch := (regs.Rsp - redZoneSize - size) &^ 15
+		saved := make([]byte, size)
+		err = readMemory(t.Tid, uintptr(scratch), saved)
+		if err != nil {
+			result <- fmt.Errorf("could not save scratch space: %s", err)
+			return
+		}
+
+		err = writeMemory(t.Tid, uintptr(scratch), append(append([]byte{}, in...), out...))
+		if err != nil {
+			result <- fmt.Errorf("could not write scratch space: %s", err)
+			return
+		}
+
+		args := buildArgs(scratch, scratch+uint64(len(in)))
+		var syscallErr error
+		returnVal, syscallErr = t.remoteSyscall(args[0], args[1:]...)
+
+		err = readMemory(t.Tid, uintptr(scratch)+uintptr(len(in)), out)
+		if err != nil {
+			result <- fmt.Errorf("could not read scratch space: %s", err)
+			return
+		}
+
+		err = writeMemory(t.Tid, uintptr(scratch), saved)
+		if err != nil {
+			result <- fmt.Errorf("could not restore scratch space: %s", err)
+			return
+		}
+
+		result <- syscallErr
+	}
+
+	err := <-result
+	return returnVal, err
+}
+
+// exitTask makes the task run the exit syscall, ending only this thread.
+// The task must be at a syscall boundary, so the syscall instruction it
+// entered by can be run again. Writing one at any other pc could be run by
+// the process's other threads. The trace loop must stop after calling it.
+func (t *TraceTask) exitTask() error {
+	var regs syscall.PtraceRegs
+	err := syscall.PtraceGetRegs(t.Tid, &regs)
+	if err != nil {
+		return fmt.Errorf("could not get regs of %d for exit: %s", t.Tid, err)
+	}
+
+	boundary, err := atSyscallBoundary(t.Tid, regs)
+	if err != nil {
+		return err
+	}
+	if !boundary {
+		return fmt.Errorf("task %d is not stopped at a syscall, at pc %x", t.Tid, regs.PC())
+	}
+
+	regs.SetPC(regs.PC() - 2)
+	regs.Rax = unix.SYS_EXIT
+	regs.Rdi = 0
+	// Stops the kernel restarting an interrupted syscall instead
+	regs.Orig_rax = ^uint64(0)
+	err = syscall.PtraceSetRegs(t.Tid, &regs)
+	if err != nil {
+		return fmt.Errorf("could not set regs of %d for exit: %s", t.Tid, err)
+	}
+
+	for {
+		// Signals arriving on the way out are suppressed
+		err = syscall.PtraceCont(t.Tid, 0)
+		if err != nil {
+			return fmt.Errorf("could not continue %d to exit: %s", t.Tid, err)
+		}
+
+		var waitStat syscall.WaitStatus
+		_, err = syscall.Wait4(t.Tid, &waitStat, syscall.WALL, nil)
+		if err != nil {
+			return fmt.Errorf("could not wait for %d to exit: %s", t.Tid, err)
+		}
+		if waitStat.Exited() || waitStat.Signaled() {
+			return nil
+		}
+	}
+}
+
+// atSyscallBoundary is true when the task is stopped at a syscall stop, or
+// on its way out of a syscall it was interrupted in, just past the syscall
+// instruction it entered by. Interrupts and faults leave -1 or an error code
+// in orig_rax, so only a syscall number there with a syscall instruction
+// before the pc is taken as a syscall.
+func atSyscallBoundary(tid int, regs syscall.PtraceRegs) (bool, error) {
+	info := make([]byte, 88)
+	err := ptrace(unix.PTRACE_GET_SYSCALL_INFO, tid, uintptr(len(info)), uintptr(unsafe.Pointer(&info[0])))
+	switch {
+	case err == syscall.EIO || err == syscall.EINVAL:
+	case err != nil:
+		return false, fmt.Errorf("could not get syscall info: %s", err)
+	case info[0] != unix.PTRACE_SYSCALL_INFO_NONE:
+		return true, nil
+	}
+
+	if int64(regs.Orig_rax) < 0 {
+		return false, nil
+	}
+	previous := make([]byte, 2)
+	count, err := syscall.PtracePeekData(tid, uintptr(regs.PC()-2), previous)
+	if err != nil || count != 2 {
+		return false, nil
+	}
+	return bytes.Equal(previous, []byte{byte(0x0f), byte(0x05)}), nil
+}
@@ -0,0 +1,95 @@
+package ptrace
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// Itimerval is the kernel's struct itimerval on x86-64
+type Itimerval struct {
+	Interval unix.Timeval
+	Value    unix.Timeval
+}
+
+// Itimerspec is the kernel's struct itimerspec on x86-64
+type Itimerspec struct {
+	Interval unix.Timespec
+	Value    unix.Timespec
+}
+
+func encode(v interface{}) []byte {
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.LittleEndian, v)
+	return buffer.Bytes()
+}
+
+func decode(data []byte, v interface{}) error {
+	err := binary.Read(bytes.NewReader(data), binary.LittleEndian, v)
+	if err != nil {
+		return fmt.Errorf("could not decode syscall result: %s", err)
+	}
+	return nil
+}
+
+// RemoteSetitimer sets the task's interval timer which, if value is not
+// nil, and returns its previous value
+func (t *TraceTask) RemoteSetitimer(which int, value *Itimerval) (Itimerval, error) {
+	var in []byte
+	if value != nil {
+		in = encode(value)
+	}
+	out := make([]byte, binary.Size(Itimerval{}))
+
+	_, err := t.remoteSyscallWithScratch(in, out, func(inAddr uint64, outAddr uint64) []uint64 {
+		if value == nil {
+			return []uint64{unix.SYS_GETITIMER, uint64(which), outAddr}
+		}
+		return []uint64{unix.SYS_SETITIMER, uint64(which), inAddr, outAddr}
+	})
+	if err != nil {
+		return Itimerval{}, err
+	}
+
+	var previous Itimerval
+	return previous, decode(out, &previous)
+}
+
+// RemoteTimerSettime sets the task's POSIX timer id, if value is not nil,
+// and returns its previous value
+func (t *TraceTask) RemoteTimerSettime(id int, value *Itimerspec) (Itimerspec, error) {
+	var in []byte
+	if value != nil {
+		in = encode(value)
+	}
+	out := make([]byte, binary.Size(Itimerspec{}))
+
+	_, err := t.remoteSyscallWithScratch(in, out, func(inAddr uint64, outAddr uint64) []uint64 {
+		if value == nil {
+			return []uint64{unix.SYS_TIMER_GETTIME, uint64(id), outAddr}
+		}
+		return []uint64{unix.SYS_TIMER_SETTIME, uint64(id), 0, inAddr, outAddr}
+	})
+	if err != nil {
+		return Itimerspec{}, err
+	}
+
+	var previous Itimerspec
+	return previous, decode(out, &previous)
+}
+
+func (t *TraceTask) RemoteTimerDelete(id int) error {
+	_, err := t.RemoteSyscall(unix.SYS_TIMER_DELETE, uint64(id))
+	return err
+}
+
+// RemoteTimerfdSettime arms or disarms a timerfd of the task with a
+// relative value
+func (t *TraceTask) RemoteTimerfdSettime(fd int, value Itimerspec) error {
+	_, err := t.remoteSyscallWithScratch(encode(value), nil, func(inAddr uint64, outAddr uint64) []uint64 {
+		return []uint64{unix.SYS_TIMERFD_SETTIME, uint64(fd), 0, inAddr, 0}
+	})
+	return err
+}
@@ -71,7 +71,7 @@ func (s *controllerService) SendRequest(ctx context.Context, req *refunction.Req
 		return nil, fmt.Errorf("could not unmarshal json request %s: %s", req.Request, err)
 	}
 
-	response, err := controller.SendRequest(request)
+	response, err := controller.SendRequestContext(ctx, request)
 	if err != nil {
 		return nil, fmt.Errorf("error sending request to container %s: %s", req.ContainerId, err)
 	}
@@ -92,7 +92,7 @@ func (s *controllerService) SendFunction(ctx context.Context, req *refunction.Fu
 		return nil, fmt.Errorf("no such controller: %s", req.ContainerId)
 	}
 
-	err := controller.SendFunction(req.Function)
+	err := controller.SendFunctionContext(ctx, req.Function)
 	if err != nil {
 		return nil, fmt.Errorf("error sending function to container %s: %s", req.ContainerId, err)
 	}
@@ -63,10 +63,23 @@ var _ = Describe("ControllerService", func() {
 			})
 			Expect(err).To(BeNil())
 
-			Expect(createdControllers[1].SendFunctionCallCount()).To(Equal(1))
-			calledFunction := createdControllers[1].SendFunctionArgsForCall(0)
+			Expect(createdControllers[1].SendFunctionContextCallCount()).To(Equal(1))
+			_, calledFunction := createdControllers[1].SendFunctionContextArgsForCall(0)
 			Expect(calledFunction).To(Equal(function))
 		})
+
+		It("passes the request's context to the controller", func() {
+			requestCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			_, err := service.SendFunction(requestCtx, &refunction.FunctionRequest{
+				ContainerId: "second",
+				Function:    "function: 1 + 1",
+			})
+			Expect(err).To(BeNil())
+
+			calledCtx, _ := createdControllers[1].SendFunctionContextArgsForCall(0)
+			Expect(calledCtx).To(Equal(requestCtx))
+		})
 	})
 
 	Context("SendRequest", func() {
@@ -76,7 +89,7 @@ var _ = Describe("ControllerService", func() {
 		})
 
 		It("sends the request to the correct controller", func() {
-			createdControllers[1].SendRequestReturns(map[string]interface{}{"back": "grape"}, nil)
+			createdControllers[1].SendRequestContextReturns(map[string]interface{}{"back": "grape"}, nil)
 
 			request := "{\"name\": \"potato\"}"
 			response, err := service.SendRequest(ctx, &refunction.Request{
@@ -85,12 +98,22 @@ var _ = Describe("ControllerService", func() {
 			})
 			Expect(err).To(BeNil())
 
-			Expect(createdControllers[1].SendRequestCallCount()).To(Equal(1))
-			calledRequest := createdControllers[1].SendRequestArgsForCall(0)
+			Expect(createdControllers[1].SendRequestContextCallCount()).To(Equal(1))
+			_, calledRequest := createdControllers[1].SendRequestContextArgsForCall(0)
 			Expect(calledRequest).To(Equal(map[string]interface{}{"name": "potato"}))
 
 			Expect(response.Response).To(Equal("{\"back\":\"grape\"}"))
 		})
+
+		It("returns an error when the controller gives up waiting for the response", func() {
+			createdControllers[1].SendRequestContextReturns("", &controller.AwaitMessageError{MessageType: "response", Err: context.DeadlineExceeded})
+
+			_, err := service.SendRequest(ctx, &refunction.Request{
+				ContainerId: "second",
+				Request:     "{}",
+			})
+			Expect(err).To(MatchError(ContainSubstring("no response message from worker")))
+		})
 	})
 
 	Context("Restore", func() {
@@ -1,63 +1,119 @@
 import json
 import fileinput
+import platform
+import struct
 from datetime import datetime
 
+PROTOCOL_VERSION = 1
+FRAMED_PROTOCOL = "framed/1"
+
+class LineChannel:
+    """One JSON message per line on stdin and stdout"""
+
+    def __init__(self):
+        self.stdin = fileinput.input()
+
+    def receive(self):
+        for line in self.stdin:
+            try:
+                data = json.loads(line)
+                if "type" not in data or "data" not in data:
+                    continue
+                return data["type"], data["data"], data.get("id")
+            except json.JSONDecodeError as e:
+                continue
+
+    def send(self, data_type, data, message_id=None):
+        action = {'type': data_type}
+        # Replies carry the id of the message they answer
+        if message_id is not None:
+            action['id'] = message_id
+        action['data'] = data
+        asjson = json.dumps(action)
+        print(asjson, flush=True)
+
+class FramedChannel:
+    """Frames on a pair of FIFOs: a 4 byte big-endian length of the rest of
+    the frame, the length of the type in one byte, the type, an 8 byte
+    big-endian id and the data as JSON"""
+
+    def __init__(self, in_path, out_path):
+        self.reader = open(in_path, "rb")
+        self.writer = open(out_path, "wb")
+
+    def receive(self):
+        while True:
+            size, = struct.unpack(">I", self.reader.read(4))
+            frame = self.reader.read(size)
+            type_length = frame[0]
+            data_type = frame[1:1 + type_length].decode()
+            message_id, = struct.unpack(">Q", frame[1 + type_length:9 + type_length])
+            try:
+                data = json.loads(frame[9 + type_length:])
+            except json.JSONDecodeError as e:
+                continue
+            return data_type, data, message_id or None
+
+    def send(self, data_type, data, message_id=None):
+        encoded_type = data_type.encode()
+        payload = json.dumps(data).encode()
+        header = struct.pack(">IB", 1 + len(encoded_type) + 8 + len(payload), len(encoded_type))
+        self.writer.write(header + encoded_type + struct.pack(">Q", message_id or 0) + payload)
+        self.writer.flush()
+
+channel = LineChannel()
+
 def start_function_server():
-    send_data("started", "")
+    global channel
+    send_data("started", {
+        "protocol_version": PROTOCOL_VERSION,
+        "runtime": "python",
+        "runtime_version": platform.python_version(),
+        "features": ["ids", "logs"],
+        "protocols": [FRAMED_PROTOCOL],
+    })
 
-    stdin = fileinput.input()
+    message_type, data, message_id = channel.receive()
+    # Controllers that do not know the framed protocol go straight to the
+    # function
+    if message_type == "protocol" and data.get("name") == FRAMED_PROTOCOL:
+        channel = FramedChannel(data["in"], data["out"])
+        send_data("protocol_ready", True, message_id)
+        message_type, data, message_id = channel.receive()
 
     loaded = False
     while not loaded:
-        try:
-            function_string = receive_data_of_type("function", stdin)
-            log(f"received function: {function_string}")
-            global main
-            exec(function_string, globals())
-            loaded = True
-        except Exception as e:
-            log(f"function load error: {e}")
-            send_data("function_loaded", False)
-            continue
-
-    send_data("function_loaded", True)
+        if message_type == "function":
+            try:
+                function_string = data
+                log(f"received function: {function_string}")
+                global main
+                exec(function_string, globals())
+                loaded = True
+                break
+            except Exception as e:
+                log(f"function load error: {e}")
+                send_data("function_loaded", False, message_id)
+        message_type, data, message_id = channel.receive()
+
+    send_data("function_loaded", True, message_id)
 
     while True:
-        message_type, data = receive_data(stdin)
+        message_type, data, message_id = channel.receive()
         if message_type == "request":
             log(f"received request: {data}")
             result = main(data)
-            send_data("response", result)
+            send_data("response", result, message_id)
 
     # Never finishes. Either killed or restored
 
-def receive_data_of_type(data_type, stdin):
-    for line in stdin:
-        try:
-            data = json.loads(line)
-            if "type" not in data or "data" not in data:
-                continue
-            if data["type"] == data_type:
-                return data["data"]
-        except json.JSONDecodeError as e:
-            continue
-
-def receive_data(stdin):
-    for line in stdin:
-        try:
-            data = json.loads(line)
-            if "type" not in data or "data" not in data:
-                continue
-            return data["type"], data["data"]
-        except json.JSONDecodeError as e:
-            continue
-
-def send_data(data_type, data):
-    action = {'type': data_type, 'data': data}
-    asjson = json.dumps(action)
-    print(asjson, flush=True)
+def send_data(data_type, data, message_id=None):
+    channel.send(data_type, data, message_id)
 
 def log(line):
+    if isinstance(channel, FramedChannel):
+        channel.send("log", line)
+        return
     log_obj = {"type": "log", "data": line, "time": str(datetime.utcnow())}
     print(json.dumps(log_obj), flush=True)
 
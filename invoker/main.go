@@ -31,6 +31,8 @@ type Config struct {
 	PoolConfig  []workerpool.GroupConfig `toml:"poolgroup"`
 	CouchConfig CouchConfig              `toml:"couch"`
 	KafkaConfig KafkaConfig              `toml:"kafka"`
+	// Most memory all worker checkpoints may take, 0 for no limit
+	CheckpointMemoryMB int `toml:"checkpoint_memory_mb"`
 }
 
 type KafkaConfig struct {
@@ -92,7 +94,7 @@ func startInvoker() int {
 	}()
 
 	// Start fixed group of workers.
-	workers, err := workerpool.NewWorkerPool(config.PoolConfig)
+	workers, err := workerpool.NewWorkerPool(config.PoolConfig, config.CheckpointMemoryMB<<20)
 	if err != nil {
 		printError(err)
 		return 1
@@ -157,19 +159,20 @@ func consumeMessage(activation *types.ActivationMessage, functionStorage storage
 	}).Debug("fetched function")
 
 	// Schedule function
-	result, err := workers.Run(function, activation.Parameters)
+	result, logs, err := workers.Run(function, activation.Parameters)
 	if err != nil {
 		return fmt.Errorf("could not run function %s: %s", function.Name, err)
 	}
 
 	messageLogger.WithFields(log.Fields{
 		"result": result,
+		"logs":   len(logs),
 	}).Debug("function run complete")
 
 	// Send ack
 	if activation.Blocking {
 		go func() {
-			err := messenger.SendResult(activation, function, result)
+			err := messenger.SendResult(activation, function, result, logs)
 			if err != nil {
 				log.Errorf("could not send result %s, %s: %s", function.Name, activation.ActivationID, err)
 			}
@@ -186,7 +189,7 @@ func consumeMessage(activation *types.ActivationMessage, functionStorage storage
 	}()
 
 	go func() {
-		err := functionStorage.StoreActivation(activation, function, result)
+		err := functionStorage.StoreActivation(activation, function, result, logs)
 		if err != nil {
 			log.Error(fmt.Errorf("could not store activation %s, %s: %s", function.Name, activation.ActivationID, err))
 		}
@@ -82,10 +82,10 @@ func (m *Messenger) SendCompletion(activation *types.ActivationMessage, function
 	return m.provider.WriteMessage(controllerTopic, rawCompletion)
 }
 
-func (m *Messenger) SendResult(activation *types.ActivationMessage, function *types.FunctionDoc, result interface{}) error {
+func (m *Messenger) SendResult(activation *types.ActivationMessage, function *types.FunctionDoc, result interface{}, logs []string) error {
 	controllerTopic := fmt.Sprintf("completed%s", activation.Controller.AsString)
 	completion := types.CompletionResponseMessage{
-		Response:      types.GenerateResponse(activation, function, result),
+		Response:      types.GenerateResponse(activation, function, result, logs),
 		TransactionID: activation.TransactionID,
 	}
 
@@ -17,7 +17,7 @@ const defaultCacheSize int = 64
 
 type FunctionStorage interface {
 	GetFunction(path string, name string) (*types.FunctionDoc, error)
-	StoreActivation(*types.ActivationMessage, *types.FunctionDoc, interface{}) error
+	StoreActivation(*types.ActivationMessage, *types.FunctionDoc, interface{}, []string) error
 }
 
 type functionStorage struct {
@@ -81,13 +81,13 @@ func (s functionStorage) GetFunction(path string, name string) (*types.FunctionD
 	return &function, nil
 }
 
-func (s functionStorage) StoreActivation(activationMessage *types.ActivationMessage, function *types.FunctionDoc, result interface{}) error {
+func (s functionStorage) StoreActivation(activationMessage *types.ActivationMessage, function *types.FunctionDoc, result interface{}, logs []string) error {
 	docID := fmt.Sprintf("%s/%s", function.Namespace, activationMessage.ActivationID)
 
 	activation := types.ActivationDoc{
 		ID:       docID,
 		Updated:  int(time.Now().Unix()),
-		Response: types.GenerateResponse(activationMessage, function, result),
+		Response: types.GenerateResponse(activationMessage, function, result, logs),
 	}
 
 	activationsJSON, err := json.Marshal(&activation)
@@ -90,8 +90,11 @@ type ResponseValue struct {
 	StatusCode int         `json:"statusCode"`
 }
 
-func GenerateResponse(activationMessage *ActivationMessage, function *FunctionDoc, result interface{}) Response {
-	logs := make([]interface{}, 0)
+func GenerateResponse(activationMessage *ActivationMessage, function *FunctionDoc, result interface{}, logLines []string) Response {
+	logs := make([]interface{}, 0, len(logLines))
+	for _, line := range logLines {
+		logs = append(logs, line)
+	}
 	return Response{
 		ActivationID: activationMessage.ActivationID,
 		Annotations:  function.Annotations,
@@ -167,9 +170,33 @@ func (f *FunctionDoc) CodeString() (string, error) {
 
 type Limits struct {
 	Concurrency int `json:"concurrency"`
-	Logs        int `json:"logs"`
-	Memory      int `json:"memory"`
-	Timeout     int `json:"timeout"`
+	// Logs is in megabytes
+	Logs    int `json:"logs"`
+	Memory  int `json:"memory"`
+	Timeout int `json:"timeout"`
+}
+
+// OpenWhisk's default log limit, in megabytes
+const defaultLogsLimit = 10
+
+// LogBytes is the most bytes of logs an activation of the function keeps
+func (l Limits) LogBytes() int {
+	if l.Logs <= 0 {
+		return defaultLogsLimit << 20
+	}
+	return l.Logs << 20
+}
+
+// OpenWhisk's default time limit, in milliseconds
+const defaultTimeout = 60000
+
+// TimeoutDuration is the longest an activation of the function may take.
+// Timeout is in milliseconds.
+func (l Limits) TimeoutDuration() time.Duration {
+	if l.Timeout <= 0 {
+		return defaultTimeout * time.Millisecond
+	}
+	return time.Duration(l.Timeout) * time.Millisecond
 }
 
 type Annotation struct {
@@ -1,11 +1,14 @@
 package workerpool
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"sync"
 	"time"
 
+	"github.com/ostenbom/refunction/controller"
 	"github.com/ostenbom/refunction/invoker/types"
 	"github.com/ostenbom/refunction/worker"
 	log "github.com/sirupsen/logrus"
@@ -13,6 +16,10 @@ import (
 
 const defaultDecommissionTime = time.Second * 20
 
+// Workers are checkpointed here after loading a function, and restored to it
+// between requests to that function
+const functionCheckpoint = "function-loaded"
+
 type Scheduler struct {
 	runtime          string
 	workers          map[string]*ScheduleWorker
@@ -27,6 +34,13 @@ type ScheduleWorker struct {
 	worker   *worker.Worker
 	runTime  time.Time
 	function string
+	// concurrency is how many requests the loaded function may be sent at
+	// once, and inFlight how many it has been. Both are guarded by the
+	// scheduler's mutex.
+	concurrency int
+	inFlight    int
+	// Testing
+	handleRequest func(request interface{}) (interface{}, error)
 }
 
 func NewScheduler(workers []*worker.Worker, runtime string) *Scheduler {
@@ -56,7 +70,7 @@ func NewFakeScheduler(workers map[string]*ScheduleWorker, undeployed []string, d
 	}
 }
 
-func (s *Scheduler) Run(function *types.FunctionDoc, request interface{}) (interface{}, error) {
+func (s *Scheduler) Run(function *types.FunctionDoc, request interface{}) (interface{}, []string, error) {
 	functionLogger := log.WithFields(log.Fields{
 		"request":      request,
 		"functionID":   function.ID,
@@ -65,15 +79,17 @@ func (s *Scheduler) Run(function *types.FunctionDoc, request interface{}) (inter
 	})
 	name, schedulable, exists := s.RunDeployedFunction(function.ID)
 	if exists {
-		schedulable.MarkRunTime()
-
 		functionLogger = functionLogger.WithFields(log.Fields{"worker": name})
 		functionLogger.Debug("running on deployed worker")
-		result, err := schedulable.worker.SendRequest(request)
-		functionLogger.WithFields(log.Fields{"result": result}).Debug("response received")
+		result, logs, err := schedulable.SendRequest(function, request)
+		logResponse(functionLogger, result, err)
 
-		s.RunComplete(name)
-		return result, err
+		// Restoring the worker would end its other requests
+		if s.RequestComplete(name) {
+			s.resetOrDecommission(name, schedulable)
+			s.RunComplete(name)
+		}
+		return result, logs, err
 	}
 
 	s.mux.Lock()
@@ -85,19 +101,39 @@ func (s *Scheduler) Run(function *types.FunctionDoc, request interface{}) (inter
 		functionLogger = functionLogger.WithFields(log.Fields{"worker": name, "code": functionCode})
 		functionLogger.Debug("loading function")
 		if err != nil {
-			return "", err
+			return "", nil, err
+		}
+		err = schedulable.LoadFunction(function, functionCode)
+		if err != nil {
+			functionLogger.WithFields(log.Fields{"error": err}).Error("could not load function")
+			// Restored to the bare runtime, the worker can load the next function
+			s.resetOrDecommission(name, schedulable)
+			s.RunAborted(name)
+			return "", nil, err
+		}
+		checkpointErr := schedulable.CheckpointFunction()
+		if checkpointErr != nil {
+			functionLogger.WithFields(log.Fields{"error": checkpointErr}).Error("could not checkpoint loaded function")
+		}
+		// Without its own checkpoint the worker cannot be reused for the
+		// function, so it is not sent further requests either
+		if checkpointErr == nil {
+			s.mux.Lock()
+			schedulable.SetFunction(function.ID)
+			s.mux.Unlock()
 		}
-		schedulable.worker.SendFunction(functionCode)
 		functionLogger.Debug("sending request")
 		// TODO: Set after request response?
 		schedulable.MarkRunTime()
-		result, err := schedulable.worker.SendRequest(request)
-		functionLogger.WithFields(log.Fields{"result": result}).Debug("response received")
+		result, logs, err := schedulable.SendRequest(function, request)
+		logResponse(functionLogger, result, err)
 
-		schedulable.SetFunction(function.ID)
-		s.RunComplete(name)
+		if s.RequestComplete(name) {
+			s.resetOrDecommission(name, schedulable)
+			s.RunComplete(name)
+		}
 		s.ScheduleDecommission(name, schedulable)
-		return result, err
+		return result, logs, err
 	} else {
 		s.mux.Unlock()
 		s.ForceDecomission()
@@ -105,6 +141,38 @@ func (s *Scheduler) Run(function *types.FunctionDoc, request interface{}) (inter
 	}
 }
 
+// resetOrDecommission returns a worker to its loaded function for the next
+// request. Workers without a function, or that fail to reset, are restored to
+// the bare runtime instead. Either restore also stops a function still running
+// a request that timed out.
+func (s *Scheduler) resetOrDecommission(name string, schedulable *ScheduleWorker) {
+	if schedulable.GetFunction() != "" {
+		err := schedulable.Reset()
+		if err == nil {
+			return
+		}
+		log.WithFields(log.Fields{"worker": name, "error": err}).Error("could not restore function checkpoint")
+		schedulable.SetFunction("")
+	}
+
+	err := schedulable.Decomission()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Hung container!: could not decomission worker %s: %s\n", name, err)
+	}
+}
+
+func logResponse(functionLogger *log.Entry, result interface{}, err error) {
+	var awaitErr *controller.AwaitMessageError
+	if errors.As(err, &awaitErr) {
+		functionLogger.WithFields(log.Fields{"error": err}).Warn("function did not respond in time")
+		return
+	}
+	functionLogger.WithFields(log.Fields{"result": result}).Debug("response received")
+}
+
+// RunDeployedFunction finds a worker with function f loaded for a request.
+// Idle workers are used first, then running ones with fewer requests in
+// flight than their function's concurrency limit.
 func (s *Scheduler) RunDeployedFunction(f string) (string, *ScheduleWorker, bool) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
@@ -112,9 +180,20 @@ func (s *Scheduler) RunDeployedFunction(f string) (string, *ScheduleWorker, bool
 		if s.workers[d].GetFunction() == f {
 			s.deployed = append(s.deployed[:i], s.deployed[i+1:]...)
 			s.running = append(s.running, d)
+			s.workers[d].inFlight = 1
+			s.workers[d].MarkRunTime()
 			return d, s.workers[d], true
 		}
 	}
+	// Running workers with nothing in flight are being reset
+	for _, r := range s.running {
+		sw := s.workers[r]
+		if sw.GetFunction() == f && sw.inFlight > 0 && sw.inFlight < sw.concurrency {
+			sw.inFlight++
+			sw.MarkRunTime()
+			return r, sw, true
+		}
+	}
 	return "", nil, false
 }
 
@@ -122,12 +201,25 @@ func (s *Scheduler) RunUndeployed() (string, *ScheduleWorker) {
 	var next string
 	next, s.undeployed = s.undeployed[0], s.undeployed[1:]
 	s.running = append(s.running, next)
+	s.workers[next].inFlight = 1
 	return next, s.workers[next]
 }
 
+// RequestComplete counts a request to the running worker as done. It is true
+// when none are left in flight, and the worker must then be reset before
+// RunComplete gives it back.
+func (s *Scheduler) RequestComplete(name string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	sw := s.workers[name]
+	sw.inFlight--
+	return sw.inFlight <= 0
+}
+
 func (s *Scheduler) RunComplete(name string) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
+	s.workers[name].inFlight = 0
 	var nameIndex int
 	for i, w := range s.running {
 		if w == name {
@@ -139,6 +231,20 @@ func (s *Scheduler) RunComplete(name string) {
 	s.deployed = append(s.deployed, name)
 }
 
+// RunAborted moves a running worker without a function back to undeployed
+func (s *Scheduler) RunAborted(name string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.workers[name].inFlight = 0
+	for i, w := range s.running {
+		if w == name {
+			s.running = append(s.running[:i], s.running[i+1:]...)
+			break
+		}
+	}
+	s.undeployed = append(s.undeployed, name)
+}
+
 func (s *Scheduler) ScheduleDecommission(name string, schedulable *ScheduleWorker) {
 	go func() {
 		for {
@@ -235,6 +341,72 @@ func (sw *ScheduleWorker) Decomission() error {
 	return sw.worker.Restore()
 }
 
+// CheckpointFunction checkpoints the worker with its function loaded,
+// replacing the checkpoint of any previous function
+func (sw *ScheduleWorker) CheckpointFunction() error {
+	// Testing
+	if sw.worker == nil {
+		return nil
+	}
+
+	return sw.worker.TakeNamedCheckpoint(functionCheckpoint)
+}
+
+// Reset restores the worker to the checkpoint taken by CheckpointFunction
+func (sw *ScheduleWorker) Reset() error {
+	// Testing
+	if sw.worker == nil {
+		return nil
+	}
+
+	return sw.worker.RestoreToNamed(functionCheckpoint)
+}
+
+// LoadFunction loads the function's code in the worker, giving up after the
+// function's time limit, and applies its concurrency limit. Runtimes that do
+// not serve requests concurrently are sent one at a time.
+func (sw *ScheduleWorker) LoadFunction(function *types.FunctionDoc, code string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), function.Limits.TimeoutDuration())
+	defer cancel()
+
+	err := sw.worker.SendFunctionContext(ctx, code)
+	if err != nil {
+		return err
+	}
+
+	concurrency := 1
+	if sw.worker.Capabilities().Concurrent() && function.Limits.Concurrency > 1 {
+		concurrency = function.Limits.Concurrency
+	}
+	sw.worker.SetConcurrency(concurrency)
+	sw.concurrency = concurrency
+	return nil
+}
+
+// SendRequest sends request to the worker's function, and returns its result
+// and up to the function's log limit of what it logged. A function that does
+// not respond within its time limit gets an AwaitMessageError, and the worker
+// must be restored before it is used again.
+func (sw *ScheduleWorker) SendRequest(function *types.FunctionDoc, request interface{}) (interface{}, []string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), function.Limits.TimeoutDuration())
+	defer cancel()
+
+	// Testing
+	if sw.worker == nil {
+		result, err := sw.handleRequest(request)
+		return result, nil, err
+	}
+
+	sw.worker.SetLogLimit(function.Limits.LogBytes())
+	result, lines, err := sw.worker.SendRequestWithLogs(ctx, request)
+
+	logs := make([]string, len(lines))
+	for i, line := range lines {
+		logs[i] = line.String()
+	}
+	return result, logs, err
+}
+
 func (sw *ScheduleWorker) MarkRunTime() {
 	sw.runTime = time.Now()
 }
@@ -249,6 +421,16 @@ func (sw *ScheduleWorker) GetFunction() string {
 
 // Functions for testing
 
+// NewFakeScheduleWorker is a worker with a function loaded that may be sent
+// concurrency requests at once, which handle answers
+func NewFakeScheduleWorker(function string, concurrency int, handle func(request interface{}) (interface{}, error)) *ScheduleWorker {
+	return &ScheduleWorker{
+		function:      function,
+		concurrency:   concurrency,
+		handleRequest: handle,
+	}
+}
+
 func (s *Scheduler) DeployedWorkers() []string {
 	s.mux.Lock()
 	defer s.mux.Unlock()
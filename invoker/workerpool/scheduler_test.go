@@ -6,6 +6,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"github.com/ostenbom/refunction/invoker/types"
 	. "github.com/ostenbom/refunction/invoker/workerpool"
 )
 
@@ -73,6 +74,14 @@ var _ = Describe("Scheduler", func() {
 		})
 	})
 
+	Describe("RunAborted", func() {
+		It("moves it from running to undeployed", func() {
+			name, _ := scheduler.RunUndeployed()
+			scheduler.RunAborted(name)
+			IsIn(scheduler, name, true, false, false)
+		})
+	})
+
 	Describe("ScheduleDecommission", func() {
 		It("moves from deployed to undeployed after decomissionTime", func() {
 			name, sw := scheduler.RunUndeployed()
@@ -99,6 +108,99 @@ var _ = Describe("Scheduler", func() {
 		})
 	})
 
+	Describe("Run", func() {
+		var (
+			function  *types.FunctionDoc
+			started   chan string
+			release   chan struct{}
+			responses chan interface{}
+		)
+
+		// handler answers requests with the worker's name once released
+		handler := func(name string) func(interface{}) (interface{}, error) {
+			return func(request interface{}) (interface{}, error) {
+				started <- name
+				<-release
+				return request, nil
+			}
+		}
+
+		deploy := func(concurrency int, names ...string) {
+			workers := make(map[string]*ScheduleWorker)
+			for _, name := range names {
+				workers[name] = NewFakeScheduleWorker(function.ID, concurrency, handler(name))
+			}
+			scheduler = NewFakeScheduler(workers, names, decommissionTime)
+			for range names {
+				name, _ := scheduler.RunUndeployed()
+				scheduler.RunComplete(name)
+			}
+		}
+
+		run := func(request string) {
+			go func() {
+				defer GinkgoRecover()
+				response, _, err := scheduler.Run(function, request)
+				Expect(err).NotTo(HaveOccurred())
+				responses <- response
+			}()
+		}
+
+		BeforeEach(func() {
+			function = &types.FunctionDoc{ID: "echo", Limits: types.Limits{Concurrency: 2}}
+			started = make(chan string, 2)
+			release = make(chan struct{})
+			responses = make(chan interface{}, 2)
+		})
+
+		It("sends overlapping requests to one worker up to its concurrency", func() {
+			deploy(2, "one")
+			run("first")
+			run("second")
+
+			Eventually(started).Should(Receive(Equal("one")))
+			Eventually(started).Should(Receive(Equal("one")))
+			IsIn(scheduler, "one", false, false, true)
+
+			close(release)
+			var first, second interface{}
+			Eventually(responses).Should(Receive(&first))
+			Eventually(responses).Should(Receive(&second))
+			Expect([]interface{}{first, second}).To(ConsistOf("first", "second"))
+			IsIn(scheduler, "one", false, true, false)
+		})
+
+		It("keeps the worker running until its last request completes", func() {
+			deploy(2, "one")
+			run("first")
+			run("second")
+			Eventually(started).Should(Receive())
+			Eventually(started).Should(Receive())
+
+			release <- struct{}{}
+			Eventually(responses).Should(Receive())
+			IsIn(scheduler, "one", false, false, true)
+
+			release <- struct{}{}
+			Eventually(responses).Should(Receive())
+			IsIn(scheduler, "one", false, true, false)
+		})
+
+		It("sends one request at a time to workers with a concurrency of one", func() {
+			deploy(1, "one", "two")
+			run("first")
+			run("second")
+
+			var first, second string
+			Eventually(started).Should(Receive(&first))
+			Eventually(started).Should(Receive(&second))
+			Expect([]string{first, second}).To(ConsistOf("one", "two"))
+
+			close(release)
+			Eventually(responses).Should(Receive())
+			Eventually(responses).Should(Receive())
+		})
+	})
 })
 
 func IsIn(s *Scheduler, name string, inUndeployed, inDeployed, inRunning bool) {
@@ -18,7 +18,9 @@ import (
 	"github.com/BurntSushi/toml"
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/namespaces"
+	"github.com/ostenbom/refunction/controller"
 	"github.com/ostenbom/refunction/invoker/types"
+	"github.com/ostenbom/refunction/state"
 	"github.com/ostenbom/refunction/worker"
 	"github.com/ostenbom/refunction/worker/containerdrunner"
 )
@@ -31,13 +33,44 @@ type WorkerPool struct {
 	schedulers map[string]*Scheduler
 }
 
+// The message protocol versions of runtime images the pool can run. Runtimes
+// from before versions were reported speak version 0.
+const (
+	MinProtocolVersion = 0
+	MaxProtocolVersion = controller.ProtocolVersion
+)
+
+// UnsupportedProtocolError is returned for runtime images that speak a
+// version of the message protocol the pool cannot run
+type UnsupportedProtocolError struct {
+	Runtime string
+	Version int
+}
+
+func (e *UnsupportedProtocolError) Error() string {
+	return fmt.Sprintf("runtime %s speaks protocol version %d, supported versions are %d to %d", e.Runtime, e.Version, MinProtocolVersion, MaxProtocolVersion)
+}
+
+// CheckCapabilities returns an UnsupportedProtocolError if the capabilities
+// a runtime reported on activation have a protocol version the pool cannot
+// run
+func CheckCapabilities(runtime string, capabilities controller.Capabilities) error {
+	if capabilities.ProtocolVersion < MinProtocolVersion || capabilities.ProtocolVersion > MaxProtocolVersion {
+		return &UnsupportedProtocolError{Runtime: runtime, Version: capabilities.ProtocolVersion}
+	}
+	return nil
+}
+
 type GroupConfig struct {
 	Size        int
 	Runtime     string
 	TargetLayer string `toml:"target_layer"`
 }
 
-func NewWorkerPool(groups []GroupConfig) (*WorkerPool, error) {
+// NewWorkerPool starts and activates the workers of each group. Their
+// checkpoints may take up to checkpointMemoryLimit bytes between them, or any
+// amount if it is 0.
+func NewWorkerPool(groups []GroupConfig, checkpointMemoryLimit int) (*WorkerPool, error) {
 	runDir, err := ioutil.TempDir("", "refunction")
 	if err != nil {
 		return nil, fmt.Errorf("could not create temp dir for worker pool: %s", err)
@@ -72,6 +105,9 @@ func NewWorkerPool(groups []GroupConfig) (*WorkerPool, error) {
 		return nil, fmt.Errorf("could not connect to containerd client: %s", err)
 	}
 
+	// Workers of one runtime checkpoint mostly identical pages, and all
+	// workers count towards the limit
+	pages := state.NewLimitedPageStore(checkpointMemoryLimit)
 	schedulers := make(map[string]*Scheduler)
 	for _, group := range groups {
 		ctx := namespaces.WithNamespace(context.Background(), "refunction-workerpool-"+group.Runtime)
@@ -91,6 +127,9 @@ func NewWorkerPool(groups []GroupConfig) (*WorkerPool, error) {
 			if err != nil {
 				return nil, fmt.Errorf("could not start worker in pool: %s", err)
 			}
+			w.SetPageStore(pages)
+			// Runtimes that do not support it stay on line messages
+			w.WithFramedProtocol()
 			workers[i] = w
 		}
 
@@ -103,6 +142,10 @@ func NewWorkerPool(groups []GroupConfig) (*WorkerPool, error) {
 			if err != nil {
 				return nil, fmt.Errorf("could not activate worker: %s", err)
 			}
+			err = CheckCapabilities(group.Runtime, w.Capabilities())
+			if err != nil {
+				return nil, fmt.Errorf("could not use worker: %w", err)
+			}
 		}
 
 		schedulers[group.Runtime] = NewScheduler(workers, group.Runtime)
@@ -147,7 +190,9 @@ func NewContainerdServer(runDir string, config containerdrunner.Config) (*exec.C
 	return cmd, nil
 }
 
-func (p *WorkerPool) Run(function *types.FunctionDoc, request interface{}) (interface{}, error) {
+// Run runs the function on a worker of its runtime, and returns its result and
+// the lines it logged
+func (p *WorkerPool) Run(function *types.FunctionDoc, request interface{}) (interface{}, []string, error) {
 	for runtime, s := range p.schedulers {
 		// Fuzzy for now. OpenWhisk calls python3 python:3 for example
 		if strings.Contains(function.Executable.Kind, runtime) {
@@ -155,7 +200,7 @@ func (p *WorkerPool) Run(function *types.FunctionDoc, request interface{}) (inte
 		}
 	}
 
-	return nil, fmt.Errorf("no such kind of runtime: %s", function.Executable.Kind)
+	return nil, nil, fmt.Errorf("no such kind of runtime: %s", function.Executable.Kind)
 }
 
 func (p *WorkerPool) Close() error {
@@ -0,0 +1,32 @@
+package workerpool_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ostenbom/refunction/controller"
+	. "github.com/ostenbom/refunction/invoker/workerpool"
+)
+
+var _ = Describe("CheckCapabilities", func() {
+	It("accepts runtimes speaking a supported protocol version", func() {
+		capabilities := controller.Capabilities{ProtocolVersion: controller.ProtocolVersion, Runtime: "python"}
+		Expect(CheckCapabilities("python", capabilities)).To(Succeed())
+	})
+
+	It("accepts runtimes from before protocol versions were reported", func() {
+		Expect(CheckCapabilities("python", controller.Capabilities{})).To(Succeed())
+	})
+
+	It("rejects runtimes speaking a newer protocol version", func() {
+		capabilities := controller.Capabilities{ProtocolVersion: 99}
+		err := CheckCapabilities("python", capabilities)
+		Expect(err).To(MatchError(ContainSubstring("runtime python speaks protocol version 99")))
+
+		var unsupported *UnsupportedProtocolError
+		Expect(errors.As(err, &unsupported)).To(BeTrue())
+		Expect(unsupported.Version).To(Equal(99))
+	})
+})
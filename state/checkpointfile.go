@@ -0,0 +1,574 @@
+package state
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+
+	"github.com/ostenbom/refunction/controller/ptrace"
+	"golang.org/x/sys/unix"
+)
+
+// Checkpoint file format. All integers are little-endian.
+//
+//   header:    magic "RFNCKPT\x00" | version uint32 | pid int64 | sections uint32
+//   section:   kind uint32 | length uint64 | body [length]byte
+//
+// Section bodies, one section per item:
+//
+//   memory (1):     start int64 | end int64 | processOffset int64 | perms uint8 |
+//                   majorDevice uint32 | minorDevice uint32 | iNode uint64 |
+//                   name string | content bytes
+//   registers (2):  tid int64 | syscall.PtraceRegs
+//   fd (3):         name string | link string | fdInfo string
+//   rlimit (4):     resource uint32 | cur uint64 | max uint64
+//   xstate (5):     tid int64 | xstate bytes
+//   process (6):    pid int64 | startTime uint64
+//   sigmask (7):    tid int64 | blocked uint64 | pending uint64
+//   sigaction (8):  signal uint32 | handler uint64 | flags uint64 |
+//                   restorer uint64 | mask uint64
+//   signals (9):    ignored uint64 | sharedPending uint64
+//   itimer (10):    which uint32 | ptrace.Itimerval
+//   timer (11):     id int32 | ptrace.Itimerspec
+//   fs (12):        umask uint32 | cwd string
+//   credentials (13): tid int64 | uids [4]uint32 | gids [4]uint32 |
+//                   caps [5]uint64 | groups uint32 | [groups]uint32
+//
+// string and bytes are a uint64 length followed by the raw data. perms holds
+// the r, w, x and s bits of the mapping from lowest to highest. Readers skip
+// sections of a kind they do not know, so new kinds can be added without
+// changing the version.
+
+const checkpointVersion uint32 = 1
+
+var checkpointMagic = [8]byte{'R', 'F', 'N', 'C', 'K', 'P', 'T', 0}
+
+const (
+	sectionMemory uint32 = iota + 1
+	sectionRegisters
+	sectionFileDescriptor
+	sectionRlimit
+	sectionXstate
+	sectionProcess
+	sectionSigmask
+	sectionSigaction
+	sectionSignals
+	sectionItimer
+	sectionTimer
+	sectionFs
+	sectionCredentials
+)
+
+const (
+	permReadable uint8 = 1 << iota
+	permWritable
+	permExecutable
+	permShared
+)
+
+type checkpointEncoder struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (e *checkpointEncoder) write(data interface{}) {
+	if e.err != nil {
+		return
+	}
+	e.err = binary.Write(e.w, binary.LittleEndian, data)
+	if e.err == nil {
+		e.n += int64(binary.Size(data))
+	}
+}
+
+func (e *checkpointEncoder) writeBytes(data []byte) {
+	e.write(uint64(len(data)))
+	if e.err != nil {
+		return
+	}
+	written, err := e.w.Write(data)
+	e.n += int64(written)
+	e.err = err
+}
+
+// writePages writes the saved pages of m as a single bytes field
+func (e *checkpointEncoder) writePages(m *Memory) {
+	e.write(uint64(len(m.pages) * os.Getpagesize()))
+	for i := range m.pages {
+		if e.err != nil {
+			return
+		}
+		written, err := e.w.Write(m.page(i))
+		e.n += int64(written)
+		e.err = err
+	}
+}
+
+func (e *checkpointEncoder) section(kind uint32, length int) {
+	e.write(kind)
+	e.write(uint64(length))
+}
+
+func bytesLength(data []byte) int {
+	return 8 + len(data)
+}
+
+// WriteTo writes the checkpoint to w in the checkpoint file format
+func (s *State) WriteTo(w io.Writer) (int64, error) {
+	buffered := bufio.NewWriter(w)
+	e := &checkpointEncoder{w: buffered}
+
+	sections := len(s.memoryLocations) + len(s.fileDescriptors) + len(s.rlimits) + len(s.processes) + len(s.sigactions) + len(s.itimers) + len(s.posixTimers) + 1
+	for _, regState := range s.registers {
+		sections += 2
+		if regState.xstate != nil {
+			sections++
+		}
+		if regState.credentials != nil {
+			sections++
+		}
+	}
+	if s.cwd != "" {
+		sections++
+	}
+	e.write(checkpointMagic)
+	e.write(checkpointVersion)
+	e.write(int64(s.pid))
+	e.write(uint32(sections))
+
+	for _, m := range s.memoryLocations {
+		name := []byte(m.name)
+		e.section(sectionMemory, 8*3+1+4*2+8+bytesLength(name)+8+len(m.pages)*os.Getpagesize())
+		e.write([]int64{m.startOffset, m.endOffset, m.processOffset})
+		e.write(m.perms())
+		e.write([]uint32{uint32(m.majorDevice), uint32(m.minorDevice)})
+		e.write(uint64(m.iNode))
+		e.writeBytes(name)
+		e.writePages(m)
+	}
+
+	for tid, regState := range s.registers {
+		e.section(sectionRegisters, 8+binary.Size(regState.regs))
+		e.write(int64(tid))
+		e.write(regState.regs)
+
+		e.section(sectionSigmask, 8*3)
+		e.write(int64(tid))
+		e.write([]uint64{regState.blocked, regState.pending})
+
+		if regState.xstate != nil {
+			e.section(sectionXstate, 8+bytesLength(regState.xstate))
+			e.write(int64(tid))
+			e.writeBytes(regState.xstate)
+		}
+
+		if creds := regState.credentials; creds != nil {
+			e.section(sectionCredentials, 8+4*8+8*5+4+4*len(creds.groups))
+			e.write(int64(tid))
+			e.write(creds.uids)
+			e.write(creds.gids)
+			e.write(creds.caps)
+			e.write(uint32(len(creds.groups)))
+			e.write(creds.groups)
+		}
+	}
+
+	for _, fd := range s.fileDescriptors {
+		name, link, fdInfo := []byte(fd.name), []byte(fd.link), []byte(fd.fdInfo)
+		e.section(sectionFileDescriptor, bytesLength(name)+bytesLength(link)+bytesLength(fdInfo))
+		e.writeBytes(name)
+		e.writeBytes(link)
+		e.writeBytes(fdInfo)
+	}
+
+	for resource, rlimit := range s.rlimits {
+		e.section(sectionRlimit, 4+8*2)
+		e.write(uint32(resource))
+		e.write([]uint64{rlimit.Cur, rlimit.Max})
+	}
+
+	for sig, action := range s.sigactions {
+		e.section(sectionSigaction, 4+binary.Size(action))
+		e.write(uint32(sig))
+		e.write(action)
+	}
+
+	e.section(sectionSignals, 8*2)
+	e.write([]uint64{s.ignoredSignals, s.sharedPending})
+
+	for which, value := range s.itimers {
+		e.section(sectionItimer, 4+binary.Size(value))
+		e.write(uint32(which))
+		e.write(value)
+	}
+
+	for id, value := range s.posixTimers {
+		e.section(sectionTimer, 4+binary.Size(value))
+		e.write(int32(id))
+		e.write(value)
+	}
+
+	if s.cwd != "" {
+		cwd := []byte(s.cwd)
+		e.section(sectionFs, 4+bytesLength(cwd))
+		e.write(s.umask)
+		e.writeBytes(cwd)
+	}
+
+	for pid, startTime := range s.processes {
+		e.section(sectionProcess, 8*2)
+		e.write(int64(pid))
+		e.write(startTime)
+	}
+
+	if e.err != nil {
+		return e.n, fmt.Errorf("could not write checkpoint: %s", e.err)
+	}
+
+	err := buffered.Flush()
+	if err != nil {
+		return e.n, fmt.Errorf("could not flush checkpoint: %s", err)
+	}
+
+	return e.n, nil
+}
+
+// Fields other than memory content are far smaller than this. Longer ones
+// come from a corrupt file.
+const maxFieldLength = 1 << 20
+
+type checkpointDecoder struct {
+	r   io.Reader
+	err error
+}
+
+// checkLength fails the decoder if a field of length bytes is longer than max
+// or than what is left of the section being read
+func (d *checkpointDecoder) checkLength(length uint64, max uint64) bool {
+	if d.err != nil {
+		return false
+	}
+	if section, ok := d.r.(*io.LimitedReader); ok && length > uint64(section.N) {
+		d.err = fmt.Errorf("field of %d bytes overruns its section, which has %d left", length, section.N)
+		return false
+	}
+	if length > max {
+		d.err = fmt.Errorf("field of %d bytes is longer than %d", length, max)
+		return false
+	}
+	return true
+}
+
+func (d *checkpointDecoder) read(data interface{}) {
+	if d.err != nil {
+		return
+	}
+	d.err = binary.Read(d.r, binary.LittleEndian, data)
+}
+
+func (d *checkpointDecoder) readBytes() []byte {
+	var length uint64
+	d.read(&length)
+	if d.err != nil {
+		return nil
+	}
+	if length == 0 || !d.checkLength(length, maxFieldLength) {
+		return nil
+	}
+
+	data := make([]byte, length)
+	_, d.err = io.ReadFull(d.r, data)
+	return data
+}
+
+// readMappedBytes reads a bytes field of at most max bytes into a buffer from
+// mapBuffer
+func (d *checkpointDecoder) readMappedBytes(max uint64) []byte {
+	var length uint64
+	d.read(&length)
+	if !d.checkLength(length, max) {
+		return nil
+	}
+
+	data, err := mapBuffer(int(length))
+	if err != nil {
+		d.err = err
+		return nil
+	}
+	_, d.err = io.ReadFull(d.r, data)
+	return data
+}
+
+// ReadState reads a checkpoint written by WriteTo, keeping its pages in
+// store. The returned state refers to the process pid, and has no trace tasks
+// until AttachTasks is called.
+func ReadState(r io.Reader, pid int, store *PageStore) (*State, error) {
+	d := &checkpointDecoder{r: bufio.NewReader(r)}
+
+	var magic [8]byte
+	var version uint32
+	var checkpointPid int64
+	var sections uint32
+	d.read(&magic)
+	d.read(&version)
+	d.read(&checkpointPid)
+	d.read(&sections)
+	if d.err != nil {
+		return nil, fmt.Errorf("could not read checkpoint header: %s", d.err)
+	}
+	if magic != checkpointMagic {
+		return nil, errors.New("not a checkpoint file")
+	}
+	// Zeroed headers have no version
+	if version < 1 || version > checkpointVersion {
+		return nil, fmt.Errorf("unsupported checkpoint version %d", version)
+	}
+
+	state := &State{
+		pid:         pid,
+		registers:   make(map[int]TaskRegState),
+		rlimits:     make(Rlimits),
+		processes:   make(map[int]uint64),
+		sigactions:  make(map[int]ptrace.Sigaction),
+		itimers:     make(map[int]ptrace.Itimerval),
+		posixTimers: make(map[int]ptrace.Itimerspec),
+		store:       store,
+	}
+	var saved []*Memory
+	var contents [][]byte
+	defer func() {
+		unmapBuffers(contents)
+	}()
+
+	for i := uint32(0); i < sections; i++ {
+		var kind uint32
+		var length uint64
+		d.read(&kind)
+		d.read(&length)
+		if d.err != nil {
+			return nil, fmt.Errorf("could not read section header: %s", d.err)
+		}
+
+		body := &checkpointDecoder{r: io.LimitReader(d.r, int64(length))}
+		switch kind {
+		case sectionMemory:
+			memory, content := body.readMemory()
+			state.memoryLocations = append(state.memoryLocations, memory)
+			// Pages are only saved for writable memory, and may not be
+			if !memory.writable || len(content) == 0 {
+				unmapBuffers([][]byte{content})
+				break
+			}
+			saved = append(saved, memory)
+			contents = append(contents, content)
+			if body.err == nil && int64(len(content)) != memory.endOffset-memory.startOffset {
+				return nil, fmt.Errorf("memory at %x has %d bytes saved for %d", memory.startOffset, len(content), memory.endOffset-memory.startOffset)
+			}
+		case sectionRegisters:
+			var tid int64
+			var regs syscall.PtraceRegs
+			body.read(&tid)
+			body.read(&regs)
+			regState := state.registers[int(tid)]
+			regState.regs = &regs
+			state.registers[int(tid)] = regState
+		case sectionXstate:
+			var tid int64
+			body.read(&tid)
+			regState := state.registers[int(tid)]
+			regState.xstate = body.readBytes()
+			state.registers[int(tid)] = regState
+		case sectionFileDescriptor:
+			state.fileDescriptors = append(state.fileDescriptors, &FileDescriptor{
+				name:   string(body.readBytes()),
+				link:   string(body.readBytes()),
+				fdInfo: string(body.readBytes()),
+			})
+		case sectionRlimit:
+			var resource uint32
+			var limits [2]uint64
+			body.read(&resource)
+			body.read(&limits)
+			state.rlimits[int(resource)] = &unix.Rlimit{Cur: limits[0], Max: limits[1]}
+		case sectionProcess:
+			var pid int64
+			var startTime uint64
+			body.read(&pid)
+			body.read(&startTime)
+			state.processes[int(pid)] = startTime
+		case sectionSigmask:
+			var tid int64
+			var masks [2]uint64
+			body.read(&tid)
+			body.read(&masks)
+			regState := state.registers[int(tid)]
+			regState.blocked, regState.pending = masks[0], masks[1]
+			state.registers[int(tid)] = regState
+		case sectionSigaction:
+			var sig uint32
+			var action ptrace.Sigaction
+			body.read(&sig)
+			body.read(&action)
+			state.sigactions[int(sig)] = action
+		case sectionSignals:
+			var signals [2]uint64
+			body.read(&signals)
+			state.ignoredSignals, state.sharedPending = signals[0], signals[1]
+		case sectionItimer:
+			var which uint32
+			var value ptrace.Itimerval
+			body.read(&which)
+			body.read(&value)
+			state.itimers[int(which)] = value
+		case sectionTimer:
+			var id int32
+			var value ptrace.Itimerspec
+			body.read(&id)
+			body.read(&value)
+			state.posixTimers[int(id)] = value
+		case sectionFs:
+			body.read(&state.umask)
+			state.cwd = string(body.readBytes())
+		case sectionCredentials:
+			var tid int64
+			var creds credentials
+			var groups uint32
+			body.read(&tid)
+			body.read(&creds.uids)
+			body.read(&creds.gids)
+			body.read(&creds.caps)
+			body.read(&groups)
+			if body.checkLength(4*uint64(groups), maxFieldLength) {
+				creds.groups = make([]uint32, groups)
+				body.read(creds.groups)
+			}
+			regState := state.registers[int(tid)]
+			regState.credentials = &creds
+			state.registers[int(tid)] = regState
+		}
+		if body.err != nil {
+			return nil, fmt.Errorf("could not read section of kind %d: %s", kind, body.err)
+		}
+
+		// Skip whatever is left, including sections of unknown kinds
+		_, err := io.Copy(ioutil.Discard, body.r)
+		if err != nil {
+			return nil, fmt.Errorf("could not skip section of kind %d: %s", kind, err)
+		}
+	}
+
+	for tid, regState := range state.registers {
+		if regState.regs == nil {
+			return nil, fmt.Errorf("checkpoint has task state but no registers for task %d", tid)
+		}
+	}
+
+	err := state.storeContent(saved, contents)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// readMemory returns the memory location and its saved content, which must
+// be unmapped
+func (d *checkpointDecoder) readMemory() (*Memory, []byte) {
+	var offsets [3]int64
+	var perms uint8
+	var devices [2]uint32
+	var iNode uint64
+	d.read(&offsets)
+	d.read(&perms)
+	d.read(&devices)
+	d.read(&iNode)
+	name := d.readBytes()
+	// Content is saved for the whole mapping or not at all
+	var size uint64
+	if offsets[1] > offsets[0] {
+		size = uint64(offsets[1] - offsets[0])
+	}
+	content := d.readMappedBytes(size)
+
+	return &Memory{
+		name:          string(name),
+		startOffset:   offsets[0],
+		endOffset:     offsets[1],
+		processOffset: offsets[2],
+		readable:      perms&permReadable != 0,
+		writable:      perms&permWritable != 0,
+		executable:    perms&permExecutable != 0,
+		shared:        perms&permShared != 0,
+		majorDevice:   int(devices[0]),
+		minorDevice:   int(devices[1]),
+		iNode:         int(iNode),
+	}, content
+}
+
+func (m *Memory) perms() uint8 {
+	var perms uint8
+	if m.readable {
+		perms |= permReadable
+	}
+	if m.writable {
+		perms |= permWritable
+	}
+	if m.executable {
+		perms |= permExecutable
+	}
+	if m.shared {
+		perms |= permShared
+	}
+	return perms
+}
+
+// AttachTasks gives a state read from a checkpoint file the trace tasks
+// it needs to restore registers. Every checkpointed task must be present.
+func (s *State) AttachTasks(tasks map[int]*ptrace.TraceTask) error {
+	for tid, regState := range s.registers {
+		task, ok := tasks[tid]
+		if !ok {
+			return fmt.Errorf("checkpointed task %d is not attached", tid)
+		}
+		regState.task = task
+		s.registers[tid] = regState
+	}
+
+	return nil
+}
+
+// VerifyMappings checks that the live process still has every mapping of the
+// checkpoint. The heap and stack may have grown, as restoring handles that.
+func (s *State) VerifyMappings() error {
+	liveMemory, err := newMemoryLocations(s.pid)
+	if err != nil {
+		return fmt.Errorf("could not get memory locations to verify: %s", err)
+	}
+
+	for _, m := range s.memoryLocations {
+		var live *Memory
+		for _, l := range liveMemory {
+			if l.name != m.name {
+				continue
+			}
+			if l.startOffset == m.startOffset || (m.name == "[stack]" && l.endOffset == m.endOffset) {
+				live = l
+				break
+			}
+		}
+
+		if live == nil {
+			return fmt.Errorf("mapping %s at %x does not exist in process %d", m.name, m.startOffset, s.pid)
+		}
+		if live.processOffset != m.processOffset || live.majorDevice != m.majorDevice || live.minorDevice != m.minorDevice || live.iNode != m.iNode {
+			return fmt.Errorf("mapping %s at %x is backed by a different file in process %d", m.name, m.startOffset, s.pid)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package state_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os/exec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ostenbom/refunction/controller/ptrace"
+	. "github.com/ostenbom/refunction/state"
+)
+
+var _ = Describe("Checkpoint files", func() {
+	var (
+		cmd   *exec.Cmd
+		tasks map[int]*ptrace.TraceTask
+		saved *State
+		file  []byte
+	)
+
+	BeforeEach(func() {
+		cmd = exec.Command("sleep", "60")
+		Expect(cmd.Start()).To(Succeed())
+		pid := cmd.Process.Pid
+
+		task, err := ptrace.NewTraceTask(pid, pid, ptrace.Options{})
+		Expect(err).NotTo(HaveOccurred())
+		tasks = map[int]*ptrace.TraceTask{pid: task}
+		Expect(task.Stop()).To(Succeed())
+
+		saved, err = NewState(pid, tasks)
+		Expect(err).NotTo(HaveOccurred())
+		saved.SetPageStore(NewPageStore())
+		Expect(saved.SaveWritablePages()).To(Succeed())
+
+		var buffer bytes.Buffer
+		written, err := saved.WriteTo(&buffer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(written).To(BeEquivalentTo(buffer.Len()))
+		file = buffer.Bytes()
+	})
+
+	AfterEach(func() {
+		saved.Release()
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	It("reads back the checkpoint it wrote", func() {
+		loaded, err := ReadState(bytes.NewReader(file), cmd.Process.Pid, NewPageStore())
+		Expect(err).NotTo(HaveOccurred())
+		defer loaded.Release()
+		Expect(loaded.AttachTasks(tasks)).To(Succeed())
+
+		Expect(loaded.MemorySize()).To(Equal(saved.MemorySize()))
+		Expect(loaded.PC()).To(Equal(saved.PC()))
+		Expect(loaded.GetRlimits()).To(Equal(saved.GetRlimits()))
+		Expect(loaded.GetFileDescriptors()).To(HaveLen(len(saved.GetFileDescriptors())))
+
+		// The process has not run since it was checkpointed
+		report, err := loaded.Verify()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Matches()).To(BeTrue(), report.String())
+		Expect(report.PagesVerified).To(BeNumerically(">", 0))
+	})
+
+	It("fails on a truncated file", func() {
+		for _, length := range []int{0, 10, len(file) / 2, len(file) - 1} {
+			_, err := ReadState(bytes.NewReader(file[:length]), cmd.Process.Pid, NewPageStore())
+			Expect(err).To(HaveOccurred(), "truncated to %d bytes", length)
+		}
+	})
+
+	It("fails on a header without a version", func() {
+		corrupt := append([]byte{}, file...)
+		binary.LittleEndian.PutUint32(corrupt[8:], 0)
+
+		_, err := ReadState(bytes.NewReader(corrupt), cmd.Process.Pid, NewPageStore())
+		Expect(err).To(MatchError("unsupported checkpoint version 0"))
+	})
+
+	It("fails on a field longer than its section", func() {
+		// A file descriptor section of 8 bytes whose name claims a terabyte
+		var corrupt bytes.Buffer
+		corrupt.Write(file[:20])
+		binary.Write(&corrupt, binary.LittleEndian, uint32(1))
+		binary.Write(&corrupt, binary.LittleEndian, uint32(3))
+		binary.Write(&corrupt, binary.LittleEndian, uint64(8))
+		binary.Write(&corrupt, binary.LittleEndian, uint64(1<<40))
+
+		_, err := ReadState(&corrupt, cmd.Process.Pid, NewPageStore())
+		Expect(err).To(MatchError(ContainSubstring("overruns its section")))
+	})
+})
@@ -0,0 +1,394 @@
+package state
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ostenbom/refunction/controller/ptrace"
+	"golang.org/x/sys/unix"
+)
+
+// credentials are a task's IDs and capability sets, from its status file.
+// IDs are real, effective, saved and filesystem, in that order.
+type credentials struct {
+	uids   [4]uint32
+	gids   [4]uint32
+	groups []uint32
+	// Inheritable, permitted, effective, bounding and ambient
+	caps [5]uint64
+}
+
+var capabilityFields = []string{"CapInh:", "CapPrm:", "CapEff:", "CapBnd:", "CapAmb:"}
+
+// CredentialChange is a credential of a task that is not what it was at
+// checkpoint time
+type CredentialChange struct {
+	Tid        int
+	Credential string
+	Checkpoint string
+	Current    string
+}
+
+// CredentialsChangedError is returned when a task's credentials could not be
+// put back, e.g. after it dropped the capabilities needed to raise them again
+type CredentialsChangedError struct {
+	Changed []CredentialChange
+}
+
+func (e *CredentialsChangedError) Error() string {
+	var changes []string
+	for _, change := range e.Changed {
+		changes = append(changes, fmt.Sprintf("task %d %s: %s -> %s", change.Tid, change.Credential, change.Checkpoint, change.Current))
+	}
+	return fmt.Sprintf("credentials changed since checkpoint: %s", strings.Join(changes, ", "))
+}
+
+func readCredentials(path string) (*credentials, error) {
+	status, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %s", path, err)
+	}
+	defer status.Close()
+
+	var creds credentials
+	scanner := bufio.NewScanner(status)
+	for scanner.Scan() {
+		line := strings.Fields(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		switch line[0] {
+		case "Uid:", "Gid:":
+			ids := &creds.uids
+			if line[0] == "Gid:" {
+				ids = &creds.gids
+			}
+			if len(line) != 5 {
+				return nil, fmt.Errorf("could not parse %s in %s", line[0], path)
+			}
+			for i, field := range line[1:] {
+				id, err := strconv.ParseUint(field, 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("could not parse %s in %s: %s", line[0], path, err)
+				}
+				ids[i] = uint32(id)
+			}
+		case "Groups:":
+			for _, field := range line[1:] {
+				group, err := strconv.ParseUint(field, 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("could not parse Groups in %s: %s", path, err)
+				}
+				creds.groups = append(creds.groups, uint32(group))
+			}
+		default:
+			for i, name := range capabilityFields {
+				if line[0] != name || len(line) != 2 {
+					continue
+				}
+				creds.caps[i], err = strconv.ParseUint(line[1], 16, 64)
+				if err != nil {
+					return nil, fmt.Errorf("could not parse %s in %s: %s", name, path, err)
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not scan %s: %s", path, err)
+	}
+
+	sort.Slice(creds.groups, func(i, j int) bool {
+		return creds.groups[i] < creds.groups[j]
+	})
+	return &creds, nil
+}
+
+// changes lists how current differs from the checkpoint credentials c
+func (c *credentials) changes(tid int, current *credentials) []CredentialChange {
+	var changes []CredentialChange
+	add := func(credential string, checkpoint interface{}, now interface{}) {
+		changes = append(changes, CredentialChange{
+			Tid:        tid,
+			Credential: credential,
+			Checkpoint: fmt.Sprint(checkpoint),
+			Current:    fmt.Sprint(now),
+		})
+	}
+
+	if c.uids != current.uids {
+		add("uids", c.uids, current.uids)
+	}
+	if c.gids != current.gids {
+		add("gids", c.gids, current.gids)
+	}
+	if fmt.Sprint(c.groups) != fmt.Sprint(current.groups) {
+		add("groups", c.groups, current.groups)
+	}
+	for i, name := range capabilityFields {
+		if c.caps[i] != current.caps[i] {
+			add(strings.TrimSuffix(name, ":"), fmt.Sprintf("%016x", c.caps[i]), fmt.Sprintf("%016x", current.caps[i]))
+		}
+	}
+	return changes
+}
+
+// readUmask reads the process's file mode creation mask
+func readUmask(pid int) (uint32, error) {
+	path := fmt.Sprintf("/proc/%d/status", pid)
+	status, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("could not open %s: %s", path, err)
+	}
+	defer status.Close()
+
+	scanner := bufio.NewScanner(status)
+	for scanner.Scan() {
+		line := strings.Fields(scanner.Text())
+		if len(line) != 2 || line[0] != "Umask:" {
+			continue
+		}
+		umask, err := strconv.ParseUint(line[1], 8, 32)
+		if err != nil {
+			return 0, fmt.Errorf("could not parse Umask in %s: %s", path, err)
+		}
+		return uint32(umask), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("could not scan %s: %s", path, err)
+	}
+
+	return 0, fmt.Errorf("no Umask in %s", path)
+}
+
+// readCwd reads the process's working directory as the process sees it,
+// relative to its root, which differs from ours in a container
+func readCwd(pid int) (string, error) {
+	cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid))
+	if err != nil {
+		return "", fmt.Errorf("could not read cwd: %s", err)
+	}
+	root, err := os.Readlink(fmt.Sprintf("/proc/%d/root", pid))
+	if err != nil {
+		return "", fmt.Errorf("could not read root: %s", err)
+	}
+
+	if root == "/" {
+		return cwd, nil
+	}
+	if cwd == root {
+		return "/", nil
+	}
+	if !strings.HasPrefix(cwd, root+"/") {
+		return "", fmt.Errorf("cwd %s is outside of root %s", cwd, root)
+	}
+	return strings.TrimPrefix(cwd, root), nil
+}
+
+// saveCredentials records the process's working directory and umask, and the
+// credentials of each task
+func (s *State) saveCredentials() error {
+	cwd, err := readCwd(s.pid)
+	if err != nil {
+		return err
+	}
+	s.cwd = cwd
+
+	s.umask, err = readUmask(s.pid)
+	if err != nil {
+		return err
+	}
+
+	for tid, regState := range s.registers {
+		creds, err := readCredentials(taskStatusPath(s.pid, tid))
+		if err != nil {
+			return err
+		}
+		regState.credentials = creds
+		s.registers[tid] = regState
+	}
+
+	return nil
+}
+
+// credentialChanges compares the working directory, umask and the credentials
+// of each task still running with the checkpoint
+func (s *State) credentialChanges(exited []int) ([]CredentialChange, error) {
+	var changes []CredentialChange
+	if s.cwd != "" {
+		cwd, err := readCwd(s.pid)
+		if err != nil {
+			return nil, err
+		}
+		if cwd != s.cwd {
+			changes = append(changes, CredentialChange{Tid: s.pid, Credential: "cwd", Checkpoint: s.cwd, Current: cwd})
+		}
+
+		umask, err := readUmask(s.pid)
+		if err != nil {
+			return nil, err
+		}
+		if umask != s.umask {
+			changes = append(changes, CredentialChange{Tid: s.pid, Credential: "umask", Checkpoint: fmt.Sprintf("%04o", s.umask), Current: fmt.Sprintf("%04o", umask)})
+		}
+	}
+
+	gone := make(map[int]bool)
+	for _, tid := range exited {
+		gone[tid] = true
+	}
+	for tid, regState := range s.registers {
+		if gone[tid] || regState.credentials == nil {
+			continue
+		}
+		current, err := readCredentials(taskStatusPath(s.pid, tid))
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, regState.credentials.changes(tid, current)...)
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Tid < changes[j].Tid
+	})
+	return changes, nil
+}
+
+// RestoreCredentials puts back the process's working directory and umask, and
+// each task's IDs, supplementary groups and capabilities. Credentials the
+// process no longer has the privilege to set again are returned in a
+// CredentialsChangedError. It reports whether any syscalls were run in the
+// process.
+func (s *State) RestoreCredentials() (bool, error) {
+	ranSyscalls := false
+
+	// Checkpoints read from older files have no working directory
+	if s.cwd != "" {
+		cwd, err := readCwd(s.pid)
+		if err != nil {
+			return ranSyscalls, err
+		}
+		if cwd != s.cwd {
+			ranSyscalls = true
+			err := s.remoteTask().RemoteChdir(s.cwd)
+			if err != nil {
+				return ranSyscalls, fmt.Errorf("could not change directory to %s: %s", s.cwd, err)
+			}
+		}
+
+		umask, err := readUmask(s.pid)
+		if err != nil {
+			return ranSyscalls, err
+		}
+		if umask != s.umask {
+			ranSyscalls = true
+			_, err := s.remoteTask().RemoteSyscall(unix.SYS_UMASK, uint64(s.umask))
+			if err != nil {
+				return ranSyscalls, fmt.Errorf("could not set umask: %s", err)
+			}
+		}
+	}
+
+	var changes []CredentialChange
+	for tid, regState := range s.registers {
+		if regState.credentials == nil {
+			continue
+		}
+
+		current, err := readCredentials(taskStatusPath(s.pid, tid))
+		if err != nil {
+			return ranSyscalls, err
+		}
+		if len(regState.credentials.changes(tid, current)) == 0 {
+			continue
+		}
+
+		ranSyscalls = true
+		err = setCredentials(regState.task, regState.credentials, current)
+		if err != nil {
+			return ranSyscalls, fmt.Errorf("could not set credentials of task %d: %s", tid, err)
+		}
+
+		current, err = readCredentials(taskStatusPath(s.pid, tid))
+		if err != nil {
+			return ranSyscalls, err
+		}
+		changes = append(changes, regState.credentials.changes(tid, current)...)
+	}
+
+	if len(changes) > 0 {
+		sort.Slice(changes, func(i, j int) bool {
+			return changes[i].Tid < changes[j].Tid
+		})
+		return ranSyscalls, &CredentialsChangedError{Changed: changes}
+	}
+	return ranSyscalls, nil
+}
+
+// setCredentials sets the task's credentials to creds. Permission errors are
+// left for the caller to find in what the task ends up with.
+func setCredentials(task *ptrace.TraceTask, creds *credentials, current *credentials) error {
+	setGroups := func() error {
+		return task.RemoteSetgroups(creds.groups)
+	}
+	setGids := func() error {
+		_, err := task.RemoteSyscall(unix.SYS_SETRESGID, uint64(creds.gids[0]), uint64(creds.gids[1]), uint64(creds.gids[2]))
+		if err != nil {
+			return err
+		}
+		// setfsgid returns the previous ID rather than an error
+		_, err = task.RemoteSyscall(unix.SYS_SETFSGID, uint64(creds.gids[3]))
+		return err
+	}
+	setUids := func() error {
+		_, err := task.RemoteSyscall(unix.SYS_SETRESUID, uint64(creds.uids[0]), uint64(creds.uids[1]), uint64(creds.uids[2]))
+		if err != nil {
+			return err
+		}
+		_, err = task.RemoteSyscall(unix.SYS_SETFSUID, uint64(creds.uids[3]))
+		return err
+	}
+
+	// Changing groups needs CAP_SETGID, which a task that gave up root as
+	// its effective user only gets back with the user
+	steps := []func() error{setGroups, setGids, setUids}
+	if creds.uids[1] == 0 && current.uids[1] != 0 {
+		steps = []func() error{setUids, setGroups, setGids}
+	}
+	for _, step := range steps {
+		err := step()
+		if err != nil && err != syscall.EPERM {
+			return err
+		}
+	}
+
+	err := task.RemoteCapset(creds.caps[2], creds.caps[1], creds.caps[0])
+	if err != nil && err != syscall.EPERM {
+		return err
+	}
+
+	// Ambient capabilities must also be permitted and inheritable, so they
+	// go back last
+	if creds.caps[4] != current.caps[4] {
+		_, err := task.RemoteSyscall(unix.SYS_PRCTL, unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0)
+		if err != nil {
+			return err
+		}
+		for capability := uint64(0); capability < 64; capability++ {
+			if creds.caps[4]&(1<<capability) == 0 {
+				continue
+			}
+			_, err := task.RemoteSyscall(unix.SYS_PRCTL, unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, capability, 0, 0)
+			if err != nil && err != syscall.EPERM {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
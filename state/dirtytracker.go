@@ -0,0 +1,238 @@
+package state
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// DirtyTracker finds the pages of a memory location that need restoring
+type DirtyTracker interface {
+	// Name identifies the strategy in restore statistics
+	Name() string
+	// Reset marks every page of the process clean. It is called whenever a
+	// checkpoint is taken or all writable pages are restored.
+	Reset(pid int) error
+	// DirtyPages reports, for each page of memory, whether it may differ
+	// from the memory's saved content
+	DirtyPages(pid int, memory *Memory) ([]bool, error)
+	// SinceReset is true when dirty pages are those written since the last
+	// Reset, so they are only valid for the checkpoint current at that time
+	SinceReset() bool
+}
+
+// SoftDirtyTracker uses the kernel's soft-dirty page bits
+type SoftDirtyTracker struct{}
+
+func (SoftDirtyTracker) Name() string {
+	return "soft-dirty"
+}
+
+func (SoftDirtyTracker) Reset(pid int) error {
+	f, err := os.OpenFile(fmt.Sprintf("/proc/%d/clear_refs", pid), os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("could not open clear_refs for pid %d: %s", pid, err)
+	}
+	defer f.Close()
+
+	// https://github.com/torvalds/linux/blob/master/Documentation/admin-guide/mm/soft-dirty.rst
+	_, err = f.WriteString("4")
+	if err != nil {
+		return fmt.Errorf("could not clear_refs for pid %d: %s", pid, err)
+	}
+	return nil
+}
+
+func (SoftDirtyTracker) DirtyPages(pid int, memory *Memory) ([]bool, error) {
+	pageSize := int64(os.Getpagesize())
+	return softDirtyBits(pid, memory.startOffset/pageSize, memory.endOffset/pageSize)
+}
+
+func (SoftDirtyTracker) SinceReset() bool {
+	return true
+}
+
+// softDirtyBits reads the soft-dirty bit of pages [startPage, endPage)
+func softDirtyBits(pid int, startPage int64, endPage int64) ([]bool, error) {
+	pagemap, err := os.Open(fmt.Sprintf("/proc/%d/pagemap", pid))
+	if err != nil {
+		return nil, fmt.Errorf("could not open pid %d pagemap: %s", pid, err)
+	}
+	defer pagemap.Close()
+
+	// 64-bit entries
+	pagemapEntrySize := int64(8)
+	entries := make([]byte, (endPage-startPage)*pagemapEntrySize)
+	read, err := pagemap.ReadAt(entries, startPage*pagemapEntrySize)
+	if err != nil || read != len(entries) {
+		return nil, fmt.Errorf("could not read pid %d pagemap: %s", pid, err)
+	}
+
+	dirty := make([]bool, endPage-startPage)
+	for i := range dirty {
+		// 55th bit is soft/dirty bit. Arch is little-endian
+		dirty[i] = entries[int64(i)*pagemapEntrySize+6]>>7 == 1
+	}
+
+	return dirty, nil
+}
+
+// FullCopyTracker treats every page as dirty
+type FullCopyTracker struct{}
+
+func (FullCopyTracker) Name() string {
+	return "full-copy"
+}
+
+func (FullCopyTracker) Reset(pid int) error {
+	return nil
+}
+
+func (FullCopyTracker) DirtyPages(pid int, memory *Memory) ([]bool, error) {
+	pageSize := int64(os.Getpagesize())
+	dirty := make([]bool, (memory.endOffset-memory.startOffset)/pageSize)
+	for i := range dirty {
+		dirty[i] = true
+	}
+	return dirty, nil
+}
+
+func (FullCopyTracker) SinceReset() bool {
+	return false
+}
+
+// HashTracker compares a hash of each current page with a hash of its saved
+// content. It reads all writable memory, but only writes back what changed.
+type HashTracker struct{}
+
+func (HashTracker) Name() string {
+	return "hash-compare"
+}
+
+func (HashTracker) Reset(pid int) error {
+	return nil
+}
+
+func (HashTracker) DirtyPages(pid int, memory *Memory) ([]bool, error) {
+	memoryFile, err := os.Open(fmt.Sprintf("/proc/%d/mem", pid))
+	if err != nil {
+		return nil, fmt.Errorf("could not open /proc/pid/mem: %s", err)
+	}
+	defer memoryFile.Close()
+
+	savedHashes := memory.hashes
+	pageSize := os.Getpagesize()
+	dirty := make([]bool, len(savedHashes))
+
+	current := make([]byte, memory.endOffset-memory.startOffset)
+	read, err := memoryFile.ReadAt(current, memory.startOffset)
+	if err == nil && read == len(current) {
+		for i := range dirty {
+			dirty[i] = pageHash(sha256.Sum256(current[i*pageSize:(i+1)*pageSize])) != savedHashes[i]
+		}
+		return dirty, nil
+	}
+	if !isEIO(err) {
+		return nil, fmt.Errorf("could not read %s at %x: %s", memory.name, memory.startOffset, err)
+	}
+
+	// Pages missing under a userfaultfd cannot be read. They were dropped by
+	// a lazy restore and are served from the checkpoint, so they are clean.
+	for i := range dirty {
+		page := current[i*pageSize : (i+1)*pageSize]
+		_, err := memoryFile.ReadAt(page, memory.startOffset+int64(i*pageSize))
+		if isEIO(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s page at %x: %s", memory.name, memory.startOffset+int64(i*pageSize), err)
+		}
+		dirty[i] = pageHash(sha256.Sum256(page)) != savedHashes[i]
+	}
+
+	return dirty, nil
+}
+
+func isEIO(err error) bool {
+	pathErr, ok := err.(*os.PathError)
+	return ok && pathErr.Err == syscall.EIO
+}
+
+func (HashTracker) SinceReset() bool {
+	return false
+}
+
+var (
+	probeOnce    sync.Once
+	probeTracker DirtyTracker
+)
+
+// ProbeDirtyTracker returns the soft-dirty tracker if the kernel sets
+// soft-dirty bits, and the hash tracker otherwise. The probe runs once,
+// against the first process it is given, which must be stopped. Every page
+// of that process is marked clean.
+func ProbeDirtyTracker(pid int) DirtyTracker {
+	probeOnce.Do(func() {
+		if softDirtyWorks(pid) {
+			probeTracker = SoftDirtyTracker{}
+		} else {
+			probeTracker = HashTracker{}
+		}
+	})
+	return probeTracker
+}
+
+// softDirtyWorks clears the soft-dirty bits of process pid and checks that
+// writing to one of its pages sets the page's bit again. The page is written
+// with the value it already holds.
+func softDirtyWorks(pid int) bool {
+	memoryLocations, err := newMemoryLocations(pid)
+	if err != nil {
+		return false
+	}
+	var target *Memory
+	for _, memory := range memoryLocations {
+		if memory.readable && memory.writable && !memory.shared {
+			target = memory
+			break
+		}
+	}
+	if target == nil {
+		return false
+	}
+
+	memoryFile, err := os.OpenFile(fmt.Sprintf("/proc/%d/mem", pid), os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	defer memoryFile.Close()
+
+	// Reading faults the page in, so it has a bit to clear
+	value := make([]byte, 1)
+	_, err = memoryFile.ReadAt(value, target.startOffset)
+	if err != nil {
+		return false
+	}
+
+	pageIndex := target.startOffset / int64(os.Getpagesize())
+	err = SoftDirtyTracker{}.Reset(pid)
+	if err != nil {
+		return false
+	}
+	clean, err := softDirtyBits(pid, pageIndex, pageIndex+1)
+	if err != nil || clean[0] {
+		return false
+	}
+
+	_, err = memoryFile.WriteAt(value, target.startOffset)
+	if err != nil {
+		return false
+	}
+	dirty, err := softDirtyBits(pid, pageIndex, pageIndex+1)
+	if err != nil {
+		return false
+	}
+	return dirty[0]
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
 )
 
 type FileDescriptor struct {
@@ -13,6 +15,32 @@ type FileDescriptor struct {
 	fdInfo string
 }
 
+// FdLinkChange is a file descriptor that points somewhere else than it did
+// at checkpoint time. Descriptors closed since have no CurrentLink.
+type FdLinkChange struct {
+	Fd             string
+	CheckpointLink string
+	CurrentLink    string
+}
+
+// FdLinksChangedError is returned when file descriptors from the checkpoint
+// were replaced, e.g. with dup2, or closed, which restore cannot repair
+type FdLinksChangedError struct {
+	Changed []FdLinkChange
+}
+
+func (e *FdLinksChangedError) Error() string {
+	var changes []string
+	for _, change := range e.Changed {
+		if change.CurrentLink == "" {
+			changes = append(changes, fmt.Sprintf("fd %s: %s closed", change.Fd, change.CheckpointLink))
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("fd %s: %s -> %s", change.Fd, change.CheckpointLink, change.CurrentLink))
+	}
+	return fmt.Sprintf("file descriptors changed target since checkpoint: %s", strings.Join(changes, ", "))
+}
+
 func newFileDescriptors(pid int) ([]*FileDescriptor, error) {
 	var fileDescriptors []*FileDescriptor
 
@@ -85,3 +113,103 @@ func (s *State) FdsChanged() (bool, error) {
 
 	return false, nil
 }
+
+func (s *State) getFileDescriptor(name string) *FileDescriptor {
+	return findFileDescriptor(s.fileDescriptors, name)
+}
+
+func findFileDescriptor(fileDescriptors []*FileDescriptor, name string) *FileDescriptor {
+	for _, fd := range fileDescriptors {
+		if fd.name == name {
+			return fd
+		}
+	}
+	return nil
+}
+
+// RestoreFileDescriptors closes file descriptors opened since the checkpoint
+// and seeks the remaining ones back to their checkpoint offsets. It reports
+// whether any syscalls were run in the process. Descriptors whose target has
+// changed, or that were closed, are returned in a *FdLinksChangedError.
+func (s *State) RestoreFileDescriptors() (bool, error) {
+	currentDescriptors, err := newFileDescriptors(s.pid)
+	if err != nil {
+		return false, fmt.Errorf("could not get new descriptors on restore: %s", err)
+	}
+
+	restored := false
+	var linkChanges []FdLinkChange
+	for _, current := range currentDescriptors {
+		fd, err := strconv.Atoi(current.name)
+		if err != nil {
+			return restored, fmt.Errorf("fd name was not int: %s", err)
+		}
+
+		checkpointFd := s.getFileDescriptor(current.name)
+		if checkpointFd == nil {
+			restored = true
+			err := s.remoteTask().RemoteClose(int(fd))
+			if err != nil {
+				return restored, fmt.Errorf("could not close fd %d: %s", fd, err)
+			}
+			continue
+		}
+
+		if checkpointFd.link != current.link {
+			linkChanges = append(linkChanges, FdLinkChange{
+				Fd:             current.name,
+				CheckpointLink: checkpointFd.link,
+				CurrentLink:    current.link,
+			})
+			continue
+		}
+
+		checkpointPos, err := checkpointFd.pos()
+		if err != nil {
+			return restored, err
+		}
+		currentPos, err := current.pos()
+		if err != nil {
+			return restored, err
+		}
+
+		if checkpointPos != currentPos {
+			restored = true
+			_, err := s.remoteTask().RemoteLseek(int(fd), checkpointPos, os.SEEK_SET)
+			if err != nil {
+				return restored, fmt.Errorf("could not seek fd %d: %s", fd, err)
+			}
+		}
+	}
+
+	for _, checkpointFd := range s.fileDescriptors {
+		if findFileDescriptor(currentDescriptors, checkpointFd.name) == nil {
+			linkChanges = append(linkChanges, FdLinkChange{
+				Fd:             checkpointFd.name,
+				CheckpointLink: checkpointFd.link,
+			})
+		}
+	}
+
+	if len(linkChanges) > 0 {
+		return restored, &FdLinksChangedError{Changed: linkChanges}
+	}
+
+	return restored, nil
+}
+
+// pos is the file offset from fdinfo, e.g. "pos:	1024"
+func (f *FileDescriptor) pos() (int64, error) {
+	for _, line := range strings.Split(f.fdInfo, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "pos:" {
+			pos, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("could not parse fd %s pos: %s", f.name, err)
+			}
+			return pos, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no pos in fd %s fdinfo", f.name)
+}
@@ -0,0 +1,66 @@
+package state_test
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ostenbom/refunction/controller/ptrace"
+	. "github.com/ostenbom/refunction/state"
+)
+
+var _ = Describe("File descriptors", func() {
+	var (
+		cmd   *exec.Cmd
+		task  *ptrace.TraceTask
+		saved *State
+	)
+
+	BeforeEach(func() {
+		// The read end of a pipe is the process's fd 3
+		reader, writer, err := os.Pipe()
+		Expect(err).NotTo(HaveOccurred())
+		defer reader.Close()
+		defer writer.Close()
+
+		cmd = exec.Command("sleep", "60")
+		cmd.ExtraFiles = []*os.File{reader}
+		Expect(cmd.Start()).To(Succeed())
+		pid := cmd.Process.Pid
+
+		task, err = ptrace.NewTraceTask(pid, pid, ptrace.Options{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(task.Stop()).To(Succeed())
+
+		saved, err = NewState(pid, map[int]*ptrace.TraceTask{pid: task})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		saved.Release()
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	It("restores nothing when no descriptor changed", func() {
+		restored, err := saved.RestoreFileDescriptors()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(restored).To(BeFalse())
+	})
+
+	It("reports descriptors closed since the checkpoint", func() {
+		Expect(task.RemoteClose(3)).To(Succeed())
+
+		_, err := saved.RestoreFileDescriptors()
+		var changed *FdLinksChangedError
+		Expect(errors.As(err, &changed)).To(BeTrue(), "got %v", err)
+		Expect(changed.Changed).To(HaveLen(1))
+		Expect(changed.Changed[0].Fd).To(Equal("3"))
+		Expect(changed.Changed[0].CheckpointLink).To(HavePrefix("pipe:"))
+		Expect(changed.Changed[0].CurrentLink).To(BeEmpty())
+		Expect(err).To(MatchError(ContainSubstring("fd 3: pipe:")))
+	})
+})
@@ -0,0 +1,190 @@
+package state
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+const defaultHugePageSize = 2 << 20
+
+var (
+	hugePageSizeOnce sync.Once
+	hugePageSizeVal  int64
+)
+
+// hugePageSize is the size of a transparent huge page, 2MB on x86-64
+func hugePageSize() int64 {
+	hugePageSizeOnce.Do(func() {
+		hugePageSizeVal = defaultHugePageSize
+		content, err := ioutil.ReadFile("/sys/kernel/mm/transparent_hugepage/hpage_pmd_size")
+		if err != nil {
+			return
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+		if err == nil && size > 0 {
+			hugePageSizeVal = size
+		}
+	})
+	return hugePageSizeVal
+}
+
+// hugePageUse is how a mapping uses transparent huge pages, from smaps
+type hugePageUse struct {
+	// Bytes of the mapping backed by anonymous huge pages
+	anonHuge int64
+	// The mapping was madvised with MADV_NOHUGEPAGE
+	disabled bool
+}
+
+// hugePageUses reads the huge page use of each mapping of the process, by
+// start address
+func hugePageUses(pid int) (map[int64]hugePageUse, error) {
+	smaps, err := os.Open(fmt.Sprintf("/proc/%d/smaps", pid))
+	if err != nil {
+		return nil, fmt.Errorf("could not open smaps: %s", err)
+	}
+	defer smaps.Close()
+
+	uses := make(map[int64]hugePageUse)
+	var start int64 = -1
+	scanner := bufio.NewScanner(smaps)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		// Each mapping starts with its line from /proc/pid/maps
+		if !strings.HasSuffix(fields[0], ":") {
+			// [vsyscall] is above the largest int64
+			offsets := strings.Split(fields[0], "-")
+			address, err := strconv.ParseUint(offsets[0], 16, 64)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse smaps offset: %s", err)
+			}
+			start = int64(address)
+			uses[start] = hugePageUse{}
+			continue
+		}
+		if start < 0 {
+			continue
+		}
+
+		use := uses[start]
+		switch fields[0] {
+		case "AnonHugePages:":
+			kB, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse AnonHugePages: %s", err)
+			}
+			use.anonHuge = kB << 10
+		case "VmFlags:":
+			for _, flag := range fields[1:] {
+				if flag == "nh" {
+					use.disabled = true
+				}
+			}
+		}
+		uses[start] = use
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not scan smaps: %s", err)
+	}
+
+	return uses, nil
+}
+
+// widenToHugePages marks every page of each huge page sized block of memory
+// dirty if any page of the block is. Huge pages are then restored, or dropped,
+// whole, with one copy instead of many and without splitting them.
+func widenToHugePages(memory *Memory, dirty []bool) {
+	pageSize := int64(os.Getpagesize())
+	hugeSize := hugePageSize()
+
+	blockStart := memory.startOffset &^ (hugeSize - 1)
+	for ; blockStart < memory.endOffset; blockStart += hugeSize {
+		first := (blockStart - memory.startOffset) / pageSize
+		if first < 0 {
+			first = 0
+		}
+		last := (blockStart + hugeSize - memory.startOffset) / pageSize
+		if last > int64(len(dirty)) {
+			last = int64(len(dirty))
+		}
+
+		anyDirty := false
+		for i := first; i < last; i++ {
+			if dirty[i] {
+				anyDirty = true
+				break
+			}
+		}
+		if !anyDirty {
+			continue
+		}
+		for i := first; i < last; i++ {
+			dirty[i] = true
+		}
+	}
+}
+
+// readHugePageUses reads the huge page use of the process's mappings, and
+// records how much of the checkpoint's writable memory is backed by huge pages
+func (s *State) readHugePageUses() (map[int64]hugePageUse, error) {
+	uses, err := hugePageUses(s.pid)
+	if err != nil {
+		return nil, err
+	}
+
+	s.hugePageBytes = 0
+	for _, memory := range s.memoryLocations {
+		if memory.writable {
+			s.hugePageBytes += uses[memory.startOffset].anonHuge
+		}
+	}
+	return uses, nil
+}
+
+// HugePageBytes is how much of the writable memory was backed by transparent
+// huge pages at the last restore
+func (s *State) HugePageBytes() int64 {
+	return s.hugePageBytes
+}
+
+// DisableHugePages madvises the process's private anonymous memory with
+// MADV_NOHUGEPAGE, so no new huge pages back it. Huge pages already in place
+// stay until they are unmapped. It reports whether any syscalls were run in
+// the process.
+func (s *State) DisableHugePages() (bool, error) {
+	uses, err := hugePageUses(s.pid)
+	if err != nil {
+		return false, err
+	}
+	currentMemory, err := newMemoryLocations(s.pid)
+	if err != nil {
+		return false, fmt.Errorf("could not get memory locations to disable huge pages: %s", err)
+	}
+
+	advised := false
+	for _, memory := range currentMemory {
+		if !lazyRestorable(memory) || uses[memory.startOffset].disabled {
+			continue
+		}
+
+		advised = true
+		_, err := s.remoteTask().RemoteSyscall(unix.SYS_MADVISE, uint64(memory.startOffset), uint64(memory.endOffset-memory.startOffset), unix.MADV_NOHUGEPAGE)
+		if err != nil {
+			return advised, fmt.Errorf("could not disable huge pages of %s at %x: %s", memory.name, memory.startOffset, err)
+		}
+	}
+
+	return advised, nil
+}
@@ -0,0 +1,403 @@
+package state
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/ostenbom/refunction/controller/ptrace"
+	"golang.org/x/sys/unix"
+)
+
+// userfaultfd ABI from linux/userfaultfd.h
+const (
+	uffdAPI              = 0xaa
+	uffdEventPagefault   = 0x12
+	uffdRegisterModeMiss = 1
+	uffdMsgSize          = 32
+	uffdMsgAddressOffset = 16
+	uffdioAPI            = 0xc018aa3f
+	uffdioRegister       = 0xc020aa00
+	uffdioWake           = 0x8010aa02
+	uffdioCopy           = 0xc028aa03
+	uffdioZeropage       = 0xc020aa04
+)
+
+type uffdioAPIArg struct {
+	api      uint64
+	features uint64
+	ioctls   uint64
+}
+
+type uffdioRange struct {
+	start  uint64
+	length uint64
+}
+
+type uffdioRegisterArg struct {
+	rng    uffdioRange
+	mode   uint64
+	ioctls uint64
+}
+
+type uffdioCopyArg struct {
+	dst    uint64
+	src    uint64
+	length uint64
+	mode   uint64
+	copied int64
+}
+
+type uffdioZeropageArg struct {
+	rng      uffdioRange
+	mode     uint64
+	zeroPage int64
+}
+
+// LazyRestorer serves page faults in the anonymous memory of a process from
+// a checkpoint, so restore only drops dirty pages and the process pays for
+// the ones it touches again. Processes forked while pages are still dropped
+// see those pages as zeroes, as the kernel does not pass the userfaultfd on.
+type LazyRestorer struct {
+	pid      int
+	fd       int
+	uffd     *os.File
+	mutex    sync.Mutex
+	state    *State
+	dropped  map[uint64]bool
+	served   int
+	closed   chan struct{}
+	finished chan struct{}
+}
+
+// NewLazyRestorer creates a userfaultfd in the process through task, which
+// must be stopped, and takes it over
+func NewLazyRestorer(pid int, task *ptrace.TraceTask) (*LazyRestorer, error) {
+	remoteFd, err := task.RemoteSyscall(unix.SYS_USERFAULTFD, unix.O_CLOEXEC|unix.O_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("could not create userfaultfd in process: %s", err)
+	}
+
+	localFd, err := takeFd(pid, int(remoteFd))
+	closeErr := task.RemoteClose(int(remoteFd))
+	if err != nil {
+		return nil, err
+	}
+	if closeErr != nil {
+		unix.Close(localFd)
+		return nil, fmt.Errorf("could not close userfaultfd in process: %s", closeErr)
+	}
+
+	api := uffdioAPIArg{api: uffdAPI}
+	err = uffdIoctl(localFd, uffdioAPI, unsafe.Pointer(&api))
+	if err != nil {
+		unix.Close(localFd)
+		return nil, fmt.Errorf("could not handshake userfaultfd api: %s", err)
+	}
+
+	// Reads go through the runtime poller, so Close can interrupt them. Fd()
+	// would make the file blocking, so ioctls use the raw fd.
+	l := &LazyRestorer{
+		pid:      pid,
+		fd:       localFd,
+		uffd:     os.NewFile(uintptr(localFd), "userfaultfd"),
+		dropped:  make(map[uint64]bool),
+		closed:   make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	go l.serve()
+
+	return l, nil
+}
+
+// takeFd duplicates fd of process pid into this process
+func takeFd(pid int, fd int) (int, error) {
+	pidfd, _, errno := syscall.Syscall(unix.SYS_PIDFD_OPEN, uintptr(pid), 0, 0)
+	if errno != 0 {
+		return 0, fmt.Errorf("could not open pidfd of %d: %s", pid, errno)
+	}
+	defer unix.Close(int(pidfd))
+
+	localFd, _, errno := syscall.Syscall(unix.SYS_PIDFD_GETFD, pidfd, uintptr(fd), 0)
+	if errno != 0 {
+		return 0, fmt.Errorf("could not get fd %d of %d: %s", fd, pid, errno)
+	}
+
+	return int(localFd), nil
+}
+
+func uffdIoctl(fd int, request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// PagesServed is how many page faults have been served from checkpoints
+func (l *LazyRestorer) PagesServed() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.served
+}
+
+// Pending is how many dropped pages have not been touched since
+func (l *LazyRestorer) Pending() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.dropped)
+}
+
+func (l *LazyRestorer) serve() {
+	defer close(l.finished)
+
+	msg := make([]byte, uffdMsgSize)
+	for {
+		_, err := l.uffd.Read(msg)
+		if err != nil {
+			select {
+			case <-l.closed:
+			default:
+				fmt.Fprintf(os.Stderr, "could not read faults of %d: %s\n", l.pid, err)
+			}
+			return
+		}
+		if msg[0] != uffdEventPagefault {
+			continue
+		}
+
+		pageSize := uint64(os.Getpagesize())
+		address := binary.LittleEndian.Uint64(msg[uffdMsgAddressOffset:]) &^ (pageSize - 1)
+
+		// Other missing pages were never touched or were dropped by the
+		// process itself since, so it expects zeroes
+		l.mutex.Lock()
+		if l.dropped[address] {
+			err = l.fill(address)
+			if err == nil {
+				l.served++
+			}
+		} else {
+			err = l.zero(address)
+		}
+		l.mutex.Unlock()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not serve fault at %x in %d: %s\n", address, l.pid, err)
+		}
+	}
+}
+
+// fill copies the checkpoint's page at address into the process and wakes
+// any threads waiting for it. The mutex must be held.
+func (l *LazyRestorer) fill(address uint64) error {
+	delete(l.dropped, address)
+	pageSize := uint64(os.Getpagesize())
+
+	var page []byte
+	if l.state != nil {
+		memory := l.state.memoryAt(address)
+		if memory != nil && memory.saved() {
+			page = memory.pages[(address-uint64(memory.startOffset))/pageSize]
+		}
+	}
+	if page == nil {
+		return l.zero(address)
+	}
+
+	copyArg := uffdioCopyArg{
+		dst:    address,
+		src:    uint64(uintptr(unsafe.Pointer(&page[0]))),
+		length: pageSize,
+	}
+	err := uffdIoctl(l.fd, uffdioCopy, unsafe.Pointer(&copyArg))
+	runtime.KeepAlive(page)
+	return l.wakeIfPresent(address, err)
+}
+
+// zero maps a page of zeroes at address and wakes any threads waiting for it
+func (l *LazyRestorer) zero(address uint64) error {
+	pageSize := uint64(os.Getpagesize())
+	zeroArg := uffdioZeropageArg{rng: uffdioRange{start: address, length: pageSize}}
+	err := uffdIoctl(l.fd, uffdioZeropage, unsafe.Pointer(&zeroArg))
+	return l.wakeIfPresent(address, err)
+}
+
+// wakeIfPresent wakes threads waiting for the page at address when err says
+// another thread faulted on the same page, which is now there
+func (l *LazyRestorer) wakeIfPresent(address uint64, err error) error {
+	if err != syscall.EEXIST {
+		return err
+	}
+	wakeArg := uffdioRange{start: address, length: uint64(os.Getpagesize())}
+	return uffdIoctl(l.fd, uffdioWake, unsafe.Pointer(&wakeArg))
+}
+
+// FillDropped copies in every page still dropped, so the process memory is
+// whole again and can be read through /proc/pid/mem
+func (l *LazyRestorer) FillDropped() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.fillDropped()
+}
+
+// Forget stops serving pages from checkpoint s, so it can be released. Pages
+// still dropped for it are filled first.
+func (l *LazyRestorer) Forget(s *State) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.state != s {
+		return nil
+	}
+
+	err := l.fillDropped()
+	l.state = nil
+	return err
+}
+
+// fillDropped must be called with the mutex held
+func (l *LazyRestorer) fillDropped() error {
+	var fillErr error
+	for address := range l.dropped {
+		err := l.fill(address)
+		// The range was unmapped or replaced since it was dropped
+		if err == syscall.ENOENT || err == syscall.EINVAL {
+			continue
+		}
+		if err != nil && fillErr == nil {
+			fillErr = fmt.Errorf("could not fill page at %x: %s", address, err)
+		}
+	}
+	return fillErr
+}
+
+// Close fills every page still dropped, so none are lost when the kernel
+// forgets the registered ranges, and stops serving faults
+func (l *LazyRestorer) Close() error {
+	fillErr := l.FillDropped()
+
+	close(l.closed)
+	err := l.uffd.Close()
+	<-l.finished
+	if fillErr != nil {
+		return fillErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not close userfaultfd: %s", err)
+	}
+	return nil
+}
+
+func (s *State) memoryAt(address uint64) *Memory {
+	for _, memory := range s.memoryLocations {
+		if uint64(memory.startOffset) <= address && address < uint64(memory.endOffset) {
+			return memory
+		}
+	}
+	return nil
+}
+
+// lazyRestorable is true for the mappings userfaultfd can serve missing
+// pages of
+func lazyRestorable(m *Memory) bool {
+	return m.writable && m.iNode == 0 && !m.shared
+}
+
+// RestoreLazily drops the dirty pages of anonymous mappings and lets lazy
+// serve them from this checkpoint when they are next touched. Dirty pages of
+// other writable mappings are written back straight away.
+func (s *State) RestoreLazily(tracker DirtyTracker, lazy *LazyRestorer) error {
+	uses, err := s.readHugePageUses()
+	if err != nil {
+		return err
+	}
+
+	lazy.mutex.Lock()
+	lazy.state = s
+
+	// Pages dropped for an earlier checkpoint now come from this one, unless
+	// they are no longer anonymous memory in it
+	for address := range lazy.dropped {
+		memory := s.memoryAt(address)
+		if memory == nil || !lazyRestorable(memory) {
+			delete(lazy.dropped, address)
+		}
+	}
+
+	var eager []*Memory
+	for _, memory := range s.memoryLocations {
+		if !memory.writable {
+			continue
+		}
+		if !lazyRestorable(memory) {
+			eager = append(eager, memory)
+			continue
+		}
+
+		err := s.restoreMemoryLazily(memory, tracker, lazy, uses[memory.startOffset])
+		if err != nil {
+			lazy.mutex.Unlock()
+			return fmt.Errorf("could not lazily restore %s at %x: %s", memory.name, memory.startOffset, err)
+		}
+	}
+	lazy.mutex.Unlock()
+
+	return s.restoreTrackedMemory(eager, tracker, uses)
+}
+
+// restoreMemoryLazily must be called with the lazy restorer's mutex held.
+// Faults are not served until it is released.
+func (s *State) restoreMemoryLazily(memory *Memory, tracker DirtyTracker, lazy *LazyRestorer, use hugePageUse) error {
+	// Registering again is allowed, and covers mappings recreated since
+	register := uffdioRegisterArg{
+		rng: uffdioRange{
+			start:  uint64(memory.startOffset),
+			length: uint64(memory.endOffset - memory.startOffset),
+		},
+		mode: uffdRegisterModeMiss,
+	}
+	err := uffdIoctl(lazy.fd, uffdioRegister, unsafe.Pointer(&register))
+	if err != nil {
+		return fmt.Errorf("could not register with userfaultfd: %s", err)
+	}
+
+	// Trackers that read memory would wait on pages dropped earlier, which
+	// cannot be served while the mutex is held
+	lazy.mutex.Unlock()
+	dirty, err := tracker.DirtyPages(s.pid, memory)
+	lazy.mutex.Lock()
+	if err != nil {
+		return fmt.Errorf("could not find dirty pages: %s", err)
+	}
+	// Dropping part of a huge page would split it
+	if use.anonHuge > 0 {
+		widenToHugePages(memory, dirty)
+	}
+
+	pageSize := int64(os.Getpagesize())
+	for start := 0; start < len(dirty); start++ {
+		if !dirty[start] {
+			continue
+		}
+		end := start
+		for end < len(dirty) && dirty[end] {
+			end++
+		}
+
+		address := memory.startOffset + int64(start)*pageSize
+		_, err := s.remoteTask().RemoteSyscall(unix.SYS_MADVISE, uint64(address), uint64(int64(end-start)*pageSize), unix.MADV_DONTNEED)
+		if err != nil {
+			return fmt.Errorf("could not drop pages at %x: %s", address, err)
+		}
+		for page := start; page < end; page++ {
+			lazy.dropped[uint64(memory.startOffset+int64(page)*pageSize)] = true
+		}
+
+		start = end
+	}
+
+	return nil
+}
@@ -0,0 +1,270 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+type MappingChangeKind int
+
+const (
+	// MappingAdded is a range that was not mapped at checkpoint time
+	MappingAdded MappingChangeKind = iota
+	// MappingRemoved is a range that was mapped at checkpoint time and is not now
+	MappingRemoved
+	// MappingResized is a range a checkpointed mapping has grown into or shrunk out of
+	MappingResized
+	// MappingReprotected is a range whose permissions differ from the checkpoint
+	MappingReprotected
+	// MappingReplaced is a range now mapped from a different backing than the checkpoint
+	MappingReplaced
+)
+
+func (k MappingChangeKind) String() string {
+	switch k {
+	case MappingAdded:
+		return "added"
+	case MappingRemoved:
+		return "removed"
+	case MappingResized:
+		return "resized"
+	case MappingReprotected:
+		return "reprotected"
+	case MappingReplaced:
+		return "replaced"
+	}
+	return "unknown"
+}
+
+// MappingChange is a range of the address space that differs from the
+// checkpoint. Checkpoint is nil for added ranges, Current for removed ones.
+type MappingChange struct {
+	Kind       MappingChangeKind
+	Start      int64
+	End        int64
+	Checkpoint *Memory
+	Current    *Memory
+}
+
+func (c MappingChange) String() string {
+	name := ""
+	if c.Checkpoint != nil {
+		name = c.Checkpoint.name
+	} else if c.Current != nil {
+		name = c.Current.name
+	}
+	return fmt.Sprintf("%s %x-%x %s", c.Kind, c.Start, c.End, name)
+}
+
+// grown is true when a resized range lies outside the checkpointed mapping
+func (c MappingChange) grown() bool {
+	return c.Start >= c.Checkpoint.endOffset || c.End <= c.Checkpoint.startOffset
+}
+
+// UnrepairableMappingsError lists the mapping changes restore could not undo
+type UnrepairableMappingsError struct {
+	Changes []MappingChange
+}
+
+func (e *UnrepairableMappingsError) Error() string {
+	changes := make([]string, len(e.Changes))
+	for i, change := range e.Changes {
+		changes[i] = change.String()
+	}
+	return fmt.Sprintf("cannot restore mappings: %s", strings.Join(changes, ", "))
+}
+
+// MappingChanges diffs the current mappings of the process against the
+// checkpoint, range by range
+func (s *State) MappingChanges() ([]MappingChange, error) {
+	currentMemory, err := newMemoryLocations(s.pid)
+	if err != nil {
+		return nil, fmt.Errorf("could not get memory locations for mapping diff: %s", err)
+	}
+
+	return diffMappings(s.memoryLocations, currentMemory), nil
+}
+
+func diffMappings(checkpointMemory []*Memory, currentMemory []*Memory) []MappingChange {
+	var changes []MappingChange
+
+	for _, current := range currentMemory {
+		for _, r := range uncoveredRanges(current, checkpointMemory) {
+			change := MappingChange{Kind: MappingAdded, Start: r[0], End: r[1], Current: current}
+			if grownFrom := sameBackingOverlap(current, checkpointMemory); grownFrom != nil {
+				change.Kind = MappingResized
+				change.Checkpoint = grownFrom
+			}
+			changes = append(changes, change)
+		}
+	}
+
+	for _, checkpoint := range checkpointMemory {
+		for _, r := range uncoveredRanges(checkpoint, currentMemory) {
+			change := MappingChange{Kind: MappingRemoved, Start: r[0], End: r[1], Checkpoint: checkpoint}
+			if shrunkTo := sameBackingOverlap(checkpoint, currentMemory); shrunkTo != nil {
+				change.Kind = MappingResized
+				change.Current = shrunkTo
+			}
+			changes = append(changes, change)
+		}
+
+		for _, current := range currentMemory {
+			start, end := overlap(checkpoint, current)
+			if start >= end {
+				continue
+			}
+
+			if !sameBacking(checkpoint, current) {
+				changes = append(changes, MappingChange{Kind: MappingReplaced, Start: start, End: end, Checkpoint: checkpoint, Current: current})
+			} else if checkpoint.perms() != current.perms() {
+				changes = append(changes, MappingChange{Kind: MappingReprotected, Start: start, End: end, Checkpoint: checkpoint, Current: current})
+			}
+		}
+	}
+
+	return changes
+}
+
+// uncoveredRanges returns the parts of m not covered by any of others.
+// others must be sorted by address, as /proc/pid/maps is.
+func uncoveredRanges(m *Memory, others []*Memory) [][2]int64 {
+	var ranges [][2]int64
+	start := m.startOffset
+	for _, o := range others {
+		if o.endOffset <= start || o.startOffset >= m.endOffset {
+			continue
+		}
+		if o.startOffset > start {
+			ranges = append(ranges, [2]int64{start, o.startOffset})
+		}
+		start = o.endOffset
+	}
+	if start < m.endOffset {
+		ranges = append(ranges, [2]int64{start, m.endOffset})
+	}
+
+	return ranges
+}
+
+func sameBackingOverlap(m *Memory, others []*Memory) *Memory {
+	for _, o := range others {
+		start, end := overlap(m, o)
+		if start < end && sameBacking(m, o) {
+			return o
+		}
+	}
+	return nil
+}
+
+func overlap(a *Memory, b *Memory) (int64, int64) {
+	start, end := a.startOffset, a.endOffset
+	if b.startOffset > start {
+		start = b.startOffset
+	}
+	if b.endOffset < end {
+		end = b.endOffset
+	}
+	return start, end
+}
+
+// sameBacking is true when two mappings refer to the same object. File
+// offsets must line up, so a file mapping moved by mremap does not match.
+func sameBacking(a *Memory, b *Memory) bool {
+	if a.name != b.name || a.shared != b.shared {
+		return false
+	}
+	if a.majorDevice != b.majorDevice || a.minorDevice != b.minorDevice || a.iNode != b.iNode {
+		return false
+	}
+	if a.iNode != 0 && a.processOffset-a.startOffset != b.processOffset-b.startOffset {
+		return false
+	}
+	return true
+}
+
+// RestoreMappings undoes the given mapping changes. Added ranges are
+// unmapped, removed anonymous private ranges are mapped again and protections
+// are reset. Pages of recreated ranges are restored by RestoreDirtyPages.
+// Changes that cannot be undone are returned in an UnrepairableMappingsError.
+func (s *State) RestoreMappings(changes []MappingChange) error {
+	var unrepairable []MappingChange
+
+	// Free address space first, so removed ranges can be mapped again
+	for _, change := range changes {
+		if change.Kind == MappingAdded || (change.Kind == MappingResized && change.grown()) {
+			err := s.remoteTask().RemoteMunmap(uint64(change.Start), uint64(change.End-change.Start))
+			if err != nil {
+				return fmt.Errorf("could not unmap %s: %s", change, err)
+			}
+		}
+	}
+
+	for _, change := range changes {
+		switch change.Kind {
+		case MappingRemoved, MappingResized, MappingReplaced:
+			if change.Kind == MappingResized && change.grown() {
+				continue
+			}
+			if !recreatable(change.Checkpoint) {
+				unrepairable = append(unrepairable, change)
+				continue
+			}
+			err := s.remoteMmapAnonymous(change.Start, change.End, change.Checkpoint.prot())
+			if err != nil {
+				return fmt.Errorf("could not map %s: %s", change, err)
+			}
+		case MappingReprotected:
+			err := s.remoteTask().RemoteMprotect(uint64(change.Start), uint64(change.End-change.Start), change.Checkpoint.prot())
+			if err != nil {
+				return fmt.Errorf("could not mprotect %s: %s", change, err)
+			}
+		}
+	}
+
+	if len(unrepairable) > 0 {
+		return &UnrepairableMappingsError{Changes: unrepairable}
+	}
+
+	return nil
+}
+
+// recreatable is true for mappings that can be mapped again from nothing
+// but their saved content
+func recreatable(m *Memory) bool {
+	if m.iNode != 0 || m.shared {
+		return false
+	}
+	// brk owns the heap, and the kernel owns anything else in brackets
+	return m.name == "" || m.name == "[stack]"
+}
+
+func (s *State) remoteMmapAnonymous(start int64, end int64, prot int) error {
+	flags := unix.MAP_PRIVATE | unix.MAP_ANONYMOUS | unix.MAP_FIXED
+	addr, err := s.remoteTask().RemoteMmap(uint64(start), uint64(end-start), prot, flags, -1, 0)
+	if err != nil {
+		return err
+	}
+
+	if int64(addr) != start {
+		return fmt.Errorf("mapped at %x instead", addr)
+	}
+
+	return nil
+}
+
+func (m *Memory) prot() int {
+	prot := unix.PROT_NONE
+	if m.readable {
+		prot |= unix.PROT_READ
+	}
+	if m.writable {
+		prot |= unix.PROT_WRITE
+	}
+	if m.executable {
+		prot |= unix.PROT_EXEC
+	}
+	return prot
+}
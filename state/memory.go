@@ -8,7 +8,7 @@ import (
 	"strings"
 	"sync"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/ostenbom/refunction/controller/ptrace"
 )
 
 type Memory struct {
@@ -23,7 +23,9 @@ type Memory struct {
 	majorDevice   int
 	minorDevice   int
 	iNode         int
-	content       []byte
+	// Saved pages, held in the state's page store. All-zero pages are nil.
+	pages  [][]byte
+	hashes []pageHash
 }
 
 func newMemoryLocations(pid int) ([]*Memory, error) {
@@ -82,37 +84,62 @@ func (s *State) getMemory(memoryName string) (*Memory, error) {
 	return memory, nil
 }
 
+// SaveWritablePages copies every writable mapping into the state
 func (s *State) SaveWritablePages() error {
-	memoryFile, err := os.OpenFile(fmt.Sprintf("/proc/%d/mem", s.pid), os.O_RDONLY, 0)
-	if err != nil {
-		return fmt.Errorf("could not open /proc/pid/mem: %s", err)
-	}
-	defer memoryFile.Close()
-
+	var writable []*Memory
+	var contents [][]byte
 	for _, memory := range s.memoryLocations {
 		if !memory.writable {
 			continue
 		}
 
-		numBytes := memory.endOffset - memory.startOffset
-		memory.content = make([]byte, numBytes)
+		content, err := mapBuffer(int(memory.endOffset - memory.startOffset))
+		if err != nil {
+			unmapBuffers(contents)
+			return err
+		}
+		writable = append(writable, memory)
+		contents = append(contents, content)
+	}
+	// Pages are copied into the page store, so the buffers can go
+	defer unmapBuffers(contents)
 
-		read, err := memoryFile.ReadAt(memory.content, memory.startOffset)
-		if err != nil || int64(read) != numBytes {
-			return fmt.Errorf("could not read /proc/pid/mem data: %s", err)
+	if s.memoryIO == ProcMemIO {
+		err := s.procMemSavePages(writable, contents)
+		if err != nil {
+			return err
+		}
+	} else {
+		var runs []ptrace.MemoryRun
+		for i, memory := range writable {
+			runs = append(runs, ptrace.MemoryRun{Address: uintptr(memory.startOffset), Local: contents[i]})
+		}
+
+		err := s.transferRuns(ptrace.ReadMemoryRuns, runs)
+		if err != nil {
+			return fmt.Errorf("could not read writable pages: %s", err)
 		}
 	}
 
-	return nil
+	return s.storeContent(writable, contents)
 }
 
-func (s *State) MemorySize() int {
-	total := 0
-	for _, m := range s.memoryLocations {
-		total += len(m.content)
+// RestoreWritablePages writes back every page saved by SaveWritablePages,
+// whether or not it is soft-dirty
+func (s *State) RestoreWritablePages() error {
+	var writable []*Memory
+	for _, memory := range s.memoryLocations {
+		if memory.writable {
+			writable = append(writable, memory)
+		}
 	}
 
-	return total
+	uses, err := s.readHugePageUses()
+	if err != nil {
+		return err
+	}
+
+	return s.restoreTrackedMemory(writable, FullCopyTracker{}, uses)
 }
 
 func (s *State) ProgramBreakChanged() (bool, error) {
@@ -205,159 +232,176 @@ func (s *State) NumMemoryLocationsChanged() (bool, error) {
 	return false, nil
 }
 
+// RestoreDirtyPages writes back the pages marked soft-dirty
 func (s *State) RestoreDirtyPages() error {
+	return s.RestoreTrackedPages(SoftDirtyTracker{})
+}
+
+// RestoreTrackedPages writes back the writable pages tracker reports dirty
+func (s *State) RestoreTrackedPages(tracker DirtyTracker) error {
+	var writable []*Memory
+	for _, memory := range s.memoryLocations {
+		if memory.writable {
+			writable = append(writable, memory)
+		}
+	}
 
-	memoryFile, err := os.OpenFile(fmt.Sprintf("/proc/%d/mem", s.pid), os.O_RDWR, 0)
+	uses, err := s.readHugePageUses()
 	if err != nil {
-		return fmt.Errorf("could not open /proc/pid/mem: %s", err)
+		return err
 	}
-	defer memoryFile.Close()
 
-	var wg sync.WaitGroup
+	return s.restoreTrackedMemory(writable, tracker, uses)
+}
 
-	for _, memory := range s.memoryLocations {
-		if !memory.writable {
-			continue
+// restoreTrackedMemory writes back the dirty pages of memories, widened to
+// whole huge pages where uses shows memory is backed by them
+func (s *State) restoreTrackedMemory(memories []*Memory, tracker DirtyTracker, uses map[int64]hugePageUse) error {
+	dirty, err := s.dirtyPages(memories, tracker)
+	if err != nil {
+		return err
+	}
+	for i, memory := range memories {
+		if uses[memory.startOffset].anonHuge > 0 {
+			widenToHugePages(memory, dirty[i])
 		}
+	}
 
-		wg.Add(1)
-		go func(memory *Memory) {
-			defer wg.Done()
-			err := s.singleMemoryRestoreDirtyPages(memory, memoryFile)
-			if err != nil {
-				log.Error(err)
-			}
-		}(memory)
+	if s.memoryIO == ProcMemIO {
+		return s.procMemRestorePages(memories, dirty)
 	}
 
-	wg.Wait()
+	var runs []ptrace.MemoryRun
+	for i, memory := range memories {
+		runs = append(runs, dirtyRuns(memory, dirty[i])...)
+	}
 
+	err = s.transferRuns(ptrace.WriteMemoryRuns, runs)
+	if err != nil {
+		return fmt.Errorf("could not write dirty pages: %s", err)
+	}
 	return nil
 }
 
-func (s *State) singleMemoryRestoreDirtyPages(memory *Memory, memoryFile *os.File) error {
-	// 64-bit entries
-	pagemapEntrySize := 8
-	pageSize := int64(os.Getpagesize())
-
-	startPage := memory.startOffset / pageSize
-	endPage := memory.endOffset / pageSize
-	numPages := endPage - startPage
-	pagemapStartOffset := startPage * int64(pagemapEntrySize)
-
+// dirtyPages asks tracker for the dirty pages of each memory location at once
+func (s *State) dirtyPages(memories []*Memory, tracker DirtyTracker) ([][]bool, error) {
+	dirty := make([][]bool, len(memories))
 	var wg sync.WaitGroup
-	parallelism := int64(8)
-
-	var batchSize int64 = numPages / parallelism
-	var remainder int64 = numPages % parallelism
+	errors := make(chan error, len(memories))
 
-	for i := int64(0); i < parallelism; i++ {
+	for i, memory := range memories {
 		wg.Add(1)
-		startIndex := i * batchSize
-		endIndex := startIndex + batchSize
-		if i == parallelism-1 {
-			endIndex = endIndex + remainder
-		}
-
-		s.restoreMemoryBatch(startIndex, endIndex, pagemapStartOffset, memory, memoryFile, &wg)
+		go func(i int, memory *Memory) {
+			defer wg.Done()
+			var err error
+			dirty[i], err = tracker.DirtyPages(s.pid, memory)
+			if err != nil {
+				errors <- fmt.Errorf("could not find dirty pages of %s at %x: %s", memory.name, memory.startOffset, err)
+			}
+		}(i, memory)
 	}
 
 	wg.Wait()
+	close(errors)
 
-	return nil
+	// nil when no memory location failed
+	return dirty, <-errors
 }
 
-func (s *State) restoreMemoryBatch(startIndex int64, endIndex int64, pagemapStartOffset int64, memory *Memory, memoryFile *os.File, wg *sync.WaitGroup) {
-	pagemapEntrySize := 8
-	pageSize := int64(os.Getpagesize())
-
-	var dirty int
-	go func(startIndex int64, endIndex int64) {
-		pagemap, err := os.OpenFile(fmt.Sprintf("/proc/%d/pagemap", s.pid), os.O_RDONLY, os.ModePerm)
-		if err != nil {
-			log.Errorf("could not open pid %d pagemap: %s", s.pid, err)
+// dirtyRuns lists the saved content of each dirty page of memory. Runs of
+// consecutive pages are coalesced when they are copied.
+func dirtyRuns(memory *Memory, dirty []bool) []ptrace.MemoryRun {
+	pageSize := os.Getpagesize()
+	var runs []ptrace.MemoryRun
+	for i, dirtySet := range dirty {
+		if !dirtySet {
+			continue
 		}
-		defer pagemap.Close()
 
-		_, err = pagemap.Seek(pagemapStartOffset+(startIndex*int64(pagemapEntrySize)), 0)
-		if err != nil {
-			log.Errorf("could not seek pid %d pagemap: %s", s.pid, err)
-		}
+		runs = append(runs, ptrace.MemoryRun{
+			Address: uintptr(memory.startOffset) + uintptr(i*pageSize),
+			Local:   memory.page(i),
+		})
+	}
+	return runs
+}
 
-		var sectionOffset = startIndex * pageSize
-		var currentPageOffset = memory.startOffset + sectionOffset
-		var currentByteNum = int(sectionOffset)
-		entryBytes := make([]byte, pagemapEntrySize)
-		for i := startIndex; i < endIndex; i++ {
+// transferRuns splits runs into one share of about the same size for each
+// concurrent transfer, so each share takes as few calls as possible
+func (s *State) transferRuns(transfer func(int, []ptrace.MemoryRun) error, runs []ptrace.MemoryRun) error {
+	total := 0
+	for _, run := range runs {
+		total += len(run.Local)
+	}
+	if total == 0 {
+		return nil
+	}
 
-			read, err := pagemap.Read(entryBytes)
-			if err != nil || read != pagemapEntrySize {
-				log.Errorf("could not read pid %d pagemap: %s", s.pid, err)
+	// Whole pages, so a page is never split between shares
+	pageSize := os.Getpagesize()
+	shareSize := (total/s.IOConcurrency() + pageSize - 1) &^ (pageSize - 1)
+
+	var shares [][]ptrace.MemoryRun
+	var share []ptrace.MemoryRun
+	size := 0
+	for _, run := range runs {
+		for len(run.Local) > 0 {
+			take := shareSize - size
+			if take > len(run.Local) {
+				take = len(run.Local)
+			}
+			share = append(share, ptrace.MemoryRun{Address: run.Address, Local: run.Local[:take]})
+			run.Address += uintptr(take)
+			run.Local = run.Local[take:]
+
+			size += take
+			if size == shareSize {
+				shares = append(shares, share)
+				share, size = nil, 0
 			}
+		}
+	}
+	if len(share) > 0 {
+		shares = append(shares, share)
+	}
 
-			// 55th bit is soft/dirty bit. Arch is little-endian
-			dirtySet := entryBytes[6] >> 7
-			if dirtySet == byte(1) {
-				dirty++
-				thisPage := memory.content[currentByteNum : currentByteNum+int(pageSize)]
-				read, err = memoryFile.WriteAt(thisPage, currentPageOffset)
-				if err != nil || int64(read) != pageSize {
-					log.Errorf("could not read pid /proc/%d/map: %s", s.pid, err)
-				}
-				// spew.Dump(thisPage)
+	var wg sync.WaitGroup
+	errors := make(chan error, len(shares))
+	for _, share := range shares {
+		wg.Add(1)
+		go func(share []ptrace.MemoryRun) {
+			defer wg.Done()
+			err := transfer(s.pid, share)
+			if err != nil {
+				errors <- fmt.Errorf("pid %d: %s", s.pid, err)
 			}
+		}(share)
+	}
 
-			currentPageOffset += pageSize
-			currentByteNum += int(pageSize)
-		}
+	wg.Wait()
+	close(errors)
 
-		wg.Done()
-	}(startIndex, endIndex)
+	return <-errors
 }
 
+// CountDirtyPages counts the soft-dirty pages of a memory location
 func (s *State) CountDirtyPages(memoryName string) (int, error) {
 	memory, err := s.getMemory(memoryName)
 	if err != nil {
 		return 0, err
 	}
 
-	pagemap, err := os.OpenFile(fmt.Sprintf("/proc/%d/pagemap", s.pid), os.O_RDONLY, os.ModePerm)
-	if err != nil {
-		return 0, fmt.Errorf("could not open pid %d pagemap: %s", s.pid, err)
-	}
-	defer pagemap.Close()
-
-	// 64-bit entries
-	pagemapEntrySize := 8
 	pageSize := int64(os.Getpagesize())
-
-	startPage := memory.startOffset / pageSize
-	endPage := memory.endOffset / pageSize
-	numPages := endPage - startPage
-	pagemapStartOffset := startPage * int64(pagemapEntrySize)
-
-	_, err = pagemap.Seek(pagemapStartOffset, 0)
+	dirtyPages, err := softDirtyBits(s.pid, memory.startOffset/pageSize, memory.endOffset/pageSize)
 	if err != nil {
-		return 0, fmt.Errorf("could not seek pid %d pagemap: %s", s.pid, err)
+		return 0, err
 	}
 
 	var dirty int
-	var currentPageOffset = memory.startOffset
-	entryBytes := make([]byte, pagemapEntrySize)
-	for i := int64(0); i < numPages; i++ {
-
-		read, err := pagemap.Read(entryBytes)
-		if err != nil || read != pagemapEntrySize {
-			return 0, fmt.Errorf("could not read pid %d pagemap: %s", s.pid, err)
-		}
-
-		// 55th bit is soft/dirty bit. Arch is little-endian
-		dirtySet := entryBytes[6] >> 7
-		if dirtySet == byte(1) {
+	for _, dirtySet := range dirtyPages {
+		if dirtySet {
 			dirty++
 		}
-
-		currentPageOffset += pageSize
 	}
 
 	return dirty, nil
@@ -0,0 +1,307 @@
+package state
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+type pageHash [sha256.Size]byte
+
+var (
+	// zeroPage stands in for all-zero pages, which are never stored. It is
+	// only ever read.
+	zeroPage     = make([]byte, os.Getpagesize())
+	zeroPageHash = pageHash(sha256.Sum256(zeroPage))
+)
+
+// ErrMemoryLimit is returned when storing a checkpoint's pages would take
+// a page store over its limit
+var ErrMemoryLimit = errors.New("checkpoint memory limit reached")
+
+// PageStore holds saved pages by the hash of their content, so checkpoints
+// with identical pages, such as those of workers of one runtime, share a
+// single copy. All-zero pages are not stored. Pages are kept in memory mapped
+// outside the Go heap, which is unmapped once no checkpoint refers to it.
+type PageStore struct {
+	mutex sync.Mutex
+	pages map[pageHash]*storedPage
+	limit int
+	// Slabs with free pages
+	available []*pageSlab
+}
+
+type storedPage struct {
+	slab  *pageSlab
+	index int
+	refs  int
+}
+
+func NewPageStore() *PageStore {
+	return &PageStore{
+		pages: make(map[pageHash]*storedPage),
+	}
+}
+
+// NewLimitedPageStore returns a store that holds at most limit bytes of pages
+func NewLimitedPageStore(limit int) *PageStore {
+	store := NewPageStore()
+	store.limit = limit
+	return store
+}
+
+// Pages is how many distinct non-zero pages are stored
+func (p *PageStore) Pages() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.pages)
+}
+
+// Size is how many bytes of page content are stored
+func (p *PageStore) Size() int {
+	return p.Pages() * os.Getpagesize()
+}
+
+// Limit is the most bytes of pages the store holds, or 0 for no limit
+func (p *PageStore) Limit() int {
+	return p.limit
+}
+
+// add references each page of content, copying in those not yet stored. It
+// returns the stored pages, with nil for all-zero pages. Nothing is stored if
+// the new pages would go over the limit.
+func (p *PageStore) add(hashes []pageHash, content []byte) ([][]byte, error) {
+	pageSize := os.Getpagesize()
+	pages := make([][]byte, len(hashes))
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.limit > 0 {
+		added := make(map[pageHash]bool)
+		for _, hash := range hashes {
+			if hash != zeroPageHash && p.pages[hash] == nil {
+				added[hash] = true
+			}
+		}
+		if (len(p.pages)+len(added))*pageSize > p.limit {
+			return nil, fmt.Errorf("storing %d new pages: %w", len(added), ErrMemoryLimit)
+		}
+	}
+
+	for i, hash := range hashes {
+		if hash == zeroPageHash {
+			continue
+		}
+
+		stored, exists := p.pages[hash]
+		if !exists {
+			var err error
+			stored, err = p.allocate()
+			if err != nil {
+				p.releaseLocked(hashes[:i])
+				return nil, err
+			}
+			copy(stored.slab.page(stored.index), content[i*pageSize:(i+1)*pageSize])
+			p.pages[hash] = stored
+		}
+		stored.refs++
+		pages[i] = stored.slab.page(stored.index)
+	}
+
+	return pages, nil
+}
+
+// allocate finds a free page, mapping a new slab if there is none
+func (p *PageStore) allocate() (*storedPage, error) {
+	if len(p.available) == 0 {
+		slab, err := newPageSlab()
+		if err != nil {
+			return nil, err
+		}
+		p.available = append(p.available, slab)
+	}
+
+	slab := p.available[len(p.available)-1]
+	index := slab.allocate()
+	if len(slab.free) == 0 {
+		p.available = p.available[:len(p.available)-1]
+	}
+	return &storedPage{slab: slab, index: index}, nil
+}
+
+// release drops a reference to each non-zero page, freeing pages no
+// checkpoint refers to
+func (p *PageStore) release(hashes []pageHash) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.releaseLocked(hashes)
+}
+
+func (p *PageStore) releaseLocked(hashes []pageHash) {
+	for _, hash := range hashes {
+		stored, exists := p.pages[hash]
+		if !exists {
+			continue
+		}
+
+		stored.refs--
+		if stored.refs == 0 {
+			delete(p.pages, hash)
+			p.free(stored)
+		}
+	}
+}
+
+// free returns a page to its slab, unmapping the slab once it is empty
+func (p *PageStore) free(stored *storedPage) {
+	slab := stored.slab
+	slab.free = append(slab.free, stored.index)
+	if len(slab.free) == 1 {
+		p.available = append(p.available, slab)
+	}
+	if len(slab.free) < slabPages {
+		return
+	}
+
+	for i, available := range p.available {
+		if available == slab {
+			p.available = append(p.available[:i], p.available[i+1:]...)
+			break
+		}
+	}
+	err := slab.unmap()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not unmap page slab: %s\n", err)
+	}
+}
+
+// hashPages hashes each page of content
+func hashPages(content []byte) []pageHash {
+	pageSize := os.Getpagesize()
+	hashes := make([]pageHash, len(content)/pageSize)
+	for i := range hashes {
+		page := content[i*pageSize : (i+1)*pageSize]
+		if isZero(page) {
+			hashes[i] = zeroPageHash
+			continue
+		}
+		hashes[i] = sha256.Sum256(page)
+	}
+	return hashes
+}
+
+func isZero(page []byte) bool {
+	for _, b := range page {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// SetPageStore chooses the store pages are saved to from now on
+func (s *State) SetPageStore(store *PageStore) {
+	s.store = store
+}
+
+func (s *State) pageStore() *PageStore {
+	if s.store == nil {
+		s.store = NewPageStore()
+	}
+	return s.store
+}
+
+// storeContent replaces the saved pages of each memory with its content,
+// kept in the state's page store. If the store cannot take all the content,
+// no memory's saved pages change.
+func (s *State) storeContent(memories []*Memory, contents [][]byte) error {
+	store := s.pageStore()
+
+	hashes := make([][]pageHash, len(memories))
+	var wg sync.WaitGroup
+	for i := range memories {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			hashes[i] = hashPages(contents[i])
+		}(i)
+	}
+	wg.Wait()
+
+	pages := make([][][]byte, len(memories))
+	for i := range memories {
+		var err error
+		pages[i], err = store.add(hashes[i], contents[i])
+		if err != nil {
+			for _, added := range hashes[:i] {
+				store.release(added)
+			}
+			return fmt.Errorf("could not store pages of %s at %x: %w", memories[i].name, memories[i].startOffset, err)
+		}
+	}
+
+	for i, memory := range memories {
+		store.release(memory.hashes)
+		memory.hashes = hashes[i]
+		memory.pages = pages[i]
+	}
+	return nil
+}
+
+// Release drops the state's references to its saved pages, so pages no
+// other checkpoint shares can be freed. The state cannot be restored after.
+func (s *State) Release() {
+	for _, memory := range s.memoryLocations {
+		if memory.hashes == nil {
+			continue
+		}
+
+		s.store.release(memory.hashes)
+		memory.hashes = nil
+		memory.pages = nil
+	}
+}
+
+// saved is true once the memory's pages have been saved
+func (m *Memory) saved() bool {
+	return m.hashes != nil
+}
+
+// page is saved page i of memory
+func (m *Memory) page(i int) []byte {
+	if m.pages[i] == nil {
+		return zeroPage
+	}
+	return m.pages[i]
+}
+
+// MemorySize is the size of a checkpoint's saved pages
+type MemorySize struct {
+	// Logical counts every saved page
+	Logical int
+	// Deduplicated counts each distinct non-zero page once. Other
+	// checkpoints in the same page store may share these pages.
+	Deduplicated int
+}
+
+func (s *State) MemorySize() MemorySize {
+	pageSize := os.Getpagesize()
+	distinct := make(map[pageHash]bool)
+
+	var size MemorySize
+	for _, memory := range s.memoryLocations {
+		size.Logical += len(memory.hashes) * pageSize
+		for i, hash := range memory.hashes {
+			if memory.pages[i] == nil || distinct[hash] {
+				continue
+			}
+			distinct[hash] = true
+			size.Deduplicated += pageSize
+		}
+	}
+
+	return size
+}
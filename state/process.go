@@ -0,0 +1,291 @@
+package state
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// How long killed processes get to become zombies or disappear
+const reapTimeout = time.Second
+
+type processInfo struct {
+	ppid      int
+	state     byte
+	startTime uint64
+}
+
+func readProcessInfo(pid int) (*processInfo, error) {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	// comm may contain spaces and brackets, so fields start after the last ')'
+	commEnd := strings.LastIndexByte(string(stat), ')')
+	if commEnd < 0 {
+		return nil, fmt.Errorf("could not parse stat of %d", pid)
+	}
+	fields := strings.Fields(string(stat[commEnd+1:]))
+	if len(fields) < 20 {
+		return nil, fmt.Errorf("could not parse stat of %d", pid)
+	}
+
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("could not parse ppid of %d: %s", pid, err)
+	}
+	startTime, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse start time of %d: %s", pid, err)
+	}
+
+	return &processInfo{
+		ppid:      ppid,
+		state:     fields[0][0],
+		startTime: startTime,
+	}, nil
+}
+
+// newContainerProcesses maps the other processes in pid's container to their
+// start times, so a reused pid is not mistaken for a checkpointed process. They
+// are listed from the container's cgroup, which keeps processes that leave
+// pid's process tree, as by double forking. Processes without a cgroup of
+// their own, such as local workers sharing the invoker's, list pid's
+// descendants instead.
+func newContainerProcesses(pid int) (map[int]uint64, error) {
+	procsPath, err := cgroupProcsPath(pid)
+	if err != nil {
+		return nil, err
+	}
+	ownProcsPath, err := cgroupProcsPath(os.Getpid())
+	if err != nil {
+		return nil, err
+	}
+	if procsPath == "" || procsPath == ownProcsPath {
+		return newDescendants(pid)
+	}
+
+	procs, err := ioutil.ReadFile(procsPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %s", procsPath, err)
+	}
+
+	processes := make(map[int]uint64)
+	for _, field := range strings.Fields(string(procs)) {
+		member, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse pid in %s: %s", procsPath, err)
+		}
+		if member == pid {
+			continue
+		}
+
+		info, err := readProcessInfo(member)
+		if err != nil {
+			// Exited while listing
+			continue
+		}
+		processes[member] = info.startTime
+	}
+
+	return processes, nil
+}
+
+// cgroupProcsPath is the cgroup.procs file of pid's cgroup in the v1 pids
+// hierarchy, or else the unified hierarchy. It is empty when neither is
+// mounted.
+func cgroupProcsPath(pid int) (string, error) {
+	cgroups, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", fmt.Errorf("could not read cgroups of %d: %s", pid, err)
+	}
+
+	// Lines are hierarchy-ID:controllers:path, with no controllers in the
+	// unified hierarchy
+	var pidsDirs []string
+	var unifiedDirs []string
+	for _, line := range strings.Split(strings.TrimSpace(string(cgroups)), "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[1] == "" {
+			unifiedDirs = append(unifiedDirs, filepath.Join("/sys/fs/cgroup", fields[2]), filepath.Join("/sys/fs/cgroup/unified", fields[2]))
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			if controller == "pids" {
+				pidsDirs = append(pidsDirs, filepath.Join("/sys/fs/cgroup/pids", fields[2]))
+			}
+		}
+	}
+
+	for _, dir := range append(pidsDirs, unifiedDirs...) {
+		procsPath := filepath.Join(dir, "cgroup.procs")
+		_, err := os.Stat(procsPath)
+		if err == nil {
+			return procsPath, nil
+		}
+	}
+	return "", nil
+}
+
+// newDescendants maps every process descended from pid to its start time
+func newDescendants(pid int) (map[int]uint64, error) {
+	procEntries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, fmt.Errorf("could not read /proc: %s", err)
+	}
+
+	children := make(map[int][]int)
+	infos := make(map[int]*processInfo)
+	for _, entry := range procEntries {
+		entryPid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		info, err := readProcessInfo(entryPid)
+		if err != nil {
+			// Exited while scanning
+			continue
+		}
+		infos[entryPid] = info
+		children[info.ppid] = append(children[info.ppid], entryPid)
+	}
+
+	descendants := make(map[int]uint64)
+	toVisit := children[pid]
+	for len(toVisit) > 0 {
+		next := toVisit[0]
+		toVisit = toVisit[1:]
+		descendants[next] = infos[next].startTime
+		toVisit = append(toVisit, children[next]...)
+	}
+
+	return descendants, nil
+}
+
+// NewProcesses returns the processes in the process's container started
+// since the checkpoint
+func (s *State) NewProcesses() ([]int, error) {
+	current, err := newContainerProcesses(s.pid)
+	if err != nil {
+		return nil, err
+	}
+
+	var newPids []int
+	for pid, startTime := range current {
+		checkpointStartTime, ok := s.processes[pid]
+		if !ok || checkpointStartTime != startTime {
+			newPids = append(newPids, pid)
+		}
+	}
+
+	return newPids, nil
+}
+
+// KillNewProcesses SIGKILLs processes started since the checkpoint and
+// reaps the ones left as zombie children of the process. It returns how
+// many processes were killed.
+func (s *State) KillNewProcesses() (int, error) {
+	newPids, err := s.NewProcesses()
+	if err != nil {
+		return 0, err
+	}
+
+	killed := 0
+	for _, pid := range newPids {
+		err := syscall.Kill(pid, syscall.SIGKILL)
+		if err == syscall.ESRCH {
+			continue
+		}
+		if err != nil {
+			return killed, fmt.Errorf("could not kill process %d: %s", pid, err)
+		}
+		killed++
+	}
+
+	// Orphans are reparented as their parents die, possibly to the process
+	// itself, so keep checking until every killed process is dead
+	deadline := time.Now().Add(reapTimeout)
+	remaining := newPids
+	for len(remaining) > 0 {
+		infos := make(map[int]*processInfo)
+		for _, pid := range remaining {
+			info, err := readProcessInfo(pid)
+			if err == nil {
+				infos[pid] = info
+			}
+		}
+
+		var stillThere []int
+		for pid, info := range infos {
+			_, parentKilled := infos[info.ppid]
+			if info.state == 'Z' && !parentKilled {
+				// Other zombies are reaped by whichever process they now belong to
+				if info.ppid == s.pid {
+					err := s.reap(pid)
+					if err != nil {
+						return killed, fmt.Errorf("could not reap process %d: %s", pid, err)
+					}
+				}
+				continue
+			}
+			stillThere = append(stillThere, pid)
+		}
+
+		remaining = stillThere
+		if len(remaining) > 0 {
+			if time.Now().After(deadline) {
+				return killed, fmt.Errorf("killed processes %v were not reaped", remaining)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	return killed, nil
+}
+
+// reap waits on a zombie child from inside the process
+func (s *State) reap(pid int) error {
+	nsPid, err := namespacePid(pid)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.remoteTask().RemoteSyscall(unix.SYS_WAIT4, uint64(nsPid), 0, unix.WALL, 0)
+	return err
+}
+
+// namespacePid is the pid of a process as seen from its own pid namespace
+func namespacePid(pid int) (int, error) {
+	status, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, fmt.Errorf("could not open status of %d: %s", pid, err)
+	}
+	defer status.Close()
+
+	scanner := bufio.NewScanner(status)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[0] == "NSpid:" {
+			return strconv.Atoi(fields[len(fields)-1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("could not scan status of %d: %s", pid, err)
+	}
+
+	// Kernels without NSpid do not nest pid namespaces in status
+	return pid, nil
+}
@@ -0,0 +1,108 @@
+package state_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ostenbom/refunction/controller/ptrace"
+	. "github.com/ostenbom/refunction/state"
+)
+
+// Once ready, starts a sleep orphaned by its parent when a line is read, and
+// prints its pid
+var doubleFork = `import os, subprocess, sys, time
+print('ready', flush=True)
+sys.stdin.readline()
+if os.fork() == 0:
+    print(subprocess.Popen(['sleep', '60']).pid, flush=True)
+    os._exit(0)
+os.wait()
+time.sleep(60)
+`
+
+var _ = Describe("Processes", func() {
+	var (
+		cgroup string
+		cmd    *exec.Cmd
+		stdin  io.WriteCloser
+		stdout *bufio.Reader
+		task   *ptrace.TraceTask
+		saved  *State
+	)
+
+	BeforeEach(func() {
+		hierarchy := "/sys/fs/cgroup/pids"
+		if _, err := os.Stat(hierarchy); err != nil {
+			hierarchy = "/sys/fs/cgroup"
+		}
+		cgroup = filepath.Join(hierarchy, fmt.Sprintf("refunction-test-%d", os.Getpid()))
+		if err := os.Mkdir(cgroup, 0755); err != nil {
+			Skip(fmt.Sprintf("could not make a cgroup: %s", err))
+		}
+
+		cmd = exec.Command("python3", "-c", doubleFork)
+		var err error
+		stdin, err = cmd.StdinPipe()
+		Expect(err).NotTo(HaveOccurred())
+		out, err := cmd.StdoutPipe()
+		Expect(err).NotTo(HaveOccurred())
+		stdout = bufio.NewReader(out)
+		Expect(cmd.Start()).To(Succeed())
+		ready, err := stdout.ReadString('\n')
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ready).To(Equal("ready\n"))
+		pid := cmd.Process.Pid
+		Expect(ioutil.WriteFile(filepath.Join(cgroup, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)).To(Succeed())
+
+		task, err = ptrace.NewTraceTask(pid, pid, ptrace.Options{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(task.Stop()).To(Succeed())
+		saved, err = NewState(pid, map[int]*ptrace.TraceTask{pid: task})
+		Expect(err).NotTo(HaveOccurred())
+		task.Continue <- 0
+		<-task.HasContinued
+	})
+
+	AfterEach(func() {
+		if cmd == nil {
+			return
+		}
+		saved.Release()
+		Expect(task.Stop()).To(Succeed())
+		task.Detach <- 1
+		<-task.HasDetached
+		cmd.Process.Kill()
+		cmd.Wait()
+		cmd = nil
+		Eventually(func() error { return os.Remove(cgroup) }).Should(Succeed())
+	})
+
+	It("finds and kills processes that left the process tree", func() {
+		_, err := stdin.Write([]byte("fork\n"))
+		Expect(err).NotTo(HaveOccurred())
+		line, err := stdout.ReadString('\n')
+		Expect(err).NotTo(HaveOccurred())
+		orphan, err := strconv.Atoi(strings.TrimSpace(line))
+		Expect(err).NotTo(HaveOccurred())
+		defer syscall.Kill(orphan, syscall.SIGKILL)
+
+		// The orphan's parent is new too until it exits
+		Eventually(func() ([]int, error) { return saved.NewProcesses() }).Should(ConsistOf(orphan))
+
+		killed, err := saved.KillNewProcesses()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(killed).To(Equal(1))
+		Eventually(func() ([]int, error) { return saved.NewProcesses() }).Should(BeEmpty())
+	})
+})
@@ -0,0 +1,146 @@
+package state
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// MemoryIO is how checkpoint memory is copied to and from the process
+type MemoryIO int
+
+const (
+	// ProcessVMIO coalesces pages into runs copied with process_vm_readv and
+	// process_vm_writev
+	ProcessVMIO MemoryIO = iota
+	// ProcMemIO reads whole mappings and writes single pages through
+	// /proc/pid/mem
+	ProcMemIO
+)
+
+const defaultIOConcurrency = 8
+
+func (io MemoryIO) String() string {
+	if io == ProcMemIO {
+		return "proc-mem"
+	}
+	return "process-vm"
+}
+
+// SetMemoryIO chooses how pages are copied, and how many copies run at once
+func (s *State) SetMemoryIO(io MemoryIO, concurrency int) {
+	s.memoryIO = io
+	s.ioConcurrency = concurrency
+}
+
+// MemoryIO is how pages are copied
+func (s *State) MemoryIO() MemoryIO {
+	return s.memoryIO
+}
+
+// IOConcurrency is how many page copies run at once
+func (s *State) IOConcurrency() int {
+	if s.ioConcurrency < 1 {
+		return defaultIOConcurrency
+	}
+	return s.ioConcurrency
+}
+
+func (s *State) procMemSavePages(memories []*Memory, contents [][]byte) error {
+	memoryFile, err := os.OpenFile(fmt.Sprintf("/proc/%d/mem", s.pid), os.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("could not open /proc/pid/mem: %s", err)
+	}
+	defer memoryFile.Close()
+
+	for i, memory := range memories {
+		read, err := memoryFile.ReadAt(contents[i], memory.startOffset)
+		if err != nil || read != len(contents[i]) {
+			return fmt.Errorf("could not read /proc/pid/mem data: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *State) procMemRestorePages(memories []*Memory, dirty [][]bool) error {
+	memoryFile, err := os.OpenFile(fmt.Sprintf("/proc/%d/mem", s.pid), os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("could not open /proc/pid/mem: %s", err)
+	}
+	defer memoryFile.Close()
+
+	var wg sync.WaitGroup
+	errors := make(chan error, len(memories))
+
+	for i, memory := range memories {
+		wg.Add(1)
+		go func(memory *Memory, dirty []bool) {
+			defer wg.Done()
+			err := s.singleMemoryRestoreDirtyPages(memory, memoryFile, dirty)
+			if err != nil {
+				errors <- err
+			}
+		}(memory, dirty[i])
+	}
+
+	wg.Wait()
+	close(errors)
+
+	// nil when no memory location failed
+	return <-errors
+}
+
+func (s *State) singleMemoryRestoreDirtyPages(memory *Memory, memoryFile *os.File, dirty []bool) error {
+	numPages := int64(len(dirty))
+	var wg sync.WaitGroup
+	parallelism := int64(s.IOConcurrency())
+	errors := make(chan error, parallelism)
+
+	var batchSize int64 = numPages / parallelism
+	var remainder int64 = numPages % parallelism
+
+	for i := int64(0); i < parallelism; i++ {
+		wg.Add(1)
+		startIndex := i * batchSize
+		endIndex := startIndex + batchSize
+		if i == parallelism-1 {
+			endIndex = endIndex + remainder
+		}
+
+		s.restoreMemoryBatch(dirty[startIndex:endIndex], startIndex, memory, memoryFile, &wg, errors)
+	}
+
+	wg.Wait()
+	close(errors)
+
+	err := <-errors
+	if err != nil {
+		return fmt.Errorf("could not restore %s at %x: %s", memory.name, memory.startOffset, err)
+	}
+
+	return nil
+}
+
+func (s *State) restoreMemoryBatch(dirty []bool, startIndex int64, memory *Memory, memoryFile *os.File, wg *sync.WaitGroup, errors chan<- error) {
+	pageSize := int64(os.Getpagesize())
+
+	go func() {
+		defer wg.Done()
+
+		var sectionOffset = startIndex * pageSize
+		var currentPageOffset = memory.startOffset + sectionOffset
+		for i, dirtySet := range dirty {
+			if dirtySet {
+				thisPage := memory.page(int(startIndex) + i)
+				written, err := memoryFile.WriteAt(thisPage, currentPageOffset)
+				if err != nil || int64(written) != pageSize {
+					errors <- fmt.Errorf("could not write pid %d page at %x: %s", s.pid, currentPageOffset, err)
+					return
+				}
+			}
+
+			currentPageOffset += pageSize
+		}
+	}()
+}
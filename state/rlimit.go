@@ -11,9 +11,22 @@ type Rlimits map[int]*unix.Rlimit
 
 func resourceList() []int {
 	return []int{
-		unix.RLIMIT_AS,
+		unix.RLIMIT_CPU,
+		unix.RLIMIT_FSIZE,
 		unix.RLIMIT_DATA,
 		unix.RLIMIT_STACK,
+		unix.RLIMIT_CORE,
+		unix.RLIMIT_RSS,
+		unix.RLIMIT_NPROC,
+		unix.RLIMIT_NOFILE,
+		unix.RLIMIT_MEMLOCK,
+		unix.RLIMIT_AS,
+		unix.RLIMIT_LOCKS,
+		unix.RLIMIT_SIGPENDING,
+		unix.RLIMIT_MSGQUEUE,
+		unix.RLIMIT_NICE,
+		unix.RLIMIT_RTPRIO,
+		unix.RLIMIT_RTTIME,
 	}
 }
 
@@ -44,3 +57,25 @@ func prlimit(pid int, resource int, oldRlimit *unix.Rlimit, newRlimit *unix.Rlim
 func (s *State) GetRlimits() Rlimits {
 	return s.rlimits
 }
+
+// RestoreRlimits sets every limit that changed since the checkpoint back
+func (s *State) RestoreRlimits() error {
+	for resource, rlimit := range s.rlimits {
+		current := new(unix.Rlimit)
+		err := prlimit(s.pid, resource, current, nil)
+		if err != nil {
+			return fmt.Errorf("could not get rlimit %d: %s", resource, err)
+		}
+
+		if *current == *rlimit {
+			continue
+		}
+
+		err = prlimit(s.pid, resource, nil, rlimit)
+		if err != nil {
+			return fmt.Errorf("could not set rlimit %d: %s", resource, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,266 @@
+package state
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/ostenbom/refunction/controller/ptrace"
+	"golang.org/x/sys/unix"
+)
+
+const numSignals = 64
+
+const (
+	sigDfl = 0
+	sigIgn = 1
+)
+
+// SIGKILL and SIGSTOP cannot be caught, ignored or blocked. Stopping the
+// process for restore also relies on SIGSTOP.
+const unchangeableSignals = 1<<(syscall.SIGKILL-1) | 1<<(syscall.SIGSTOP-1)
+
+func sigBit(sig int) uint64 {
+	return 1 << uint(sig-1)
+}
+
+type signalStatus struct {
+	pending       uint64
+	sharedPending uint64
+	blocked       uint64
+	ignored       uint64
+	caught        uint64
+}
+
+func readSignalStatus(path string) (*signalStatus, error) {
+	status, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %s", path, err)
+	}
+	defer status.Close()
+
+	var signals signalStatus
+	fields := map[string]*uint64{
+		"SigPnd:": &signals.pending,
+		"ShdPnd:": &signals.sharedPending,
+		"SigBlk:": &signals.blocked,
+		"SigIgn:": &signals.ignored,
+		"SigCgt:": &signals.caught,
+	}
+
+	scanner := bufio.NewScanner(status)
+	for scanner.Scan() {
+		line := strings.Fields(scanner.Text())
+		if len(line) != 2 {
+			continue
+		}
+		field, ok := fields[line[0]]
+		if !ok {
+			continue
+		}
+		*field, err = strconv.ParseUint(line[1], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s in %s: %s", line[0], path, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not scan %s: %s", path, err)
+	}
+
+	return &signals, nil
+}
+
+func taskStatusPath(pid int, tid int) string {
+	return fmt.Sprintf("/proc/%d/task/%d/status", pid, tid)
+}
+
+// getSigmask must be called from the tracing thread of tid
+func getSigmask(tid int) (uint64, error) {
+	var mask uint64
+	_, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, unix.PTRACE_GETSIGMASK, uintptr(tid), unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask)), 0, 0)
+	if errno != 0 {
+		return 0, fmt.Errorf("could not get signal mask of %d: %s", tid, errno)
+	}
+	return mask, nil
+}
+
+// setSigmask must be called from the tracing thread of tid
+func setSigmask(tid int, mask uint64) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, unix.PTRACE_SETSIGMASK, uintptr(tid), unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask)), 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("could not set signal mask of %d: %s", tid, errno)
+	}
+	return nil
+}
+
+// saveSignals records pending signals and the process's signal actions.
+// Blocked masks are saved along with the registers of each task.
+func (s *State) saveSignals() error {
+	processSignals, err := readSignalStatus(fmt.Sprintf("/proc/%d/status", s.pid))
+	if err != nil {
+		return err
+	}
+	s.ignoredSignals = processSignals.ignored
+	s.sharedPending = processSignals.sharedPending
+
+	for tid, regState := range s.registers {
+		taskSignals, err := readSignalStatus(taskStatusPath(s.pid, tid))
+		if err != nil {
+			return err
+		}
+		regState.pending = taskSignals.pending
+		s.registers[tid] = regState
+	}
+
+	// Only caught signals have more to their action than the handler
+	s.sigactions = make(map[int]ptrace.Sigaction)
+	for sig := 1; sig <= numSignals; sig++ {
+		if processSignals.caught&sigBit(sig) == 0 {
+			continue
+		}
+		action, err := s.remoteTask().RemoteRtSigaction(sig, nil)
+		if err != nil {
+			return fmt.Errorf("could not get action of signal %d: %s", sig, err)
+		}
+		s.sigactions[sig] = action
+	}
+
+	return nil
+}
+
+// RestoreSignals discards signals that became pending after the checkpoint,
+// then puts back the signal actions and each task's blocked mask. Signals
+// pending at checkpoint time that were delivered since, or discarded along
+// with new instances of the same signal, are raised again while blocked, so
+// they are pending once more. It reports whether any syscalls were run in the
+// process.
+func (s *State) RestoreSignals() (bool, error) {
+	processSignals, err := readSignalStatus(fmt.Sprintf("/proc/%d/status", s.pid))
+	if err != nil {
+		return false, err
+	}
+
+	newPending := processSignals.sharedPending &^ s.sharedPending
+	taskSignals := make(map[int]*signalStatus)
+	for tid, regState := range s.registers {
+		signals, err := readSignalStatus(taskStatusPath(s.pid, tid))
+		if err != nil {
+			return false, err
+		}
+		taskSignals[tid] = signals
+		newPending |= signals.pending &^ regState.pending
+	}
+	newPending &^= unchangeableSignals
+
+	ranSyscalls := false
+
+	// Setting a signal to be ignored discards any pending instances of it, in
+	// every task
+	ignore := ptrace.Sigaction{Handler: sigIgn}
+	for sig := 1; sig <= numSignals; sig++ {
+		if newPending&sigBit(sig) == 0 {
+			continue
+		}
+		ranSyscalls = true
+		_, err := s.remoteTask().RemoteRtSigaction(sig, &ignore)
+		if err != nil {
+			return ranSyscalls, fmt.Errorf("could not discard pending signal %d: %s", sig, err)
+		}
+	}
+
+	for sig := 1; sig <= numSignals; sig++ {
+		bit := sigBit(sig)
+		if bit&unchangeableSignals != 0 {
+			continue
+		}
+
+		checkpointAction, checkpointCaught := s.sigactions[sig]
+		ignoredChanged := processSignals.ignored&bit != s.ignoredSignals&bit
+		// A caught signal's handler may have been swapped for another
+		if !checkpointCaught && processSignals.caught&bit == 0 && !ignoredChanged && newPending&bit == 0 {
+			continue
+		}
+
+		action := ptrace.Sigaction{Handler: sigDfl}
+		if checkpointCaught {
+			action = checkpointAction
+		} else if s.ignoredSignals&bit != 0 {
+			action.Handler = sigIgn
+		}
+
+		ranSyscalls = true
+		_, err := s.remoteTask().RemoteRtSigaction(sig, &action)
+		if err != nil {
+			return ranSyscalls, fmt.Errorf("could not restore action of signal %d: %s", sig, err)
+		}
+	}
+
+	for tid, regState := range s.registers {
+		if taskSignals[tid].blocked == regState.blocked {
+			continue
+		}
+
+		result := make(chan error)
+		regState.task.InStopFunction <- func(t *ptrace.TraceTask) {
+			result <- setSigmask(t.Tid, regState.blocked)
+		}
+		err := <-result
+		if err != nil {
+			return ranSyscalls, err
+		}
+	}
+
+	err = s.requeueSignals()
+	return ranSyscalls, err
+}
+
+// requeueSignals raises the signals pending at checkpoint time that are no
+// longer pending. New signals must already be discarded and blocked masks
+// restored. Signals that the tasks no longer block would be delivered rather
+// than left pending, so they are not raised. Their siginfo is lost, as the
+// checkpoint does not keep it.
+func (s *State) requeueSignals() error {
+	processSignals, err := readSignalStatus(fmt.Sprintf("/proc/%d/status", s.pid))
+	if err != nil {
+		return err
+	}
+
+	blockedByAll := ^uint64(0)
+	for _, regState := range s.registers {
+		blockedByAll &= regState.blocked
+	}
+
+	shared := s.sharedPending &^ processSignals.sharedPending &^ unchangeableSignals
+	for sig := 1; sig <= numSignals; sig++ {
+		if shared&sigBit(sig)&blockedByAll == 0 {
+			continue
+		}
+		err := syscall.Kill(s.pid, syscall.Signal(sig))
+		if err != nil {
+			return fmt.Errorf("could not raise pending signal %d: %s", sig, err)
+		}
+	}
+
+	for tid, regState := range s.registers {
+		taskSignals, err := readSignalStatus(taskStatusPath(s.pid, tid))
+		if err != nil {
+			return err
+		}
+		lost := regState.pending &^ taskSignals.pending &^ unchangeableSignals
+		for sig := 1; sig <= numSignals; sig++ {
+			if lost&sigBit(sig)&regState.blocked == 0 {
+				continue
+			}
+			err := syscall.Tgkill(s.pid, tid, syscall.Signal(sig))
+			if err != nil {
+				return fmt.Errorf("could not raise pending signal %d in task %d: %s", sig, tid, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package state_test
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ostenbom/refunction/controller/ptrace"
+	. "github.com/ostenbom/refunction/state"
+)
+
+// Blocks SIGUSR1 in its main thread and a second thread, whose tid it prints
+var blockingThreads = `import signal, threading, time
+signal.pthread_sigmask(signal.SIG_BLOCK, {signal.SIGUSR1})
+thread = threading.Thread(target=time.sleep, args=(60,))
+thread.start()
+print(thread.native_id, flush=True)
+time.sleep(60)
+`
+
+// pendingSignals is the SigPnd of a task
+func pendingSignals(pid int, tid int) uint64 {
+	status, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/task/%d/status", pid, tid))
+	Expect(err).NotTo(HaveOccurred())
+	for _, line := range strings.Split(string(status), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "SigPnd:" {
+			pending, err := strconv.ParseUint(fields[1], 16, 64)
+			Expect(err).NotTo(HaveOccurred())
+			return pending
+		}
+	}
+	Fail("no SigPnd in task status")
+	return 0
+}
+
+var _ = Describe("Signals", func() {
+	var (
+		cmd    *exec.Cmd
+		pid    int
+		thread int
+		tasks  map[int]*ptrace.TraceTask
+	)
+	usr1 := uint64(1) << (syscall.SIGUSR1 - 1)
+
+	BeforeEach(func() {
+		cmd = exec.Command("python3", "-c", blockingThreads)
+		stdout, err := cmd.StdoutPipe()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cmd.Start()).To(Succeed())
+		line, err := bufio.NewReader(stdout).ReadString('\n')
+		Expect(err).NotTo(HaveOccurred())
+		thread, err = strconv.Atoi(strings.TrimSpace(line))
+		Expect(err).NotTo(HaveOccurred())
+		pid = cmd.Process.Pid
+
+		tasks = make(map[int]*ptrace.TraceTask)
+		for _, tid := range []int{pid, thread} {
+			task, err := ptrace.NewTraceTask(tid, pid, ptrace.Options{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(task.Stop()).To(Succeed())
+			tasks[tid] = task
+		}
+	})
+
+	AfterEach(func() {
+		// Traced threads are not reaped after the kill until detached
+		for _, task := range tasks {
+			task.Detach <- 1
+			<-task.HasDetached
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	It("keeps signals pending in one task when discarding new ones in another", func() {
+		Expect(syscall.Tgkill(pid, pid, syscall.SIGUSR1)).To(Succeed())
+		saved, err := NewState(pid, tasks)
+		Expect(err).NotTo(HaveOccurred())
+		defer saved.Release()
+
+		Expect(syscall.Tgkill(pid, thread, syscall.SIGUSR1)).To(Succeed())
+		Expect(pendingSignals(pid, thread) & usr1).NotTo(BeZero())
+
+		_, err = saved.RestoreSignals()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pendingSignals(pid, pid) & usr1).NotTo(BeZero())
+		Expect(pendingSignals(pid, thread) & usr1).To(BeZero())
+	})
+})
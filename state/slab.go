@@ -0,0 +1,69 @@
+package state
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// slabPages is how many pages the page store maps at once
+const slabPages = 512
+
+// pageSlab is anonymous memory mapped outside the Go heap, so stored pages
+// add nothing to garbage collection
+type pageSlab struct {
+	memory []byte
+	free   []int
+}
+
+func newPageSlab() (*pageSlab, error) {
+	pageSize := os.Getpagesize()
+	memory, err := unix.Mmap(-1, 0, slabPages*pageSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return nil, fmt.Errorf("could not map page slab: %s", err)
+	}
+
+	free := make([]int, slabPages)
+	for i := range free {
+		free[i] = slabPages - 1 - i
+	}
+	return &pageSlab{memory: memory, free: free}, nil
+}
+
+func (s *pageSlab) page(index int) []byte {
+	pageSize := os.Getpagesize()
+	return s.memory[index*pageSize : (index+1)*pageSize : (index+1)*pageSize]
+}
+
+// allocate takes a free page of the slab, which must have one
+func (s *pageSlab) allocate() int {
+	index := s.free[len(s.free)-1]
+	s.free = s.free[:len(s.free)-1]
+	return index
+}
+
+func (s *pageSlab) unmap() error {
+	return unix.Munmap(s.memory)
+}
+
+// mapBuffer maps size bytes outside the Go heap for content on its way into
+// the page store. It is unmapped with unmapBuffer.
+func mapBuffer(size int) ([]byte, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	buffer, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return nil, fmt.Errorf("could not map %d byte buffer: %s", size, err)
+	}
+	return buffer, nil
+}
+
+func unmapBuffers(buffers [][]byte) {
+	for _, buffer := range buffers {
+		if buffer != nil {
+			unix.Munmap(buffer)
+		}
+	}
+}
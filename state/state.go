@@ -6,11 +6,17 @@ import (
 	"syscall"
 
 	"github.com/ostenbom/refunction/controller/ptrace"
+	"golang.org/x/sys/unix"
 )
 
 type TaskRegState struct {
-	task *ptrace.TraceTask
-	regs *syscall.PtraceRegs
+	task    *ptrace.TraceTask
+	regs    *syscall.PtraceRegs
+	xstate  []byte
+	blocked uint64
+	pending uint64
+	// Checkpoints read from older files have no credentials
+	credentials *credentials
 }
 
 type State struct {
@@ -19,6 +25,18 @@ type State struct {
 	memoryLocations []*Memory
 	fileDescriptors []*FileDescriptor
 	rlimits         Rlimits
+	processes       map[int]uint64
+	sigactions      map[int]ptrace.Sigaction
+	ignoredSignals  uint64
+	sharedPending   uint64
+	itimers         map[int]ptrace.Itimerval
+	posixTimers     map[int]ptrace.Itimerspec
+	memoryIO        MemoryIO
+	ioConcurrency   int
+	store           *PageStore
+	hugePageBytes   int64
+	cwd             string
+	umask           uint32
 }
 
 //NewState caller must ensure process stopped before getting state
@@ -26,7 +44,7 @@ func NewState(pid int, tasks map[int]*ptrace.TraceTask) (*State, error) {
 	var state State
 	state.registers = make(map[int]TaskRegState)
 
-	errors := make(chan error)
+	errors := make(chan error, len(tasks))
 	results := make(chan TaskRegState, len(tasks))
 	var wg sync.WaitGroup
 	for _, task := range tasks {
@@ -37,10 +55,23 @@ func NewState(pid int, tasks map[int]*ptrace.TraceTask) (*State, error) {
 			err := syscall.PtraceGetRegs(t.Tid, &regs)
 			if err != nil {
 				errors <- err
+				return
+			}
+			xstate, err := getXstate(t.Tid)
+			if err != nil {
+				errors <- err
+				return
+			}
+			blocked, err := getSigmask(t.Tid)
+			if err != nil {
+				errors <- err
+				return
 			}
 			results <- TaskRegState{
-				task: t,
-				regs: &regs,
+				task:    t,
+				regs:    &regs,
+				xstate:  xstate,
+				blocked: blocked,
 			}
 		}
 	}
@@ -75,20 +106,55 @@ func NewState(pid int, tasks map[int]*ptrace.TraceTask) (*State, error) {
 	}
 	state.rlimits = rlimits
 
+	processes, err := newContainerProcesses(pid)
+	if err != nil {
+		return nil, fmt.Errorf("could not create process state: %s", err)
+	}
+	state.processes = processes
+
 	state.pid = pid
 
+	err = state.saveSignals()
+	if err != nil {
+		return nil, fmt.Errorf("could not create signal state: %s", err)
+	}
+
+	err = state.saveTimers()
+	if err != nil {
+		return nil, fmt.Errorf("could not create timer state: %s", err)
+	}
+
+	err = state.saveCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("could not create credential state: %s", err)
+	}
+
 	return &state, nil
 }
 
 func (s *State) RestoreRegs() error {
-	errors := make(chan error)
+	errors := make(chan error, len(s.registers))
 	var wg sync.WaitGroup
 	for tid := range s.registers {
 		wg.Add(1)
 		regState := s.registers[tid]
 		regState.task.InStopFunction <- func(t *ptrace.TraceTask) {
 			defer wg.Done()
+			// Checkpoints read from older files, or taken without XSAVE, have no
+			// xstate
+			if regState.xstate != nil {
+				err := setXstate(t.Tid, regState.xstate)
+				if err != nil {
+					errors <- err
+					return
+				}
+			}
 			err := syscall.PtraceSetRegs(t.Tid, regState.regs)
+			if err != nil {
+				errors <- err
+				return
+			}
+			err = verifyTLSBase(t.Tid, regState.regs)
 			if err != nil {
 				errors <- err
 			}
@@ -109,7 +175,7 @@ func (s *State) RestoreProgramBreak() error {
 	if err != nil {
 		return err
 	}
-	afterOffset, err := s.runSyscall(12, uint64(beforeHeap.endOffset), 0)
+	afterOffset, err := s.remoteTask().RemoteSyscall(unix.SYS_BRK, uint64(beforeHeap.endOffset))
 	if err != nil {
 		return err
 	}
@@ -142,64 +208,10 @@ func (s *State) FixupSyscallState() error {
 	return <-errors
 }
 
-func (s *State) UnmapNewLocations() error {
-	currentMemory, err := newMemoryLocations(s.pid)
-	if err != nil {
-		return fmt.Errorf("could not get new memory on memory changed check: %s", err)
-	}
-
-	newLocations := calculateNewLocations(s.memoryLocations, currentMemory)
-	for _, loc := range newLocations {
-		returnVal, err := s.runSyscall(11, uint64(loc.startOffset), uint64(loc.endOffset-loc.startOffset))
-		if err != nil {
-			return fmt.Errorf("could not unmap new location: %s", err)
-		}
-		if returnVal != 0 {
-			return fmt.Errorf("could not unmap new location")
-		}
-	}
-
-	return nil
-}
-
-func calculateNewLocations(oldState []*Memory, newState []*Memory) []*Memory {
-	var newLocations []*Memory
-	for _, newLoc := range newState {
-		existed := false
-		for _, oldLoc := range oldState {
-			if newLoc.name == oldLoc.name && newLoc.startOffset == oldLoc.startOffset {
-				existed = true
-			}
-		}
-		if !existed {
-			newLocations = append(newLocations, newLoc)
-		}
-	}
-
-	return newLocations
-}
-
-func (s *State) runSyscall(syscallNum uint64, arg1 uint64, arg2 uint64) (uint64, error) {
-	// We could work on any thread
-	regState := s.chooseAnyRegState()
-
-	var syscallRegs syscall.PtraceRegs
-	// Set registers to correct arguments
-	syscallRegs.Rax = syscallNum
-	syscallRegs.Rdi = arg1
-	syscallRegs.Rsi = arg2
-	// syscallRegs.Rdx = arg3
-	// syscallRegs.Rcx = arg4
-	// syscallRegs.R8 = arg5
-	// syscallRegs.R9 = arg6
-
-	regState.task.RunSyscall <- syscallRegs
-	select {
-	case returnRegs := <-regState.task.SyscallReturn:
-		return returnRegs.Rax, nil
-	case err := <-regState.task.SyscallError:
-		return 0, err
-	}
+// remoteTask returns the task to run remote syscalls on. We could work on
+// any thread.
+func (s *State) remoteTask() *ptrace.TraceTask {
+	return s.chooseAnyRegState().task
 }
 
 func (s *State) chooseAnyRegState() TaskRegState {
@@ -0,0 +1,60 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+)
+
+func currentTids(pid int) (map[int]bool, error) {
+	taskDirs, err := ioutil.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+	if err != nil {
+		return nil, fmt.Errorf("could not read task entries: %s", err)
+	}
+
+	tids := make(map[int]bool)
+	for _, t := range taskDirs {
+		tid, err := strconv.Atoi(t.Name())
+		if err != nil {
+			return nil, fmt.Errorf("tid was not int: %s", err)
+		}
+		tids[tid] = true
+	}
+
+	return tids, nil
+}
+
+// NewTasks returns the threads of the process started since the checkpoint
+func (s *State) NewTasks() ([]int, error) {
+	tids, err := currentTids(s.pid)
+	if err != nil {
+		return nil, err
+	}
+
+	var newTids []int
+	for tid := range tids {
+		if _, ok := s.registers[tid]; !ok {
+			newTids = append(newTids, tid)
+		}
+	}
+
+	return newTids, nil
+}
+
+// ExitedTasks returns the checkpointed threads that no longer exist. A
+// process with exited threads cannot be restored.
+func (s *State) ExitedTasks() ([]int, error) {
+	tids, err := currentTids(s.pid)
+	if err != nil {
+		return nil, err
+	}
+
+	var exitedTids []int
+	for tid := range s.registers {
+		if !tids[tid] {
+			exitedTids = append(exitedTids, tid)
+		}
+	}
+
+	return exitedTids, nil
+}
@@ -0,0 +1,228 @@
+package state
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ostenbom/refunction/controller/ptrace"
+	"golang.org/x/sys/unix"
+)
+
+// Interval timers from linux/time.h. ITIMER_REAL backs alarm.
+const (
+	itimerReal    = 0
+	itimerVirtual = 1
+	itimerProf    = 2
+)
+
+var itimers = []int{itimerReal, itimerVirtual, itimerProf}
+
+const timerfdLink = "anon_inode:[timerfd]"
+
+func itimerArmed(value ptrace.Itimerval) bool {
+	return value.Value.Sec != 0 || value.Value.Usec != 0
+}
+
+func itimerspecArmed(value ptrace.Itimerspec) bool {
+	return value.Value.Sec != 0 || value.Value.Nsec != 0
+}
+
+// posixTimerIDs reads the ids of the process's timer_create timers from
+// /proc/pid/timers, which is missing on kernels without checkpoint/restore
+func posixTimerIDs(pid int) ([]int, error) {
+	timers, err := os.Open(fmt.Sprintf("/proc/%d/timers", pid))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open timers: %s", err)
+	}
+	defer timers.Close()
+
+	var ids []int
+	scanner := bufio.NewScanner(timers)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != "ID:" {
+			continue
+		}
+		id, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("could not parse timer id: %s", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not scan timers: %s", err)
+	}
+
+	return ids, nil
+}
+
+// saveTimers records the armed interval timers, including alarm, and every
+// POSIX timer. Timerfds are saved with their fdinfo.
+func (s *State) saveTimers() error {
+	s.itimers = make(map[int]ptrace.Itimerval)
+	for _, which := range itimers {
+		value, err := s.remoteTask().RemoteSetitimer(which, nil)
+		if err != nil {
+			return fmt.Errorf("could not get interval timer %d: %s", which, err)
+		}
+		if itimerArmed(value) {
+			s.itimers[which] = value
+		}
+	}
+
+	ids, err := posixTimerIDs(s.pid)
+	if err != nil {
+		return err
+	}
+
+	s.posixTimers = make(map[int]ptrace.Itimerspec)
+	for _, id := range ids {
+		value, err := s.remoteTask().RemoteTimerSettime(id, nil)
+		if err != nil {
+			return fmt.Errorf("could not get timer %d: %s", id, err)
+		}
+		s.posixTimers[id] = value
+	}
+
+	return nil
+}
+
+// RestoreTimers disarms timers armed since the checkpoint, deletes POSIX
+// timers created since and re-arms the checkpoint's timers with the time
+// they had left. Timers already as they were at the checkpoint are left
+// alone. Expirations of a timerfd not yet read are lost. Timerfds opened
+// since are closed by RestoreFileDescriptors, so it must run first. It
+// reports whether any timers were changed.
+func (s *State) RestoreTimers() (bool, error) {
+	changed := false
+
+	for _, which := range itimers {
+		current, err := s.remoteTask().RemoteSetitimer(which, nil)
+		if err != nil {
+			return changed, fmt.Errorf("could not get interval timer %d: %s", which, err)
+		}
+
+		checkpoint, checkpointArmed := s.itimers[which]
+		if !checkpointArmed && !itimerArmed(current) {
+			continue
+		}
+		changed = true
+		_, err = s.remoteTask().RemoteSetitimer(which, &checkpoint)
+		if err != nil {
+			return changed, fmt.Errorf("could not reset interval timer %d: %s", which, err)
+		}
+	}
+
+	ids, err := posixTimerIDs(s.pid)
+	if err != nil {
+		return changed, err
+	}
+
+	current := make(map[int]bool)
+	for _, id := range ids {
+		current[id] = true
+		if _, ok := s.posixTimers[id]; ok {
+			continue
+		}
+		changed = true
+		err := s.remoteTask().RemoteTimerDelete(id)
+		if err != nil {
+			return changed, fmt.Errorf("could not delete timer %d: %s", id, err)
+		}
+	}
+
+	for id, checkpoint := range s.posixTimers {
+		if !current[id] {
+			return changed, fmt.Errorf("timer %d was deleted since the checkpoint", id)
+		}
+		// Armed timers count down, so only disarmed ones can be unchanged
+		value, err := s.remoteTask().RemoteTimerSettime(id, nil)
+		if err != nil {
+			return changed, fmt.Errorf("could not get timer %d: %s", id, err)
+		}
+		if value == checkpoint {
+			continue
+		}
+		changed = true
+		_, err = s.remoteTask().RemoteTimerSettime(id, &checkpoint)
+		if err != nil {
+			return changed, fmt.Errorf("could not reset timer %d: %s", id, err)
+		}
+	}
+
+	timerfdsRestored, err := s.restoreTimerfds()
+	return changed || timerfdsRestored, err
+}
+
+func (s *State) restoreTimerfds() (bool, error) {
+	currentDescriptors, err := newFileDescriptors(s.pid)
+	if err != nil {
+		return false, fmt.Errorf("could not get descriptors for timerfds: %s", err)
+	}
+
+	restored := false
+	for _, current := range currentDescriptors {
+		checkpointFd := s.getFileDescriptor(current.name)
+		if checkpointFd == nil || checkpointFd.link != timerfdLink || current.link != timerfdLink {
+			continue
+		}
+
+		checkpointValue, err := checkpointFd.timerfdValue()
+		if err != nil {
+			return restored, err
+		}
+		currentValue, err := current.timerfdValue()
+		if err != nil {
+			return restored, err
+		}
+		if !itimerspecArmed(checkpointValue) && !itimerspecArmed(currentValue) {
+			continue
+		}
+
+		fd, err := strconv.Atoi(current.name)
+		if err != nil {
+			return restored, fmt.Errorf("fd name was not int: %s", err)
+		}
+		restored = true
+		err = s.remoteTask().RemoteTimerfdSettime(fd, checkpointValue)
+		if err != nil {
+			return restored, fmt.Errorf("could not reset timerfd %d: %s", fd, err)
+		}
+	}
+
+	return restored, nil
+}
+
+// timerfdValue is the time left and interval from a timerfd's fdinfo,
+// e.g. "it_value: (0, 999)"
+func (f *FileDescriptor) timerfdValue() (ptrace.Itimerspec, error) {
+	var value ptrace.Itimerspec
+	found := 0
+	for _, line := range strings.Split(f.fdInfo, "\n") {
+		var spec *unix.Timespec
+		if strings.HasPrefix(line, "it_value:") {
+			spec = &value.Value
+		} else if strings.HasPrefix(line, "it_interval:") {
+			spec = &value.Interval
+		} else {
+			continue
+		}
+
+		_, err := fmt.Sscanf(line[strings.IndexByte(line, ':')+1:], " (%d, %d)", &spec.Sec, &spec.Nsec)
+		if err != nil {
+			return value, fmt.Errorf("could not parse fd %s timer: %s", f.name, err)
+		}
+		found++
+	}
+
+	if found != 2 {
+		return value, fmt.Errorf("no timer in fd %s fdinfo", f.name)
+	}
+	return value, nil
+}
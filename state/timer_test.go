@@ -0,0 +1,84 @@
+package state_test
+
+import (
+	"bufio"
+	"os/exec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ostenbom/refunction/controller/ptrace"
+	. "github.com/ostenbom/refunction/state"
+)
+
+// Creates POSIX timer 0 disarmed and timer 1 armed for an hour
+var posixTimers = `import ctypes, sys, time
+rt = ctypes.CDLL('librt.so.1')
+timer = ctypes.c_void_p()
+rt.timer_create(1, None, ctypes.byref(timer))
+rt.timer_create(1, None, ctypes.byref(timer))
+spec = (ctypes.c_long * 4)(0, 0, 3600, 0)
+rt.timer_settime(timer, 0, spec, None)
+print('ready', flush=True)
+time.sleep(60)
+`
+
+var _ = Describe("Timers", func() {
+	var (
+		cmd   *exec.Cmd
+		task  *ptrace.TraceTask
+		saved *State
+	)
+
+	BeforeEach(func() {
+		cmd = exec.Command("python3", "-c", posixTimers)
+		stdout, err := cmd.StdoutPipe()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cmd.Start()).To(Succeed())
+		ready, err := bufio.NewReader(stdout).ReadString('\n')
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ready).To(Equal("ready\n"))
+		pid := cmd.Process.Pid
+
+		task, err = ptrace.NewTraceTask(pid, pid, ptrace.Options{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(task.Stop()).To(Succeed())
+
+		saved, err = NewState(pid, map[int]*ptrace.TraceTask{pid: task})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		saved.Release()
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	It("leaves disarmed timers that did not change alone", func() {
+		armed, err := task.RemoteTimerSettime(1, &ptrace.Itimerspec{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(armed.Value.Sec).To(BeNumerically(">", 0))
+
+		// A checkpoint of both timers disarmed
+		disarmed, err := NewState(cmd.Process.Pid, map[int]*ptrace.TraceTask{cmd.Process.Pid: task})
+		Expect(err).NotTo(HaveOccurred())
+		defer disarmed.Release()
+
+		changed, err := disarmed.RestoreTimers()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changed).To(BeFalse())
+	})
+
+	It("re-arms timers disarmed since the checkpoint", func() {
+		_, err := task.RemoteTimerSettime(1, &ptrace.Itimerspec{})
+		Expect(err).NotTo(HaveOccurred())
+
+		changed, err := saved.RestoreTimers()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changed).To(BeTrue())
+
+		value, err := task.RemoteTimerSettime(1, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value.Value.Sec).To(BeNumerically(">", 3500))
+	})
+})
@@ -0,0 +1,337 @@
+package state
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/ostenbom/refunction/controller/ptrace"
+	"golang.org/x/sys/unix"
+)
+
+// VerifyReport lists everything found to differ between a process and its
+// checkpoint. A report with no differences Matches.
+type VerifyReport struct {
+	Mappings []MappingChange
+	Pages    []PageDifference
+	// Tasks present in only one of the process and the checkpoint
+	NewTasks        []int
+	ExitedTasks     []int
+	Registers       []RegisterDifference
+	FileDescriptors []FdDifference
+	Rlimits         []RlimitDifference
+	Credentials     []CredentialChange
+	// PagesVerified counts the saved pages compared with the process
+	PagesVerified int
+}
+
+// PageDifference is a writable page whose content is not the checkpoint's
+type PageDifference struct {
+	Mapping string
+	Address int64
+}
+
+// RegisterDifference is a general purpose register of a task that does not
+// hold its checkpoint value
+type RegisterDifference struct {
+	Tid        int
+	Register   string
+	Checkpoint uint64
+	Current    uint64
+}
+
+// FdDifference is a file descriptor whose target or offset is not the
+// checkpoint's. The link is empty on the side the descriptor is missing from.
+type FdDifference struct {
+	Fd             string
+	CheckpointLink string
+	CurrentLink    string
+	CheckpointPos  int64
+	CurrentPos     int64
+}
+
+// RlimitDifference is a resource limit that is not the checkpoint's
+type RlimitDifference struct {
+	Resource   int
+	Checkpoint unix.Rlimit
+	Current    unix.Rlimit
+}
+
+// Matches is true when nothing differs from the checkpoint
+func (r *VerifyReport) Matches() bool {
+	return len(r.Mappings) == 0 && len(r.Pages) == 0 && len(r.NewTasks) == 0 && len(r.ExitedTasks) == 0 &&
+		len(r.Registers) == 0 && len(r.FileDescriptors) == 0 && len(r.Rlimits) == 0 && len(r.Credentials) == 0
+}
+
+func (r *VerifyReport) String() string {
+	if r.Matches() {
+		return fmt.Sprintf("matches checkpoint, %d pages verified", r.PagesVerified)
+	}
+
+	var differences []string
+	for _, change := range r.Mappings {
+		differences = append(differences, fmt.Sprintf("mapping %s", change))
+	}
+	if len(r.Pages) > 0 {
+		differences = append(differences, fmt.Sprintf("%d of %d pages, first %s at %x", len(r.Pages), r.PagesVerified, r.Pages[0].Mapping, r.Pages[0].Address))
+	}
+	if len(r.NewTasks) > 0 {
+		differences = append(differences, fmt.Sprintf("new tasks %v", r.NewTasks))
+	}
+	if len(r.ExitedTasks) > 0 {
+		differences = append(differences, fmt.Sprintf("exited tasks %v", r.ExitedTasks))
+	}
+	for _, regs := range r.Registers {
+		differences = append(differences, fmt.Sprintf("task %d %s: %x -> %x", regs.Tid, regs.Register, regs.Checkpoint, regs.Current))
+	}
+	for _, fd := range r.FileDescriptors {
+		differences = append(differences, fmt.Sprintf("fd %s: %s@%d -> %s@%d", fd.Fd, fd.CheckpointLink, fd.CheckpointPos, fd.CurrentLink, fd.CurrentPos))
+	}
+	for _, rlimit := range r.Rlimits {
+		differences = append(differences, fmt.Sprintf("rlimit %d: %v -> %v", rlimit.Resource, rlimit.Checkpoint, rlimit.Current))
+	}
+	for _, change := range r.Credentials {
+		differences = append(differences, fmt.Sprintf("task %d %s: %s -> %s", change.Tid, change.Credential, change.Checkpoint, change.Current))
+	}
+	return strings.Join(differences, ", ")
+}
+
+// VerifyError is returned when a restored process does not match its
+// checkpoint
+type VerifyError struct {
+	Report *VerifyReport
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("restored process does not match checkpoint: %s", e.Report)
+}
+
+// Verify compares the process with the checkpoint: its mappings, the hash of
+// every saved page, the registers of each task, its file descriptors, its
+// rlimits and its credentials. The process must be stopped.
+//
+// Reading every saved page faults in each page a lazy restore dropped, so
+// verifying a lazy restore makes it as costly as an eager one.
+func (s *State) Verify() (*VerifyReport, error) {
+	var report VerifyReport
+
+	currentMemory, err := newMemoryLocations(s.pid)
+	if err != nil {
+		return nil, fmt.Errorf("could not get memory locations to verify: %s", err)
+	}
+	report.Mappings = diffMappings(s.memoryLocations, currentMemory)
+
+	err = s.verifyPages(&report, currentMemory)
+	if err != nil {
+		return nil, err
+	}
+
+	report.NewTasks, err = s.NewTasks()
+	if err != nil {
+		return nil, fmt.Errorf("could not get new tasks to verify: %s", err)
+	}
+	report.ExitedTasks, err = s.ExitedTasks()
+	if err != nil {
+		return nil, fmt.Errorf("could not get exited tasks to verify: %s", err)
+	}
+
+	err = s.verifyRegisters(&report, report.ExitedTasks)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.verifyFileDescriptors(&report)
+	if err != nil {
+		return nil, err
+	}
+
+	for resource, rlimit := range s.rlimits {
+		var current unix.Rlimit
+		err := prlimit(s.pid, resource, &current, nil)
+		if err != nil {
+			return nil, fmt.Errorf("could not get rlimit %d to verify: %s", resource, err)
+		}
+		if current != *rlimit {
+			report.Rlimits = append(report.Rlimits, RlimitDifference{Resource: resource, Checkpoint: *rlimit, Current: current})
+		}
+	}
+	sort.Slice(report.Rlimits, func(i, j int) bool {
+		return report.Rlimits[i].Resource < report.Rlimits[j].Resource
+	})
+
+	report.Credentials, err = s.credentialChanges(report.ExitedTasks)
+	if err != nil {
+		return nil, err
+	}
+
+	return &report, nil
+}
+
+// verifyPages hashes the saved memory still mapped in the process. Memory
+// that is not is left to the mapping differences.
+func (s *State) verifyPages(report *VerifyReport, currentMemory []*Memory) error {
+	var memories []*Memory
+	var contents [][]byte
+	for _, memory := range s.memoryLocations {
+		if !memory.saved() || len(uncoveredRanges(memory, currentMemory)) > 0 {
+			continue
+		}
+
+		content, err := mapBuffer(int(memory.endOffset - memory.startOffset))
+		if err != nil {
+			unmapBuffers(contents)
+			return err
+		}
+		memories = append(memories, memory)
+		contents = append(contents, content)
+	}
+	defer unmapBuffers(contents)
+
+	var runs []ptrace.MemoryRun
+	for i, memory := range memories {
+		runs = append(runs, ptrace.MemoryRun{Address: uintptr(memory.startOffset), Local: contents[i]})
+	}
+	err := s.transferRuns(ptrace.ReadMemoryRuns, runs)
+	if err != nil {
+		return fmt.Errorf("could not read pages to verify: %s", err)
+	}
+
+	hashes := make([][]pageHash, len(memories))
+	var wg sync.WaitGroup
+	for i := range memories {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			hashes[i] = hashPages(contents[i])
+		}(i)
+	}
+	wg.Wait()
+
+	pageSize := os.Getpagesize()
+	for i, memory := range memories {
+		report.PagesVerified += len(hashes[i])
+		for page, hash := range hashes[i] {
+			if hash != memory.hashes[page] {
+				report.Pages = append(report.Pages, PageDifference{
+					Mapping: memory.name,
+					Address: memory.startOffset + int64(page*pageSize),
+				})
+			}
+		}
+	}
+
+	return nil
+}
+
+// verifyRegisters compares the general purpose registers of each task still
+// running with the checkpoint
+func (s *State) verifyRegisters(report *VerifyReport, exited []int) error {
+	gone := make(map[int]bool)
+	for _, tid := range exited {
+		gone[tid] = true
+	}
+
+	var mutex sync.Mutex
+	errors := make(chan error, len(s.registers))
+	var wg sync.WaitGroup
+	for tid, regState := range s.registers {
+		if gone[tid] || regState.task == nil {
+			continue
+		}
+
+		wg.Add(1)
+		regState := regState
+		regState.task.InStopFunction <- func(t *ptrace.TraceTask) {
+			defer wg.Done()
+			var current syscall.PtraceRegs
+			err := syscall.PtraceGetRegs(t.Tid, &current)
+			if err != nil {
+				errors <- fmt.Errorf("could not get regs of task %d to verify: %s", t.Tid, err)
+				return
+			}
+
+			differences := diffRegisters(t.Tid, regState.regs, &current)
+			mutex.Lock()
+			report.Registers = append(report.Registers, differences...)
+			mutex.Unlock()
+		}
+	}
+	wg.Wait()
+	close(errors)
+
+	sort.Slice(report.Registers, func(i, j int) bool {
+		return report.Registers[i].Tid < report.Registers[j].Tid
+	})
+
+	// nil when every task was read
+	return <-errors
+}
+
+func diffRegisters(tid int, checkpoint *syscall.PtraceRegs, current *syscall.PtraceRegs) []RegisterDifference {
+	var differences []RegisterDifference
+	checkpointValue := reflect.ValueOf(checkpoint).Elem()
+	currentValue := reflect.ValueOf(current).Elem()
+	for i := 0; i < checkpointValue.NumField(); i++ {
+		before := checkpointValue.Field(i).Uint()
+		after := currentValue.Field(i).Uint()
+		if before != after {
+			differences = append(differences, RegisterDifference{
+				Tid:        tid,
+				Register:   strings.ToLower(checkpointValue.Type().Field(i).Name),
+				Checkpoint: before,
+				Current:    after,
+			})
+		}
+	}
+	return differences
+}
+
+func (s *State) verifyFileDescriptors(report *VerifyReport) error {
+	currentDescriptors, err := newFileDescriptors(s.pid)
+	if err != nil {
+		return fmt.Errorf("could not get descriptors to verify: %s", err)
+	}
+
+	current := make(map[string]*FileDescriptor)
+	for _, fd := range currentDescriptors {
+		current[fd.name] = fd
+		if s.getFileDescriptor(fd.name) == nil {
+			pos, _ := fd.pos()
+			report.FileDescriptors = append(report.FileDescriptors, FdDifference{Fd: fd.name, CurrentLink: fd.link, CurrentPos: pos})
+		}
+	}
+
+	for _, checkpointFd := range s.fileDescriptors {
+		checkpointPos, err := checkpointFd.pos()
+		if err != nil {
+			return err
+		}
+
+		currentFd, exists := current[checkpointFd.name]
+		if !exists {
+			report.FileDescriptors = append(report.FileDescriptors, FdDifference{Fd: checkpointFd.name, CheckpointLink: checkpointFd.link, CheckpointPos: checkpointPos})
+			continue
+		}
+
+		currentPos, err := currentFd.pos()
+		if err != nil {
+			return err
+		}
+
+		if checkpointFd.link != currentFd.link || checkpointPos != currentPos {
+			report.FileDescriptors = append(report.FileDescriptors, FdDifference{
+				Fd:             checkpointFd.name,
+				CheckpointLink: checkpointFd.link,
+				CurrentLink:    currentFd.link,
+				CheckpointPos:  checkpointPos,
+				CurrentPos:     currentPos,
+			})
+		}
+	}
+
+	return nil
+}
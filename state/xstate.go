@@ -0,0 +1,63 @@
+package state
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// NT_X86_XSTATE regset holds the x87, SSE and AVX state in XSAVE layout
+const ntX86Xstate = 0x202
+
+// Large enough for the XSAVE area of any current x86 cpu. The kernel
+// shortens the iovec to the size it actually wrote.
+const xstateBufferSize = 16 * 1024
+
+// getXstate must be called from the tracing thread of tid. It returns nil on
+// cpus without XSAVE, whose checkpoints keep no xstate.
+func getXstate(tid int) ([]byte, error) {
+	xstate := make([]byte, xstateBufferSize)
+	iov := unix.Iovec{Base: &xstate[0]}
+	iov.SetLen(len(xstate))
+
+	_, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, unix.PTRACE_GETREGSET, uintptr(tid), ntX86Xstate, uintptr(unsafe.Pointer(&iov)), 0, 0)
+	if errno == syscall.EINVAL || errno == syscall.ENODEV {
+		return nil, nil
+	}
+	if errno != 0 {
+		return nil, fmt.Errorf("could not get xstate of %d: %s", tid, errno)
+	}
+
+	return xstate[:iov.Len], nil
+}
+
+// setXstate must be called from the tracing thread of tid
+func setXstate(tid int, xstate []byte) error {
+	iov := unix.Iovec{Base: &xstate[0]}
+	iov.SetLen(len(xstate))
+
+	_, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, unix.PTRACE_SETREGSET, uintptr(tid), ntX86Xstate, uintptr(unsafe.Pointer(&iov)), 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("could not set xstate of %d: %s", tid, errno)
+	}
+
+	return nil
+}
+
+// verifyTLSBase checks the fs and gs bases of tid took the values in regs.
+// Must be called from the tracing thread of tid.
+func verifyTLSBase(tid int, regs *syscall.PtraceRegs) error {
+	var current syscall.PtraceRegs
+	err := syscall.PtraceGetRegs(tid, &current)
+	if err != nil {
+		return fmt.Errorf("could not get regs of %d: %s", tid, err)
+	}
+
+	if current.Fs_base != regs.Fs_base || current.Gs_base != regs.Gs_base {
+		return fmt.Errorf("tls base of %d is fs %x gs %x, wanted fs %x gs %x", tid, current.Fs_base, current.Gs_base, regs.Fs_base, regs.Gs_base)
+	}
+
+	return nil
+}
@@ -0,0 +1,286 @@
+package worker_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/ostenbom/refunction/worker"
+)
+
+// canaryReport records which categories of state a canary written by one
+// function could be found in by the next
+type canaryReport map[string]bool
+
+func (r canaryReport) leaked() []string {
+	var leaked []string
+	for category, found := range r {
+		if found {
+			leaked = append(leaked, category)
+		}
+	}
+	sort.Strings(leaked)
+	return leaked
+}
+
+type canaryFunctions struct {
+	runtime     string
+	targetLayer string
+	// Writer stores the request's canary in globals, the environment, a file
+	// and a runtime cache. Searcher reports which of those it finds it in.
+	writer   func() string
+	searcher func() string
+}
+
+var pythonCanaryWriter = `import os
+import re
+
+def main(req):
+  global leaked
+  leaked = req['canary']
+  os.environ['CANARY'] = leaked
+  with open('/tmp/canary', 'w') as f:
+    f.write(leaked)
+  re.compile(leaked)
+  return req
+`
+
+var pythonCanarySearcher = `import os
+import re
+
+def main(req):
+  canary = req['canary']
+  in_file = False
+  try:
+    with open('/tmp/canary') as f:
+      in_file = canary in f.read()
+  except OSError:
+    pass
+  return {
+    'globals': any(value == canary for value in list(globals().values()) if isinstance(value, str)),
+    'environment': canary in os.environ.values(),
+    'filesystem': in_file,
+    'caches': any(canary in str(key) for key in re._cache),
+  }
+`
+
+var nodeCanaryWriter = `var fs = require('fs')
+function main(req) {
+  global.leaked = req.canary
+  process.env.CANARY = req.canary
+  fs.writeFileSync('/tmp/canary', req.canary)
+  require('path').leaked = req.canary
+  return req
+}
+exports.handler = main
+`
+
+var nodeCanarySearcher = `var fs = require('fs')
+function main(req) {
+  var inFile = false
+  try {
+    inFile = fs.readFileSync('/tmp/canary', 'utf8').indexOf(req.canary) >= 0
+  } catch (e) {}
+  return {
+    globals: Object.keys(global).some(function(key) { return global[key] === req.canary }),
+    environment: Object.keys(process.env).some(function(key) { return process.env[key] === req.canary }),
+    filesystem: inFile,
+    caches: require('path').leaked === req.canary,
+  }
+}
+exports.handler = main
+`
+
+var _ = Describe("Canary Leak Testing", func() {
+	var id string
+	var worker *Worker
+
+	BeforeEach(func() {
+		id = strconv.Itoa(GinkgoParallelNode())
+	})
+
+	AfterEach(func() {
+		if worker != nil {
+			Expect(worker.End()).To(Succeed())
+			worker = nil
+		}
+	})
+
+	runtimes := []canaryFunctions{
+		{
+			runtime:     "python",
+			targetLayer: "serverless-function.py",
+			writer:      func() string { return pythonCanaryWriter },
+			searcher:    func() string { return pythonCanarySearcher },
+		},
+		{
+			runtime:     "node",
+			targetLayer: "serverless-function.js",
+			writer:      func() string { return nodeCanaryWriter },
+			searcher:    func() string { return nodeCanarySearcher },
+		},
+		{
+			runtime:     "java",
+			targetLayer: "serverless-java",
+			writer:      func() string { return javaCanaryJar("canary-writer.jar") },
+			searcher:    func() string { return javaCanaryJar("canary-searcher.jar") },
+		},
+	}
+
+	for _, functions := range runtimes {
+		functions := functions
+
+		Context(fmt.Sprintf("in a %s worker", functions.runtime), func() {
+			var report canaryReport
+
+			JustBeforeEach(func() {
+				writer := functions.writer()
+				searcher := functions.searcher()
+
+				var err error
+				worker, err = NewWorker(id, client, functions.runtime, functions.targetLayer)
+				Expect(err).NotTo(HaveOccurred())
+				worker.WithStdPipes(GinkgoWriter, GinkgoWriter, GinkgoWriter)
+				Expect(worker.Start()).To(Succeed())
+
+				report = runCanary(worker, writer, searcher)
+				fmt.Fprintf(GinkgoWriter, "%s canary report: %v\n", functions.runtime, report)
+			})
+
+			It("does not leak a canary through process state to the next function", func() {
+				Expect(report.leaked()).NotTo(ContainElement("memory"))
+				Expect(report.leaked()).NotTo(ContainElement("globals"))
+				Expect(report.leaked()).NotTo(ContainElement("environment"))
+				Expect(report.leaked()).NotTo(ContainElement("caches"))
+			})
+
+			// Restore does not roll back the container's writable layer
+			PIt("does not leak a canary through the filesystem to the next function", func() {
+				Expect(report.leaked()).NotTo(ContainElement("filesystem"))
+			})
+		})
+	}
+})
+
+// runCanary has the writer store a fresh canary, restores the worker and
+// loads the searcher to look for it. The process's memory is searched before
+// the searcher is given the canary.
+func runCanary(worker *Worker, writer, searcher string) canaryReport {
+	canary := newCanary()
+	request := map[string]interface{}{"canary": canary}
+
+	Expect(worker.Activate()).To(Succeed())
+	Expect(worker.SendFunction(writer)).To(Succeed())
+	_, err := worker.SendRequest(request)
+	Expect(err).NotTo(HaveOccurred())
+
+	Expect(worker.Stop()).To(Succeed())
+	written, err := memoryContains(worker.Pid(), []byte(canary))
+	Expect(err).NotTo(HaveOccurred())
+	Expect(written).To(BeTrue(), "writer did not hold the canary in memory")
+	worker.Continue()
+
+	Expect(worker.Restore()).To(Succeed())
+	Expect(worker.SendFunction(searcher)).To(Succeed())
+
+	report := make(canaryReport)
+	Expect(worker.Stop()).To(Succeed())
+	report["memory"], err = memoryContains(worker.Pid(), []byte(canary))
+	Expect(err).NotTo(HaveOccurred())
+	worker.Continue()
+
+	response, err := worker.SendRequest(request)
+	Expect(err).NotTo(HaveOccurred())
+	found, ok := response.(map[string]interface{})
+	Expect(ok).To(BeTrue(), "searcher returned %v", response)
+	for _, category := range []string{"globals", "environment", "filesystem", "caches"} {
+		Expect(found).To(HaveKey(category))
+		report[category] = found[category] == true
+	}
+
+	return report
+}
+
+func newCanary() string {
+	random := make([]byte, 16)
+	_, err := rand.Read(random)
+	Expect(err).NotTo(HaveOccurred())
+	return fmt.Sprintf("refunction-canary-%x", random)
+}
+
+// javaCanaryJar is a function jar built with the serverless-java image
+func javaCanaryJar(name string) string {
+	jar, err := ioutil.ReadFile("images/serverless-java/" + name)
+	Expect(err).NotTo(HaveOccurred(), "run make in images/serverless-java to build the canary jars")
+	return base64.StdEncoding.EncodeToString(jar)
+}
+
+// memoryContains searches every readable mapping of the process for data
+func memoryContains(pid int, data []byte) (bool, error) {
+	maps, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return false, err
+	}
+	defer maps.Close()
+
+	memory, err := os.Open(fmt.Sprintf("/proc/%d/mem", pid))
+	if err != nil {
+		return false, err
+	}
+	defer memory.Close()
+
+	pageSize := int64(os.Getpagesize())
+	chunk := make([]byte, 1<<20)
+	scanner := bufio.NewScanner(maps)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[1][0] != 'r' {
+			continue
+		}
+		if len(fields) >= 6 && (fields[5] == "[vvar]" || fields[5] == "[vsyscall]") {
+			continue
+		}
+
+		var start, end int64
+		_, err := fmt.Sscanf(fields[0], "%x-%x", &start, &end)
+		if err != nil {
+			return false, err
+		}
+
+		// Chunks overlap so data across a chunk boundary is found
+		for offset := start; offset < end; {
+			size := int64(len(chunk))
+			if end-offset < size {
+				size = end - offset
+			}
+			read, _ := memory.ReadAt(chunk[:size], offset)
+			if bytes.Contains(chunk[:read], data) {
+				return true, nil
+			}
+			if read < int(size) {
+				// Pages without backing, such as past the end of a file,
+				// cannot be read and hold nothing, so the scan goes on after
+				// the page that stopped the read
+				unreadable := offset + int64(read)
+				offset = unreadable - unreadable%pageSize + pageSize
+				continue
+			}
+			if offset+size == end {
+				break
+			}
+			offset += size - int64(len(data))
+		}
+	}
+
+	return false, scanner.Err()
+}
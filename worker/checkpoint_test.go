@@ -1,13 +1,19 @@
 package worker_test
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"strconv"
+	"syscall"
 	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"golang.org/x/sys/unix"
 
+	"github.com/ostenbom/refunction/state"
 	. "github.com/ostenbom/refunction/worker"
 )
 
@@ -52,6 +58,38 @@ var _ = Describe("Worker Manager checkpointing", func() {
 			Expect(exists).To(BeTrue())
 			_, exists = rlimits[unix.RLIMIT_STACK]
 			Expect(exists).To(BeTrue())
+			_, exists = rlimits[unix.RLIMIT_NOFILE]
+			Expect(exists).To(BeTrue())
+		})
+
+		Context("when the program changes its limits", func() {
+			BeforeEach(func() {
+				targetLayer = "rlimitchanger"
+			})
+
+			It("can reset the limits", func() {
+				Expect(worker.Attach()).To(Succeed())
+				defer worker.Detach()
+				Expect(worker.Stop()).To(Succeed())
+				state, err := worker.State()
+				Expect(err).NotTo(HaveOccurred())
+				worker.Continue()
+
+				// Changes limits on SIGUSR1
+				Expect(worker.SendSignalCont(syscall.SIGUSR1)).To(Succeed())
+				time.Sleep(time.Millisecond * 100)
+
+				Expect(worker.Stop()).To(Succeed())
+				changedState, err := worker.State()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(changedState.GetRlimits()).NotTo(Equal(state.GetRlimits()))
+
+				Expect(state.RestoreRlimits()).To(Succeed())
+
+				restoredState, err := worker.State()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(restoredState.GetRlimits()).To(Equal(state.GetRlimits()))
+			})
 		})
 	})
 
@@ -101,6 +139,7 @@ var _ = Describe("Worker Manager checkpointing", func() {
 				Expect(dirtyHeap).NotTo(Equal(0))
 			})
 
+			measureMemoryIO(func() *Worker { return worker })
 		})
 
 		Context("for loop stack", func() {
@@ -140,7 +179,44 @@ var _ = Describe("Worker Manager checkpointing", func() {
 				Expect(state.SaveWritablePages()).To(Succeed())
 
 				memSize := state.MemorySize()
-				Expect(memSize).NotTo(Equal(0))
+				Expect(memSize.Logical).NotTo(Equal(0))
+				Expect(memSize.Deduplicated).To(BeNumerically("<=", memSize.Logical))
+			})
+
+			It("keeps identical pages of checkpoints once in a page store", func() {
+				pages := state.NewPageStore()
+				worker.SetPageStore(pages)
+				Expect(worker.Attach()).To(Succeed())
+				Expect(worker.Stop()).To(Succeed())
+				defer worker.Detach()
+
+				first, err := worker.State()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(first.SaveWritablePages()).To(Succeed())
+				stored := pages.Size()
+				Expect(stored).To(Equal(first.MemorySize().Deduplicated))
+
+				second, err := worker.State()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(second.SaveWritablePages()).To(Succeed())
+				Expect(second.MemorySize()).To(Equal(first.MemorySize()))
+				Expect(pages.Size()).To(Equal(stored))
+
+				first.Release()
+				Expect(pages.Size()).To(Equal(stored))
+				second.Release()
+				Expect(pages.Pages()).To(Equal(0))
+			})
+
+			It("fails to checkpoint over the page store limit", func() {
+				pages := state.NewLimitedPageStore(os.Getpagesize())
+				worker.SetPageStore(pages)
+				Expect(worker.Attach()).To(Succeed())
+				defer worker.Detach()
+
+				err := worker.TakeCheckpoint()
+				Expect(errors.Is(err, state.ErrMemoryLimit)).To(BeTrue())
+				Expect(pages.Pages()).To(Equal(0))
 			})
 
 			It("has no memory region changes", func() {
@@ -187,6 +263,27 @@ var _ = Describe("Worker Manager checkpointing", func() {
 				Expect(changed).To(BeFalse())
 			})
 
+			It("can persist a checkpoint and load it back", func() {
+				Expect(worker.Attach()).To(Succeed())
+				defer worker.Detach()
+				Expect(worker.TakeCheckpoint()).To(Succeed())
+
+				checkpointFile, err := ioutil.TempFile("", "checkpoint")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(checkpointFile.Close()).To(Succeed())
+				defer os.Remove(checkpointFile.Name())
+
+				Expect(worker.SaveCheckpoint(0, checkpointFile.Name())).To(Succeed())
+				Expect(worker.LoadCheckpoint(checkpointFile.Name())).To(Succeed())
+
+				checkpoints := worker.Checkpoints()
+				Expect(len(checkpoints)).To(Equal(2))
+				Expect(checkpoints[1].MemorySize()).To(Equal(checkpoints[0].MemorySize()))
+				Expect(checkpoints[1].PC()).To(Equal(checkpoints[0].PC()))
+				Expect(checkpoints[1].GetFileDescriptors()).To(HaveLen(len(checkpoints[0].GetFileDescriptors())))
+				Expect(checkpoints[1].GetRlimits()).To(Equal(checkpoints[0].GetRlimits()))
+			})
+
 			It("has a program counter", func() {
 				Expect(worker.Attach()).To(Succeed())
 				Expect(worker.Stop()).To(Succeed())
@@ -218,6 +315,8 @@ var _ = Describe("Worker Manager checkpointing", func() {
 				Expect(err).NotTo(HaveOccurred())
 				Expect(changed).To(BeTrue())
 			})
+
+			measureMemoryIO(func() *Worker { return worker })
 		})
 
 		Context("opened files", func() {
@@ -243,3 +342,30 @@ var _ = Describe("Worker Manager checkpointing", func() {
 		})
 	})
 })
+
+// measureMemoryIO compares checkpoint and restore times of each way of
+// copying pages. Every page is restored, so the copying dominates.
+func measureMemoryIO(getWorker func() *Worker) {
+	for _, io := range []state.MemoryIO{state.ProcMemIO, state.ProcessVMIO} {
+		io := io
+
+		Measure(fmt.Sprintf("checkpoint and restore with %s memory io", io), func(b Benchmarker) {
+			worker := getWorker()
+			Expect(worker.Attach()).To(Succeed())
+			defer worker.Detach()
+			worker.SetMemoryIO(io, 0)
+			worker.SetDirtyTracker(state.FullCopyTracker{})
+
+			b.Time("checkpoint", func() {
+				Expect(worker.TakeCheckpoint()).To(Succeed())
+			})
+
+			for i := 0; i < 5; i++ {
+				time.Sleep(time.Millisecond * 60)
+				b.Time("restore", func() {
+					Expect(worker.Restore()).To(Succeed())
+				})
+			}
+		}, 5)
+	}
+}
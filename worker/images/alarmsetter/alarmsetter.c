@@ -0,0 +1,67 @@
+#include <signal.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <time.h>
+#include <unistd.h>
+
+volatile sig_atomic_t usr_interrupt = 0;
+volatile sig_atomic_t alarm_fired = 0;
+
+void
+synch_signal (int sig) {
+  usr_interrupt = 1;
+}
+
+void
+alarm_signal (int sig) {
+  alarm_fired = 1;
+}
+
+int main() {
+  printf("starting\n");
+
+  struct sigaction usr_action;
+  sigemptyset (&usr_action.sa_mask);
+  usr_action.sa_flags = 0;
+  usr_action.sa_handler = synch_signal;
+  sigaction (SIGUSR1, &usr_action, NULL);
+
+  struct sigaction alarm_action;
+  sigemptyset (&alarm_action.sa_mask);
+  alarm_action.sa_flags = 0;
+  alarm_action.sa_handler = alarm_signal;
+  sigaction (SIGALRM, &alarm_action, NULL);
+
+  struct timespec wait;
+  wait.tv_sec = 0;
+  wait.tv_nsec = 50000000L; // 50ms
+
+  int armed = 0;
+  while (1) {
+    if (usr_interrupt && !armed) {
+      alarm(1);
+
+      timer_t timer;
+      struct sigevent event = {0};
+      event.sigev_notify = SIGEV_SIGNAL;
+      event.sigev_signo = SIGALRM;
+      struct itimerspec value = {0};
+      value.it_value.tv_sec = 1;
+      if (timer_create(CLOCK_MONOTONIC, &event, &timer) == 0) {
+        timer_settime(timer, 0, &value, NULL);
+      }
+
+      printf("timers armed\n");
+      armed = 1;
+    }
+
+    if (alarm_fired) {
+      FILE *fp = fopen("alarm.txt", "w");
+      fprintf(fp, "fired\n");
+      fclose(fp);
+      alarm_fired = 0;
+    }
+
+    nanosleep(&wait, NULL);
+  }
+}
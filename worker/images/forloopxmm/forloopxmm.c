@@ -0,0 +1,61 @@
+#include <fcntl.h>
+#include <stdio.h>
+#include <sys/syscall.h>
+#include <time.h>
+
+// Built with -mgeneral-regs-only, so the count lives only in xmm15.
+// The loop calls no libc functions, which could clobber it.
+
+static long raw_syscall(long number, long a, long b, long c) {
+  long ret;
+  __asm__ volatile ("syscall"
+      : "=a" (ret)
+      : "a" (number), "D" (a), "S" (b), "d" (c)
+      : "rcx", "r11", "memory");
+  return ret;
+}
+
+static int format_count(char *buf, unsigned long count) {
+  char digits[20];
+  int n = 0;
+  do {
+    digits[n++] = '0' + count % 10;
+    count /= 10;
+  } while (count);
+
+  int i = 0;
+  buf[i++] = 'a';
+  buf[i++] = 't';
+  buf[i++] = ':';
+  buf[i++] = ' ';
+  while (n) {
+    buf[i++] = digits[--n];
+  }
+  buf[i++] = '\n';
+  return i;
+}
+
+int main() {
+  printf("starting\n");
+
+  int fd = open("count.txt", O_WRONLY | O_CREAT | O_TRUNC, 0644);
+
+  struct timespec wait;
+  wait.tv_sec = 0;
+  wait.tv_nsec = 50000000L; // 50ms
+
+  __asm__ volatile ("pxor %xmm15, %xmm15");
+
+  char buf[32];
+  while (1) {
+    unsigned long count;
+    __asm__ volatile ("movq %%xmm15, %0" : "=r" (count));
+
+    int len = format_count(buf, count);
+    raw_syscall(SYS_write, fd, (long) buf, len);
+
+    count++;
+    __asm__ volatile ("movq %0, %%xmm15" :: "r" (count));
+    raw_syscall(SYS_nanosleep, (long) &wait, 0, 0);
+  }
+}
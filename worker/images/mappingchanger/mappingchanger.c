@@ -0,0 +1,58 @@
+#include <signal.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/mman.h>
+#include <time.h>
+
+#define REGION_SIZE (4 * 4096)
+
+volatile sig_atomic_t usr_interrupt = 0;
+
+void
+synch_signal (int sig) {
+  usr_interrupt = 1;
+}
+
+int main() {
+  printf("starting\n");
+
+  struct sigaction usr_action;
+  sigemptyset (&usr_action.sa_mask);
+  usr_action.sa_flags = 0;
+  usr_action.sa_handler = synch_signal;
+  sigaction (SIGUSR1, &usr_action, NULL);
+
+  char *removed = mmap(NULL, REGION_SIZE, PROT_READ | PROT_WRITE, MAP_PRIVATE | MAP_ANONYMOUS, -1, 0);
+  char *protected = mmap(NULL, REGION_SIZE, PROT_READ | PROT_WRITE, MAP_PRIVATE | MAP_ANONYMOUS, -1, 0);
+  if (removed == MAP_FAILED || protected == MAP_FAILED) {
+    exit(1);
+  }
+  memset(removed, 'a', REGION_SIZE);
+
+  struct timespec wait;
+  wait.tv_sec = 0;
+  wait.tv_nsec = 50000000L; // 50ms
+
+  int changed = 0;
+  while (1) {
+    if (usr_interrupt && !changed) {
+      munmap(removed, REGION_SIZE);
+      mprotect(protected, REGION_SIZE, PROT_READ);
+      mmap(NULL, REGION_SIZE, PROT_READ | PROT_WRITE, MAP_PRIVATE | MAP_ANONYMOUS, -1, 0);
+
+      printf("mappings changed\n");
+      changed = 1;
+    }
+
+    if (!changed) {
+      // Faults if the regions were not restored
+      if (removed[REGION_SIZE - 1] != 'a') {
+        exit(1);
+      }
+      protected[0]++;
+    }
+
+    nanosleep(&wait, NULL);
+  }
+}
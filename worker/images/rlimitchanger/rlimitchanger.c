@@ -0,0 +1,46 @@
+#include <signal.h>
+#include <stdio.h>
+#include <sys/resource.h>
+#include <time.h>
+
+volatile sig_atomic_t usr_interrupt = 0;
+
+void
+synch_signal (int sig) {
+  usr_interrupt = 1;
+}
+
+int main() {
+  printf("starting\n");
+
+  struct sigaction usr_action;
+  sigemptyset (&usr_action.sa_mask);
+  usr_action.sa_flags = 0;
+  usr_action.sa_handler = synch_signal;
+  sigaction (SIGUSR1, &usr_action, NULL);
+
+  struct timespec wait;
+  wait.tv_sec = 0;
+  wait.tv_nsec = 50000000L; // 50ms
+
+  int changed = 0;
+  while (1) {
+    if (usr_interrupt && !changed) {
+      struct rlimit nofile = {64, 128};
+      setrlimit(RLIMIT_NOFILE, &nofile);
+
+      struct rlimit stack;
+      getrlimit(RLIMIT_STACK, &stack);
+      stack.rlim_cur = 1024 * 1024;
+      setrlimit(RLIMIT_STACK, &stack);
+
+      struct rlimit core = {0, 0};
+      setrlimit(RLIMIT_CORE, &core);
+
+      printf("limits changed\n");
+      changed = 1;
+    }
+
+    nanosleep(&wait, NULL);
+  }
+}
@@ -1,23 +1,50 @@
+var fs = require("fs")
+var net = require("net")
 var readline = require("readline")
+
+var PROTOCOL_VERSION = 1
+var FRAMED_PROTOCOL = "framed/1"
+
 var rl = readline.createInterface({
   input: process.stdin,
   output: process.stdout,
   terminal: false
 });
 
-console.log(JSON.stringify({"type": "started", "data": ""}))
+// Messages go out one JSON object per line until the controller switches to
+// the framed protocol
+var send = function(type, id, data) {
+  console.log(JSON.stringify({'type': type, 'id': id, 'data': data}))
+}
 
-var loaded = false
-var f = null
+send('started', undefined, {
+  'protocol_version': PROTOCOL_VERSION,
+  'runtime': 'node',
+  'runtime_version': process.versions.node,
+  'features': ['ids', 'concurrency'],
+  'protocols': [FRAMED_PROTOCOL]
+})
 
-rl.on('line', function(line){
-  try {
-    request = JSON.parse(line)
-  } catch(error) {
-    console.error(error)
+var user_exports = null
+
+function handle(message) {
+  if (user_exports === null) {
+    loadFunction(message)
     return
   }
 
+  if (message['type'] !== 'request') {
+    return;
+  }
+
+  // Handlers that return a promise serve further requests while they wait,
+  // so each response carries the id of its request
+  Promise.resolve(user_exports.handler(message['data'])).then(function(result) {
+    send('response', message['id'], result)
+  })
+}
+
+function loadFunction(request) {
   if (request['type'] !== 'function') {
     return
   }
@@ -27,35 +54,93 @@ rl.on('line', function(line){
   var Module = module.constructor
   var m = new Module()
   m._compile(funcString, '/tmp/none')
-  user_exports = m.exports;
 
-  if (user_exports === null) {
-    console.log(JSON.stringify({'type': 'function_loaded', 'data': false}))
+  if (m.exports === null) {
+    send('function_loaded', request['id'], false)
     return
   }
 
-  console.log(JSON.stringify({'type': 'function_loaded', 'data': true}))
-
-  rl.close()
-  var rl2 = readline.createInterface({
-    input: process.stdin,
-    output: process.stdout,
-    terminal: false
-  });
-
-  rl2.on('line', function(line) {
-    try {
-      request = JSON.parse(line)
-    } catch(error) {
-      console.error(error)
-      return
-    }
+  user_exports = m.exports
+  send('function_loaded', request['id'], true)
+}
 
-    if (request['type'] !== 'request') {
-      return;
-    }
+// Frames are a 4 byte big-endian length of the rest of the frame, the length
+// of the type in one byte, the type, an 8 byte big-endian id and the data as
+// JSON
+function useFramedProtocol(switchMessage) {
+  var input = new net.Socket({fd: fs.openSync(switchMessage['data']['in'], 'r'), readable: true, writable: false})
+  var output = new net.Socket({fd: fs.openSync(switchMessage['data']['out'], 'w'), readable: false, writable: true})
+
+  send = function(type, id, data) {
+    var encodedType = Buffer.from(type)
+    var payload = Buffer.from(JSON.stringify(data === undefined ? null : data))
+    var header = Buffer.alloc(4 + 1 + encodedType.length + 8)
+    header.writeUInt32BE(header.length - 4 + payload.length, 0)
+    header.writeUInt8(encodedType.length, 4)
+    encodedType.copy(header, 5)
+    id = id || 0
+    header.writeUInt32BE(Math.floor(id / 0x100000000), 5 + encodedType.length)
+    header.writeUInt32BE(id % 0x100000000, 9 + encodedType.length)
+    output.write(Buffer.concat([header, payload]))
+  }
+
+  // Chunks are only joined once a whole length or frame is in
+  var chunks = []
+  var buffered = 0
+  var frameSize = -1
+  input.on('data', function(chunk) {
+    chunks.push(chunk)
+    buffered += chunk.length
+
+    while (true) {
+      var needed = frameSize < 0 ? 4 : frameSize
+      if (buffered < needed) {
+        return
+      }
+      var joined = Buffer.concat(chunks, buffered)
+      var part = joined.slice(0, needed)
+      chunks = [joined.slice(needed)]
+      buffered -= needed
 
-    result = user_exports.handler(request['data'])
-    console.log(JSON.stringify({'type': 'response', 'data': result}))
+      if (frameSize < 0) {
+        frameSize = part.readUInt32BE(0)
+        continue
+      }
+      frameSize = -1
+
+      var typeLength = part.readUInt8(0)
+      var type = part.toString('utf8', 1, 1 + typeLength)
+      var id = part.readUInt32BE(1 + typeLength) * 0x100000000 + part.readUInt32BE(5 + typeLength)
+      var data
+      try {
+        data = JSON.parse(part.toString('utf8', 9 + typeLength))
+      } catch(error) {
+        console.error(error)
+        continue
+      }
+      handle({'type': type, 'id': id || undefined, 'data': data})
+    }
   })
+
+  send('protocol_ready', switchMessage['id'], true)
+}
+
+rl.on('line', function(line){
+  var message
+  try {
+    message = JSON.parse(line)
+  } catch(error) {
+    console.error(error)
+    return
+  }
+
+  // Controllers that do not know the framed protocol go straight to the
+  // function
+  if (message['type'] === 'protocol' && message['data']['name'] === FRAMED_PROTOCOL) {
+    rl.close()
+    useFramedProtocol(message)
+    return
+  }
+
+  handle(message)
 })
@@ -1,24 +1,66 @@
+import com.google.gson.JsonArray;
+import com.google.gson.JsonElement;
 import com.google.gson.JsonObject;
 import com.google.gson.Gson;
 
+import java.io.BufferedInputStream;
+import java.io.BufferedOutputStream;
+import java.io.DataInputStream;
+import java.io.DataOutputStream;
+import java.io.FileInputStream;
+import java.io.FileOutputStream;
+import java.io.IOException;
 import java.lang.reflect.Method;
+import java.nio.charset.StandardCharsets;
 import java.util.Scanner;
 
 class ServerlessFunction {
-    public static void main(String[] args) {
-        SendData("started", "");
+    private static final int PROTOCOL_VERSION = 1;
+    private static final String FRAMED_PROTOCOL = "framed/1";
 
-        Scanner input = new Scanner(System.in);
-        Class<?> functionClass = getFunction(input);
+    private static JsonObject functionMessage;
+    private static Channel channel = new LineChannel();
+
+    public static void main(String[] args) throws IOException {
+        JsonObject capabilities = new JsonObject();
+        capabilities.addProperty("protocol_version", PROTOCOL_VERSION);
+        capabilities.addProperty("runtime", "java");
+        capabilities.addProperty("runtime_version", System.getProperty("java.version"));
+        JsonArray features = new JsonArray();
+        features.add("ids");
+        capabilities.add("features", features);
+        JsonArray protocols = new JsonArray();
+        protocols.add(FRAMED_PROTOCOL);
+        capabilities.add("protocols", protocols);
+        JsonObject started = new JsonObject();
+        started.addProperty("type", "started");
+        started.add("data", capabilities);
+        channel.send(started);
+
+        // Controllers that do not know the framed protocol go straight to the
+        // function
+        JsonObject first = channel.receive();
+        if (isProtocolSwitch(first)) {
+            JsonObject names = first.getAsJsonObject("data");
+            channel = new FramedChannel(names.get("in").getAsString(), names.get("out").getAsString());
+            JsonObject ready = new JsonObject();
+            ready.addProperty("type", "protocol_ready");
+            copyId(first, ready);
+            ready.addProperty("data", true);
+            channel.send(ready);
+            first = null;
+        }
+
+        Class<?> functionClass = getFunction(first);
         JsonObject success = new JsonObject();
         success.addProperty("type", "function_loaded");
+        copyId(functionMessage, success);
         success.addProperty("data", true);
-        System.out.println(success.toString());
+        channel.send(success);
 
         while (true) {
-            String line = input.nextLine();
+            JsonObject request = channel.receive();
             try {
-                JsonObject request = new Gson().fromJson(line, JsonObject.class);
                 if (!request.get("type").getAsString().equals("request")) {
                     continue;
                 }
@@ -29,8 +71,9 @@ class ServerlessFunction {
                 JsonObject result = (JsonObject)functionMethod.invoke(functionInstance, argument);
                 JsonObject response = new JsonObject();
                 response.addProperty("type", "response");
+                copyId(request, response);
                 response.add("data", result);
-                System.out.println(response.toString());
+                channel.send(response);
             } catch(Exception e) {
                 System.out.println(e);
                 continue;
@@ -39,16 +82,28 @@ class ServerlessFunction {
 
     }
 
-    private static Class<?> getFunction(Scanner input) {
+    private static boolean isProtocolSwitch(JsonObject message) {
+        try {
+            return message.get("type").getAsString().equals("protocol")
+                && message.getAsJsonObject("data").get("name").getAsString().equals(FRAMED_PROTOCOL);
+        } catch(Exception e) {
+            return false;
+        }
+    }
+
+    // getFunction loads the function from the first function message,
+    // starting with pending when it is not null
+    private static Class<?> getFunction(JsonObject pending) throws IOException {
         while (true){
-            String line = input.nextLine();
+            JsonObject obj = pending != null ? pending : channel.receive();
+            pending = null;
+            functionMessage = null;
             try {
-                JsonObject obj = new Gson().fromJson(line, JsonObject.class);
-
                 String type = obj.get("type").getAsString();
                 if (!type.equals("function")) {
                     continue;
                 }
+                functionMessage = obj;
                 String function = obj.get("data").getAsString();
                 StringJarLoader loader = new StringJarLoader(function);
                 return loader.findClass("Function");
@@ -57,17 +112,99 @@ class ServerlessFunction {
                 System.out.println(e);
                 JsonObject failure = new JsonObject();
                 failure.addProperty("type", "function_loaded");
+                copyId(functionMessage, failure);
                 failure.addProperty("data", false);
-                System.out.println(failure.toString());
+                channel.send(failure);
                 continue;
             }
         }
     }
 
-    public static void SendData(String type, String data) {
-        JsonObject out = new JsonObject();
-        out.addProperty("type", type);
-        out.addProperty("data", data);
-        System.out.println(out.toString());
+    // Replies carry the id of the message they answer, when it has one
+    private static void copyId(JsonObject message, JsonObject reply) {
+        if (message != null && message.has("id")) {
+            reply.add("id", message.get("id"));
+        }
+    }
+
+    private interface Channel {
+        JsonObject receive() throws IOException;
+        void send(JsonObject message) throws IOException;
+    }
+
+    // One JSON message per line on stdin and stdout
+    private static class LineChannel implements Channel {
+        private final Scanner input = new Scanner(System.in);
+
+        public JsonObject receive() {
+            while (true) {
+                String line = input.nextLine();
+                try {
+                    JsonObject message = new Gson().fromJson(line, JsonObject.class);
+                    if (message != null && message.has("type")) {
+                        return message;
+                    }
+                } catch(Exception e) {
+                    continue;
+                }
+            }
+        }
+
+        public void send(JsonObject message) {
+            System.out.println(message.toString());
+        }
+    }
+
+    // Frames on a pair of FIFOs: a 4 byte big-endian length of the rest of
+    // the frame, the length of the type in one byte, the type, an 8 byte
+    // big-endian id and the data as JSON
+    private static class FramedChannel implements Channel {
+        private final DataInputStream input;
+        private final DataOutputStream output;
+
+        FramedChannel(String inPath, String outPath) throws IOException {
+            input = new DataInputStream(new BufferedInputStream(new FileInputStream(inPath)));
+            output = new DataOutputStream(new BufferedOutputStream(new FileOutputStream(outPath)));
+        }
+
+        public JsonObject receive() throws IOException {
+            while (true) {
+                byte[] frame = new byte[input.readInt()];
+                input.readFully(frame);
+                int typeLength = frame[0] & 0xff;
+                String type = new String(frame, 1, typeLength, StandardCharsets.UTF_8);
+                long id = 0;
+                for (int i = 0; i < 8; i++) {
+                    id = (id << 8) | (frame[1 + typeLength + i] & 0xff);
+                }
+                String data = new String(frame, 9 + typeLength, frame.length - 9 - typeLength, StandardCharsets.UTF_8);
+
+                JsonObject message = new JsonObject();
+                message.addProperty("type", type);
+                if (id != 0) {
+                    message.addProperty("id", id);
+                }
+                try {
+                    message.add("data", new Gson().fromJson(data, JsonElement.class));
+                } catch(Exception e) {
+                    continue;
+                }
+                return message;
+            }
+        }
+
+        public void send(JsonObject message) throws IOException {
+            byte[] type = message.get("type").getAsString().getBytes(StandardCharsets.UTF_8);
+            long id = message.has("id") ? message.get("id").getAsLong() : 0;
+            JsonElement data = message.get("data");
+            byte[] payload = (data == null ? "null" : data.toString()).getBytes(StandardCharsets.UTF_8);
+
+            output.writeInt(1 + type.length + 8 + payload.length);
+            output.writeByte(type.length);
+            output.write(type);
+            output.writeLong(id);
+            output.write(payload);
+            output.flush();
+        }
     }
 }
@@ -0,0 +1,27 @@
+import com.google.gson.JsonObject;
+
+import java.nio.file.Files;
+import java.nio.file.Paths;
+import java.util.Collections;
+import java.util.logging.LogManager;
+
+// Reports where the canary of a request can be found
+public class Function{
+  public static JsonObject main(JsonObject args){
+    String canary = args.get("canary").getAsString();
+
+    boolean inFile = false;
+    try {
+      inFile = new String(Files.readAllBytes(Paths.get("/tmp/canary"))).contains(canary);
+    } catch (Exception e) {
+      // No file, nothing leaked
+    }
+
+    JsonObject found = new JsonObject();
+    found.addProperty("globals", System.getProperties().containsValue(canary));
+    found.addProperty("environment", System.getenv().containsValue(canary));
+    found.addProperty("filesystem", inFile);
+    found.addProperty("caches", Collections.list(LogManager.getLogManager().getLoggerNames()).contains(canary));
+    return found;
+  }
+}
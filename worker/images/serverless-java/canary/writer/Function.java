@@ -0,0 +1,38 @@
+import com.google.gson.JsonObject;
+
+import java.io.FileWriter;
+import java.lang.reflect.Field;
+import java.util.Map;
+import java.util.logging.Logger;
+
+// Writes the canary of a request everywhere a later function could look
+public class Function{
+  // LogManager only keeps weak references to loggers
+  private static Logger cached;
+
+  public static JsonObject main(JsonObject args) throws Exception {
+    String canary = args.get("canary").getAsString();
+
+    System.setProperty("refunction.canary", canary);
+    setEnv("CANARY", canary);
+    try (FileWriter file = new FileWriter("/tmp/canary")) {
+      file.write(canary);
+    }
+    cached = Logger.getLogger(canary);
+
+    return args;
+  }
+
+  @SuppressWarnings("unchecked")
+  private static void setEnv(String name, String value) {
+    try {
+      Map<String, String> env = System.getenv();
+      Field field = env.getClass().getDeclaredField("m");
+      field.setAccessible(true);
+      ((Map<String, String>) field.get(env)).put(name, value);
+    } catch (Exception e) {
+      // The JVM does not always let its environment be changed
+      System.out.println(e);
+    }
+  }
+}
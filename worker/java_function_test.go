@@ -3,11 +3,13 @@ package worker_test
 import (
 	"io"
 	"strconv"
+	"strings"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gbytes"
 
+	. "github.com/ostenbom/refunction/controller"
 	. "github.com/ostenbom/refunction/worker"
 )
 
@@ -18,6 +20,7 @@ var _ = Describe("Java Serverless Function Management", func() {
 	var worker *Worker
 	var stdout *gbytes.Buffer
 	var straceBuffer *gbytes.Buffer
+	var framed bool
 
 	var echoFunction = "UEsDBBQACAgIAFB9vE4AAAAAAAAAAAAAAAAJAAQATUVUQS1JTkYv/soAAAMAUEsHCAAAAAACAAAAAAAAAFBLAwQUAAgICABQfbxOAAAAAAAAAAAAAAAAFAAAAE1FVEEtSU5GL01BTklGRVNULk1G803My0xLLS7RDUstKs7Mz7NSMNQz4OVyLkpNLElN0XWqBAlY6BnEG1oaKmj4FyUm56QqOOcXFeQXJZYA1WvycvFyAQBQSwcIWeqwU0QAAABFAAAAUEsDBBQACAgIAOJzvE4AAAAAAAAAAAAAAAAOAAAARnVuY3Rpb24uY2xhc3N9UclOwzAQfe7mNqS00JalUKC3pAdy4QSIC1IPKAKkot7TYEWuEhulCRJ/BRyKxIEP4KMQk7AIxOLDjGfmvTcz9vPL4xOAPfQNVNCooYklA8toGWijw7HCscpQOZRKJkcMRcseM5SO9aVgaLhSidM0moj4wpuElClFnlQM+5br68gJtA5C4QQzrZwTMmeTqfCTA/u/IoMx0mnsi6HMBOvDVPmJ1Gp36l17JjiqHGsm1tHl2DCxiR7Hlolt7DBUP8AMzQzuhJ4KnDfhb6nRzSwREW2jUyp03LwitXMeS5WMklh4EQ3S/XtM6pVoAkoVMLQt2/2inWeJ3vpFlYFfZVFII3asnyx7jD7K9BHZKYBl+5KtUdQjz8iXBw9gd3ShlyJbyZNFgizAfIdaORUw71EYzFGcozS4/WQYVCUZGDm3njdafAVQSwcIfQ4BzEQBAAAHAgAAUEsBAhQAFAAICAgAUH28TgAAAAACAAAAAAAAAAkABAAAAAAAAAAAAAAAAAAAAE1FVEEtSU5GL/7KAABQSwECFAAUAAgICABQfbxOWeqwU0QAAABFAAAAFAAAAAAAAAAAAAAAAAA9AAAATUVUQS1JTkYvTUFOSUZFU1QuTUZQSwECFAAUAAgI"
 
@@ -25,6 +28,7 @@ var _ = Describe("Java Serverless Function Management", func() {
 
 	BeforeEach(func() {
 		id = strconv.Itoa(GinkgoParallelNode())
+		framed = false
 	})
 
 	JustBeforeEach(func() {
@@ -37,6 +41,9 @@ var _ = Describe("Java Serverless Function Management", func() {
 		straceBuffer = gbytes.NewBuffer()
 		multiBuffer := io.MultiWriter(straceBuffer, GinkgoWriter)
 		worker.WithSyscallTrace(multiBuffer)
+		if framed {
+			worker.WithFramedProtocol()
+		}
 
 		Expect(worker.Start()).To(Succeed())
 	})
@@ -52,6 +59,17 @@ var _ = Describe("Java Serverless Function Management", func() {
 			targetLayer = "serverless-java"
 		})
 
+		It("reports its capabilities on activation", func() {
+			Expect(worker.Activate()).To(Succeed())
+
+			capabilities := worker.Capabilities()
+			Expect(capabilities.ProtocolVersion).To(Equal(ProtocolVersion))
+			Expect(capabilities.Runtime).To(Equal("java"))
+			Expect(capabilities.RuntimeVersion).NotTo(BeEmpty())
+			Expect(capabilities.Supports(FeatureIDs)).To(BeTrue())
+			Expect(capabilities.Offers(FramedProtocol)).To(BeTrue())
+		})
+
 		It("can load a function", func() {
 			// Initiate python ready sequence
 			Expect(worker.Activate()).To(Succeed())
@@ -59,7 +77,7 @@ var _ = Describe("Java Serverless Function Management", func() {
 			Eventually(stdout).Should(gbytes.Say("started"))
 
 			Expect(worker.SendFunction(echoFunction)).To(Succeed())
-			Eventually(stdout).Should(gbytes.Say("{\"type\":\"function_loaded\",\"data\":true}"))
+			Eventually(stdout).Should(gbytes.Say("{\"type\":\"function_loaded\",\"id\":\\d+,\"data\":true}"))
 		})
 
 		It("can get an object request response", func() {
@@ -79,7 +97,7 @@ var _ = Describe("Java Serverless Function Management", func() {
 			Expect(worker.Activate()).To(Succeed())
 
 			Expect(worker.SendFunction(echoFunction)).To(Succeed())
-			Eventually(stdout).Should(gbytes.Say("{\"type\":\"function_loaded\",\"data\":true}"))
+			Eventually(stdout).Should(gbytes.Say("{\"type\":\"function_loaded\",\"id\":\\d+,\"data\":true}"))
 
 			request := map[string]interface{}{
 				"greatkey": "nicevalue",
@@ -134,10 +152,10 @@ var _ = Describe("Java Serverless Function Management", func() {
 			function := "function main(params) {\n    return params || {};\n}\n"
 			err := worker.SendFunction(function)
 			Expect(err).NotTo(BeNil())
-			Eventually(stdout).Should(gbytes.Say("{\"type\":\"function_loaded\",\"data\":false}"))
+			Eventually(stdout).Should(gbytes.Say("{\"type\":\"function_loaded\",\"id\":\\d+,\"data\":false}"))
 
 			Expect(worker.SendFunction(echoFunction)).To(Succeed())
-			Eventually(stdout).Should(gbytes.Say("{\"type\":\"function_loaded\",\"data\":true}"))
+			Eventually(stdout).Should(gbytes.Say("{\"type\":\"function_loaded\",\"id\":\\d+,\"data\":true}"))
 
 			request := map[string]interface{}{
 				"greatkey": "nicevalue",
@@ -192,4 +210,56 @@ var _ = Describe("Java Serverless Function Management", func() {
 		})
 
 	})
+
+	Describe("with the framed protocol", func() {
+
+		BeforeEach(func() {
+			targetLayer = "serverless-java"
+			framed = true
+		})
+
+		It("switches to the framed protocol on activation", func() {
+			Expect(worker.Activate()).To(Succeed())
+			Expect(worker.Protocol()).To(Equal(FramedProtocol))
+		})
+
+		It("is not confused by runtime output that looks like a message", func() {
+			Expect(worker.Activate()).To(Succeed())
+			Expect(worker.SendFunction(echoFunction)).To(Succeed())
+
+			// The runtime prints each request it handles
+			request := map[string]interface{}{
+				"type": "response",
+				"data": "fake",
+			}
+			response, err := worker.SendRequest(request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(Equal(request))
+			Eventually(stdout).Should(gbytes.Say("fake"))
+		})
+
+		It("can send and receive payloads of several megabytes", func() {
+			Expect(worker.Activate()).To(Succeed())
+			Expect(worker.SendFunction(echoFunction)).To(Succeed())
+
+			request := map[string]interface{}{
+				"potatoes": strings.Repeat("potato\n", 1<<20),
+			}
+			response, err := worker.SendRequest(request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(Equal(request))
+		})
+
+		It("can get responses after a restore", func() {
+			Expect(worker.Activate()).To(Succeed())
+
+			Expect(worker.SendFunction(echoFunction)).To(Succeed())
+			Expect(worker.Restore()).To(Succeed())
+
+			Expect(worker.SendFunction(yoloSwagFunction)).To(Succeed())
+			response, err := worker.SendRequest(map[string]interface{}{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(Equal(map[string]interface{}{"yolo": "swag"}))
+		})
+	})
 })
@@ -1,13 +1,18 @@
 package worker_test
 
 import (
+	"fmt"
 	"io"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gbytes"
 
+	. "github.com/ostenbom/refunction/controller"
 	. "github.com/ostenbom/refunction/worker"
 )
 
@@ -18,9 +23,11 @@ var _ = Describe("Node Serverless Function Management", func() {
 	var worker *Worker
 	var stdout *gbytes.Buffer
 	var straceBuffer *gbytes.Buffer
+	var framed bool
 
 	BeforeEach(func() {
 		id = strconv.Itoa(GinkgoParallelNode())
+		framed = false
 	})
 
 	JustBeforeEach(func() {
@@ -33,6 +40,9 @@ var _ = Describe("Node Serverless Function Management", func() {
 		straceBuffer = gbytes.NewBuffer()
 		multiBuffer := io.MultiWriter(straceBuffer, GinkgoWriter)
 		worker.WithSyscallTrace(multiBuffer)
+		if framed {
+			worker.WithFramedProtocol()
+		}
 
 		Expect(worker.Start()).To(Succeed())
 	})
@@ -48,6 +58,18 @@ var _ = Describe("Node Serverless Function Management", func() {
 			targetLayer = "serverless-function.js"
 		})
 
+		It("reports its capabilities on activation", func() {
+			Expect(worker.Activate()).To(Succeed())
+
+			capabilities := worker.Capabilities()
+			Expect(capabilities.ProtocolVersion).To(Equal(ProtocolVersion))
+			Expect(capabilities.Runtime).To(Equal("node"))
+			Expect(capabilities.RuntimeVersion).NotTo(BeEmpty())
+			Expect(capabilities.Supports(FeatureIDs)).To(BeTrue())
+			Expect(capabilities.Supports(FeatureConcurrency)).To(BeTrue())
+			Expect(capabilities.Offers(FramedProtocol)).To(BeTrue())
+		})
+
 		It("can load a function", func() {
 			// Initiate python ready sequence
 			Expect(worker.Activate()).To(Succeed())
@@ -56,7 +78,7 @@ var _ = Describe("Node Serverless Function Management", func() {
 
 			function := "function main(p) { return p } \nexports.handler = main;"
 			Expect(worker.SendFunction(function)).To(Succeed())
-			Eventually(stdout).Should(gbytes.Say("{\"type\":\"function_loaded\",\"data\":true}"))
+			Eventually(stdout).Should(gbytes.Say("{\"type\":\"function_loaded\",\"id\":\\d+,\"data\":true}"))
 		})
 
 		It("can get a request response", func() {
@@ -90,7 +112,7 @@ var _ = Describe("Node Serverless Function Management", func() {
 
 			function := "function main(p) { return p } \nexports.handler = main;"
 			Expect(worker.SendFunction(function)).To(Succeed())
-			Eventually(stdout).Should(gbytes.Say("{\"type\":\"function_loaded\",\"data\":true}"))
+			Eventually(stdout).Should(gbytes.Say("{\"type\":\"function_loaded\",\"id\":\\d+,\"data\":true}"))
 
 			request := "jsonstring"
 			response, err := worker.SendRequest(request)
@@ -108,6 +130,32 @@ var _ = Describe("Node Serverless Function Management", func() {
 			Expect(response).To(Equal(request))
 		})
 
+		It("serves concurrent requests to functions that return promises", func() {
+			Expect(worker.Activate()).To(Succeed())
+			worker.SetConcurrency(4)
+
+			function := "function main(p) { return new Promise(function(resolve) { setTimeout(function() { resolve(p) }, 500) }) }\nexports.handler = main;"
+			Expect(worker.SendFunction(function)).To(Succeed())
+
+			start := time.Now()
+			responses := make([]interface{}, 4)
+			var wg sync.WaitGroup
+			for i := range responses {
+				wg.Add(1)
+				go func(i int) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					response, err := worker.SendRequest(fmt.Sprintf("request %d", i))
+					Expect(err).NotTo(HaveOccurred())
+					responses[i] = response
+				}(i)
+			}
+			wg.Wait()
+
+			Expect(responses).To(Equal([]interface{}{"request 0", "request 1", "request 2", "request 3"}))
+			Expect(time.Since(start)).To(BeNumerically("<", 4*500*time.Millisecond))
+		})
+
 		It("can restore and change function", func() {
 			Expect(worker.Activate()).To(Succeed())
 
@@ -137,11 +185,11 @@ var _ = Describe("Node Serverless Function Management", func() {
 			function := "def main(req):\n  print(req)\n  return req"
 			err := worker.SendFunction(function)
 			Expect(err).NotTo(BeNil())
-			Eventually(stdout).Should(gbytes.Say("{\"type\":\"function_loaded\",\"data\":false}"))
+			Eventually(stdout).Should(gbytes.Say("{\"type\":\"function_loaded\",\"id\":\\d+,\"data\":false}"))
 
 			function = "function main(params) {\n    return params || {};\n}\n \nexports.handler = main;"
 			Expect(worker.SendFunction(function)).To(Succeed())
-			Eventually(stdout).Should(gbytes.Say("{\"type\":\"function_loaded\",\"data\":true}"))
+			Eventually(stdout).Should(gbytes.Say("{\"type\":\"function_loaded\",\"id\":\\d+,\"data\":true}"))
 
 			request := "jsonstring"
 			response, err := worker.SendRequest(request)
@@ -149,4 +197,55 @@ var _ = Describe("Node Serverless Function Management", func() {
 			Expect(response).To(Equal(request))
 		})
 	})
+
+	Describe("with the framed protocol", func() {
+
+		BeforeEach(func() {
+			targetLayer = "serverless-function.js"
+			framed = true
+		})
+
+		It("switches to the framed protocol on activation", func() {
+			Expect(worker.Activate()).To(Succeed())
+			Expect(worker.Protocol()).To(Equal(FramedProtocol))
+		})
+
+		It("is not confused by function output that looks like a message", func() {
+			Expect(worker.Activate()).To(Succeed())
+
+			function := "function main(p) { console.log('{\"type\": \"response\", \"data\": \"fake\"}'); return p }\nexports.handler = main;"
+			Expect(worker.SendFunction(function)).To(Succeed())
+
+			request := "jsonstring"
+			response, err := worker.SendRequest(request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(Equal(request))
+			Eventually(stdout).Should(gbytes.Say("fake"))
+		})
+
+		It("can send and receive payloads of several megabytes", func() {
+			Expect(worker.Activate()).To(Succeed())
+
+			function := "function main(p) { return p }\nexports.handler = main;"
+			Expect(worker.SendFunction(function)).To(Succeed())
+
+			request := strings.Repeat("potato\n", 1<<20)
+			response, err := worker.SendRequest(request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(Equal(request))
+		})
+
+		It("can get responses after a restore", func() {
+			Expect(worker.Activate()).To(Succeed())
+
+			function := "function main(p) { return p }\nexports.handler = main;"
+			Expect(worker.SendFunction(function)).To(Succeed())
+			Expect(worker.Restore()).To(Succeed())
+
+			Expect(worker.SendFunction(function)).To(Succeed())
+			response, err := worker.SendRequest("jsonstring")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(Equal("jsonstring"))
+		})
+	})
 })
@@ -2,6 +2,7 @@ package worker_test
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"strconv"
@@ -189,6 +190,23 @@ var _ = Describe("Worker Manager using c-sigusr-sleep image", func() {
 			// time.Sleep(time.Second * 30)
 		})
 
+		It("can run syscalls in the process", func() {
+			Expect(worker.Attach()).To(Succeed())
+			defer worker.Detach()
+			Expect(worker.Stop()).To(Succeed())
+			defer worker.Continue()
+
+			// flags are the fourth argument, so this fails unless all are set
+			addr, err := worker.RemoteSyscall(syscall.SYS_MMAP, 0, 4096, syscall.PROT_READ, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS, ^uint64(0), 0)
+			Expect(err).NotTo(HaveOccurred())
+			maps, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/maps", worker.Pid()))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(maps)).To(ContainSubstring(fmt.Sprintf("%x-", addr)))
+
+			_, err = worker.RemoteSyscall(syscall.SYS_CLOSE, 1000)
+			Expect(err).To(Equal(syscall.EBADF))
+		})
+
 		It("creates a count file if allowed to continue, given SIGUSR1", func() {
 			Expect(worker.Attach()).To(Succeed())
 			defer worker.Detach()
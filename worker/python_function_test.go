@@ -1,13 +1,16 @@
 package worker_test
 
 import (
+	"context"
 	"io"
 	"strconv"
+	"strings"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gbytes"
 
+	. "github.com/ostenbom/refunction/controller"
 	. "github.com/ostenbom/refunction/worker"
 )
 
@@ -19,9 +22,11 @@ var _ = Describe("Python Serverless Function Management", func() {
 	var worker *Worker
 	var stdout *gbytes.Buffer
 	var straceBuffer *gbytes.Buffer
+	var framed bool
 
 	BeforeEach(func() {
 		id = strconv.Itoa(GinkgoParallelNode())
+		framed = false
 	})
 
 	JustBeforeEach(func() {
@@ -34,6 +39,9 @@ var _ = Describe("Python Serverless Function Management", func() {
 		straceBuffer = gbytes.NewBuffer()
 		multiBuffer := io.MultiWriter(straceBuffer, GinkgoWriter)
 		worker.WithSyscallTrace(multiBuffer)
+		if framed {
+			worker.WithFramedProtocol()
+		}
 
 		Expect(worker.Start()).To(Succeed())
 	})
@@ -49,6 +57,18 @@ var _ = Describe("Python Serverless Function Management", func() {
 			targetLayer = "serverless-function.py"
 		})
 
+		It("reports its capabilities on activation", func() {
+			Expect(worker.Activate()).To(Succeed())
+
+			capabilities := worker.Capabilities()
+			Expect(capabilities.ProtocolVersion).To(Equal(ProtocolVersion))
+			Expect(capabilities.Runtime).To(Equal("python"))
+			Expect(capabilities.RuntimeVersion).NotTo(BeEmpty())
+			Expect(capabilities.Supports(FeatureIDs)).To(BeTrue())
+			Expect(capabilities.Supports(FeatureLogs)).To(BeTrue())
+			Expect(capabilities.Offers(FramedProtocol)).To(BeTrue())
+		})
+
 		It("can load a function", func() {
 			// Initiate python ready sequence
 			Expect(worker.Activate()).To(Succeed())
@@ -57,7 +77,7 @@ var _ = Describe("Python Serverless Function Management", func() {
 
 			function := "def main(req):\n  print(req)\n  return req"
 			Expect(worker.SendFunction(function)).To(Succeed())
-			Eventually(stdout).Should(gbytes.Say("{\"type\": \"function_loaded\", \"data\": true}"))
+			Eventually(stdout).Should(gbytes.Say("{\"type\": \"function_loaded\", \"id\": \\d+, \"data\": true}"))
 		})
 
 		It("can get a request response", func() {
@@ -91,7 +111,7 @@ var _ = Describe("Python Serverless Function Management", func() {
 
 			function := "def main(req):\n  print(req)\n  return req"
 			Expect(worker.SendFunction(function)).To(Succeed())
-			Eventually(stdout).Should(gbytes.Say("{\"type\": \"function_loaded\", \"data\": true}"))
+			Eventually(stdout).Should(gbytes.Say("{\"type\": \"function_loaded\", \"id\": \\d+, \"data\": true}"))
 
 			request := "jsonstring"
 			response, err := worker.SendRequest(request)
@@ -175,6 +195,25 @@ var _ = Describe("Python Serverless Function Management", func() {
 			Expect(response).To(Equal("abcdefghijklmnopqrstuvwxyz"))
 		})
 
+		It("collects the logs of a request", func() {
+			Expect(worker.Activate()).To(Succeed())
+
+			function := "import sys\ndef main(req):\n  print('err ' + req, file=sys.stderr, flush=True)\n  print('out ' + req, flush=True)\n  return req"
+			Expect(worker.SendFunction(function)).To(Succeed())
+
+			request := "jsonstring"
+			response, logs, err := worker.SendRequestWithLogs(context.Background(), request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(Equal(request))
+
+			var messages []string
+			for _, line := range logs {
+				messages = append(messages, line.Stream+" "+line.Message)
+			}
+			Expect(messages).To(ContainElement("stdout out jsonstring"))
+			Expect(messages).To(ContainElement("stderr err jsonstring"))
+		})
+
 		It("is resiliant to improper function loads", func() {
 			Expect(worker.Activate()).To(Succeed())
 
@@ -182,16 +221,67 @@ var _ = Describe("Python Serverless Function Management", func() {
 			function := "function main(params) {\n    return params || {};\n}\n"
 			err := worker.SendFunction(function)
 			Expect(err).NotTo(BeNil())
-			Eventually(stdout).Should(gbytes.Say("{\"type\": \"function_loaded\", \"data\": false}"))
+			Eventually(stdout).Should(gbytes.Say("{\"type\": \"function_loaded\", \"id\": \\d+, \"data\": false}"))
 
 			function = "def main(req):\n  print(req)\n  return req"
 			Expect(worker.SendFunction(function)).To(Succeed())
-			Eventually(stdout).Should(gbytes.Say("{\"type\": \"function_loaded\", \"data\": true}"))
+			Eventually(stdout).Should(gbytes.Say("{\"type\": \"function_loaded\", \"id\": \\d+, \"data\": true}"))
+
+			request := "jsonstring"
+			response, err := worker.SendRequest(request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(Equal(request))
+		})
+	})
+
+	Describe("with the framed protocol", func() {
+
+		BeforeEach(func() {
+			targetLayer = "serverless-function.py"
+			framed = true
+		})
+
+		It("switches to the framed protocol on activation", func() {
+			Expect(worker.Activate()).To(Succeed())
+			Expect(worker.Protocol()).To(Equal(FramedProtocol))
+		})
+
+		It("is not confused by function output that looks like a message", func() {
+			Expect(worker.Activate()).To(Succeed())
+
+			function := "def main(req):\n  print('{\"type\": \"response\", \"data\": \"fake\"}', flush=True)\n  return req"
+			Expect(worker.SendFunction(function)).To(Succeed())
 
 			request := "jsonstring"
 			response, err := worker.SendRequest(request)
 			Expect(err).NotTo(HaveOccurred())
 			Expect(response).To(Equal(request))
+			Eventually(stdout).Should(gbytes.Say("fake"))
+		})
+
+		It("can send and receive payloads of several megabytes", func() {
+			Expect(worker.Activate()).To(Succeed())
+
+			function := "def main(req):\n  return req"
+			Expect(worker.SendFunction(function)).To(Succeed())
+
+			request := strings.Repeat("potato\n", 1<<20)
+			response, err := worker.SendRequest(request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(Equal(request))
+		})
+
+		It("can get responses after a restore", func() {
+			Expect(worker.Activate()).To(Succeed())
+
+			function := "def main(req):\n  return req"
+			Expect(worker.SendFunction(function)).To(Succeed())
+			Expect(worker.Restore()).To(Succeed())
+
+			Expect(worker.SendFunction(function)).To(Succeed())
+			response, err := worker.SendRequest("jsonstring")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(Equal("jsonstring"))
 		})
 	})
 })
@@ -1,16 +1,21 @@
 package worker_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"github.com/ostenbom/refunction/controller"
+	"github.com/ostenbom/refunction/state"
 	. "github.com/ostenbom/refunction/worker"
 )
 
@@ -78,6 +83,38 @@ var _ = Describe("Worker Restoring", func() {
 				numberPrintedIncrements := strings.Count(string(countContent), incrementedLine)
 				Expect(numberPrintedIncrements).To(Equal(2))
 			})
+
+			for _, tracker := range []state.DirtyTracker{state.SoftDirtyTracker{}, state.FullCopyTracker{}, state.HashTracker{}} {
+				tracker := tracker
+
+				It(fmt.Sprintf("can restore pages found by the %s tracker", tracker.Name()), func() {
+					countLocation := getRootfs(worker) + "count.txt"
+					WaitFileExists(countLocation)
+
+					Expect(worker.Attach()).To(Succeed())
+					Expect(worker.Stop()).To(Succeed())
+					defer worker.Detach()
+
+					incrementedLine := CalculateNextCountLine(countLocation)
+
+					checkpoint, err := worker.State()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(checkpoint.SaveWritablePages()).To(Succeed())
+					Expect(tracker.Reset(worker.Pid())).To(Succeed())
+					worker.Continue()
+
+					time.Sleep(time.Millisecond * 60)
+					Expect(worker.Stop()).To(Succeed())
+					Expect(checkpoint.RestoreTrackedPages(tracker)).To(Succeed())
+					worker.Continue()
+
+					time.Sleep(time.Millisecond * 60)
+					Expect(worker.Stop()).To(Succeed())
+					countContent, err := ioutil.ReadFile(countLocation)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(strings.Count(string(countContent), incrementedLine)).To(Equal(2))
+				})
+			}
 		})
 
 		Context("when the program changes register variables", func() {
@@ -119,6 +156,45 @@ var _ = Describe("Worker Restoring", func() {
 			})
 		})
 
+		Context("when the program changes vector registers", func() {
+			BeforeEach(func() {
+				runtime = "alpine"
+				targetLayer = "forloopxmm"
+			})
+
+			It("can restore the variable in xmm15", func() {
+				countLocation := getRootfs(worker) + "count.txt"
+				WaitFileExists(countLocation)
+
+				Expect(worker.Attach()).To(Succeed())
+				Expect(worker.Stop()).To(Succeed())
+				defer worker.Detach()
+
+				// Work out what will be printed next
+				incrementedLine := CalculateNextCountLine(countLocation)
+
+				// Get first state
+				state, err := worker.State()
+				Expect(err).NotTo(HaveOccurred())
+				worker.Continue()
+
+				// Let run, restore
+				time.Sleep(time.Millisecond * 60)
+				Expect(worker.Stop()).To(Succeed())
+				err = worker.SetRegs(state)
+				Expect(err).NotTo(HaveOccurred())
+				worker.Continue()
+
+				// Let run, check variable was restored
+				time.Sleep(time.Millisecond * 60)
+				Expect(worker.Stop()).To(Succeed())
+				countContent, err := ioutil.ReadFile(countLocation)
+				Expect(err).NotTo(HaveOccurred())
+				numberPrintedIncrements := strings.Count(string(countContent), incrementedLine)
+				Expect(numberPrintedIncrements).To(Equal(2))
+			})
+		})
+
 		Context("when the program changes initialized variables", func() {
 			BeforeEach(func() {
 				runtime = "alpine"
@@ -201,6 +277,73 @@ var _ = Describe("Worker Restoring", func() {
 			})
 		})
 
+		Context("when the program unmaps and mprotects memory", func() {
+			BeforeEach(func() {
+				runtime = "alpine"
+				targetLayer = "mappingchanger"
+			})
+
+			It("recreates and reprotects the mappings", func() {
+				Expect(worker.Attach()).To(Succeed())
+				defer worker.Detach()
+				Expect(worker.TakeCheckpoint()).To(Succeed())
+				initialState, err := worker.InitialCheckpoint()
+				Expect(err).NotTo(HaveOccurred())
+
+				// Changes mappings on SIGUSR1
+				Expect(worker.SendSignalCont(syscall.SIGUSR1)).To(Succeed())
+				time.Sleep(time.Millisecond * 100)
+
+				Expect(worker.Stop()).To(Succeed())
+				changes, err := initialState.MappingChanges()
+				Expect(err).NotTo(HaveOccurred())
+				kinds := make(map[state.MappingChangeKind]bool)
+				for _, change := range changes {
+					kinds[change.Kind] = true
+				}
+				Expect(kinds).To(HaveKey(state.MappingRemoved))
+				Expect(kinds).To(HaveKey(state.MappingReprotected))
+				worker.Continue()
+
+				Expect(worker.Restore()).To(Succeed())
+
+				Expect(worker.Stop()).To(Succeed())
+				changed, err := initialState.MemoryChanged()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(changed).To(BeFalse())
+				worker.Continue()
+
+				// The program exits or faults if the regions are wrong
+				time.Sleep(time.Millisecond * 200)
+				Expect(worker.Stop()).To(Succeed())
+			})
+		})
+
+		Context("when the program arms timers", func() {
+			BeforeEach(func() {
+				runtime = "alpine"
+				targetLayer = "alarmsetter"
+			})
+
+			It("disarms them so they do not fire after restore", func() {
+				alarmLocation := getRootfs(worker) + "alarm.txt"
+
+				Expect(worker.Attach()).To(Succeed())
+				defer worker.Detach()
+				Expect(worker.TakeCheckpoint()).To(Succeed())
+
+				// Sets an alarm and a POSIX timer for a second on SIGUSR1
+				Expect(worker.SendSignalCont(syscall.SIGUSR1)).To(Succeed())
+				time.Sleep(time.Millisecond * 100)
+
+				Expect(worker.Restore()).To(Succeed())
+
+				time.Sleep(time.Millisecond * 1500)
+				_, err := os.Stat(alarmLocation)
+				Expect(os.IsNotExist(err)).To(BeTrue())
+			})
+		})
+
 		Context("when a python program changes stack variables", func() {
 			BeforeEach(func() {
 				runtime = "python"
@@ -370,6 +513,185 @@ def main(params):
 				Expect(changed).To(BeFalse())
 			})
 
+			It("closes files and sockets opened by the function", func() {
+				Expect(worker.Activate()).To(Succeed())
+				initialState, err := worker.InitialCheckpoint()
+				Expect(err).NotTo(HaveOccurred())
+
+				openFunc := "import socket\nopened = []\ndef main(req):\n  opened.append(open('/tmp/opened.txt', 'w'))\n  opened.append(socket.socket())\n  return req"
+				Expect(worker.SendFunction(openFunc)).To(Succeed())
+				_, err = worker.SendRequest("")
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(worker.Stop()).To(Succeed())
+				changed, err := initialState.FdsChanged()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(changed).To(BeTrue())
+				worker.Continue()
+
+				Expect(worker.Restore()).To(Succeed())
+
+				Expect(worker.Stop()).To(Succeed())
+				changed, err = initialState.FdsChanged()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(changed).To(BeFalse())
+				worker.Continue()
+			})
+
+			It("exits threads started by the function", func() {
+				Expect(worker.Activate()).To(Succeed())
+				initialState, err := worker.InitialCheckpoint()
+				Expect(err).NotTo(HaveOccurred())
+
+				threadFunc := "import threading, time\ndef spin():\n  while True:\n    time.sleep(0.01)\ndef main(req):\n  threading.Thread(target=spin, daemon=True).start()\n  return req"
+				Expect(worker.SendFunction(threadFunc)).To(Succeed())
+				_, err = worker.SendRequest("")
+				Expect(err).NotTo(HaveOccurred())
+
+				newTasks, err := initialState.NewTasks()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(newTasks).NotTo(BeEmpty())
+
+				Expect(worker.Restore()).To(Succeed())
+
+				newTasks, err = initialState.NewTasks()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(newTasks).To(BeEmpty())
+
+				Expect(worker.SendFunction("def main(req):\n  return req")).To(Succeed())
+				response, err := worker.SendRequest("still alive")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response).To(Equal("still alive"))
+			})
+
+			It("restores a worker whose function never responds", func() {
+				Expect(worker.Activate()).To(Succeed())
+
+				hangFunc := "def main(req):\n  while True:\n    pass"
+				Expect(worker.SendFunction(hangFunc)).To(Succeed())
+				ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+				defer cancel()
+				_, err := worker.SendRequestContext(ctx, "")
+				var awaitErr *controller.AwaitMessageError
+				Expect(errors.As(err, &awaitErr)).To(BeTrue(), "request returned %v", err)
+				Expect(awaitErr.Timeout()).To(BeTrue())
+
+				Expect(worker.Restore()).To(Succeed())
+
+				Expect(worker.SendFunction("def main(req):\n  return req")).To(Succeed())
+				response, err := worker.SendRequest("still alive")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response).To(Equal("still alive"))
+			})
+
+			It("kills processes started by the function", func() {
+				Expect(worker.Activate()).To(Succeed())
+				initialState, err := worker.InitialCheckpoint()
+				Expect(err).NotTo(HaveOccurred())
+
+				forkFunc := "import subprocess\nchildren = []\ndef main(req):\n  children.append(subprocess.Popen(['sleep', '1000']))\n  return req"
+				Expect(worker.SendFunction(forkFunc)).To(Succeed())
+				_, err = worker.SendRequest("")
+				Expect(err).NotTo(HaveOccurred())
+
+				newProcesses, err := initialState.NewProcesses()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(newProcesses).To(HaveLen(1))
+
+				Expect(worker.Restore()).To(Succeed())
+				Expect(worker.LastRestoreStats().ProcessesKilled).To(Equal(1))
+
+				newProcesses, err = initialState.NewProcesses()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(newProcesses).To(BeEmpty())
+			})
+
+			It("resets signal handlers, masks and pending signals", func() {
+				Expect(worker.Activate()).To(Succeed())
+				Expect(worker.Stop()).To(Succeed())
+				initialSignals := signalStatus(worker.Pid())
+				worker.Continue()
+
+				signalFunc := "import os, signal\ndef main(req):\n  signal.signal(signal.SIGTERM, lambda s, f: None)\n  signal.signal(signal.SIGHUP, signal.SIG_IGN)\n  signal.pthread_sigmask(signal.SIG_BLOCK, {signal.SIGINT, signal.SIGUSR2})\n  os.kill(os.getpid(), signal.SIGUSR2)\n  return req"
+				Expect(worker.SendFunction(signalFunc)).To(Succeed())
+				_, err := worker.SendRequest("")
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(worker.Stop()).To(Succeed())
+				Expect(signalStatus(worker.Pid())).NotTo(Equal(initialSignals))
+				worker.Continue()
+
+				Expect(worker.Restore()).To(Succeed())
+
+				Expect(worker.Stop()).To(Succeed())
+				Expect(signalStatus(worker.Pid())).To(Equal(initialSignals))
+				worker.Continue()
+			})
+
+			It("raises signals pending at the checkpoint again", func() {
+				Expect(worker.Activate()).To(Succeed())
+
+				pendingFunc := "import os, signal\nsignal.signal(signal.SIGUSR1, lambda s, f: None)\ndef main(req):\n  if req == 'block':\n    signal.pthread_sigmask(signal.SIG_BLOCK, {signal.SIGUSR1})\n    os.kill(os.getpid(), signal.SIGUSR1)\n  else:\n    signal.pthread_sigmask(signal.SIG_UNBLOCK, {signal.SIGUSR1})\n  return req"
+				Expect(worker.SendFunction(pendingFunc)).To(Succeed())
+				_, err := worker.SendRequest("block")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(worker.TakeCheckpoint()).To(Succeed())
+
+				Expect(worker.Stop()).To(Succeed())
+				pendingSignals := signalStatus(worker.Pid())
+				worker.Continue()
+
+				// Delivers the pending signal
+				_, err = worker.SendRequest("unblock")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(worker.Stop()).To(Succeed())
+				Expect(signalStatus(worker.Pid())).NotTo(Equal(pendingSignals))
+				worker.Continue()
+
+				Expect(worker.RestoreTo(1)).To(Succeed())
+
+				Expect(worker.Stop()).To(Succeed())
+				Expect(signalStatus(worker.Pid())).To(Equal(pendingSignals))
+				worker.Continue()
+			})
+
+			It("restores the working directory, umask and credentials", func() {
+				Expect(worker.Activate()).To(Succeed())
+				Expect(worker.Stop()).To(Succeed())
+				initialCredentials := credentialStatus(worker.Pid())
+				worker.Continue()
+
+				credentialFunc := "import os\ndef main(req):\n  os.chdir('/tmp')\n  os.umask(0o077)\n  os.setgroups([5, 6])\n  os.setresgid(-1, 1000, -1)\n  os.setresuid(-1, 1000, -1)\n  return req"
+				Expect(worker.SendFunction(credentialFunc)).To(Succeed())
+				_, err := worker.SendRequest("")
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(worker.Stop()).To(Succeed())
+				Expect(credentialStatus(worker.Pid())).NotTo(Equal(initialCredentials))
+				worker.Continue()
+
+				Expect(worker.Restore()).To(Succeed())
+
+				Expect(worker.Stop()).To(Succeed())
+				Expect(credentialStatus(worker.Pid())).To(Equal(initialCredentials))
+				worker.Continue()
+			})
+
+			It("fails to restore credentials the function gave up for good", func() {
+				Expect(worker.Activate()).To(Succeed())
+
+				dropFunc := "import os\ndef main(req):\n  os.setresuid(1000, 1000, 1000)\n  return req"
+				Expect(worker.SendFunction(dropFunc)).To(Succeed())
+				_, err := worker.SendRequest("")
+				Expect(err).NotTo(HaveOccurred())
+
+				err = worker.Restore()
+				var changed *state.CredentialsChangedError
+				Expect(errors.As(err, &changed)).To(BeTrue(), "restore returned %v", err)
+				Expect(changed.Changed).NotTo(BeEmpty())
+				worker.Continue()
+			})
+
 			// TODO: We are not testing for mremaps here
 			It("leaves all memory the same as it was after restore", func() {
 				Expect(worker.Activate()).To(Succeed())
@@ -392,10 +714,187 @@ def main(params):
 				Expect(err).NotTo(HaveOccurred())
 				Expect(changed).To(BeFalse())
 			})
+
+			for _, mode := range []controller.RestoreMode{controller.EagerRestore, controller.LazyRestore} {
+				mode := mode
+
+				It(fmt.Sprintf("verifies %s restores against the checkpoint", mode), func() {
+					Expect(worker.SetRestoreMode(mode)).To(Succeed())
+					worker.SetVerifyRestore(true)
+					Expect(worker.Activate()).To(Succeed())
+					initialState, err := worker.InitialCheckpoint()
+					Expect(err).NotTo(HaveOccurred())
+
+					openFunc := largeMemoryFunc + "\nopened = open('/tmp/opened.txt', 'w')\n"
+					Expect(worker.SendFunction(openFunc)).To(Succeed())
+					_, err = worker.SendRequest("")
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(worker.Stop()).To(Succeed())
+					report, err := initialState.Verify()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(report.Matches()).To(BeFalse())
+					Expect(report.Pages).NotTo(BeEmpty())
+					Expect(report.FileDescriptors).NotTo(BeEmpty())
+					worker.Continue()
+
+					Expect(worker.Restore()).To(Succeed())
+					report = worker.LastVerifyReport()
+					Expect(report).NotTo(BeNil())
+					Expect(report.Matches()).To(BeTrue(), report.String())
+					Expect(report.PagesVerified).To(BeNumerically(">", 0))
+
+					Expect(worker.SendFunction(largeMemoryFunc)).To(Succeed())
+					response, err := worker.SendRequest("")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(len(response.(string))).To(Equal(100000))
+				})
+			}
+
+			It("restores to a named checkpoint and back to the runtime checkpoint", func() {
+				Expect(worker.Activate()).To(Succeed())
+				runtimeState, err := worker.InitialCheckpoint()
+				Expect(err).NotTo(HaveOccurred())
+
+				countFunc := "count = 0\ndef main(req):\n  global count\n  count += 1\n  return count"
+				Expect(worker.SendFunction(countFunc)).To(Succeed())
+				Expect(worker.TakeNamedCheckpoint("function-loaded")).To(Succeed())
+				Expect(worker.Checkpoints()).To(HaveLen(2))
+
+				Expect(worker.SendRequest("")).To(Equal(float64(1)))
+				Expect(worker.SendRequest("")).To(Equal(float64(2)))
+
+				Expect(worker.RestoreToNamed("function-loaded")).To(Succeed())
+				Expect(worker.LastRestoreStats().FullMemory).To(BeFalse())
+				Expect(worker.SendRequest("")).To(Equal(float64(1)))
+
+				// Dirty pages were tracked against the function checkpoint
+				Expect(worker.RestoreTo(0)).To(Succeed())
+				Expect(worker.LastRestoreStats().FullMemory).To(BeTrue())
+				changed, err := runtimeState.MemoryChanged()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(changed).To(BeFalse())
+
+				Expect(worker.RestoreToNamed("function-loaded")).To(Succeed())
+				Expect(worker.LastRestoreStats().FullMemory).To(BeTrue())
+				Expect(worker.SendRequest("")).To(Equal(float64(1)))
+			})
+
+			It("serves restored pages lazily", func() {
+				Expect(worker.SetRestoreMode(controller.LazyRestore)).To(Succeed())
+				Expect(worker.Activate()).To(Succeed())
+
+				countFunc := "count = 0\ndef main(req):\n  global count\n  count += 1\n  return count"
+				Expect(worker.SendFunction(countFunc)).To(Succeed())
+				Expect(worker.TakeNamedCheckpoint("function-loaded")).To(Succeed())
+
+				for i := 0; i < 3; i++ {
+					Expect(worker.SendRequest("")).To(Equal(float64(1)))
+					Expect(worker.RestoreToNamed("function-loaded")).To(Succeed())
+					Expect(worker.LastRestoreStats().Mode).To(Equal(controller.LazyRestore))
+				}
+
+				Expect(worker.RestoreTo(0)).To(Succeed())
+				Expect(worker.SendFunction(countFunc)).To(Succeed())
+				Expect(worker.SendRequest("")).To(Equal(float64(1)))
+
+				Expect(worker.SetRestoreMode(controller.EagerRestore)).To(Succeed())
+				Expect(worker.SendRequest("")).To(Equal(float64(2)))
+			})
+
+			for _, mode := range []controller.RestoreMode{controller.EagerRestore, controller.LazyRestore} {
+				mode := mode
+
+				Measure(fmt.Sprintf("restore and request time with %s restore", mode), func(b Benchmarker) {
+					Expect(worker.SetRestoreMode(mode)).To(Succeed())
+					Expect(worker.Activate()).To(Succeed())
+					Expect(worker.SendFunction(largeMemoryFunc)).To(Succeed())
+					Expect(worker.TakeNamedCheckpoint("function-loaded")).To(Succeed())
+
+					for i := 0; i < 5; i++ {
+						b.Time("request", func() {
+							response, err := worker.SendRequest("")
+							Expect(err).NotTo(HaveOccurred())
+							Expect(len(response.(string))).To(Equal(100000))
+						})
+						Expect(worker.RestoreToNamed("function-loaded")).To(Succeed())
+						b.RecordValueWithPrecision("restore", worker.LastRestoreStats().Duration.Seconds()*1000, "ms", 3)
+					}
+				}, 3)
+			}
+
+			It("restores with transparent huge pages disabled", func() {
+				worker.SetHugePages(false)
+				worker.SetVerifyRestore(true)
+				Expect(worker.Activate()).To(Succeed())
+
+				for i := 0; i < 3; i++ {
+					Expect(worker.SendFunction(largeMemoryFunc)).To(Succeed())
+					response, err := worker.SendRequest("")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(len(response.(string))).To(Equal(100000))
+
+					Expect(worker.Restore()).To(Succeed())
+					Expect(worker.LastVerifyReport().Matches()).To(BeTrue())
+				}
+			})
+
+			for _, hugePages := range []bool{true, false} {
+				hugePages := hugePages
+
+				Measure(fmt.Sprintf("restore time with huge pages enabled: %t", hugePages), func(b Benchmarker) {
+					worker.SetHugePages(hugePages)
+					Expect(worker.Activate()).To(Succeed())
+					Expect(worker.SendFunction(largeMemoryFunc)).To(Succeed())
+					Expect(worker.TakeNamedCheckpoint("function-loaded")).To(Succeed())
+
+					for i := 0; i < 5; i++ {
+						_, err := worker.SendRequest("")
+						Expect(err).NotTo(HaveOccurred())
+						Expect(worker.RestoreToNamed("function-loaded")).To(Succeed())
+						stats := worker.LastRestoreStats()
+						b.RecordValueWithPrecision("restore", stats.Duration.Seconds()*1000, "ms", 3)
+						b.RecordValueWithPrecision("huge pages", float64(stats.HugePageBytes)/(1<<20), "MB", 1)
+					}
+				}, 3)
+			}
 		})
 	})
 })
 
+// signalStatus returns the signal lines of /proc/pid/status
+func signalStatus(pid int) []string {
+	status, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	Expect(err).NotTo(HaveOccurred())
+
+	var signalLines []string
+	for _, line := range strings.Split(string(status), "\n") {
+		if strings.HasPrefix(line, "Sig") || strings.HasPrefix(line, "ShdPnd") {
+			signalLines = append(signalLines, line)
+		}
+	}
+	return signalLines
+}
+
+// credentialStatus is the process's working directory and the lines of its
+// status file restore puts back with its credentials
+func credentialStatus(pid int) []string {
+	cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid))
+	Expect(err).NotTo(HaveOccurred())
+	status, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	Expect(err).NotTo(HaveOccurred())
+
+	credentialLines := []string{cwd}
+	for _, line := range strings.Split(string(status), "\n") {
+		for _, prefix := range []string{"Umask:", "Uid:", "Gid:", "Groups:", "Cap"} {
+			if strings.HasPrefix(line, prefix) {
+				credentialLines = append(credentialLines, line)
+			}
+		}
+	}
+	return credentialLines
+}
+
 func WaitFileExists(location string) {
 	Eventually(func() bool {
 		_, err := os.Stat(location)
@@ -67,8 +67,13 @@ type Worker struct {
 	task           containerd.Task
 	taskExitChan   <-chan containerd.ExitStatus
 	IP             net.IP
+	framed         bool
+	protocolDir    string
 }
 
+// Where the FIFOs of the framed protocol are mounted in the container
+const runtimeProtocolDir = "/run/refunction"
+
 func (m *Worker) WithStdPipes(stderrWriter io.Writer, stdoutWriters ...io.Writer) {
 	m.stderrWriters = []io.Writer{stderrWriter}
 	m.stdoutWriters = stdoutWriters
@@ -96,10 +101,34 @@ func (m *Worker) connectStdPipes() {
 	m.creator = cio.NewCreator(cio.WithStreams(stdinRead, collectedStdOut, collectedStdErr))
 
 	m.controller.SetStreams(stdinWrite, stdoutRead, stderrRead)
+}
+
+// WithFramedProtocol offers the framed protocol to the runtime, which it
+// switches to on activation if it supports it
+func (m *Worker) WithFramedProtocol() {
+	m.framed = true
+}
+
+// protocolDirMount makes the FIFOs of the framed protocol and mounts them in
+// the container
+func (m *Worker) protocolDirMount() (oci.SpecOpts, error) {
+	dir, err := ioutil.TempDir("", "refunction-protocol")
+	if err != nil {
+		return nil, fmt.Errorf("could not make protocol dir: %s", err)
+	}
+	m.protocolDir = dir
+
+	err = m.controller.EnableFramedProtocol(dir, runtimeProtocolDir)
+	if err != nil {
+		return nil, err
+	}
 
-	go func() {
-		io.Copy(os.Stderr, stderrRead)
-	}()
+	return oci.WithMounts([]specs.Mount{{
+		Destination: runtimeProtocolDir,
+		Type:        "bind",
+		Source:      dir,
+		Options:     []string{"rbind", "rw"},
+	}}), nil
 }
 
 func (m *Worker) WithSyscallTrace(to io.Writer) {
@@ -161,11 +190,20 @@ func (m *Worker) Start() error {
 		return fmt.Errorf("could not close container ip file: %s", err)
 	}
 
+	specOpts := []oci.SpecOpts{WithNetNsHook(ipFileName), oci.WithProcessArgs(processArgs...), WithDefaultMemoryLimit, oci.WithDefaultPathEnv}
+	if m.framed {
+		protocolMount, err := m.protocolDirMount()
+		if err != nil {
+			return err
+		}
+		specOpts = append(specOpts, protocolMount)
+	}
+
 	container, err := m.client.NewContainer(
 		m.ctx,
 		m.ContainerID,
 		containerd.WithSnapshot(m.ContainerID),
-		containerd.WithNewSpec(WithNetNsHook(ipFileName), oci.WithProcessArgs(processArgs...), WithDefaultMemoryLimit, oci.WithDefaultPathEnv),
+		containerd.WithNewSpec(specOpts...),
 	)
 	if err != nil {
 		return fmt.Errorf("could not create worker container: %s", err)
@@ -219,6 +257,18 @@ func (m *Worker) TakeCheckpoint() error {
 	return m.controller.TakeCheckpoint()
 }
 
+func (m *Worker) TakeNamedCheckpoint(name string) error {
+	return m.controller.TakeNamedCheckpoint(name)
+}
+
+func (m *Worker) SaveCheckpoint(index int, path string) error {
+	return m.controller.SaveCheckpoint(index, path)
+}
+
+func (m *Worker) LoadCheckpoint(path string) error {
+	return m.controller.LoadCheckpoint(path)
+}
+
 func (m *Worker) Checkpoints() []*State {
 	return m.controller.Checkpoints()
 }
@@ -227,14 +277,42 @@ func (m *Worker) SendFunction(function string) error {
 	return m.controller.SendFunction(function)
 }
 
+func (m *Worker) SendFunctionContext(ctx context.Context, function string) error {
+	return m.controller.SendFunctionContext(ctx, function)
+}
+
 func (m *Worker) SendRequest(request interface{}) (interface{}, error) {
 	return m.controller.SendRequest(request)
 }
 
+func (m *Worker) SendRequestContext(ctx context.Context, request interface{}) (interface{}, error) {
+	return m.controller.SendRequestContext(ctx, request)
+}
+
+func (m *Worker) SendRequestWithLogs(ctx context.Context, request interface{}) (interface{}, []controller.LogLine, error) {
+	return m.controller.SendRequestWithLogs(ctx, request)
+}
+
+func (m *Worker) SetLogLimit(bytes int) {
+	m.controller.SetLogLimit(bytes)
+}
+
 func (m *Worker) AwaitMessage(messageType string) controller.Message {
 	return m.controller.AwaitMessage(messageType)
 }
 
+func (m *Worker) AwaitMessageContext(ctx context.Context, messageType string) (controller.Message, error) {
+	return m.controller.AwaitMessageContext(ctx, messageType)
+}
+
+func (m *Worker) Protocol() string {
+	return m.controller.Protocol()
+}
+
+func (m *Worker) Capabilities() controller.Capabilities {
+	return m.controller.Capabilities()
+}
+
 func (m *Worker) SendMessage(messageType string, data interface{}) error {
 	return m.controller.SendMessage(messageType, data)
 }
@@ -251,6 +329,14 @@ func (m *Worker) Restore() error {
 	return m.controller.Restore()
 }
 
+func (m *Worker) RestoreTo(index int) error {
+	return m.controller.RestoreTo(index)
+}
+
+func (m *Worker) RestoreToNamed(name string) error {
+	return m.controller.RestoreToNamed(name)
+}
+
 func (m *Worker) Detach() error {
 	return m.controller.Detach()
 }
@@ -295,6 +381,50 @@ func (m *Worker) ClearMemRefs() error {
 	return m.controller.ClearMemRefs()
 }
 
+func (m *Worker) SetRestoreMode(mode controller.RestoreMode) error {
+	return m.controller.SetRestoreMode(mode)
+}
+
+func (m *Worker) SetMemoryIO(io MemoryIO, concurrency int) {
+	m.controller.SetMemoryIO(io, concurrency)
+}
+
+func (m *Worker) SetPageStore(store *PageStore) {
+	m.controller.SetPageStore(store)
+}
+
+func (m *Worker) SetHugePages(enabled bool) {
+	m.controller.SetHugePages(enabled)
+}
+
+func (m *Worker) SetConcurrency(limit int) {
+	m.controller.SetConcurrency(limit)
+}
+
+func (m *Worker) SetDirtyTracker(tracker DirtyTracker) {
+	m.controller.SetDirtyTracker(tracker)
+}
+
+func (m *Worker) DirtyTracker() DirtyTracker {
+	return m.controller.DirtyTracker()
+}
+
+func (m *Worker) RemoteSyscall(nr uint64, args ...uint64) (uint64, error) {
+	return m.controller.RemoteSyscall(nr, args...)
+}
+
+func (m *Worker) LastRestoreStats() controller.RestoreStats {
+	return m.controller.LastRestoreStats()
+}
+
+func (m *Worker) SetVerifyRestore(verify bool) {
+	m.controller.SetVerifyRestore(verify)
+}
+
+func (m *Worker) LastVerifyReport() *VerifyReport {
+	return m.controller.LastVerifyReport()
+}
+
 func (m *Worker) GetImage(name string) (containerd.Image, error) {
 	return m.client.GetImage(m.ctx, name)
 }
@@ -331,6 +461,10 @@ func (m *Worker) End() error {
 		m.container.Delete(m.ctx, containerd.WithSnapshotCleanup)
 	}
 
+	if m.protocolDir != "" {
+		os.RemoveAll(m.protocolDir)
+	}
+
 	if controllerErr != nil {
 		fmt.Errorf("controller failed to end: %s", controllerErr)
 	}